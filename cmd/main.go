@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"net/http"
@@ -17,10 +18,13 @@ import (
 	"file-sharing-platform/internal/config"
 	"file-sharing-platform/internal/db"
 	"file-sharing-platform/internal/middleware"
+	"file-sharing-platform/internal/models"
 	"file-sharing-platform/internal/service"
 	"file-sharing-platform/internal/websocket"
 	"file-sharing-platform/internal/worker"
 	"file-sharing-platform/pkg/cache"
+	"file-sharing-platform/pkg/encryption"
+	"file-sharing-platform/pkg/ratelimit"
 	"file-sharing-platform/pkg/storage"
 
 	"github.com/gin-gonic/gin"
@@ -47,6 +51,21 @@ func main() {
 	// Initialize repositories
 	userRepo := db.NewUserRepository(database)
 	fileRepo := db.NewFileRepository(database)
+	uploadRepo := db.NewUploadRepository(database)
+	shareAccessRepo := db.NewShareAccessRepository(database)
+	fileRequestRepo := db.NewFileRequestRepository(database)
+	folderRepo := db.NewFolderRepository(database)
+	versionRepo := db.NewFileVersionRepository(database)
+	blobRepo := db.NewBlobRepository(database)
+	refreshTokenRepo := db.NewRefreshTokenRepository(database)
+	sessionRepo := db.NewSessionRepository(database)
+	personalTokenRepo := db.NewPersonalTokenRepository(database)
+
+	if len(cfg.AdminEmails) > 0 {
+		if err := userRepo.GrantAdmin(cfg.AdminEmails); err != nil {
+			log.Fatalf("Failed to grant admin: %v", err)
+		}
+	}
 
 	// Initialize cache
 	var cacheClient cache.Cache
@@ -59,12 +78,29 @@ func main() {
 		cacheClient = cache.NewMemoryCache()
 	}
 
+	// Initialize rate limiter, shared by all instances through Redis
+	var limiter ratelimit.Limiter
+	if cfg.RedisURL != "" {
+		limiter, err = ratelimit.NewRedisLimiter(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("Failed to initialize Redis rate limiter: %v", err)
+		}
+	} else {
+		limiter = ratelimit.NewMemoryLimiter()
+	}
+
+	apiLimit := middleware.RateLimit(limiter, middleware.RatePolicy{Name: "api", Limit: cfg.RateLimit, Window: cfg.RateLimitWindow})
+	loginLimit := middleware.RateLimit(limiter, middleware.RatePolicy{Name: "login", Limit: cfg.RateLimitLogin, Window: cfg.RateLimitWindow})
+	unlockLimit := middleware.RateLimit(limiter, middleware.RatePolicy{Name: "unlock", Limit: cfg.RateLimitUnlock, Window: cfg.RateLimitWindow})
+	uploadLimit := middleware.RateLimit(limiter, middleware.RatePolicy{Name: "upload", Limit: cfg.RateLimitUpload, Window: cfg.RateLimitWindow})
+	downloadLimit := middleware.RateLimit(limiter, middleware.RatePolicy{Name: "download", Limit: cfg.RateLimitDownload, Window: cfg.RateLimitWindow})
+
 	// Corrected fileCache initialization
 	fileCache := cache.NewFileCache(cacheClient, cfg.CacheTTL)
 	// Initialize storage
 	var storageProvider storage.FileStorage
 	if cfg.S3Bucket != "" {
-		storageProvider, err = storage.NewS3Storage(cfg.S3Region, cfg.S3Bucket, cfg.S3Endpoint, cfg.S3AccessKey, cfg.S3SecretKey)
+		storageProvider, err = storage.NewS3Storage(cfg.S3Region, cfg.S3Bucket, cfg.S3Endpoint, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3PartSize, cfg.S3UploadConcurrency)
 	} else {
 		storageProvider, err = storage.NewLocalStorage(cfg.LocalStoragePath, cfg.LocalStorageBaseURL)
 	}
@@ -72,63 +108,243 @@ func main() {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 
+	// Keep reading objects not migrated yet from the previous backend
+	if cfg.StorageFallback != "" {
+		fallback, err := config.NewStorageBackend(cfg, cfg.StorageFallback)
+		if err != nil {
+			log.Fatalf("Failed to initialize fallback storage: %v", err)
+		}
+
+		storageProvider = storage.NewFallbackStorage(storageProvider, fallback)
+	}
+
+	// Encrypt files at rest if enabled
+	if cfg.EncryptionEnabled {
+		keyProvider, err := newKeyProvider(cfg)
+		if err != nil {
+			log.Fatalf("Failed to initialize key provider: %v", err)
+		}
+
+		storageProvider = storage.NewEncryptedStorage(storageProvider, keyProvider)
+	}
+
 	// Initialize WebSocket hub
 	notificationHub := websocket.NewNotificationHub()
 
+	// Initialize storage quota service
+	quotaService := service.NewQuotaService(userRepo, models.StorageQuota{
+		Bytes: cfg.DefaultQuotaBytes,
+		Files: cfg.DefaultQuotaFiles,
+	})
+
 	// Initialize file service
-	fileService := service.NewFileService(fileRepo, storageProvider, fileCache, cfg.BaseShareURL)
+	fileService := service.NewFileService(fileRepo, folderRepo, versionRepo, blobRepo, storageProvider, fileCache, quotaService, cfg.BaseShareURL, cfg.DedupEnabled, cfg.ChecksumMD5)
+
+	// Initialize folder service
+	folderService := service.NewFolderService(folderRepo, fileRepo, fileService)
+
+	// Initialize file version service
+	versionService := service.NewVersionService(versionRepo, fileService, cfg.VersionKeepLast, cfg.VersionKeepDays)
+
+	// Initialize storage scrub service
+	scrubService := service.NewScrubService(fileService)
+
+	// Initialize share access log service
+	shareAccessService := service.NewShareAccessService(shareAccessRepo, fileRepo, notificationHub, cacheClient)
+
+	// Initialize file request service
+	fileRequestService := service.NewFileRequestService(fileRequestRepo, fileService, notificationHub, cfg.BaseShareURL, cfg.FileRequestMaxSize)
+
+	// Initialize resumable upload service
+	uploadService, err := service.NewUploadService(uploadRepo, fileService, cfg.UploadStagingPath, cfg.UploadSessionTTL)
+	if err != nil {
+		log.Fatalf("Failed to initialize upload service: %v", err)
+	}
 
 	// Initialize background workers
 	fileCleanupWorker := worker.NewFileCleanupWorker(fileService, time.Duration(cfg.CacheTTL)*time.Second, 10)
+	uploadCleanupWorker := worker.NewUploadCleanupWorker(uploadService, cfg.UploadCleanupInterval, 100)
+	keyRotationWorker := worker.NewKeyRotationWorker(fileService, cfg.KeyRotationInterval, 100)
+	versionPruneWorker := worker.NewVersionPruneWorker(versionService, cfg.VersionPruneInterval, 100)
+	trashPurgeWorker := worker.NewTrashPurgeWorker(fileService, cfg.TrashRetention, cfg.TrashPurgeInterval, 100)
+	scrubWorker := worker.NewScrubWorker(scrubService, models.ScrubOptions{
+		OrphanAction:    cfg.ScrubOrphanAction,
+		DryRun:          cfg.ScrubDryRun,
+		VerifyChecksums: cfg.ScrubVerifyChecksums,
+		GracePeriod:     cfg.ScrubGracePeriod,
+		BatchSize:       500,
+	}, cfg.ScrubInterval)
 
 	go fileCleanupWorker.Start()
+	go uploadCleanupWorker.Start()
+	go versionPruneWorker.Start()
+	go trashPurgeWorker.Start()
+	if cfg.EncryptionEnabled {
+		go keyRotationWorker.Start()
+	}
+	if cfg.ScrubEnabled {
+		go scrubWorker.Start()
+	}
+	if cfg.DedupEnabled {
+		go func() {
+			moved, err := fileService.BackfillBlobs(context.Background(), 100)
+			if err != nil {
+				log.Printf("Error moving existing files to deduplicated blobs: %v", err)
+			}
+			if moved > 0 {
+				log.Printf("Moved %d existing files and versions to deduplicated blobs", moved)
+			}
+		}()
+	}
 
-	// Initialize JWT authentication
-	jwtAuth := auth.NewJWTAuth(cfg.JWTSecret, time.Hour*24)
+	// Initialize JWT authentication, signing with the key set at
+	// JWT_KEYS_PATH if configured and with JWT_SECRET otherwise
+	jwtAuth := auth.NewJWTAuth(cfg.JWTSecret, cfg.JWTExpiration)
+	if cfg.JWTKeysPath != "" {
+		keys, err := auth.LoadKeySet(cfg.JWTKeysPath)
+		if err != nil {
+			log.Fatalf("Failed to initialize JWT authentication: %v", err)
+		}
 
-	if err != nil {
-		log.Fatalf("Failed to initialize JWT authentication: %v", err)
+		jwtAuth = auth.NewJWTAuthWithKeys(keys, cfg.JWTExpiration)
 	}
 
+	tokenService := service.NewTokenService(userRepo, refreshTokenRepo, sessionRepo, jwtAuth, cacheClient, cfg.RefreshTokenTTL)
+	personalTokenService := service.NewPersonalTokenService(personalTokenRepo, cacheClient)
+
 	// Initialize API handlers
-	authHandler := api.NewAuthHandler(userRepo, jwtAuth)
-	fileHandler := api.NewFileHandler(fileService)
+	authHandler := api.NewAuthHandler(userRepo, jwtAuth, tokenService)
+	fileHandler := api.NewFileHandler(fileService, shareAccessService, auth.NewShareAccess(cfg.JWTSecret, cfg.ShareAccessTTL))
+	uploadHandler := api.NewUploadHandler(uploadService)
+	shareHandler := api.NewShareHandler(fileService, shareAccessService)
+	fileRequestHandler := api.NewFileRequestHandler(fileRequestService)
+	folderHandler := api.NewFolderHandler(folderService)
+	versionHandler := api.NewVersionHandler(versionService)
+	quotaHandler := api.NewQuotaHandler(quotaService)
+	personalTokenHandler := api.NewPersonalTokenHandler(personalTokenService)
+	keyHandler := api.NewKeyHandler(keyRotationWorker)
 
-	// Initialize router
+	// Initialize router. Client IPs are only taken from forwarding headers
+	// set by trusted proxies.
 	router := gin.Default()
+	if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid trusted proxies: %v", err)
+	}
 
 	// Apply middleware
 	router.Use(middleware.RequestLogger)
-	router.Use(middleware.AuthMiddleware(jwtAuth))
 
 	// Auth routes
-	router.POST("/api/register", authHandler.Register)
-	router.POST("/api/login", authHandler.Login)
+	router.POST("/api/register", loginLimit, authHandler.Register)
+	router.POST("/api/login", loginLimit, authHandler.Login)
+	router.POST("/api/token/refresh", loginLimit, authHandler.Refresh)
+
+	// Public keys for other services to verify access tokens with
+	router.GET("/.well-known/jwks.json", authHandler.JWKS)
 
 	// WebSocket route
-	router.GET("/ws/notifications", func(c *gin.Context) {
-		notificationHub.HandleWebSocket(c.Writer, c.Request)
+	router.GET("/ws/notifications", middleware.AuthMiddleware(tokenService, personalTokenService), middleware.RequireScope(auth.ScopeFilesRead), func(c *gin.Context) {
+		userID, err := auth.GetUserIDFromContext(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+
+		notificationHub.HandleWebSocket(c.Writer, c.Request, userID)
 	})
 
 	// Public file share route
-	router.GET("/share/:share_token", fileHandler.GetSharedFile)
+	router.GET("/share/:share_token", apiLimit, downloadLimit, fileHandler.GetSharedFile)
+	router.POST("/share/:share_token/unlock", apiLimit, unlockLimit, fileHandler.UnlockSharedFile)
+
+	// Public file request routes
+	router.GET("/request/:token", apiLimit, fileRequestHandler.GetFileRequest)
+	router.POST("/request/:token/upload", apiLimit, uploadLimit, fileRequestHandler.UploadToFileRequest)
 
-	// Protected routes (require authentication)
+	// Protected routes (require authentication), limited per user. Routes
+	// usable with personal access tokens check the token's scopes; routes
+	// managing the account need a login session.
 	authRoutes := router.Group("/api")
-	authRoutes.Use(middleware.AuthMiddleware(jwtAuth))
+	authRoutes.Use(middleware.AuthMiddleware(tokenService, personalTokenService), apiLimit)
+
+	filesRead := middleware.RequireScope(auth.ScopeFilesRead)
+	filesWrite := middleware.RequireScope(auth.ScopeFilesWrite)
+	sharesManage := middleware.RequireScope(auth.ScopeSharesManage)
+	sessionOnly := middleware.RequireSession()
 
-	authRoutes.POST("/upload", fileHandler.UploadFile)
-	authRoutes.GET("/files", fileHandler.GetUserFiles)
-	authRoutes.DELETE("/files/:file_id", fileHandler.DeleteFile)
-	authRoutes.GET("/share/:file_id", fileHandler.ShareFile)
+	authRoutes.POST("/logout", sessionOnly, authHandler.Logout)
+	authRoutes.POST("/logout/all", sessionOnly, authHandler.LogoutAll)
+	authRoutes.GET("/sessions", sessionOnly, authHandler.ListSessions)
+	authRoutes.DELETE("/sessions/:id", sessionOnly, authHandler.RevokeSession)
+
+	// Personal access token routes
+	authRoutes.POST("/tokens", sessionOnly, personalTokenHandler.CreateToken)
+	authRoutes.GET("/tokens", sessionOnly, personalTokenHandler.ListTokens)
+	authRoutes.DELETE("/tokens/:id", sessionOnly, personalTokenHandler.RevokeToken)
+
+	authRoutes.POST("/upload", filesWrite, uploadLimit, fileHandler.UploadFile)
+	authRoutes.GET("/files", filesRead, fileHandler.GetUserFiles)
+	authRoutes.GET("/files/:file_id/download", filesRead, downloadLimit, fileHandler.DownloadFile)
+	authRoutes.DELETE("/files/:file_id", filesWrite, fileHandler.DeleteFile)
+	authRoutes.POST("/files/:file_id/move", filesWrite, fileHandler.MoveFile)
+	authRoutes.GET("/search", filesRead, fileHandler.SearchFiles)
+	authRoutes.GET("/trash", filesRead, fileHandler.ListTrash)
+	authRoutes.POST("/trash/:id/restore", filesWrite, fileHandler.RestoreFile)
+	authRoutes.GET("/share/:file_id", sharesManage, fileHandler.ShareFile)
+	authRoutes.POST("/share/:file_id", sharesManage, fileHandler.ShareFile)
+
+	// File version routes
+	authRoutes.POST("/files/:file_id/versions", filesWrite, uploadLimit, versionHandler.UploadVersion)
+	authRoutes.GET("/files/:file_id/versions", filesRead, versionHandler.ListVersions)
+	authRoutes.GET("/files/:file_id/versions/:version/download", filesRead, downloadLimit, versionHandler.DownloadVersion)
+	authRoutes.POST("/files/:file_id/versions/:version/restore", filesWrite, versionHandler.RestoreVersion)
+	authRoutes.GET("/me/version-retention", filesRead, versionHandler.GetRetentionPolicy)
+	authRoutes.PUT("/me/version-retention", filesWrite, versionHandler.SetRetentionPolicy)
+	authRoutes.DELETE("/me/version-retention", filesWrite, versionHandler.ResetRetentionPolicy)
+
+	// Storage quota routes
+	authRoutes.GET("/me/usage", filesRead, quotaHandler.GetUsage)
+
+	adminRoutes := authRoutes.Group("/admin")
+	adminRoutes.Use(sessionOnly, middleware.AdminMiddleware(userRepo))
+	adminRoutes.GET("/users/:id/quota", quotaHandler.GetUserUsage)
+	adminRoutes.PUT("/users/:id/quota", quotaHandler.SetUserQuota)
+	adminRoutes.DELETE("/users/:id/quota", quotaHandler.ResetUserQuota)
+	adminRoutes.POST("/keys/rewrap", keyHandler.RewrapKeys)
+
+	// Share link management routes
+	authRoutes.GET("/files/:file_id/shares", sharesManage, shareHandler.ListFileShares)
+	authRoutes.GET("/shares", sharesManage, shareHandler.ListShares)
+	authRoutes.PATCH("/shares/:id", sharesManage, shareHandler.UpdateShare)
+	authRoutes.DELETE("/shares/:id", sharesManage, shareHandler.RevokeShare)
+	authRoutes.GET("/shares/:id/accesses", sharesManage, shareHandler.ListShareAccesses)
+
+	// Folder routes
+	authRoutes.POST("/folders", filesWrite, folderHandler.CreateFolder)
+	authRoutes.GET("/folders/:id", filesRead, folderHandler.GetFolder)
+	authRoutes.PATCH("/folders/:id", filesWrite, folderHandler.UpdateFolder)
+	authRoutes.DELETE("/folders/:id", filesWrite, folderHandler.DeleteFolder)
+	authRoutes.GET("/fs/path/*path", filesRead, folderHandler.GetPath)
+
+	// File request routes
+	authRoutes.POST("/file-requests", sharesManage, fileRequestHandler.CreateFileRequest)
+	authRoutes.GET("/file-requests", sharesManage, fileRequestHandler.ListFileRequests)
+	authRoutes.DELETE("/file-requests/:id", sharesManage, fileRequestHandler.DeleteFileRequest)
+
+	// Resumable upload routes
+	authRoutes.POST("/uploads", filesWrite, uploadLimit, uploadHandler.CreateUpload)
+	authRoutes.HEAD("/uploads/:upload_id", filesWrite, uploadHandler.GetUploadOffset)
+	authRoutes.PATCH("/uploads/:upload_id", filesWrite, uploadHandler.PatchUpload)
+	authRoutes.DELETE("/uploads/:upload_id", filesWrite, uploadHandler.CancelUpload)
 
 	// Create HTTP server
+	// Only the headers and idle connections are timed: a read or write timeout
+	// would cut off uploads and downloads of large files over slow connections
 	server := &http.Server{
-		Addr:         fmt.Sprintf(":%s", cfg.ServerPort),
-		Handler:      router,
-		ReadTimeout:  cfg.CacheTTL,
-		WriteTimeout: cfg.CacheTTL,
-		IdleTimeout:  cfg.CacheTTL,
+		Addr:              fmt.Sprintf(":%s", cfg.ServerPort),
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
 	}
 
 	// Start server in a goroutine
@@ -155,6 +371,29 @@ func main() {
 
 	// Stop background workers
 	fileCleanupWorker.Stop()
+	uploadCleanupWorker.Stop()
+	keyRotationWorker.Stop()
+	versionPruneWorker.Stop()
+	trashPurgeWorker.Stop()
+	scrubWorker.Stop()
 
 	log.Println("Server stopped gracefully")
 }
+
+// newKeyProvider creates the master key provider selected in the config
+func newKeyProvider(cfg *config.Config) (encryption.KeyProvider, error) {
+	switch cfg.KeyProvider {
+	case "env":
+		masterKey, err := base64.StdEncoding.DecodeString(cfg.EncryptionMasterKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode encryption master key: %w", err)
+		}
+		return encryption.NewKeyring(encryption.DefaultKeyID, map[string][]byte{encryption.DefaultKeyID: masterKey})
+	case "keyring":
+		return encryption.LoadKeyring(cfg.KeyringPath)
+	case "vault":
+		return encryption.NewVaultTransit(cfg.VaultAddress, cfg.VaultToken, cfg.VaultTransitMount, cfg.VaultTransitKey), nil
+	default:
+		return nil, fmt.Errorf("unknown key provider: %s", cfg.KeyProvider)
+	}
+}
@@ -0,0 +1,176 @@
+// Command migrate-storage copies all stored objects from one storage
+// backend to another and points the database at the copies.
+//
+// It can run while the server stays online: configure the server with the
+// target backend and STORAGE_FALLBACK set to the source backend, so files
+// not migrated yet are still read from the source, then run
+//
+//	migrate-storage -from local -to s3
+//
+// The migration can be interrupted and run again; objects already moved are
+// skipped. Backends are configured with the same environment variables as
+// the server.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"file-sharing-platform/internal/config"
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+	"file-sharing-platform/pkg/cache"
+)
+
+func main() {
+	from := flag.String("from", "", "storage backend to migrate from: local or s3")
+	to := flag.String("to", "", "storage backend to migrate to: local or s3")
+	concurrency := flag.Int("concurrency", 4, "number of objects copied at a time")
+	batchSize := flag.Int("batch", 500, "number of objects read from the database at a time")
+	deleteSource := flag.Bool("delete-source", false, "delete objects from the source backend once migrated")
+	flag.Parse()
+
+	if *from == "" || *to == "" || *from == *to {
+		log.Fatalf("-from and -to must name two different backends")
+	}
+	if *concurrency < 1 || *batchSize < 1 {
+		log.Fatalf("-concurrency and -batch must be positive")
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	database, err := db.New(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer database.Close()
+
+	if err := database.Init(); err != nil {
+		log.Fatalf("Failed to run migrations: %v", err)
+	}
+
+	source, err := config.NewStorageBackend(cfg, *from)
+	if err != nil {
+		log.Fatalf("Failed to initialize source storage: %v", err)
+	}
+
+	target, err := config.NewStorageBackend(cfg, *to)
+	if err != nil {
+		log.Fatalf("Failed to initialize target storage: %v", err)
+	}
+
+	// Files cached by the server hold storage paths, so drop them from a
+	// shared cache once they move
+	var cacheClient cache.Cache = cache.NewMemoryCache()
+	if cfg.RedisURL != "" {
+		redisCache, err := cache.NewRedisCache(cfg.RedisURL)
+		if err != nil {
+			log.Printf("Redis cache unavailable, cached files will expire on their own: %v", err)
+		} else {
+			cacheClient = redisCache
+		}
+	}
+	fileCache := cache.NewFileCache(cacheClient, cfg.CacheTTL)
+
+	fileRepo := db.NewFileRepository(database)
+	migrationService := service.NewMigrationService(fileRepo, source, target, fileCache, *deleteSource)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	counts := migrate(ctx, migrationService, *concurrency, *batchSize)
+
+	log.Printf(
+		"Migration from %s to %s finished: %d copied, %d skipped, %d gone, %d failed",
+		*from, *to,
+		counts[service.MigrationCopied],
+		counts[service.MigrationSkipped],
+		counts[service.MigrationGone],
+		counts["failed"],
+	)
+
+	if ctx.Err() != nil {
+		log.Println("Migration interrupted, run it again to continue")
+		os.Exit(1)
+	}
+	if counts["failed"] > 0 {
+		log.Println("Some objects failed to migrate, run it again to retry them")
+		os.Exit(1)
+	}
+}
+
+// migrate walks all stored objects and migrates them with up to
+// concurrency objects in flight. It returns the number of objects per
+// outcome, with failures counted as "failed".
+func migrate(ctx context.Context, migrationService *service.MigrationService, concurrency, batchSize int) map[string]int {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		counts = make(map[string]int)
+	)
+
+	objects := make(chan models.StoredObject)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for object := range objects {
+				outcome, err := migrationService.MigrateObject(ctx, object)
+				if err != nil {
+					log.Printf("Failed to migrate %s: %v", object.StoragePath, err)
+					outcome = "failed"
+				}
+
+				mu.Lock()
+				counts[outcome]++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	afterPath := ""
+	walked := 0
+
+walk:
+	for {
+		batch, err := migrationService.GetObjectsToMigrate(ctx, afterPath, batchSize)
+		if err != nil {
+			log.Printf("Failed to get objects to migrate: %v", err)
+			mu.Lock()
+			counts["failed"]++
+			mu.Unlock()
+			break
+		}
+
+		for _, object := range batch {
+			select {
+			case objects <- object:
+			case <-ctx.Done():
+				break walk
+			}
+		}
+
+		walked += len(batch)
+		log.Printf("Queued %d objects", walked)
+
+		if len(batch) < batchSize {
+			break
+		}
+		afterPath = batch[len(batch)-1].StoragePath
+	}
+
+	close(objects)
+	wg.Wait()
+
+	return counts
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -8,19 +9,22 @@ import (
 	"file-sharing-platform/internal/auth"
 	"file-sharing-platform/internal/db"
 	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
 )
 
 // AuthHandler handles authentication endpoints
 type AuthHandler struct {
-	userRepo *db.UserRepository
-	jwtAuth  *auth.JWTAuth
+	userRepo     *db.UserRepository
+	jwtAuth      *auth.JWTAuth
+	tokenService *service.TokenService
 }
 
 // NewAuthHandler creates a new auth handler
-func NewAuthHandler(userRepo *db.UserRepository, jwtAuth *auth.JWTAuth) *AuthHandler {
+func NewAuthHandler(userRepo *db.UserRepository, jwtAuth *auth.JWTAuth, tokenService *service.TokenService) *AuthHandler {
 	return &AuthHandler{
-		userRepo: userRepo,
-		jwtAuth:  jwtAuth,
+		userRepo:     userRepo,
+		jwtAuth:      jwtAuth,
+		tokenService: tokenService,
 	}
 }
 
@@ -46,17 +50,14 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		return
 	}
 
-	// Generate JWT token
-	token, expiresAt, err := h.jwtAuth.GenerateToken(user)
+	// Start a session and generate its tokens
+	tokens, err := h.tokenService.IssueTokens(c.Request.Context(), user, clientSession(c, req.DeviceLabel))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusCreated, models.AuthResponse{
-		Token:     token,
-		ExpiresAt: expiresAt.Unix(),
-	})
+	c.JSON(http.StatusCreated, tokens)
 }
 
 // Login handles user login
@@ -80,17 +81,135 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Generate JWT token
-	token, expiresAt, err := h.jwtAuth.GenerateToken(user)
+	// Start a session and generate its tokens
+	tokens, err := h.tokenService.IssueTokens(c.Request.Context(), user, clientSession(c, req.DeviceLabel))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, models.AuthResponse{
-		Token:     token,
-		ExpiresAt: expiresAt.Unix(),
-	})
+	c.JSON(http.StatusOK, tokens)
+}
+
+// clientSession describes the client a session is started from
+func clientSession(c *gin.Context, deviceLabel string) *models.Session {
+	return &models.Session{
+		IPAddress:   c.ClientIP(),
+		UserAgent:   c.Request.UserAgent(),
+		DeviceLabel: deviceLabel,
+	}
+}
+
+// Refresh exchanges a refresh token for a new access token and refresh
+// token. The refresh token sent cannot be used again.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req models.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	tokens, err := h.tokenService.Refresh(c.Request.Context(), req.RefreshToken)
+	if err != nil {
+		if errors.Is(err, service.ErrInvalidRefreshToken) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// Logout ends the session the request was made with, revoking its access
+// and refresh tokens
+func (h *AuthHandler) Logout(c *gin.Context) {
+	claims, err := auth.GetClaimsFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// The body is optional
+	var req models.LogoutRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	err = h.tokenService.Logout(c.Request.Context(), claims, req.RefreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// LogoutAll revokes all access and refresh tokens of the user, logging out
+// every session
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	err = h.tokenService.LogoutAll(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListSessions lists the sessions the user is logged in with
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	claims, err := auth.GetClaimsFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	sessions, err := h.tokenService.ListSessions(c.Request.Context(), claims.UserID, claims.SessionID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSession logs out one of the user's sessions
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	err = h.tokenService.RevokeSession(c.Request.Context(), userID, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, service.ErrSessionNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// JWKS publishes the public keys access tokens are signed with, so other
+// services can verify them
+func (h *AuthHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.jwtAuth.JWKS())
 }
 
 // SetupRoutes registers the authentication endpoints
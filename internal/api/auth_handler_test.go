@@ -2,45 +2,43 @@ package api
 
 import (
 	"bytes"
+	"database/sql"
 	"encoding/json"
-	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/db"
 	"file-sharing-platform/internal/models"
-)
-
-// MockUserRepository is a mock implementation of the UserRepository
-type MockUserRepository struct {
-	users map[string]models.User
-}
+	"file-sharing-platform/internal/service"
+	"file-sharing-platform/pkg/cache"
 
-func NewMockUserRepository() *MockUserRepository {
-	return &MockUserRepository{
-		users: make(map[string]models.User),
-	}
-}
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
 
-func (r *MockUserRepository) CreateUser(user models.User) (int64, error) {
-	user.ID = int64(len(r.users) + 1)
-	r.users[user.Email] = user
-	return user.ID, nil
-}
+func TestRegisterHandler(t *testing.T) {
+	database, mock := newMockDatabase(t)
 
-func (r *MockUserRepository) GetUserByEmail(email string) (models.User, error) {
-	if user, exists := r.users[email]; exists {
-		return user, nil
-	}
-	return models.User{}, ErrNotFound
-}
+	// Create handler backed by the mock database
+	userRepo := db.NewUserRepository(database)
+	jwtAuth := auth.NewJWTAuth("secret", time.Hour)
+	tokenService := service.NewTokenService(userRepo, db.NewRefreshTokenRepository(database), db.NewSessionRepository(database), jwtAuth, cache.NewMemoryCache(), time.Hour)
+	authHandler := NewAuthHandler(userRepo, jwtAuth, tokenService)
 
-var ErrNotFound = errors.New("record not found")
+	now := time.Now()
+	mock.ExpectQuery("FROM users").WithArgs("test@example.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery("INSERT INTO users").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "email", "token_generation", "created_at", "updated_at"}).
+			AddRow(1, "test@example.com", 0, now, now))
+	mock.ExpectExec("DELETE FROM refresh_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO sessions").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(0, 1))
 
-func TestRegisterHandler(t *testing.T) {
-	// Create handler with mock repository
-	authHandler := &auth.JWTAuth{UserRepo: NewMockUserRepository()}
+	router := gin.New()
+	router.POST("/register", authHandler.Register)
 
 	// Create test request body
 	registerReq := map[string]string{
@@ -60,22 +58,30 @@ func TestRegisterHandler(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	// Call the handler
-	authHandler.Register(rr, req)
+	router.ServeHTTP(rr, req)
 
 	// Check status code
 	if status := rr.Code; status != http.StatusCreated {
-		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		t.Fatalf("handler returned wrong status code: got %v want %v: %s", status, http.StatusCreated, rr.Body.String())
 	}
 
 	// Check response body
-	var response map[string]string
+	var response models.AuthResponse
 	err = json.Unmarshal(rr.Body.Bytes(), &response)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Check that we got a user ID
-	if _, exists := response["user_id"]; !exists {
-		t.Errorf("expected user_id in response, got: %v", response)
+	// Check that we got tokens for the new user
+	claims, err := jwtAuth.ValidateToken(response.Token)
+	if err != nil || claims.UserID != 1 {
+		t.Errorf("expected an access token of the new user, got %+v, %v", claims, err)
+	}
+	if response.RefreshToken == "" || response.SessionID == "" {
+		t.Errorf("expected a refresh token and session, got: %+v", response)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
 	}
 }
@@ -1,22 +1,66 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
 	"file-sharing-platform/internal/service"
 
 	"github.com/gin-gonic/gin"
 )
 
+// shareAccessCookie holds the access token of an unlocked share link
+const shareAccessCookie = "share_access"
+
+// maxFormFieldSize is the longest form field value read ahead of the file
+// in a streamed multipart upload
+const maxFormFieldSize = 4 << 10
+
+// multipartOverhead is the room left for the multipart envelope and form
+// fields around a file when its size is told from the size of the request
+const multipartOverhead = 1 << 20
+
+// errNoFilePart is returned when a multipart upload has no "file" part
+var errNoFilePart = errors.New("no file provided")
+
+// sharePasswordPage is the form shown to browsers opening a password
+// protected share link
+var sharePasswordPage = template.Must(template.New("share-password").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Password required</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+<p>{{.Message}}</p>
+<input type="password" name="password" autofocus required>
+<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`))
+
 type FileHandler struct {
-	fileService *service.FileService
+	fileService        *service.FileService
+	shareAccessService *service.ShareAccessService
+	shareAccess        *auth.ShareAccess
 }
 
-func NewFileHandler(fileService *service.FileService) *FileHandler {
+func NewFileHandler(fileService *service.FileService, shareAccessService *service.ShareAccessService, shareAccess *auth.ShareAccess) *FileHandler {
 	return &FileHandler{
-		fileService: fileService,
+		fileService:        fileService,
+		shareAccessService: shareAccessService,
+		shareAccess:        shareAccess,
 	}
 }
 
@@ -27,22 +71,36 @@ func (h *FileHandler) UploadFile(c *gin.Context) {
 		return
 	}
 
-	err = c.Request.ParseMultipartForm(10 << 20)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to parse form"})
+	expected, ok := expectedChecksums(c)
+	if !ok {
 		return
 	}
 
-	file, header, err := c.Request.FormFile("file")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+	part, fields, ok := readFilePart(c)
+	if !ok {
 		return
 	}
-	defer file.Close()
+
+	folderID := fields["folder_id"]
+	if folderID == "" {
+		folderID = c.Query("folder_id")
+	}
 
 	ctx := c.Request.Context()
-	fileInfo, err := h.fileService.UploadFile(ctx, userID, header.Filename, header.Size, header.Header.Get("Content-Type"), file)
+	fileInfo, err := h.fileService.UploadFile(ctx, userID, folderID, part.FileName(), uploadSize(c.Request), part.Header.Get("Content-Type"), part, expected)
 	if err != nil {
+		if errors.Is(err, service.ErrChecksumMismatch) {
+			checksumMismatch(c)
+			return
+		}
+		if errors.Is(err, service.ErrQuotaExceeded) {
+			quotaExceeded(c)
+			return
+		}
+		if isDestinationError(err) {
+			folderError(c, err, "Failed to upload file")
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file: " + err.Error()})
 		return
 	}
@@ -50,6 +108,113 @@ func (h *FileHandler) UploadFile(c *gin.Context) {
 	c.JSON(http.StatusOK, fileInfo)
 }
 
+// nextFilePart reads a multipart upload up to its "file" part, which is
+// returned for the file to be streamed instead of spooled to disk. Form
+// fields have to come before the file; their values are returned by name.
+func nextFilePart(r *http.Request) (*multipart.Part, map[string]string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil, errNoFilePart
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FormName() == "file" {
+			return part, fields, nil
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+		if err != nil {
+			return nil, nil, err
+		}
+		fields[part.FormName()] = string(value)
+	}
+}
+
+// readFilePart reads a multipart upload up to its file like nextFilePart. It
+// responds with 400 and returns false if there is no file.
+func readFilePart(c *gin.Context) (*multipart.Part, map[string]string, bool) {
+	part, fields, err := nextFilePart(c.Request)
+	if errors.Is(err, errNoFilePart) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+		return nil, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to parse form"})
+		return nil, nil, false
+	}
+
+	return part, fields, true
+}
+
+// uploadSize tells the size of the file in a multipart upload from the
+// Content-Length of the request, -1 if it is not known, so uploads that
+// cannot fit are refused before they are read. Room is left for the
+// envelope, so the actual size is counted while the file is streamed.
+func uploadSize(r *http.Request) int64 {
+	if r.ContentLength < 0 {
+		return -1
+	}
+
+	return max(r.ContentLength-multipartOverhead, 0)
+}
+
+// expectedChecksums reads the checksums a client expects an upload to have
+// from the X-Checksum-Sha256 and X-Checksum-Md5 headers, given in hex. It
+// responds with 400 and returns false if a header is malformed.
+func expectedChecksums(c *gin.Context) (models.Checksums, bool) {
+	expected := models.Checksums{
+		SHA256: strings.ToLower(strings.TrimSpace(c.GetHeader("X-Checksum-Sha256"))),
+		MD5:    strings.ToLower(strings.TrimSpace(c.GetHeader("X-Checksum-Md5"))),
+	}
+
+	if expected.SHA256 != "" && !isHexDigest(expected.SHA256, 32) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid X-Checksum-Sha256"})
+		return expected, false
+	}
+
+	if expected.MD5 != "" && !isHexDigest(expected.MD5, 16) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid X-Checksum-Md5"})
+		return expected, false
+	}
+
+	return expected, true
+}
+
+// isHexDigest reports whether s is a hex encoded digest of size bytes
+func isHexDigest(s string, size int) bool {
+	decoded, err := hex.DecodeString(s)
+	return err == nil && len(decoded) == size
+}
+
+// checksumMismatch reports an upload rejected because its content did not
+// match the expected checksums
+func checksumMismatch(c *gin.Context) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Uploaded content does not match the expected checksum"})
+}
+
+// quotaExceeded reports an upload rejected because it would take the user
+// over their storage quota
+func quotaExceeded(c *gin.Context) {
+	c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Storage quota exceeded"})
+}
+
+// isDestinationError reports whether err rejects the folder or name a new
+// file was to be stored under
+func isDestinationError(err error) bool {
+	return errors.Is(err, service.ErrFolderNotFound) ||
+		errors.Is(err, service.ErrNameTaken) ||
+		errors.Is(err, service.ErrInvalidName)
+}
+
 func (h *FileHandler) GetUserFiles(c *gin.Context) {
 	userID, err := auth.GetUserIDFromContext(c)
 	if err != nil {
@@ -57,78 +222,417 @@ func (h *FileHandler) GetUserFiles(c *gin.Context) {
 		return
 	}
 
+	var req models.ListFilesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	var scope *models.FolderScope
+	if req.FolderID != "" {
+		scope = &models.FolderScope{FolderID: req.FolderID, Recursive: req.Recursive}
+	}
+
 	ctx := c.Request.Context()
-	files, err := h.fileService.GetUserFiles(ctx, userID, 0, 0)
+	files, err := h.fileService.GetUserFiles(ctx, userID, scope, req.Limit, req.Offset)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving files"})
+		folderError(c, err, "Error retrieving files")
 		return
 	}
 
 	c.JSON(http.StatusOK, files)
 }
 
-func (h *FileHandler) ShareFile(c *gin.Context) {
+// SearchFiles searches the user's files, optionally within a folder or
+// folder subtree
+func (h *FileHandler) SearchFiles(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.SearchFilesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid search parameters"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	files, err := h.fileService.SearchFiles(ctx, userID, &req)
+	if err != nil {
+		folderError(c, err, "Error searching files")
+		return
+	}
+
+	c.JSON(http.StatusOK, files)
+}
+
+// MoveFile moves a file to another folder
+func (h *FileHandler) MoveFile(c *gin.Context) {
 	userID, err := auth.GetUserIDFromContext(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	fileID, err := strconv.ParseInt(c.Param("file_id"), 10, 64)
+	var req models.MoveFileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	file, err := h.fileService.MoveFile(ctx, c.Param("file_id"), userID, req.FolderID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		folderError(c, err, "Error moving file")
 		return
 	}
 
-	expirationHours := 24
-	if expStr := c.Query("expires_in"); expStr != "" {
-		if exp, err := strconv.Atoi(expStr); err == nil && exp > 0 {
-			expirationHours = exp
+	c.JSON(http.StatusOK, file)
+}
+
+func (h *FileHandler) ShareFile(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Share options come from a JSON body, with the expiration in hours
+	// still accepted as a query parameter
+	var req models.ShareFileRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	if req.ExpiresIn == "" {
+		expirationHours := 24
+		if expStr := c.Query("expires_in"); expStr != "" {
+			if exp, err := strconv.Atoi(expStr); err == nil && exp > 0 {
+				expirationHours = exp
+			}
 		}
+		req.ExpiresIn = fmt.Sprintf("%dh", expirationHours)
 	}
 
 	ctx := c.Request.Context()
-	shareURL, err := h.fileService.ShareFile(ctx, strconv.FormatInt(userID, 10), fileID, strconv.Itoa(expirationHours))
+	sharedFile, err := h.fileService.ShareFile(ctx, c.Param("file_id"), userID, &req)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error sharing file"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"share_url": shareURL.ShareURL})
+	c.JSON(http.StatusOK, models.ShareFileResponse{
+		ShareURL:           sharedFile.ShareURL,
+		ExpiresAt:          sharedFile.ExpiresAt,
+		PasswordProtected:  sharedFile.PasswordHash != "",
+		BurnAfterReading:   sharedFile.BurnAfterReading,
+		RemainingDownloads: sharedFile.RemainingDownloads,
+	})
 }
 
 func (h *FileHandler) GetSharedFile(c *gin.Context) {
 	shareToken := c.Param("share_token")
 
 	ctx := c.Request.Context()
-	fileInfo, err := h.fileService.GetFile(ctx, shareToken)
+	sharedFile, err := h.fileService.GetShareLink(ctx, shareToken)
 	if err != nil {
+		h.recordShareAccess(c, shareToken, false, service.ShareAccessReason(err))
+		shareLinkError(c, err)
+		return
+	}
+
+	// Password protected links need the access cookie set by UnlockSharedFile
+	if sharedFile.PasswordHash != "" && !h.hasShareAccess(c, sharedFile) {
+		h.recordShareAccess(c, shareToken, false, service.ShareAccessPasswordRequired)
+		promptSharePassword(c, shareToken, http.StatusUnauthorized, "Password required")
+		return
+	}
+
+	// Links with a download limit always serve the whole file and charge
+	// every request, so ranges cannot be used to read them for free
+	if sharedFile.MaxDownloads > 0 {
+		c.Request.Header.Del("Range")
+	}
+
+	countDownload := countsAsDownload(c.Request)
+	fileInfo, reader, err := h.fileService.OpenSharedFile(ctx, shareToken, countDownload)
+	if err != nil {
+		h.recordShareAccess(c, shareToken, false, service.ShareAccessReason(err))
+		shareLinkError(c, err)
+		return
+	}
+	defer reader.Close()
+
+	if countDownload {
+		h.recordShareAccess(c, shareToken, true, service.ShareAccessDownload)
+	} else {
+		h.recordShareAccess(c, shareToken, true, service.ShareAccessPartial)
+	}
+
+	// One-time downloads must not be kept by caches along the way
+	if sharedFile.BurnAfterReading {
+		c.Header("Cache-Control", "no-store")
+	}
+
+	serveFile(c, fileInfo, reader)
+}
+
+// countsAsDownload reports whether a request to a share link counts against
+// its download count. Only requests fetching the start of the file count, so
+// resuming an interrupted download of a link without a download limit with a
+// Range request is not counted again.
+func countsAsDownload(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	return rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+// shareLinkError reports a share link that cannot be opened. Links that have
+// expired or run out of downloads are gone for good.
+func shareLinkError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrShareExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has expired"})
+	case errors.Is(err, service.ErrShareExhausted):
+		c.JSON(http.StatusGone, gin.H{"error": "Share link has no downloads left"})
+	default:
 		c.JSON(http.StatusNotFound, gin.H{"error": "File not found or share expired"})
+	}
+}
+
+// UnlockSharedFile checks the password of a share link and sets a
+// short-lived access cookie for the link when it is correct
+func (h *FileHandler) UnlockSharedFile(c *gin.Context) {
+	shareToken := c.Param("share_token")
+
+	var req models.UnlockShareRequest
+	if err := c.ShouldBind(&req); err != nil {
+		promptSharePassword(c, shareToken, http.StatusBadRequest, "Password required")
+		return
+	}
+
+	ctx := c.Request.Context()
+	sharedFile, err := h.fileService.UnlockShareLink(ctx, shareToken, req.Password)
+	if err != nil {
+		h.recordShareAccess(c, shareToken, false, service.ShareAccessReason(err))
+		switch {
+		case errors.Is(err, service.ErrInvalidSharePassword):
+			promptSharePassword(c, shareToken, http.StatusUnauthorized, "Invalid password")
+		case errors.Is(err, service.ErrShareLocked):
+			promptSharePassword(c, shareToken, http.StatusTooManyRequests, "Too many attempts, try again later")
+		default:
+			shareLinkError(c, err)
+		}
 		return
 	}
 
-	c.Redirect(http.StatusFound, fileInfo.PublicURL)
+	h.recordShareAccess(c, shareToken, true, service.ShareAccessUnlocked)
+
+	token, expiresAt := h.shareAccess.IssueToken(shareAccessSubject(sharedFile))
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     shareAccessCookie,
+		Value:    token,
+		Path:     "/share/" + shareToken,
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	if wantsHTML(c) {
+		c.Redirect(http.StatusSeeOther, "/share/"+shareToken)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"expires_at": expiresAt})
 }
 
-func (h *FileHandler) DeleteFile(c *gin.Context) {
+// recordShareAccess adds a use of a share link to its access log
+func (h *FileHandler) recordShareAccess(c *gin.Context, shareToken string, success bool, reason string) {
+	err := h.shareAccessService.RecordAccess(c.Request.Context(), shareToken, &models.ShareAccess{
+		IPAddress: c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+		Referrer:  c.Request.Referer(),
+		Success:   success,
+		Reason:    reason,
+	})
+	if err != nil {
+		log.Printf("Failed to record share access: %v", err)
+	}
+}
+
+// hasShareAccess reports whether the request carries a valid access cookie
+// for a password protected share link
+func (h *FileHandler) hasShareAccess(c *gin.Context, sharedFile *models.SharedFile) bool {
+	token, err := c.Cookie(shareAccessCookie)
+	if err != nil {
+		return false
+	}
+
+	return h.shareAccess.VerifyToken(token, shareAccessSubject(sharedFile))
+}
+
+// shareAccessSubject binds access tokens to a share link and its current
+// password, so changing the password revokes outstanding cookies
+func shareAccessSubject(sharedFile *models.SharedFile) string {
+	return sharedFile.ID + ":" + sharedFile.PasswordHash
+}
+
+// promptSharePassword asks for the password of a share link, as an HTML form
+// for browsers and as JSON otherwise
+func promptSharePassword(c *gin.Context, shareToken string, status int, message string) {
+	if !wantsHTML(c) {
+		c.JSON(status, gin.H{"error": message, "password_required": true})
+		return
+	}
+
+	c.Status(status)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	_ = sharePasswordPage.Execute(c.Writer, map[string]string{
+		"Action":  "/share/" + shareToken + "/unlock",
+		"Message": message,
+	})
+}
+
+// wantsHTML reports whether the client prefers HTML over JSON
+func wantsHTML(c *gin.Context) bool {
+	return c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) == gin.MIMEHTML
+}
+
+func (h *FileHandler) DownloadFile(c *gin.Context) {
 	userID, err := auth.GetUserIDFromContext(c)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
-	fileID, err := strconv.ParseInt(c.Param("file_id"), 10, 64)
+	ctx := c.Request.Context()
+	fileInfo, reader, err := h.fileService.OpenFile(ctx, c.Param("file_id"), userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file ID"})
+		if errors.Is(err, service.ErrFileNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download file"})
+		return
+	}
+	defer reader.Close()
+
+	serveFile(c, fileInfo, reader)
+}
+
+// serveFile streams a file to the client. http.ServeContent takes care of
+// Range/206 responses and the If-None-Match, If-Modified-Since and If-Range
+// preconditions based on the ETag and Last-Modified values set here.
+func serveFile(c *gin.Context, file *models.File, content io.ReadSeeker) {
+	c.Header("ETag", fileETag(file))
+	if digest := fileDigest(file); digest != "" {
+		c.Header("Digest", digest)
+		c.Header("Repr-Digest", fileReprDigest(file))
+	}
+	if c.Writer.Header().Get("Cache-Control") == "" {
+		c.Header("Cache-Control", "private, no-cache")
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	if file.ContentType != "" {
+		c.Header("Content-Type", file.ContentType)
+	}
+
+	http.ServeContent(c.Writer, c.Request, file.Name, file.UpdatedAt, content)
+}
+
+// fileETag derives a strong ETag from the file identity and last update
+func fileETag(file *models.File) string {
+	return fmt.Sprintf(`"%s-%x"`, file.ID, file.UpdatedAt.UnixNano())
+}
+
+// fileDigest formats the checksums of a file for the Digest header of
+// RFC 3230, empty if no checksums were recorded
+func fileDigest(file *models.File) string {
+	if file.SHA256 == "" {
+		return ""
+	}
+
+	digest := "sha-256=" + hexToBase64(file.SHA256)
+	if file.MD5 != "" {
+		digest += ",md5=" + hexToBase64(file.MD5)
+	}
+
+	return digest
+}
+
+// fileReprDigest formats the SHA-256 checksum of a file for the Repr-Digest
+// header of RFC 9530
+func fileReprDigest(file *models.File) string {
+	return "sha-256=:" + hexToBase64(file.SHA256) + ":"
+}
+
+// hexToBase64 re-encodes a hex encoded checksum in base64
+func hexToBase64(s string) string {
+	decoded, _ := hex.DecodeString(s)
+	return base64.StdEncoding.EncodeToString(decoded)
+}
+
+// DeleteFile moves a file to the trash
+func (h *FileHandler) DeleteFile(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
 		return
 	}
 
 	ctx := c.Request.Context()
-	err = h.fileService.DeleteFile(ctx, strconv.FormatInt(userID, 10), fileID)
+	err = h.fileService.TrashFile(ctx, c.Param("file_id"), userID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error deleting file"})
+		folderError(c, err, "Error deleting file")
 		return
 	}
 
 	c.Status(http.StatusNoContent)
 }
+
+// ListTrash lists the files in the user's trash, most recently deleted first
+func (h *FileHandler) ListTrash(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.ListTrashRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pagination parameters"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	files, err := h.fileService.ListTrash(ctx, userID, req.Limit, req.Offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving trash"})
+		return
+	}
+
+	c.JSON(http.StatusOK, files)
+}
+
+// RestoreFile takes a file out of the trash
+func (h *FileHandler) RestoreFile(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	file, err := h.fileService.RestoreFile(ctx, c.Param("id"), userID)
+	if err != nil {
+		folderError(c, err, "Error restoring file")
+		return
+	}
+
+	c.JSON(http.StatusOK, file)
+}
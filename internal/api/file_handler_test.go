@@ -0,0 +1,342 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+	"file-sharing-platform/pkg/cache"
+	"file-sharing-platform/pkg/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+const sharedContent = "0123456789"
+
+// newShareRouter serves a file holding sharedContent through the share
+// link routes, the download route of its owner and the share link
+// management routes, with the file already cached and stored
+func newShareRouter(t *testing.T, database *db.Database) *gin.Engine {
+	t.Helper()
+
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://localhost")
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	storagePath, _, err := store.Upload(strings.NewReader(sharedContent), "file.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("failed to store file: %v", err)
+	}
+
+	fileRepo := db.NewFileRepository(database)
+	fileCache := cache.NewFileCache(cache.NewMemoryCache(), time.Hour)
+	_ = fileCache.SetFile(context.Background(), &models.File{
+		ID:          "file-1",
+		UserID:      1,
+		Name:        "file.txt",
+		Size:        int64(len(sharedContent)),
+		ContentType: "text/plain",
+		StoragePath: storagePath,
+		UpdatedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+
+	fileService := service.NewFileService(fileRepo, nil, nil, nil, store, fileCache, nil, "http://localhost", false, false)
+	shareAccessService := service.NewShareAccessService(db.NewShareAccessRepository(database), fileRepo, nil, cache.NewMemoryCache())
+	fileHandler := NewFileHandler(fileService, shareAccessService, nil)
+	shareHandler := NewShareHandler(fileService, nil)
+
+	router := newTestRouter()
+	router.GET("/share/:share_token", fileHandler.GetSharedFile)
+	router.GET("/files/:file_id/download", fileHandler.DownloadFile)
+	router.PATCH("/shares/:id", shareHandler.UpdateShare)
+
+	return router
+}
+
+// shareRows returns share link rows as the repository reads them
+func shareRows(shares ...models.SharedFile) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "file_id", "share_url", "created_at", "password_hash", "max_downloads", "download_count", "burn_after_reading"})
+	for _, share := range shares {
+		rows.AddRow(share.ID, share.FileID, share.ShareURL, time.Now(), share.PasswordHash, share.MaxDownloads, share.DownloadCount, share.BurnAfterReading)
+	}
+
+	return rows
+}
+
+// expectShareLink expects the share link to be looked up by the handler, when
+// the file is opened and when the access is recorded
+func expectShareLink(mock sqlmock.Sqlmock, maxDownloads, downloadCount int) {
+	share := models.SharedFile{ID: "share-1", FileID: "file-1", ShareURL: "token", MaxDownloads: maxDownloads, DownloadCount: downloadCount}
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("FROM shared_files").WithArgs("token").WillReturnRows(shareRows(share))
+	}
+
+	mock.ExpectQuery("FROM files").WithArgs("file-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name"}).AddRow("file-1", 1, "file.txt"))
+	mock.ExpectQuery("INSERT INTO share_accesses").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+}
+
+func TestGetSharedFileChargesRangeRequestsOfLimitedLinks(t *testing.T) {
+	for _, rangeHeader := range []string{"bytes=-4", "bytes=3-", "bytes=0-"} {
+		database, mock := newMockDatabase(t)
+		router := newShareRouter(t, database)
+
+		expectShareLink(mock, 2, 1)
+		mock.ExpectExec("UPDATE shared_files").WithArgs("share-1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+		req := httptest.NewRequest(http.MethodGet, "/share/token", nil)
+		req.Header.Set("Range", rangeHeader)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// The range is ignored and the whole file served
+		if rr.Code != http.StatusOK || rr.Body.String() != sharedContent {
+			t.Errorf("Range %s: expected the whole file, got %d %q", rangeHeader, rr.Code, rr.Body.String())
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Range %s: %v", rangeHeader, err)
+		}
+	}
+}
+
+func TestGetSharedFileRejectsRangeRequestsOfExhaustedLinks(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	router := newShareRouter(t, database)
+
+	// The last download was taken between the lookup and the download
+	expectShareLink(mock, 1, 0)
+	mock.ExpectExec("UPDATE shared_files").WithArgs("share-1").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	req := httptest.NewRequest(http.MethodGet, "/share/token", nil)
+	req.Header.Set("Range", "bytes=-4")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusGone {
+		t.Errorf("expected %d, got %d %q", http.StatusGone, rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGetSharedFileServesRangesOfUnlimitedLinks(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	router := newShareRouter(t, database)
+
+	// Resuming a download of an unlimited link is not counted
+	expectShareLink(mock, 0, 3)
+
+	req := httptest.NewRequest(http.MethodGet, "/share/token", nil)
+	req.Header.Set("Range", "bytes=3-")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != sharedContent[3:] {
+		t.Errorf("expected the requested range, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// Further ranges fetched by the same client are not logged again
+	for i := 0; i < 3; i++ {
+		mock.ExpectQuery("FROM shared_files").WithArgs("token").
+			WillReturnRows(shareRows(models.SharedFile{ID: "share-1", FileID: "file-1", ShareURL: "token"}))
+	}
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	req = httptest.NewRequest(http.MethodGet, "/share/token", nil)
+	req.Header.Set("Range", "bytes=5-")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPartialContent {
+		t.Errorf("expected the requested range, got %d %q", rr.Code, rr.Body.String())
+	}
+	if logged.Len() != 0 {
+		t.Errorf("expected the access not to be recorded, got %q", logged.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadFileServesRanges(t *testing.T) {
+	database, _ := newMockDatabase(t)
+	router := newShareRouter(t, database)
+
+	req := httptest.NewRequest(http.MethodGet, "/files/file-1/download", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != sharedContent[2:6] {
+		t.Errorf("expected the requested range, got %d %q", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("expected Content-Range bytes 2-5/10, got %q", got)
+	}
+}
+
+func TestDownloadFileRevalidatesWithETag(t *testing.T) {
+	database, _ := newMockDatabase(t)
+	router := newShareRouter(t, database)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/files/file-1/download", nil))
+
+	etag := rr.Header().Get("ETag")
+	if rr.Code != http.StatusOK || rr.Body.String() != sharedContent || etag == "" {
+		t.Fatalf("expected the file with an ETag, got %d %q (ETag %q)", rr.Code, rr.Body.String(), etag)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		want        int
+	}{
+		{etag, http.StatusNotModified},
+		{`"other", ` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/files/file-1/download", nil)
+		req.Header.Set("If-None-Match", tt.ifNoneMatch)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("If-None-Match %s: expected %d, got %d", tt.ifNoneMatch, tt.want, rr.Code)
+		}
+		if tt.want == http.StatusNotModified && rr.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: expected no body, got %q", tt.ifNoneMatch, rr.Body.String())
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	reader io.Reader
+	read   int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.read += n
+	return n, err
+}
+
+func TestUploadFileIsCutOffOverQuota(t *testing.T) {
+	database, mock := newMockDatabase(t)
+
+	dir := t.TempDir()
+	store, err := storage.NewLocalStorage(dir, "http://localhost")
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	quotaService := service.NewQuotaService(db.NewUserRepository(database), models.StorageQuota{})
+	fileService := service.NewFileService(db.NewFileRepository(database), nil, nil, nil, store, nil, quotaService, "http://localhost", false, false)
+	router := newTestRouter()
+	router.POST("/files", NewFileHandler(fileService, nil, nil).UploadFile)
+
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(int64(1), "", "big.bin").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectQuery("SELECT used_bytes").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"used_bytes", "used_files", "has_quota", "quota_bytes", "quota_files"}).
+			AddRow(0, 0, true, 1024, nil))
+
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("file", "big.bin")
+	_, _ = part.Write(make([]byte, 1<<20))
+	_ = writer.Close()
+
+	// The body is not a bytes.Reader, so its length is not known in advance
+	body := &countingReader{reader: &form}
+	total := form.Len()
+	req := httptest.NewRequest(http.MethodPost, "/files", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("expected 507, got %d %s", rr.Code, rr.Body.String())
+	}
+	if body.read >= total {
+		t.Errorf("expected the upload to be cut off, read %d of %d bytes", body.read, total)
+	}
+
+	stored := 0
+	_ = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			stored++
+		}
+		return nil
+	})
+	if stored != 0 {
+		t.Errorf("expected nothing stored, got %d files", stored)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDownloadFileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		want   int
+	}{
+		{"missing file", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, user_id, name").WithArgs("file-2").WillReturnError(sql.ErrNoRows)
+		}, http.StatusNotFound},
+		{"file of another user", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, user_id, name").WithArgs("file-2").
+				WillReturnRows(sqlmock.NewRows([]string{"id", "user_id"}).AddRow("file-2", 2))
+		}, http.StatusNotFound},
+		{"database failure", func(mock sqlmock.Sqlmock) {
+			mock.ExpectQuery("SELECT id, user_id, name").WithArgs("file-2").WillReturnError(errors.New("connection refused"))
+		}, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		database, mock := newMockDatabase(t)
+		router := newShareRouter(t, database)
+		tt.expect(mock)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/files/file-2/download", nil))
+
+		if rr.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d %s", tt.name, tt.want, rr.Code, rr.Body.String())
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FileRequestHandler serves file request links: owners create and manage
+// them, and anyone with the link can upload files through it
+type FileRequestHandler struct {
+	fileRequestService *service.FileRequestService
+}
+
+func NewFileRequestHandler(fileRequestService *service.FileRequestService) *FileRequestHandler {
+	return &FileRequestHandler{
+		fileRequestService: fileRequestService,
+	}
+}
+
+// CreateFileRequest creates a file request link
+func (h *FileRequestHandler) CreateFileRequest(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.CreateFileRequestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	request, err := h.fileRequestService.CreateFileRequest(ctx, userID, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error creating file request: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, request)
+}
+
+// ListFileRequests lists the user's file request links
+func (h *FileRequestHandler) ListFileRequests(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	requests, err := h.fileRequestService.ListFileRequests(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving file requests"})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+// DeleteFileRequest closes a file request link
+func (h *FileRequestHandler) DeleteFileRequest(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = h.fileRequestService.DeleteFileRequest(ctx, c.Param("id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetFileRequest describes a file request link to the people uploading through it
+func (h *FileRequestHandler) GetFileRequest(c *gin.Context) {
+	ctx := c.Request.Context()
+	request, err := h.fileRequestService.GetOpenFileRequest(ctx, c.Param("token"))
+	if err != nil {
+		fileRequestError(c, err)
+		return
+	}
+
+	info := gin.H{
+		"title":                 request.Title,
+		"password_required":     request.PasswordProtected,
+		"max_file_size":         request.MaxFileSize,
+		"allowed_content_types": request.AllowedContentTypes,
+	}
+	if !request.ExpiresAt.IsZero() {
+		info["expires_at"] = request.ExpiresAt
+	}
+	if request.MaxFiles > 0 {
+		info["remaining_files"] = request.MaxFiles - request.FileCount
+	}
+
+	c.JSON(http.StatusOK, info)
+}
+
+// UploadToFileRequest receives a file through a file request link. The file
+// is streamed from multipart form field "file". The link password, if any,
+// is sent in the X-File-Request-Password header or in a "password" field
+// before the file, so it is checked before the file is read.
+func (h *FileRequestHandler) UploadToFileRequest(c *gin.Context) {
+	token := c.Param("token")
+
+	ctx := c.Request.Context()
+	request, err := h.fileRequestService.GetOpenFileRequest(ctx, token)
+	if err != nil {
+		fileRequestError(c, err)
+		return
+	}
+
+	// Refuse bodies that cannot fit before reading them, and don't read
+	// further than the file could go
+	maxBodySize := h.fileRequestService.UploadLimit(request) + multipartOverhead
+	if c.Request.ContentLength > maxBodySize {
+		fileRequestError(c, service.ErrFileTooLarge)
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBodySize)
+
+	part, fields, err := nextFilePart(c.Request)
+	if err != nil {
+		if bodyTooLarge(err) {
+			fileRequestError(c, service.ErrFileTooLarge)
+			return
+		}
+		if errors.Is(err, errNoFilePart) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unable to parse form"})
+		return
+	}
+
+	password := c.GetHeader("X-File-Request-Password")
+	if password == "" {
+		password = fields["password"]
+	}
+
+	uploaded, err := h.fileRequestService.Upload(ctx, token, password, part.FileName(), uploadSize(c.Request), part.Header.Get("Content-Type"), part)
+	if err != nil {
+		fileRequestError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"file_id": uploaded.ID,
+		"name":    uploaded.Name,
+		"size":    uploaded.Size,
+		"sha256":  uploaded.SHA256,
+	})
+}
+
+// bodyTooLarge reports whether err comes from reading past the size allowed
+// for a request body
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// fileRequestError reports why a file request link refused an upload
+func fileRequestError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, service.ErrFileRequestNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File request not found"})
+	case errors.Is(err, service.ErrFileRequestExpired):
+		c.JSON(http.StatusGone, gin.H{"error": "File request has expired"})
+	case errors.Is(err, service.ErrFileRequestFull):
+		c.JSON(http.StatusGone, gin.H{"error": "File request does not accept more files"})
+	case errors.Is(err, service.ErrInvalidFileRequestPassword):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password", "password_required": true})
+	case errors.Is(err, service.ErrFileRequestLocked):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many attempts, try again later"})
+	case errors.Is(err, service.ErrFileTooLarge), bodyTooLarge(err):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is too large"})
+	case errors.Is(err, service.ErrContentTypeNotAllowed):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "File type not accepted"})
+	case errors.Is(err, service.ErrQuotaExceeded):
+		c.JSON(http.StatusInsufficientStorage, gin.H{"error": "File request owner is out of storage"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file"})
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/service"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newFileRequestRouter serves the upload route of file request links, which
+// accept files of up to maxFileSize bytes
+func newFileRequestRouter(database *db.Database, maxFileSize int64) *gin.Engine {
+	fileRequestService := service.NewFileRequestService(db.NewFileRequestRepository(database), nil, nil, "http://localhost", maxFileSize)
+
+	router := gin.New()
+	router.POST("/request/:token/upload", NewFileRequestHandler(fileRequestService).UploadToFileRequest)
+
+	return router
+}
+
+// expectFileRequest expects the file request link "token" to be looked up
+// times times
+func expectFileRequest(mock sqlmock.Sqlmock, times int, passwordHash string, maxFileSize int64) {
+	for i := 0; i < times; i++ {
+		mock.ExpectQuery("SELECT id, user_id, token").WithArgs("token").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "token", "title", "password_hash", "expires_at", "max_file_size", "allowed_content_types", "max_files", "file_count", "created_at"}).
+				AddRow("request-1", 1, "token", "Send me files", passwordHash, time.Now().Add(time.Hour), maxFileSize, "{}", 0, 0, time.Now()))
+	}
+}
+
+// newFileRequestUpload creates an upload of size bytes through the file
+// request link "token", with a body whose length is not known in advance
+func newFileRequestUpload(size int) (*http.Request, *countingReader, int) {
+	var form bytes.Buffer
+	writer := multipart.NewWriter(&form)
+	part, _ := writer.CreateFormFile("file", "report.pdf")
+	_, _ = part.Write(make([]byte, size))
+	_ = writer.Close()
+
+	body := &countingReader{reader: &form}
+	total := form.Len()
+	req := httptest.NewRequest(http.MethodPost, "/request/token/upload", body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return req, body, total
+}
+
+func TestUploadToFileRequestChecksPasswordBeforeReadingFile(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	router := newFileRequestRouter(database, 10<<20)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	expectFileRequest(mock, 2, string(hash), 0)
+	mock.ExpectExec("UPDATE file_requests").WithArgs("request-1", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	req, body, total := newFileRequestUpload(1 << 20)
+	req.Header.Set("X-File-Request-Password", "wrong")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d %s", rr.Code, rr.Body.String())
+	}
+	if body.read >= total {
+		t.Errorf("expected the file not to be read, read %d of %d bytes", body.read, total)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUploadToFileRequestRefusesBodiesOverServerLimit(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	router := newFileRequestRouter(database, 1<<20)
+
+	// The link sets no limit of its own
+	expectFileRequest(mock, 1, "", 0)
+
+	req, body, _ := newFileRequestUpload(16)
+	req.ContentLength = 4 << 20
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected 413, got %d %s", rr.Code, rr.Body.String())
+	}
+	if body.read != 0 {
+		t.Errorf("expected the body not to be read, read %d bytes", body.read)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FolderHandler lets users organize their files in folders
+type FolderHandler struct {
+	folderService *service.FolderService
+}
+
+func NewFolderHandler(folderService *service.FolderService) *FolderHandler {
+	return &FolderHandler{
+		folderService: folderService,
+	}
+}
+
+// CreateFolder creates a folder
+func (h *FolderHandler) CreateFolder(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.CreateFolderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	folder, err := h.folderService.CreateFolder(ctx, userID, &req)
+	if err != nil {
+		folderError(c, err, "Error creating folder")
+		return
+	}
+
+	c.JSON(http.StatusCreated, folder)
+}
+
+// GetFolder returns a folder with its subfolders and a page of its files
+func (h *FolderHandler) GetFolder(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.ListFolderRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pagination parameters"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	contents, err := h.folderService.GetFolderContents(ctx, c.Param("id"), userID, &req)
+	if err != nil {
+		folderError(c, err, "Error retrieving folder")
+		return
+	}
+
+	c.JSON(http.StatusOK, contents)
+}
+
+// UpdateFolder renames a folder or moves it to another parent folder
+func (h *FolderHandler) UpdateFolder(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.UpdateFolderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	folder, err := h.folderService.UpdateFolder(ctx, c.Param("id"), userID, &req)
+	if err != nil {
+		folderError(c, err, "Error updating folder")
+		return
+	}
+
+	c.JSON(http.StatusOK, folder)
+}
+
+// DeleteFolder deletes a folder with everything in it
+func (h *FolderHandler) DeleteFolder(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = h.folderService.DeleteFolder(ctx, c.Param("id"), userID)
+	if err != nil {
+		folderError(c, err, "Error deleting folder")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetPath looks up a path like /api/fs/path/a/b/c in the user's file tree
+// and returns the folder or file it leads to
+func (h *FolderHandler) GetPath(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.ListFolderRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pagination parameters"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	entry, err := h.folderService.ResolvePath(ctx, userID, c.Param("path"), &req)
+	if err != nil {
+		folderError(c, err, "Error resolving path")
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// folderError reports a failed folder or file tree operation, using message
+// for unexpected errors
+func folderError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, service.ErrFolderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Folder not found"})
+	case errors.Is(err, service.ErrFileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errors.Is(err, service.ErrPathNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Path not found"})
+	case errors.Is(err, service.ErrNameTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "A file or folder with this name already exists"})
+	case errors.Is(err, service.ErrInvalidName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+	case errors.Is(err, service.ErrFolderCycle):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A folder cannot be moved into itself"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"testing"
+
+	"file-sharing-platform/internal/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newMockDatabase creates a database backed by sqlmock. Expectations are
+// matched in any order, as handlers run several independent queries.
+func newMockDatabase(t *testing.T) (*db.Database, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	mock.MatchExpectationsInOrder(false)
+
+	return &db.Database{DB: sqlx.NewDb(conn, "postgres")}, mock
+}
+
+// newTestRouter creates a router authenticating every request as user 1
+func newTestRouter() *gin.Engine {
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("userID", int64(1)) })
+
+	return router
+}
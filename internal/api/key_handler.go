@@ -0,0 +1,31 @@
+package api
+
+import (
+	"net/http"
+
+	"file-sharing-platform/internal/worker"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeyHandler lets admins manage the master keys files are encrypted with
+type KeyHandler struct {
+	keyRotationWorker *worker.KeyRotationWorker
+}
+
+func NewKeyHandler(keyRotationWorker *worker.KeyRotationWorker) *KeyHandler {
+	return &KeyHandler{
+		keyRotationWorker: keyRotationWorker,
+	}
+}
+
+// RewrapKeys starts re-wrapping file keys under the current master key right
+// away, after a master key rotation. The keys are re-wrapped in the background.
+func (h *KeyHandler) RewrapKeys(c *gin.Context) {
+	if !h.keyRotationWorker.Trigger() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Encryption is not enabled"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
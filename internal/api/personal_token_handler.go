@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PersonalTokenHandler lets users create, list and revoke their personal
+// access tokens
+type PersonalTokenHandler struct {
+	personalTokenService *service.PersonalTokenService
+}
+
+func NewPersonalTokenHandler(personalTokenService *service.PersonalTokenService) *PersonalTokenHandler {
+	return &PersonalTokenHandler{
+		personalTokenService: personalTokenService,
+	}
+}
+
+// CreateToken creates a personal access token. The token is only ever
+// returned in this response.
+func (h *PersonalTokenHandler) CreateToken(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.CreatePersonalTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	token, err := h.personalTokenService.CreateToken(ctx, userID, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error creating personal access token: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusCreated, token)
+}
+
+// ListTokens lists the user's personal access tokens
+func (h *PersonalTokenHandler) ListTokens(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tokens, err := h.personalTokenService.ListTokens(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving personal access tokens"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// RevokeToken revokes one of the user's personal access tokens
+func (h *PersonalTokenHandler) RevokeToken(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = h.personalTokenService.RevokeToken(ctx, userID, c.Param("id"))
+	if err != nil {
+		if errors.Is(err, service.ErrPersonalTokenNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Personal access token not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke personal access token"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QuotaHandler lets users see how much storage they use and lets admins
+// set the storage quotas of users
+type QuotaHandler struct {
+	quotaService *service.QuotaService
+}
+
+func NewQuotaHandler(quotaService *service.QuotaService) *QuotaHandler {
+	return &QuotaHandler{
+		quotaService: quotaService,
+	}
+}
+
+// GetUsage returns the storage usage and quota of the user
+func (h *QuotaHandler) GetUsage(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	usage, err := h.quotaService.GetUsage(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving storage usage"})
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// GetUserUsage returns the storage usage and quota of any user
+func (h *QuotaHandler) GetUserUsage(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	usage, err := h.quotaService.GetUsage(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// SetUserQuota sets the storage quota of a user
+func (h *QuotaHandler) SetUserQuota(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req models.SetQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	usage, err := h.quotaService.SetQuota(ctx, userID, &req)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
+
+// ResetUserQuota returns a user to the default storage quota
+func (h *QuotaHandler) ResetUserQuota(c *gin.Context) {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	usage, err := h.quotaService.ResetQuota(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, usage)
+}
@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShareHandler lets users manage the share links of their files
+type ShareHandler struct {
+	fileService        *service.FileService
+	shareAccessService *service.ShareAccessService
+}
+
+func NewShareHandler(fileService *service.FileService, shareAccessService *service.ShareAccessService) *ShareHandler {
+	return &ShareHandler{
+		fileService:        fileService,
+		shareAccessService: shareAccessService,
+	}
+}
+
+// ListShares lists the share links of all of the user's files
+func (h *ShareHandler) ListShares(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	shares, err := h.fileService.ListShares(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving share links"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+// ListFileShares lists the share links of one file
+func (h *ShareHandler) ListFileShares(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	shares, err := h.fileService.ListFileShares(ctx, c.Param("file_id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+// UpdateShare changes the expiry, password or download limits of a share link
+func (h *ShareHandler) UpdateShare(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.UpdateShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	sharedFile, err := h.fileService.UpdateShare(ctx, c.Param("id"), userID, &req)
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrShareNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		case errors.Is(err, service.ErrInvalidExpiration):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expiration format"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Error updating share link"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, sharedFile)
+}
+
+// RevokeShare deletes a share link
+func (h *ShareHandler) RevokeShare(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	err = h.fileService.RevokeShare(ctx, c.Param("id"), userID)
+	if err != nil {
+		if errors.Is(err, service.ErrShareNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error revoking share link"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// ListShareAccesses returns a page of a share link's access log with
+// per-day access counts
+func (h *ShareHandler) ListShareAccesses(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.ListShareAccessesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid pagination parameters"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	accesses, err := h.shareAccessService.ListAccesses(ctx, c.Param("id"), userID, &req)
+	if err != nil {
+		if errors.Is(err, service.ErrShareNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving share accesses"})
+		return
+	}
+
+	c.JSON(http.StatusOK, accesses)
+}
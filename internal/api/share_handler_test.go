@@ -0,0 +1,122 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// expectOwnShare expects the share link to be looked up for its owner
+func expectOwnShare(mock sqlmock.Sqlmock, share models.SharedFile) {
+	share.ID, share.FileID, share.ShareURL = "share-1", "file-1", "token"
+	mock.ExpectQuery("FROM shared_files sf").WithArgs("share-1", int64(1)).WillReturnRows(shareRows(share))
+}
+
+// patchShare sends changes to the share link and decodes the updated link
+func patchShare(t *testing.T, router http.Handler, body string) models.SharedFile {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPatch, "/shares/share-1", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var sharedFile models.SharedFile
+	if err := json.Unmarshal(rr.Body.Bytes(), &sharedFile); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %q", rr.Code, rr.Body.String())
+	}
+
+	return sharedFile
+}
+
+func TestUpdateShareReportsPasswordProtection(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	router := newShareRouter(t, database)
+
+	expectOwnShare(mock, models.SharedFile{PasswordHash: "hash"})
+	mock.ExpectExec("UPDATE shared_files").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	sharedFile := patchShare(t, router, `{"max_downloads": 3}`)
+	if !sharedFile.PasswordProtected {
+		t.Errorf("expected the link to be reported as password protected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateShareErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		lookup  error
+		status  int
+		message string
+	}{
+		{"not found", `{}`, sql.ErrNoRows, http.StatusNotFound, "Share link not found"},
+		{"database error", `{}`, errors.New("connection refused"), http.StatusInternalServerError, "Error updating share link"},
+		{"invalid expiration", `{"expires_in": "soon"}`, nil, http.StatusBadRequest, "Invalid expiration format"},
+	}
+
+	for _, tt := range tests {
+		database, mock := newMockDatabase(t)
+		router := newShareRouter(t, database)
+
+		if tt.lookup != nil {
+			mock.ExpectQuery("FROM shared_files sf").WillReturnError(tt.lookup)
+		} else {
+			expectOwnShare(mock, models.SharedFile{})
+		}
+
+		req := httptest.NewRequest(http.MethodPatch, "/shares/share-1", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		// Errors are reported with fixed messages only
+		want, _ := json.Marshal(gin.H{"error": tt.message})
+		if rr.Code != tt.status || rr.Body.String() != string(want) {
+			t.Errorf("%s: expected %d %s, got %d %s", tt.name, tt.status, want, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestUpdateShareTurningBurnAfterReadingOff(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		maxDownloads int
+	}{
+		{"without a limit", `{"burn_after_reading": false}`, 0},
+		{"with a new limit", `{"burn_after_reading": false, "max_downloads": 5}`, 5},
+	}
+
+	for _, tt := range tests {
+		database, mock := newMockDatabase(t)
+		router := newShareRouter(t, database)
+
+		expectOwnShare(mock, models.SharedFile{MaxDownloads: 1, BurnAfterReading: true})
+		mock.ExpectExec("UPDATE shared_files").
+			WithArgs(sqlmock.AnyArg(), "", tt.maxDownloads, false, false, "share-1").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		sharedFile := patchShare(t, router, tt.body)
+		if sharedFile.MaxDownloads != tt.maxDownloads || sharedFile.BurnAfterReading {
+			t.Errorf("%s: expected %d downloads without burn after reading, got %+v", tt.name, tt.maxDownloads, sharedFile)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
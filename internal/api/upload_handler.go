@@ -0,0 +1,214 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tusVersion is the tus protocol version spoken by the upload endpoints
+const tusVersion = "1.0.0"
+
+type UploadHandler struct {
+	uploadService *service.UploadService
+}
+
+func NewUploadHandler(uploadService *service.UploadService) *UploadHandler {
+	return &UploadHandler{
+		uploadService: uploadService,
+	}
+}
+
+// CreateUpload starts a resumable upload. The total size comes from the
+// Upload-Length header and the file name, type and destination folder from
+// Upload-Metadata. Checksums of the complete file can be given in the
+// X-Checksum-Sha256 and X-Checksum-Md5 headers.
+func (h *UploadHandler) CreateUpload(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+
+	size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Length"})
+		return
+	}
+
+	metadata := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	fileName := metadata["filename"]
+	if fileName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "filename is required in Upload-Metadata"})
+		return
+	}
+
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	expected, ok := expectedChecksums(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	session, err := h.uploadService.CreateUpload(ctx, userID, metadata["folder_id"], fileName, contentType, size, expected)
+	if err != nil {
+		if errors.Is(err, service.ErrQuotaExceeded) {
+			quotaExceeded(c)
+			return
+		}
+		if isDestinationError(err) {
+			folderError(c, err, "Failed to create upload")
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	c.Header("Location", "/api/uploads/"+session.ID)
+	c.Header("Upload-Offset", "0")
+	c.JSON(http.StatusCreated, session)
+}
+
+// GetUploadOffset reports how many bytes of an upload have been received
+func (h *UploadHandler) GetUploadOffset(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+
+	ctx := c.Request.Context()
+	session, err := h.uploadService.GetUpload(ctx, c.Param("upload_id"), userID)
+	if err != nil {
+		if errors.Is(err, service.ErrUploadExpired) {
+			c.Status(http.StatusGone)
+			return
+		}
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+// PatchUpload writes a chunk at the offset given in Upload-Offset. The
+// response for the final chunk carries the created file.
+func (h *UploadHandler) PatchUpload(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Upload-Offset"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	session, file, err := h.uploadService.WriteChunk(ctx, c.Param("upload_id"), userID, offset, c.Request.Body)
+	if session != nil {
+		c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, service.ErrUploadExpired):
+			c.JSON(http.StatusGone, gin.H{"error": "Upload expired"})
+		case session == nil:
+			c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		case errors.Is(err, service.ErrOffsetMismatch):
+			c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset does not match current offset"})
+		case errors.Is(err, service.ErrChecksumMismatch):
+			checksumMismatch(c)
+		case errors.Is(err, service.ErrQuotaExceeded):
+			quotaExceeded(c)
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write upload"})
+		}
+		return
+	}
+
+	if file == nil {
+		c.Status(http.StatusNoContent)
+		return
+	}
+
+	c.JSON(http.StatusOK, models.FileUploadResponse{
+		FileID:    file.ID,
+		PublicURL: file.PublicURL,
+		Checksums: file.Checksums,
+	})
+}
+
+// CancelUpload terminates an upload and discards the received bytes
+func (h *UploadHandler) CancelUpload(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	c.Header("Tus-Resumable", tusVersion)
+
+	ctx := c.Request.Context()
+	err = h.uploadService.CancelUpload(ctx, c.Param("upload_id"), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header, a comma separated
+// list of keys each followed by an optional base64 encoded value
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 {
+			continue
+		}
+
+		value := ""
+		if len(parts) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+
+		metadata[parts[0]] = value
+	}
+
+	return metadata
+}
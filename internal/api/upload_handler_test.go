@@ -0,0 +1,90 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/service"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+)
+
+// newUploadRouter serves the resumable upload routes
+func newUploadRouter(t *testing.T, database *db.Database) *gin.Engine {
+	t.Helper()
+
+	uploadService, err := service.NewUploadService(db.NewUploadRepository(database), nil, t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create upload service: %v", err)
+	}
+	uploadHandler := NewUploadHandler(uploadService)
+
+	router := newTestRouter()
+	router.HEAD("/uploads/:upload_id", uploadHandler.GetUploadOffset)
+	router.PATCH("/uploads/:upload_id", uploadHandler.PatchUpload)
+
+	return router
+}
+
+// expectUploadSession expects the upload session to be looked up times times
+func expectUploadSession(mock sqlmock.Sqlmock, times int, expiresAt time.Time) {
+	for i := 0; i < times; i++ {
+		mock.ExpectQuery("FROM upload_sessions").WithArgs("upload-1", int64(1)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "file_name", "size", "upload_offset", "expires_at"}).
+				AddRow("upload-1", 1, "file.txt", 10, 0, expiresAt))
+	}
+}
+
+// newPatchRequest creates a request sending a chunk at offset 0
+func newPatchRequest() *http.Request {
+	req := httptest.NewRequest(http.MethodPatch, "/uploads/upload-1", strings.NewReader("abc"))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+
+	return req
+}
+
+func TestExpiredUploadsAreGone(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	router := newUploadRouter(t, database)
+
+	expectUploadSession(mock, 3, time.Now().Add(-time.Minute))
+
+	for _, req := range []*http.Request{httptest.NewRequest(http.MethodHead, "/uploads/upload-1", nil), newPatchRequest()} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusGone {
+			t.Errorf("%s: expected %d, got %d", req.Method, http.StatusGone, rr.Code)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPatchUploadHidesInternalErrors(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	router := newUploadRouter(t, database)
+
+	expectUploadSession(mock, 2, time.Now().Add(time.Hour))
+	mock.ExpectExec("UPDATE upload_sessions").WillReturnError(errors.New("pq: connection to 10.0.0.5 refused"))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, newPatchRequest())
+
+	if rr.Code != http.StatusInternalServerError || rr.Body.String() != `{"error":"Failed to write upload"}` {
+		t.Errorf("expected a fixed error message, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
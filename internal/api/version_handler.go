@@ -0,0 +1,197 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// VersionHandler lets users upload new versions of their files, browse and
+// restore previous versions, and choose how long previous versions are kept
+type VersionHandler struct {
+	versionService *service.VersionService
+}
+
+func NewVersionHandler(versionService *service.VersionService) *VersionHandler {
+	return &VersionHandler{
+		versionService: versionService,
+	}
+}
+
+// UploadVersion uploads new content for an existing file
+func (h *VersionHandler) UploadVersion(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	expected, ok := expectedChecksums(c)
+	if !ok {
+		return
+	}
+
+	part, _, ok := readFilePart(c)
+	if !ok {
+		return
+	}
+
+	ctx := c.Request.Context()
+	fileInfo, err := h.versionService.UploadVersion(ctx, c.Param("file_id"), userID, uploadSize(c.Request), part.Header.Get("Content-Type"), part, expected)
+	if err != nil {
+		versionError(c, err, "Failed to upload file version")
+		return
+	}
+
+	c.JSON(http.StatusCreated, fileInfo)
+}
+
+// ListVersions lists the current and previous versions of a file
+func (h *VersionHandler) ListVersions(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	versions, err := h.versionService.ListVersions(ctx, c.Param("file_id"), userID)
+	if err != nil {
+		versionError(c, err, "Error retrieving file versions")
+		return
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+// DownloadVersion downloads a version of a file
+func (h *VersionHandler) DownloadVersion(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	fileInfo, reader, err := h.versionService.OpenVersion(ctx, c.Param("file_id"), userID, version)
+	if err != nil {
+		versionError(c, err, "Error opening file version")
+		return
+	}
+	defer reader.Close()
+
+	serveFile(c, fileInfo, reader)
+}
+
+// RestoreVersion makes a previous version the current version of a file
+func (h *VersionHandler) RestoreVersion(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	fileInfo, err := h.versionService.RestoreVersion(ctx, c.Param("file_id"), userID, version)
+	if err != nil {
+		versionError(c, err, "Error restoring file version")
+		return
+	}
+
+	c.JSON(http.StatusOK, fileInfo)
+}
+
+// GetRetentionPolicy returns the version retention policy of the user
+func (h *VersionHandler) GetRetentionPolicy(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	policy, err := h.versionService.GetRetentionPolicy(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error retrieving version retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// SetRetentionPolicy sets the version retention policy of the user
+func (h *VersionHandler) SetRetentionPolicy(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req models.VersionRetentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	policy, err := h.versionService.SetRetentionPolicy(ctx, userID, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error saving version retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// ResetRetentionPolicy returns the user to the default version retention policy
+func (h *VersionHandler) ResetRetentionPolicy(c *gin.Context) {
+	userID, err := auth.GetUserIDFromContext(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	policy, err := h.versionService.ResetRetentionPolicy(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Error resetting version retention policy"})
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// versionError reports a failed file version operation, using message for
+// unexpected errors
+func versionError(c *gin.Context, err error, message string) {
+	switch {
+	case errors.Is(err, service.ErrFileNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+	case errors.Is(err, service.ErrVersionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "File version not found"})
+	case errors.Is(err, service.ErrChecksumMismatch):
+		checksumMismatch(c)
+	case errors.Is(err, service.ErrQuotaExceeded):
+		quotaExceeded(c)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+}
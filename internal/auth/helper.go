@@ -2,15 +2,10 @@ package auth
 
 import (
 	"errors"
-	"net/http"
-	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 )
 
-var jwtSecret = []byte("your-secret-key") // Ensure this is loaded from env/config
-
 // GetUserIDFromContext retrieves user ID from gin.Context
 func GetUserIDFromContext(c *gin.Context) (int64, error) {
 	userID, exists := c.Get("userID")
@@ -26,48 +21,43 @@ func GetUserIDFromContext(c *gin.Context) (int64, error) {
 	return uid, nil
 }
 
-func ValidateToken(tokenString string) (*JWTClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	if err != nil {
-		return nil, err
+// GetClaimsFromContext retrieves the claims of the access token the request
+// was authenticated with from gin.Context
+func GetClaimsFromContext(c *gin.Context) (*JWTClaims, error) {
+	value, exists := c.Get("claims")
+	if !exists {
+		return nil, errors.New("token claims not found in context")
 	}
 
-	if claims, ok := token.Claims.(*JWTClaims); ok && token.Valid {
-		return claims, nil
+	claims, ok := value.(*JWTClaims)
+	if !ok {
+		return nil, errors.New("token claims are not valid")
 	}
 
-	return nil, errors.New("invalid token")
+	return claims, nil
 }
 
-// GetTokenFromRequest extracts JWT token from Authorization header
-func GetTokenFromRequest(r *http.Request) (string, error) {
-	authHeader := r.Header.Get("Authorization")
-	if authHeader == "" {
-		return "", errors.New("authorization header is missing")
-	}
-
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
-		return "", errors.New("invalid authorization header format")
+// HasScope reports whether the request was authenticated with a token that
+// grants scope. Access tokens of login sessions grant every scope; personal
+// access tokens only the scopes they were created with. Requests not
+// authenticated with either have no scope.
+func HasScope(c *gin.Context, scope string) bool {
+	value, exists := c.Get("scopes")
+	if !exists {
+		_, err := GetClaimsFromContext(c)
+		return err == nil
 	}
 
-	return parts[1], nil
-}
-
-// GetUserIDFromRequest extracts user ID from JWT token in request
-func GetUserIDFromRequest(r *http.Request) (int64, error) {
-	token, err := GetTokenFromRequest(r)
-	if err != nil {
-		return 0, err
+	scopes, ok := value.([]string)
+	if !ok {
+		return false
 	}
 
-	claims, err := ValidateToken(token)
-	if err != nil {
-		return 0, err
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
 	}
 
-	return claims.UserID, nil
+	return false
 }
@@ -8,18 +8,24 @@ import (
 	"file-sharing-platform/internal/models"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 // JWTAuth handles JWT authentication
 type JWTAuth struct {
-	secretKey     string
+	keys          *KeySet
 	tokenDuration time.Duration
 }
 
-// JWTClaims represents the JWT claims
+// JWTClaims represents the JWT claims. The registered ID claim (jti)
+// identifies a token so it can be revoked on its own; Generation is the
+// token generation of the user when the token was issued and SessionID the
+// login session the token belongs to.
 type JWTClaims struct {
-	UserID int64  `json:"user_id"`
-	Email  string `json:"email"`
+	UserID     int64  `json:"user_id"`
+	Email      string `json:"email"`
+	Generation int64  `json:"gen"`
+	SessionID  string `json:"sid,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -27,30 +33,55 @@ func (c *JWTClaims) Valid() error {
 	return nil
 }
 
-// NewJWTAuth creates a new JWT authentication handler
+// NewJWTAuth creates a new JWT authentication handler signing tokens with
+// HS256 and a shared secret
 func NewJWTAuth(secretKey string, tokenDuration time.Duration) *JWTAuth {
+	return NewJWTAuthWithKeys(NewHMACKeySet(secretKey), tokenDuration)
+}
+
+// NewJWTAuthWithKeys creates a new JWT authentication handler signing tokens
+// with the current key of keys
+func NewJWTAuthWithKeys(keys *KeySet, tokenDuration time.Duration) *JWTAuth {
 	return &JWTAuth{
-		secretKey:     secretKey,
+		keys:          keys,
 		tokenDuration: tokenDuration,
 	}
 }
 
-// GenerateToken generates a JWT token for a user
-func (a *JWTAuth) GenerateToken(user *models.User) (string, time.Time, error) {
+// TokenDuration returns how long generated tokens are valid
+func (a *JWTAuth) TokenDuration() time.Duration {
+	return a.tokenDuration
+}
+
+// JWKS returns the public keys other services can verify tokens with
+func (a *JWTAuth) JWKS() *JWKS {
+	return a.keys.JWKS(time.Now())
+}
+
+// GenerateToken generates a JWT token for a user in a login session
+func (a *JWTAuth) GenerateToken(user *models.User, sessionID string) (string, time.Time, error) {
 	expirationTime := time.Now().Add(a.tokenDuration)
 
 	claims := &JWTClaims{
-		UserID: user.ID,
-		Email:  user.Email,
+		UserID:     user.ID,
+		Email:      user.Email,
+		Generation: user.TokenGeneration,
+		SessionID:  sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Subject:   fmt.Sprintf("%d", user.ID),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(a.secretKey))
+	key := a.keys.current()
+	token := jwt.NewWithClaims(key.method, claims)
+	if key.id != "" {
+		token.Header["kid"] = key.id
+	}
+
+	tokenString, err := token.SignedString(key.privateKey)
 	if err != nil {
 		return "", time.Time{}, fmt.Errorf("failed to sign token: %w", err)
 	}
@@ -63,12 +94,19 @@ func (a *JWTAuth) ValidateToken(tokenString string) (*JWTClaims, error) {
 	claims := &JWTClaims{}
 
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		// Validate the signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := a.keys.verificationKey(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key: %q", kid)
+		}
+
+		// Validate the signing method, so a public key is never taken for
+		// an HMAC secret
+		if token.Method.Alg() != key.method.Alg() {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(a.secretKey), nil
+		return key.publicKey, nil
 	})
 
 	if err != nil {
@@ -0,0 +1,259 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is a key access tokens are signed or verified with, identified
+// by the kid header of the tokens it signed
+type SigningKey struct {
+	id         string
+	method     jwt.SigningMethod
+	privateKey interface{} // nil for keys only kept to verify tokens
+	publicKey  interface{}
+
+	// verifyUntil ends the grace period of a retired key; zero keeps the
+	// key until it is removed from the key set
+	verifyUntil time.Time
+}
+
+// KeySet holds the keys access tokens are signed with. New tokens are signed
+// with the current key; tokens signed with any other key of the set still
+// verify until its grace period ends, so keys can be rotated without
+// logging anyone out.
+type KeySet struct {
+	currentKeyID string
+	keys         map[string]*SigningKey
+}
+
+// NewHMACKeySet creates a key set signing tokens with HS256 and a shared
+// secret. Its tokens carry no kid and cannot be verified through the JWKS.
+func NewHMACKeySet(secret string) *KeySet {
+	key := &SigningKey{
+		method:     jwt.SigningMethodHS256,
+		privateKey: []byte(secret),
+		publicKey:  []byte(secret),
+	}
+
+	return &KeySet{keys: map[string]*SigningKey{"": key}}
+}
+
+// keySetFile is the on-disk format of a key set, with PEM encoded keys in
+// separate files. Paths are relative to the key set file:
+//
+//	{"current_key_id": "2024-06", "keys": {
+//	  "2024-06": {"alg": "EdDSA", "private_key_file": "2024-06.pem"},
+//	  "2024-01": {"alg": "RS256", "public_key_file": "2024-01.pub.pem", "verify_until": "2024-06-02T00:00:00Z"}
+//	}}
+type keySetFile struct {
+	CurrentKeyID string                `json:"current_key_id"`
+	Keys         map[string]keySetItem `json:"keys"`
+}
+
+// keySetItem is a key in a key set file. Keys other than the current one
+// may leave out the private key.
+type keySetItem struct {
+	Algorithm      string     `json:"alg"`
+	PrivateKeyFile string     `json:"private_key_file"`
+	PublicKeyFile  string     `json:"public_key_file"`
+	VerifyUntil    *time.Time `json:"verify_until"`
+}
+
+// LoadKeySet reads a key set from a JSON file. To rotate, add a new key to
+// the file, and once every instance knows it point current_key_id at it.
+// Keep the old key until the tokens it signed have expired, or set its
+// verify_until.
+func LoadKeySet(path string) (*KeySet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing keys: %w", err)
+	}
+
+	var file keySetFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing keys: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	keySet := &KeySet{
+		currentKeyID: file.CurrentKeyID,
+		keys:         make(map[string]*SigningKey, len(file.Keys)),
+	}
+
+	for id, item := range file.Keys {
+		key, err := loadSigningKey(dir, id, item)
+		if err != nil {
+			return nil, err
+		}
+		keySet.keys[id] = key
+	}
+
+	current, ok := keySet.keys[keySet.currentKeyID]
+	if !ok || keySet.currentKeyID == "" {
+		return nil, fmt.Errorf("current signing key %q not in key set", keySet.currentKeyID)
+	}
+	if current.privateKey == nil {
+		return nil, fmt.Errorf("current signing key %q has no private key", keySet.currentKeyID)
+	}
+	if !current.verifyUntil.IsZero() {
+		return nil, fmt.Errorf("current signing key %q cannot have verify_until", keySet.currentKeyID)
+	}
+
+	return keySet, nil
+}
+
+// loadSigningKey reads the PEM files of a key in a key set file
+func loadSigningKey(dir, id string, item keySetItem) (*SigningKey, error) {
+	key := &SigningKey{id: id}
+	if item.VerifyUntil != nil {
+		key.verifyUntil = *item.VerifyUntil
+	}
+
+	privatePEM, err := readKeyFile(dir, item.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key %q: %w", id, err)
+	}
+
+	publicPEM, err := readKeyFile(dir, item.PublicKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key %q: %w", id, err)
+	}
+
+	if privatePEM == nil && publicPEM == nil {
+		return nil, fmt.Errorf("signing key %q has no key file", id)
+	}
+
+	switch item.Algorithm {
+	case "RS256":
+		key.method = jwt.SigningMethodRS256
+		if privatePEM != nil {
+			var private *rsa.PrivateKey
+			private, err = jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+			if err == nil {
+				key.privateKey, key.publicKey = private, &private.PublicKey
+			}
+		} else {
+			key.publicKey, err = jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+		}
+	case "EdDSA":
+		key.method = jwt.SigningMethodEdDSA
+		if privatePEM != nil {
+			var private interface{}
+			private, err = jwt.ParseEdPrivateKeyFromPEM(privatePEM)
+			if err == nil {
+				key.privateKey, key.publicKey = private, private.(ed25519.PrivateKey).Public()
+			}
+		} else {
+			key.publicKey, err = jwt.ParseEdPublicKeyFromPEM(publicPEM)
+		}
+	default:
+		return nil, fmt.Errorf("signing key %q: unsupported algorithm %q", id, item.Algorithm)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %q: %w", id, err)
+	}
+
+	return key, nil
+}
+
+// readKeyFile reads a key file, relative to dir unless the path is
+// absolute. An empty path reads nothing.
+func readKeyFile(dir, path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	return os.ReadFile(path)
+}
+
+// current returns the key new tokens are signed with
+func (ks *KeySet) current() *SigningKey {
+	return ks.keys[ks.currentKeyID]
+}
+
+// verificationKey returns the key identified by kid if tokens it signed are
+// still accepted at now
+func (ks *KeySet) verificationKey(kid string, now time.Time) (*SigningKey, bool) {
+	key, ok := ks.keys[kid]
+	if !ok || key.expired(now) {
+		return nil, false
+	}
+
+	return key, true
+}
+
+// expired reports whether the grace period of a retired key is over
+func (k *SigningKey) expired(now time.Time) bool {
+	return k.id != "" && !k.verifyUntil.IsZero() && !now.Before(k.verifyUntil)
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+
+	// RSA keys
+	Modulus  string `json:"n,omitempty"`
+	Exponent string `json:"e,omitempty"`
+
+	// Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set, the document other services fetch to verify
+// tokens
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys tokens are currently accepted from. Shared
+// secrets are never published.
+func (ks *KeySet) JWKS(now time.Time) *JWKS {
+	jwks := &JWKS{Keys: []JWK{}}
+
+	for _, key := range ks.keys {
+		if key.expired(now) {
+			continue
+		}
+
+		jwk := JWK{KeyID: key.id, Use: "sig", Algorithm: key.method.Alg()}
+		switch public := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.Modulus = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.Exponent = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		default:
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool { return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID })
+
+	return jwks
+}
@@ -0,0 +1,170 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/models"
+)
+
+// writeKeyFiles writes a PEM private key and its public key to dir
+func writeKeyFiles(t *testing.T, dir, name string, private, public interface{}) {
+	t.Helper()
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatalf("failed to encode private key: %v", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+
+	files := map[string]*pem.Block{
+		name + ".pem":     {Type: "PRIVATE KEY", Bytes: der},
+		name + ".pub.pem": {Type: "PUBLIC KEY", Bytes: publicDER},
+	}
+	for file, block := range files {
+		if err := os.WriteFile(filepath.Join(dir, file), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatalf("failed to write key file: %v", err)
+		}
+	}
+}
+
+// loadKeySet writes a key set file to dir and loads it
+func loadKeySet(t *testing.T, dir, content string) *KeySet {
+	t.Helper()
+
+	path := filepath.Join(dir, "keys.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write key set: %v", err)
+	}
+
+	keys, err := LoadKeySet(path)
+	if err != nil {
+		t.Fatalf("failed to load key set: %v", err)
+	}
+
+	return keys
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	user := &models.User{ID: 7, Email: "user@example.com"}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+	writeKeyFiles(t, dir, "old", rsaKey, &rsaKey.PublicKey)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate Ed25519 key: %v", err)
+	}
+	writeKeyFiles(t, dir, "new", edPrivate, edPublic)
+
+	before := NewJWTAuthWithKeys(loadKeySet(t, dir, `{"current_key_id": "old", "keys": {
+		"old": {"alg": "RS256", "private_key_file": "old.pem"}
+	}}`), time.Minute)
+
+	oldToken, _, err := before.GenerateToken(user, "session")
+	if err != nil {
+		t.Fatalf("failed to sign with RS256: %v", err)
+	}
+
+	// After rotating, new tokens are signed with the new key and tokens of
+	// the old key verify with its public key alone
+	after := NewJWTAuthWithKeys(loadKeySet(t, dir, `{"current_key_id": "new", "keys": {
+		"new": {"alg": "EdDSA", "private_key_file": "new.pem"},
+		"old": {"alg": "RS256", "public_key_file": "old.pub.pem"}
+	}}`), time.Minute)
+
+	newToken, _, err := after.GenerateToken(user, "session")
+	if err != nil {
+		t.Fatalf("failed to sign with EdDSA: %v", err)
+	}
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		claims, err := after.ValidateToken(token)
+		if err != nil || claims.UserID != user.ID {
+			t.Fatalf("expected the %s token to verify, got %+v, %v", name, claims, err)
+		}
+	}
+
+	if _, err := before.ValidateToken(newToken); err == nil {
+		t.Fatalf("expected a token of an unknown key to fail")
+	}
+
+	jwks := after.JWKS()
+	if len(jwks.Keys) != 2 {
+		t.Fatalf("expected both keys to be published, got %+v", jwks.Keys)
+	}
+	if k := jwks.Keys[0]; k.KeyID != "new" || k.KeyType != "OKP" || k.Curve != "Ed25519" || k.X == "" {
+		t.Fatalf("unexpected Ed25519 key %+v", k)
+	}
+	if k := jwks.Keys[1]; k.KeyID != "old" || k.KeyType != "RSA" || k.Algorithm != "RS256" || k.Modulus == "" || k.Exponent != "AQAB" {
+		t.Fatalf("unexpected RSA key %+v", k)
+	}
+
+	// Once its grace period is over the old key is neither accepted nor
+	// published
+	retired := NewJWTAuthWithKeys(loadKeySet(t, dir, `{"current_key_id": "new", "keys": {
+		"new": {"alg": "EdDSA", "private_key_file": "new.pem"},
+		"old": {"alg": "RS256", "public_key_file": "old.pub.pem", "verify_until": "2000-01-01T00:00:00Z"}
+	}}`), time.Minute)
+
+	if _, err := retired.ValidateToken(oldToken); err == nil {
+		t.Fatalf("expected a token of a retired key to fail")
+	}
+	if len(retired.JWKS().Keys) != 1 {
+		t.Fatalf("expected the retired key not to be published")
+	}
+}
+
+func TestKeySetRejectsOtherAlgorithms(t *testing.T) {
+	dir := t.TempDir()
+	user := &models.User{ID: 7}
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate Ed25519 key: %v", err)
+	}
+	writeKeyFiles(t, dir, "key", edPrivate, edPublic)
+
+	jwtAuth := NewJWTAuthWithKeys(loadKeySet(t, dir, `{"current_key_id": "key", "keys": {
+		"key": {"alg": "EdDSA", "private_key_file": "key.pem"}
+	}}`), time.Minute)
+
+	// An HS256 token must not verify against an asymmetric key set
+	hmacToken, _, _ := NewJWTAuth("secret", time.Minute).GenerateToken(user, "")
+	if _, err := jwtAuth.ValidateToken(hmacToken); err == nil {
+		t.Fatalf("expected an HS256 token to fail")
+	}
+
+	if len(NewJWTAuth("secret", time.Minute).JWKS().Keys) != 0 {
+		t.Fatalf("expected a shared secret never to be published")
+	}
+
+	for _, content := range []string{
+		`{"current_key_id": "missing", "keys": {"key": {"alg": "EdDSA", "private_key_file": "key.pem"}}}`,
+		`{"current_key_id": "key", "keys": {"key": {"alg": "EdDSA", "public_key_file": "key.pub.pem"}}}`,
+		`{"current_key_id": "key", "keys": {"key": {"alg": "HS256", "private_key_file": "key.pem"}}}`,
+		`{"current_key_id": "key", "keys": {"key": {"alg": "RS256", "private_key_file": "key.pem"}}}`,
+	} {
+		path := filepath.Join(dir, "invalid.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("failed to write key set: %v", err)
+		}
+		if _, err := LoadKeySet(path); err == nil {
+			t.Errorf("expected key set %s to be rejected", content)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// PersonalTokenPrefix starts every personal access token, so secret
+// scanners can recognize a leaked token and it can be told apart from a JWT
+const PersonalTokenPrefix = "fsp_"
+
+// personalTokenHintLength is how many characters of a personal access token
+// are kept in the clear so users can tell their tokens apart
+const personalTokenHintLength = len(PersonalTokenPrefix) + 6
+
+// Scopes a personal access token can be granted
+const (
+	ScopeFilesRead    = "files:read"
+	ScopeFilesWrite   = "files:write"
+	ScopeSharesManage = "shares:manage"
+)
+
+// Scopes lists all scopes a personal access token can be granted
+var Scopes = []string{ScopeFilesRead, ScopeFilesWrite, ScopeSharesManage}
+
+// IsScope reports whether scope is a known scope
+func IsScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewPersonalToken generates a random personal access token, the hash it is
+// stored under and the start of the token shown to identify it
+func NewPersonalToken() (string, string, string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to generate personal access token: %w", err)
+	}
+
+	token := PersonalTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashToken(token), token[:personalTokenHintLength], nil
+}
+
+// IsPersonalToken reports whether a bearer token is a personal access token
+// rather than a JWT
+func IsPersonalToken(token string) bool {
+	return strings.HasPrefix(token, PersonalTokenPrefix)
+}
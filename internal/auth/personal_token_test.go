@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewPersonalToken(t *testing.T) {
+	token, hash, hint, err := NewPersonalToken()
+	if err != nil {
+		t.Fatalf("failed to generate personal access token: %v", err)
+	}
+
+	if !IsPersonalToken(token) {
+		t.Fatalf("expected %q to start with %q", token, PersonalTokenPrefix)
+	}
+	if hash != HashToken(token) {
+		t.Fatalf("expected the returned hash to be the hash of the token")
+	}
+	if !strings.HasPrefix(token, hint) || len(hint) >= len(token)/2 {
+		t.Fatalf("expected %q to be a short start of the token", hint)
+	}
+
+	if IsPersonalToken("eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.e30.sig") {
+		t.Fatalf("expected a JWT not to be taken for a personal access token")
+	}
+}
@@ -0,0 +1,22 @@
+package auth
+
+import "testing"
+
+func TestNewRefreshToken(t *testing.T) {
+	token, hash, err := NewRefreshToken()
+	if err != nil {
+		t.Fatalf("failed to generate refresh token: %v", err)
+	}
+
+	if hash != HashToken(token) {
+		t.Fatalf("expected the returned hash to be the hash of the token")
+	}
+	if hash == token {
+		t.Fatalf("expected the token not to be stored as is")
+	}
+
+	other, _, _ := NewRefreshToken()
+	if other == token {
+		t.Fatalf("expected a new token every time")
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ShareAccess issues and verifies short-lived tokens proving that the password
+// of a share link has been entered. Tokens are bound to a subject, such as the
+// share ID and password hash, so they stop working when the password changes.
+type ShareAccess struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewShareAccess creates a new share access token issuer
+func NewShareAccess(secret string, ttl time.Duration) *ShareAccess {
+	return &ShareAccess{
+		secret: []byte(secret),
+		ttl:    ttl,
+	}
+}
+
+// IssueToken creates an access token for subject
+func (a *ShareAccess) IssueToken(subject string) (string, time.Time) {
+	expiresAt := time.Now().Add(a.ttl)
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+
+	return expiry + "." + a.sign(subject, expiry), expiresAt
+}
+
+// VerifyToken checks that token was issued for subject and has not expired
+func (a *ShareAccess) VerifyToken(token, subject string) bool {
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || time.Now().Unix() > expiresAt {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(a.sign(subject, expiry)))
+}
+
+// sign computes the token signature
+func (a *ShareAccess) sign(subject, expiry string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte("share-access:" + subject + ":" + expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShareAccessToken(t *testing.T) {
+	access := NewShareAccess("secret", time.Minute)
+
+	token, expiresAt := access.IssueToken("share:hash")
+	if time.Until(expiresAt) <= 0 {
+		t.Fatalf("expected expiry in the future, got %v", expiresAt)
+	}
+
+	if !access.VerifyToken(token, "share:hash") {
+		t.Errorf("expected token to verify")
+	}
+
+	if access.VerifyToken(token, "share:other-hash") {
+		t.Errorf("expected token for another subject to fail")
+	}
+
+	if NewShareAccess("other-secret", time.Minute).VerifyToken(token, "share:hash") {
+		t.Errorf("expected token signed with another secret to fail")
+	}
+
+	if access.VerifyToken(token+"x", "share:hash") || access.VerifyToken("garbage", "share:hash") {
+		t.Errorf("expected malformed tokens to fail")
+	}
+
+	expired, _ := NewShareAccess("secret", -time.Minute).IssueToken("share:hash")
+	if access.VerifyToken(expired, "share:hash") {
+		t.Errorf("expected expired token to fail")
+	}
+}
@@ -0,0 +1,19 @@
+package config
+
+import (
+	"fmt"
+
+	"file-sharing-platform/pkg/storage"
+)
+
+// NewStorageBackend creates the "local" or "s3" storage backend from the config
+func NewStorageBackend(cfg *Config, backend string) (storage.FileStorage, error) {
+	switch backend {
+	case "local":
+		return storage.NewLocalStorage(cfg.LocalStoragePath, cfg.LocalStorageBaseURL)
+	case "s3":
+		return storage.NewS3Storage(cfg.S3Region, cfg.S3Bucket, cfg.S3Endpoint, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3PartSize, cfg.S3UploadConcurrency)
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
+}
@@ -0,0 +1,403 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// BlobRepository handles the deduplicated blobs that files and file
+// versions refer to by hash
+type BlobRepository struct {
+	db *Database
+}
+
+// NewBlobRepository creates a new blob repository
+func NewBlobRepository(db *Database) *BlobRepository {
+	return &BlobRepository{db: db}
+}
+
+// lockBlobHash locks a blob hash until the end of the transaction. The lock
+// is held while content is stored under the hash or deleted, so content at
+// the path of a blob is never deleted after it was stored there again.
+func lockBlobHash(tx *sqlx.Tx, hash string) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('blob:' || $1))`, hash)
+	if err != nil {
+		return fmt.Errorf("failed to lock blob: %w", err)
+	}
+
+	return nil
+}
+
+// AcquireBlob adds a reference to the blob with the hash of blob and fills
+// in blob with the stored blob. If there is no such blob yet, store is
+// called to store its content and fill in where it is, and blob is saved as
+// a new blob; true is then returned. Content stored for a blob that could
+// not be saved is left behind, to be stored over by the next upload of the
+// same content.
+func (r *BlobRepository) AcquireBlob(blob *models.Blob, store func(blob *models.Blob) error) (bool, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = lockBlobHash(tx, blob.Hash)
+	if err != nil {
+		return false, err
+	}
+
+	query := `
+		UPDATE blobs SET ref_count = ref_count + 1
+		WHERE hash = $1
+		RETURNING hash, storage_path, public_url, ref_count, created_at,
+		          encrypted_key, encryption_key_id, encryption_version
+	`
+
+	err = tx.Get(blob, query, blob.Hash)
+	if err == nil {
+		err = tx.Commit()
+		if err != nil {
+			return false, fmt.Errorf("failed to commit blob reference: %w", err)
+		}
+		return false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return false, fmt.Errorf("failed to acquire blob: %w", err)
+	}
+
+	err = store(blob)
+	if err != nil {
+		return false, err
+	}
+
+	blob.RefCount = 1
+	blob.CreatedAt = time.Now()
+
+	query = `
+		INSERT INTO blobs (
+			hash, storage_path, public_url, encrypted_key, encryption_key_id,
+			encryption_version, ref_count, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	_, err = tx.Exec(
+		query,
+		blob.Hash,
+		blob.StoragePath,
+		blob.PublicURL,
+		blob.EncryptedKey,
+		blob.EncryptionKeyID,
+		blob.EncryptionVersion,
+		blob.RefCount,
+		blob.CreatedAt,
+	)
+	if err != nil {
+		return false, fmt.Errorf("failed to create blob: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("failed to commit blob: %w", err)
+	}
+
+	return true, nil
+}
+
+// DeleteBlobContent deletes the content of a blob released by its last
+// reference, unless a blob stored at the same path was created again since.
+func (r *BlobRepository) DeleteBlobContent(blob *models.Blob, deleteContent func(storagePath string) error) error {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = lockBlobHash(tx, blob.Hash)
+	if err != nil {
+		return err
+	}
+
+	var stored bool
+	query := `SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = $1 AND storage_path = $2)`
+
+	err = tx.Get(&stored, query, blob.Hash, blob.StoragePath)
+	if err != nil {
+		return fmt.Errorf("failed to check blob: %w", err)
+	}
+
+	if stored {
+		return nil
+	}
+
+	return deleteContent(blob.StoragePath)
+}
+
+// ReleaseBlob removes a reference to a blob. It returns the blob if that
+// was the last reference, in which case its content can be deleted.
+func (r *BlobRepository) ReleaseBlob(hash string) (*models.Blob, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	released, err := releaseBlobs(tx, []string{hash})
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit blob release: %w", err)
+	}
+
+	if len(released) == 0 {
+		return nil, nil
+	}
+
+	return &released[0], nil
+}
+
+// releaseBlobs removes a reference to each of the blobs with the given
+// hashes, which may repeat. Blobs left without references are deleted and
+// returned so their content can be deleted once the transaction commits.
+func releaseBlobs(tx *sqlx.Tx, hashes []string) ([]models.Blob, error) {
+	released := []models.Blob{}
+
+	for _, hash := range hashes {
+		var refCount int
+		err := tx.Get(&refCount, `UPDATE blobs SET ref_count = ref_count - 1 WHERE hash = $1 RETURNING ref_count`, hash)
+		if errors.Is(err, sql.ErrNoRows) {
+			// Already gone, nothing left to release
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to release blob: %w", err)
+		}
+
+		if refCount > 0 {
+			continue
+		}
+
+		var blob models.Blob
+		query := `
+			DELETE FROM blobs
+			WHERE hash = $1 AND ref_count <= 0
+			RETURNING hash, storage_path, public_url, ref_count, created_at,
+			          encrypted_key, encryption_key_id, encryption_version
+		`
+
+		err = tx.Get(&blob, query, hash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete blob: %w", err)
+		}
+
+		released = append(released, blob)
+	}
+
+	return released, nil
+}
+
+// nonEmpty returns the blob hashes of hashes, leaving out the empty hashes
+// of content that is not deduplicated
+func nonEmpty(hashes []string) []string {
+	blobHashes := []string{}
+	for _, hash := range hashes {
+		if hash != "" {
+			blobHashes = append(blobHashes, hash)
+		}
+	}
+
+	return blobHashes
+}
+
+// GetBlobsToRewrap gets up to batchSize encrypted blobs with a hash after
+// afterHash, in hash order, whose data key is not wrapped under keyID
+func (r *BlobRepository) GetBlobsToRewrap(keyID string, afterHash string, batchSize int) ([]models.Blob, error) {
+	blobs := []models.Blob{}
+	query := `
+		SELECT hash, encrypted_key, encryption_key_id, encryption_version
+		FROM blobs
+		WHERE encryption_version > 0 AND encryption_key_id <> $1 AND hash > $2
+		ORDER BY hash
+		LIMIT $3
+	`
+
+	err := r.db.DB.Select(&blobs, query, keyID, afterHash, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blobs to rewrap: %w", err)
+	}
+
+	return blobs, nil
+}
+
+// UpdateBlobKey replaces the wrapped data key of a blob. The update only
+// applies if the blob is still wrapped under oldKeyID, and reports whether it did.
+func (r *BlobRepository) UpdateBlobKey(hash string, oldKeyID string, encryptedKey []byte, keyID string) (bool, error) {
+	query := `
+		UPDATE blobs
+		SET encrypted_key = $1, encryption_key_id = $2
+		WHERE hash = $3 AND encryption_key_id = $4
+	`
+
+	result, err := r.db.DB.Exec(query, encryptedKey, keyID, hash, oldKeyID)
+	if err != nil {
+		return false, fmt.Errorf("failed to update blob key: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// GetBlobs gets up to batchSize blobs with a hash after afterHash, in hash order
+func (r *BlobRepository) GetBlobs(afterHash string, batchSize int) ([]models.Blob, error) {
+	blobs := []models.Blob{}
+	query := `
+		SELECT hash, storage_path, public_url, ref_count, created_at,
+		       encrypted_key, encryption_key_id, encryption_version
+		FROM blobs
+		WHERE hash > $1
+		ORDER BY hash
+		LIMIT $2
+	`
+
+	err := r.db.DB.Select(&blobs, query, afterHash, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blobs: %w", err)
+	}
+
+	return blobs, nil
+}
+
+// GetContentWithoutBlob gets the IDs of up to batchSize rows of table
+// ("files" or "file_versions") with an ID after afterID, in ID order, whose
+// content has a SHA-256 checksum but is not in a blob
+func (r *BlobRepository) GetContentWithoutBlob(table, afterID string, batchSize int) ([]string, error) {
+	ids := []string{}
+	query := fmt.Sprintf(`
+		SELECT id FROM %s
+		WHERE blob_hash = '' AND sha256 <> '' AND id > $1
+		ORDER BY id
+		LIMIT $2
+	`, table)
+
+	err := r.db.DB.Select(&ids, query, afterID, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content without blob: %w", err)
+	}
+
+	return ids, nil
+}
+
+// MoveToBlob makes a row of table ("files" or "file_versions") whose content
+// is not in a blob refer to the blob with the SHA-256 checksum of its
+// content. If there is no such blob, one is created from the row's own
+// content. Otherwise the path of the row's own content is returned, as
+// nothing refers to it any more and it can be deleted.
+func (r *BlobRepository) MoveToBlob(table, id string) (string, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// The row's own content, as it would be stored as a blob
+	var content models.Blob
+	query := fmt.Sprintf(`
+		SELECT sha256 AS hash, storage_path, public_url, encrypted_key, encryption_key_id, encryption_version
+		FROM %s
+		WHERE id = $1 AND blob_hash = '' AND sha256 <> ''
+		FOR UPDATE
+	`, table)
+
+	err = tx.Get(&content, query, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Moved or deleted in the meantime
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get content: %w", err)
+	}
+
+	err = lockBlobHash(tx, content.Hash)
+	if err != nil {
+		return "", err
+	}
+
+	var blob models.Blob
+	var created bool
+	query = `
+		INSERT INTO blobs (
+			hash, storage_path, public_url, encrypted_key, encryption_key_id,
+			encryption_version, ref_count, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, 1, $7)
+		ON CONFLICT (hash) DO UPDATE SET ref_count = blobs.ref_count + 1
+		RETURNING storage_path, public_url, encrypted_key, encryption_key_id,
+		          encryption_version, (xmax = 0) AS created
+	`
+
+	err = tx.QueryRowx(
+		query,
+		content.Hash,
+		content.StoragePath,
+		content.PublicURL,
+		content.EncryptedKey,
+		content.EncryptionKeyID,
+		content.EncryptionVersion,
+		time.Now(),
+	).Scan(
+		&blob.StoragePath,
+		&blob.PublicURL,
+		&blob.EncryptedKey,
+		&blob.EncryptionKeyID,
+		&blob.EncryptionVersion,
+		&created,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to acquire blob: %w", err)
+	}
+
+	query = fmt.Sprintf(`
+		UPDATE %s
+		SET blob_hash = $1, storage_path = $2, public_url = $3,
+		    encrypted_key = $4, encryption_key_id = $5, encryption_version = $6
+		WHERE id = $7
+	`, table)
+
+	_, err = tx.Exec(
+		query,
+		content.Hash,
+		blob.StoragePath,
+		blob.PublicURL,
+		blob.EncryptedKey,
+		blob.EncryptionKeyID,
+		blob.EncryptionVersion,
+		id,
+	)
+	if err != nil {
+		return "", fmt.Errorf("failed to move content to blob: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return "", fmt.Errorf("failed to commit blob: %w", err)
+	}
+
+	if created {
+		return "", nil
+	}
+
+	return content.StoragePath, nil
+}
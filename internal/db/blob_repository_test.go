@@ -0,0 +1,175 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var blobColumns = []string{"hash", "storage_path", "public_url", "ref_count", "created_at", "encrypted_key", "encryption_key_id", "encryption_version"}
+
+func TestAcquireBlobReferencesExistingBlob(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	blobRepo := NewBlobRepository(database)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs("abc").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count \\+ 1").WithArgs("abc").
+		WillReturnRows(sqlmock.NewRows(blobColumns).
+			AddRow("abc", "blobs/ab/abc", "http://localhost/blobs/ab/abc", 2, time.Now(), nil, "", 0))
+	mock.ExpectCommit()
+
+	blob := &models.Blob{Hash: "abc"}
+	created, err := blobRepo.AcquireBlob(blob, func(blob *models.Blob) error {
+		t.Errorf("expected the content of an existing blob not to be stored again")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if created || blob.StoragePath != "blobs/ab/abc" || blob.RefCount != 2 {
+		t.Errorf("expected the existing blob, got %+v (created %v)", blob, created)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcquireBlobStoresNewBlob(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	blobRepo := NewBlobRepository(database)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs("abc").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count \\+ 1").WithArgs("abc").
+		WillReturnRows(sqlmock.NewRows(blobColumns))
+	mock.ExpectExec("INSERT INTO blobs").
+		WithArgs("abc", "blobs/ab/abc", "", sqlmock.AnyArg(), "", 0, 1, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	stored := 0
+	blob := &models.Blob{Hash: "abc"}
+	created, err := blobRepo.AcquireBlob(blob, func(blob *models.Blob) error {
+		stored++
+		blob.StoragePath = "blobs/ab/abc"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !created || stored != 1 || blob.RefCount != 1 {
+		t.Errorf("expected a new blob stored once, got %+v (created %v, stored %d times)", blob, created, stored)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAcquireBlobDoesNotSaveUnstoredBlob(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	blobRepo := NewBlobRepository(database)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs("abc").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count \\+ 1").WithArgs("abc").
+		WillReturnRows(sqlmock.NewRows(blobColumns))
+	mock.ExpectRollback()
+
+	storeErr := errors.New("storage unavailable")
+	_, err := blobRepo.AcquireBlob(&models.Blob{Hash: "abc"}, func(blob *models.Blob) error {
+		return storeErr
+	})
+	if !errors.Is(err, storeErr) {
+		t.Fatalf("expected the storage error, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReleaseBlobsCountsReferences(t *testing.T) {
+	database, mock := newMockDatabase(t)
+
+	mock.ExpectBegin()
+
+	// Still referenced by another file
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count - 1").WithArgs("shared").
+		WillReturnRows(sqlmock.NewRows([]string{"ref_count"}).AddRow(1))
+
+	// Already released by a concurrent deletion
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count - 1").WithArgs("gone").
+		WillReturnRows(sqlmock.NewRows([]string{"ref_count"}))
+
+	// Referenced twice by the rows released, by the last time
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count - 1").WithArgs("last").
+		WillReturnRows(sqlmock.NewRows([]string{"ref_count"}).AddRow(1))
+	mock.ExpectQuery("UPDATE blobs SET ref_count = ref_count - 1").WithArgs("last").
+		WillReturnRows(sqlmock.NewRows([]string{"ref_count"}).AddRow(0))
+	mock.ExpectQuery("DELETE FROM blobs").WithArgs("last").
+		WillReturnRows(sqlmock.NewRows(blobColumns).
+			AddRow("last", "blobs/la/last", "", 0, time.Now(), nil, "", 0))
+
+	mock.ExpectCommit()
+
+	tx, err := database.DB.Beginx()
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %v", err)
+	}
+
+	released, err := releaseBlobs(tx, []string{"shared", "gone", "last", "last"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	if len(released) != 1 || released[0].Hash != "last" || released[0].StoragePath != "blobs/la/last" {
+		t.Errorf("expected only the last blob to be released, got %+v", released)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeleteBlobContentKeepsStoredAgainContent(t *testing.T) {
+	for _, stored := range []bool{false, true} {
+		database, mock := newMockDatabase(t)
+		blobRepo := NewBlobRepository(database)
+
+		mock.ExpectBegin()
+		mock.ExpectExec("pg_advisory_xact_lock").WithArgs("abc").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT EXISTS").WithArgs("abc", "blobs/ab/abc").
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(stored))
+		mock.ExpectRollback()
+
+		deleted := false
+		err := blobRepo.DeleteBlobContent(&models.Blob{Hash: "abc", StoragePath: "blobs/ab/abc"}, func(storagePath string) error {
+			deleted = true
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// Content uploaded again since its blob was released is kept
+		if deleted == stored {
+			t.Errorf("stored again %v: expected deleted to be %v", stored, !stored)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	}
+}
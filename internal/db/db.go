@@ -61,6 +61,20 @@ func (d *Database) Init() error {
 		return fmt.Errorf("failed to create files table: %w", err)
 	}
 
+	// Create folders table
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS folders (
+		id VARCHAR(36) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		parent_id VARCHAR(36) REFERENCES folders(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create folders table: %w", err)
+	}
+
 	// Create shared_files table
 	_, err = d.DB.Exec(`
 	CREATE TABLE IF NOT EXISTS shared_files (
@@ -74,6 +88,247 @@ func (d *Database) Init() error {
 		return fmt.Errorf("failed to create shared_files table: %w", err)
 	}
 
+	// Create file_requests table
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS file_requests (
+		id VARCHAR(36) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		token VARCHAR(36) UNIQUE NOT NULL,
+		title VARCHAR(255) NOT NULL,
+		password_hash VARCHAR(255) NOT NULL DEFAULT '',
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		locked_until TIMESTAMP WITH TIME ZONE,
+		expires_at TIMESTAMP WITH TIME ZONE,
+		max_file_size BIGINT NOT NULL DEFAULT 0,
+		allowed_content_types TEXT[] NOT NULL DEFAULT '{}',
+		max_files INTEGER NOT NULL DEFAULT 0,
+		file_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create file_requests table: %w", err)
+	}
+
+	// Create upload_sessions table
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id VARCHAR(36) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		file_name VARCHAR(255) NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		size BIGINT NOT NULL,
+		upload_offset BIGINT NOT NULL DEFAULT 0,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create upload_sessions table: %w", err)
+	}
+
+	// Create file_versions table, holding the previous versions of files.
+	// The current version of a file is the files row itself.
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS file_versions (
+		id VARCHAR(36) PRIMARY KEY,
+		file_id VARCHAR(36) NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+		version INTEGER NOT NULL,
+		size BIGINT NOT NULL,
+		content_type VARCHAR(255) NOT NULL,
+		storage_path VARCHAR(512) NOT NULL,
+		public_url VARCHAR(512) NOT NULL,
+		encrypted_key BYTEA,
+		encryption_key_id VARCHAR(255) NOT NULL DEFAULT 'default',
+		encryption_version INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		replaced_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		UNIQUE (file_id, version)
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create file_versions table: %w", err)
+	}
+
+	// Create version_retention table, holding the version retention policies
+	// of users who changed the default
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS version_retention (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		keep_last INTEGER NOT NULL DEFAULT 0,
+		keep_days INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create version_retention table: %w", err)
+	}
+
+	// Create blobs table, holding deduplicated content shared by files and
+	// file versions with the same SHA-256 hash
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS blobs (
+		hash VARCHAR(64) PRIMARY KEY,
+		storage_path VARCHAR(512) NOT NULL,
+		public_url VARCHAR(512) NOT NULL,
+		encrypted_key BYTEA,
+		encryption_key_id VARCHAR(255) NOT NULL DEFAULT 'default',
+		encryption_version INTEGER NOT NULL DEFAULT 0,
+		ref_count INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create blobs table: %w", err)
+	}
+
+	// Create refresh_tokens table. Tokens are stored hashed; each refresh
+	// replaces a token with a new one of the same family.
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS refresh_tokens (
+		id VARCHAR(36) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		family_id VARCHAR(36) NOT NULL,
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP WITH TIME ZONE,
+		revoked_at TIMESTAMP WITH TIME ZONE
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh_tokens table: %w", err)
+	}
+
+	// Create sessions table, one row per login. The refresh tokens of a
+	// session form a family whose ID is the session ID.
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS sessions (
+		id VARCHAR(36) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		ip_address VARCHAR(45) NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		device_label VARCHAR(255) NOT NULL DEFAULT '',
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+		revoked_at TIMESTAMP WITH TIME ZONE
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create sessions table: %w", err)
+	}
+
+	// Create personal_access_tokens table. Tokens are stored hashed.
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS personal_access_tokens (
+		id VARCHAR(36) PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		token_hash VARCHAR(64) UNIQUE NOT NULL,
+		token_hint VARCHAR(16) NOT NULL,
+		scopes TEXT[] NOT NULL DEFAULT '{}',
+		expires_at TIMESTAMP WITH TIME ZONE,
+		last_used_at TIMESTAMP WITH TIME ZONE,
+		created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+		revoked_at TIMESTAMP WITH TIME ZONE
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create personal_access_tokens table: %w", err)
+	}
+
+	// Create schema_migrations table, recording the data migrations that ran
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		name VARCHAR(255) PRIMARY KEY,
+		applied_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	// Add columns introduced after the initial schema
+	columns := []string{
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS encrypted_key BYTEA",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS encryption_version INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS encryption_key_id VARCHAR(255) NOT NULL DEFAULT 'default'",
+		"ALTER TABLE shared_files ADD COLUMN IF NOT EXISTS password_hash VARCHAR(255) NOT NULL DEFAULT ''",
+		"ALTER TABLE shared_files ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE shared_files ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE",
+		"ALTER TABLE shared_files ADD COLUMN IF NOT EXISTS max_downloads INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE shared_files ADD COLUMN IF NOT EXISTS download_count INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE shared_files ADD COLUMN IF NOT EXISTS burn_after_reading BOOLEAN NOT NULL DEFAULT FALSE",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS file_request_id VARCHAR(36) NOT NULL DEFAULT ''",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS folder_id VARCHAR(36) REFERENCES folders(id) ON DELETE SET NULL",
+		"ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS folder_id VARCHAR(36) NOT NULL DEFAULT ''",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS version_created_at TIMESTAMP WITH TIME ZONE",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP WITH TIME ZONE",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS blob_hash VARCHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS blob_hash VARCHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS sha256 VARCHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE files ADD COLUMN IF NOT EXISTS md5 VARCHAR(32) NOT NULL DEFAULT ''",
+		"ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS sha256 VARCHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS md5 VARCHAR(32) NOT NULL DEFAULT ''",
+		"ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS expected_sha256 VARCHAR(64) NOT NULL DEFAULT ''",
+		"ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS expected_md5 VARCHAR(32) NOT NULL DEFAULT ''",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS has_quota BOOLEAN NOT NULL DEFAULT FALSE",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_bytes BIGINT",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_files BIGINT",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS used_bytes BIGINT NOT NULL DEFAULT 0",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS used_files BIGINT NOT NULL DEFAULT 0",
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS token_generation BIGINT NOT NULL DEFAULT 0",
+	}
+
+	for _, column := range columns {
+		_, err = d.DB.Exec(column)
+		if err != nil {
+			return fmt.Errorf("failed to add column: %w", err)
+		}
+	}
+
+	// Storage usage is counted from existing files once, when usage
+	// tracking is added
+	err = d.migrateOnce("count_storage_usage", `
+		UPDATE users u
+		SET used_bytes = COALESCE((SELECT SUM(size) FROM files WHERE user_id = u.id), 0) +
+		                 COALESCE((SELECT SUM(v.size) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.user_id = u.id), 0),
+		    used_files = (SELECT COUNT(*) FROM files WHERE user_id = u.id)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to count storage usage: %w", err)
+	}
+
+	// Create share_accesses table
+	_, err = d.DB.Exec(`
+	CREATE TABLE IF NOT EXISTS share_accesses (
+		id BIGSERIAL PRIMARY KEY,
+		share_id VARCHAR(36) NOT NULL REFERENCES shared_files(id) ON DELETE CASCADE,
+		accessed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		ip_address VARCHAR(45) NOT NULL,
+		user_agent TEXT NOT NULL DEFAULT '',
+		referrer TEXT NOT NULL DEFAULT '',
+		success BOOLEAN NOT NULL,
+		reason VARCHAR(32) NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create share_accesses table: %w", err)
+	}
+
+	// Live files sharing a name in the same folder predate the unique index
+	// on file names and are renamed once, before it is created
+	var namesUnique bool
+	err = d.DB.Get(&namesUnique, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_indexes WHERE indexname = 'idx_files_unique_live_name'
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to check file name index: %w", err)
+	}
+
+	if !namesUnique {
+		err = d.renameDuplicateFiles()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Create indexes for performance
 	indexes := []string{
 		"CREATE INDEX IF NOT EXISTS idx_files_user_id ON files(user_id)",
@@ -82,6 +337,23 @@ func (d *Database) Init() error {
 		"CREATE INDEX IF NOT EXISTS idx_files_created_at ON files(created_at)",
 		"CREATE INDEX IF NOT EXISTS idx_shared_files_file_id ON shared_files(file_id)",
 		"CREATE INDEX IF NOT EXISTS idx_files_expires_at ON files(expires_at)",
+		"CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at ON upload_sessions(expires_at)",
+		"CREATE INDEX IF NOT EXISTS idx_share_accesses_share_id ON share_accesses(share_id, accessed_at)",
+		"CREATE INDEX IF NOT EXISTS idx_file_requests_user_id ON file_requests(user_id)",
+		"CREATE INDEX IF NOT EXISTS idx_files_folder_id ON files(folder_id)",
+		"CREATE INDEX IF NOT EXISTS idx_folders_parent_id ON folders(parent_id)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_unique_name ON folders(user_id, COALESCE(parent_id, ''), name)",
+		"CREATE INDEX IF NOT EXISTS idx_file_versions_replaced_at ON file_versions(replaced_at)",
+		// Trashed files do not hold on to their name
+		"DROP INDEX IF EXISTS idx_files_unique_name",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_files_unique_live_name ON files(user_id, COALESCE(folder_id, ''), name) WHERE deleted_at IS NULL",
+		"CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL",
+		"CREATE INDEX IF NOT EXISTS idx_files_storage_path ON files(storage_path)",
+		"CREATE INDEX IF NOT EXISTS idx_file_versions_storage_path ON file_versions(storage_path)",
+		"CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id)",
+		"CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id, expires_at)",
+		"CREATE INDEX IF NOT EXISTS idx_sessions_user_id ON sessions(user_id, expires_at)",
+		"CREATE INDEX IF NOT EXISTS idx_personal_access_tokens_user_id ON personal_access_tokens(user_id)",
 	}
 
 	for _, idx := range indexes {
@@ -94,6 +366,76 @@ func (d *Database) Init() error {
 	return nil
 }
 
+// renameDuplicateFiles renames live files that share their name with an
+// older file in the same folder to "name (n)". A new name can clash with
+// another file in turn, so it runs until no duplicates are left.
+func (d *Database) renameDuplicateFiles() error {
+	query := `
+		UPDATE files f
+		SET name = d.name || ' (' || d.position || ')', updated_at = NOW()
+		FROM (
+			SELECT id, name, ROW_NUMBER() OVER (
+				PARTITION BY user_id, COALESCE(folder_id, ''), name
+				ORDER BY created_at, id
+			) AS position
+			FROM files
+			WHERE deleted_at IS NULL
+		) d
+		WHERE f.id = d.id AND d.position > 1
+	`
+
+	for {
+		result, err := d.DB.Exec(query)
+		if err != nil {
+			return fmt.Errorf("failed to rename duplicate files: %w", err)
+		}
+
+		renamed, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+
+		if renamed == 0 {
+			return nil
+		}
+
+		log.Printf("Renamed %d files sharing a name with another file in their folder", renamed)
+	}
+}
+
+// migrateOnce runs a data migration in a transaction, together with
+// recording it in schema_migrations, unless it ran before. A migration that
+// fails or is interrupted runs again on the next start.
+func (d *Database) migrateOnce(name, query string) error {
+	tx, err := d.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Waits for another instance running the same migration
+	result, err := tx.Exec(`INSERT INTO schema_migrations (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, name)
+	if err != nil {
+		return fmt.Errorf("failed to record migration: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	_, err = tx.Exec(query)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // Close closes the database connection
 func (d *Database) Close() error {
 	return d.DB.Close()
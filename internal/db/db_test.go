@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+// newMockDatabase creates a database backed by sqlmock
+func newMockDatabase(t *testing.T) (*Database, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &Database{DB: sqlx.NewDb(conn, "postgres")}, mock
+}
+
+func TestRenameDuplicateFiles(t *testing.T) {
+	database, mock := newMockDatabase(t)
+
+	// Renaming a duplicate clashed with an existing name, which is renamed
+	// again on the next pass
+	mock.ExpectExec("UPDATE files f SET name").WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec("UPDATE files f SET name").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE files f SET name").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := database.renameDuplicateFiles(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateOnce(t *testing.T) {
+	database, mock := newMockDatabase(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs("count").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := database.migrateOnce("count", "UPDATE users SET used_files = 0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Once recorded the migration is skipped
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs("count").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	if err := database.migrateOnce("count", "UPDATE users SET used_files = 0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A failed migration is not recorded, so it runs again
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs("other").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users").WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	if err := database.migrateOnce("other", "UPDATE users SET used_files = 0"); err == nil {
+		t.Fatalf("expected the failed migration to be returned")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,12 +1,15 @@
 package db
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"time"
 
 	"file-sharing-platform/internal/models"
 
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // FileRepository handles file-related database operations
@@ -20,7 +23,7 @@ func NewFileRepository(db *Database) *FileRepository {
 }
 
 // CreateFile adds a new file to the database
-func (r *FileRepository) CreateFile(file *models.File) error {
+func (r *FileRepository) CreateFile(file *models.File, limit models.StorageQuota) error {
 	if file.ID == "" {
 		file.ID = uuid.New().String()
 	}
@@ -28,18 +31,29 @@ func (r *FileRepository) CreateFile(file *models.File) error {
 	now := time.Now()
 	file.CreatedAt = now
 	file.UpdatedAt = now
+	file.Version = 1
+	file.VersionCreatedAt = now
+
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
 	query := `
 		INSERT INTO files (
 			id, user_id, name, size, content_type, storage_path, 
-			public_url, is_public, expires_at, created_at, updated_at
+			public_url, is_public, expires_at, created_at, updated_at,
+			encrypted_key, encryption_key_id, encryption_version, file_request_id,
+			folder_id, version, version_created_at, blob_hash, sha256, md5
 		)
 		VALUES (
-			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11
+			$1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15,
+			NULLIF($16, ''), $17, $18, $19, $20, $21
 		)
 	`
 
-	_, err := r.db.DB.Exec(
+	_, err = tx.Exec(
 		query,
 		file.ID,
 		file.UserID,
@@ -52,23 +66,50 @@ func (r *FileRepository) CreateFile(file *models.File) error {
 		file.ExpiresAt,
 		file.CreatedAt,
 		file.UpdatedAt,
+		file.EncryptedKey,
+		file.EncryptionKeyID,
+		file.EncryptionVersion,
+		file.FileRequestID,
+		file.FolderID,
+		file.Version,
+		file.VersionCreatedAt,
+		file.BlobHash,
+		file.SHA256,
+		file.MD5,
 	)
 
 	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create file: %w", ErrNameTaken)
+		}
 		return fmt.Errorf("failed to create file: %w", err)
 	}
 
+	err = chargeUsage(tx, file.UserID, file.Size, 1, limit)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit file: %w", err)
+	}
+
 	return nil
 }
 
-// GetFileByID retrieves a file by ID
+// GetFileByID retrieves a file by ID. Files in the trash are not returned.
 func (r *FileRepository) GetFileByID(id string) (*models.File, error) {
 	var file models.File
 	query := `
 		SELECT id, user_id, name, size, content_type, storage_path, 
-		       public_url, is_public, expires_at, created_at, updated_at
+		       public_url, is_public, expires_at, created_at, updated_at,
+		       encrypted_key, encryption_key_id, encryption_version, file_request_id,
+		       COALESCE(folder_id, '') AS folder_id, version,
+		       COALESCE(version_created_at, created_at) AS version_created_at, blob_hash,
+		       sha256, md5
 		FROM files
-		WHERE id = $1
+		WHERE id = $1 AND deleted_at IS NULL
 	`
 
 	err := r.db.DB.Get(&file, query, id)
@@ -79,19 +120,25 @@ func (r *FileRepository) GetFileByID(id string) (*models.File, error) {
 	return &file, nil
 }
 
-// GetFilesByUserID gets all files for a user
-func (r *FileRepository) GetFilesByUserID(userID int64, limit, offset int) ([]models.File, error) {
+// GetFilesByUserID gets the files of a user that are not in the trash,
+// limited to a folder or folder subtree when scope is not nil
+func (r *FileRepository) GetFilesByUserID(userID int64, scope *models.FolderScope, limit, offset int) ([]models.File, error) {
 	files := []models.File{}
 	query := `
 		SELECT id, user_id, name, size, content_type, 
-		       public_url, is_public, expires_at, created_at, updated_at
+		       public_url, is_public, expires_at, created_at, updated_at, file_request_id,
+		       COALESCE(folder_id, '') AS folder_id, version, sha256, md5
 		FROM files
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-		LIMIT $2 OFFSET $3
+		WHERE user_id = $1 AND deleted_at IS NULL
 	`
 
-	err := r.db.DB.Select(&files, query, userID, limit, offset)
+	params := []interface{}{userID}
+	query, params = addFolderScope(query, params, scope)
+
+	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d OFFSET $%d", len(params)+1, len(params)+2)
+	params = append(params, limit, offset)
+
+	err := r.db.DB.Select(&files, query, params...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get files by user ID: %w", err)
 	}
@@ -120,6 +167,9 @@ func (r *FileRepository) UpdateFile(file *models.File) error {
 	)
 
 	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to update file: %w", ErrNameTaken)
+		}
 		return fmt.Errorf("failed to update file: %w", err)
 	}
 
@@ -135,13 +185,308 @@ func (r *FileRepository) UpdateFile(file *models.File) error {
 	return nil
 }
 
-// DeleteFile deletes a file from the database
-func (r *FileRepository) DeleteFile(id string, userID int64) error {
-	query := `DELETE FROM files WHERE id = $1 AND user_id = $2`
+// MoveFile moves a file to another folder, the root folder when folderID is empty
+func (r *FileRepository) MoveFile(id string, userID int64, folderID string) error {
+	query := `
+		UPDATE files
+		SET folder_id = NULLIF($1, ''), updated_at = $2
+		WHERE id = $3 AND user_id = $4
+	`
+
+	result, err := r.db.DB.Exec(query, folderID, time.Now(), id, userID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to move file: %w", ErrNameTaken)
+		}
+		return fmt.Errorf("failed to move file: %w", err)
+	}
 
-	result, err := r.db.DB.Exec(query, id, userID)
+	count, err := result.RowsAffected()
 	if err != nil {
-		return fmt.Errorf("failed to delete file: %w", err)
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("file not found or not owned by user")
+	}
+
+	return nil
+}
+
+// GetFileByName gets the file with the given name in a folder, ignoring
+// files in the trash
+func (r *FileRepository) GetFileByName(userID int64, folderID, name string) (*models.File, error) {
+	var file models.File
+	query := `
+		SELECT id, user_id, name, size, content_type, 
+		       public_url, is_public, expires_at, created_at, updated_at, file_request_id,
+		       COALESCE(folder_id, '') AS folder_id, version, sha256, md5
+		FROM files
+		WHERE user_id = $1 AND COALESCE(folder_id, '') = $2 AND name = $3 AND deleted_at IS NULL
+	`
+
+	err := r.db.DB.Get(&file, query, userID, folderID, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file by name: %w", err)
+	}
+
+	return &file, nil
+}
+
+// FileNameExists reports whether a folder already holds a file with the
+// given name. Files in the trash do not count.
+func (r *FileRepository) FileNameExists(userID int64, folderID, name string) (bool, error) {
+	var exists bool
+	query := `
+		SELECT EXISTS (
+			SELECT 1 FROM files
+			WHERE user_id = $1 AND COALESCE(folder_id, '') = $2 AND name = $3 AND deleted_at IS NULL
+		)
+	`
+
+	err := r.db.DB.Get(&exists, query, userID, folderID, name)
+	if err != nil {
+		return false, fmt.Errorf("failed to check file name: %w", err)
+	}
+
+	return exists, nil
+}
+
+// addFolderScope limits a file query to the folder or folder subtree of
+// scope, adding its parameters after params. A nil scope leaves the query
+// unchanged.
+func addFolderScope(query string, params []interface{}, scope *models.FolderScope) (string, []interface{}) {
+	switch {
+	case scope == nil:
+		return query, params
+	case scope.FolderID == "" && scope.Recursive:
+		// The subtree of the root folder is everything
+		return query, params
+	case scope.FolderID == "":
+		return query + " AND folder_id IS NULL", params
+	case !scope.Recursive:
+		params = append(params, scope.FolderID)
+		return query + fmt.Sprintf(" AND folder_id = $%d", len(params)), params
+	default:
+		params = append(params, scope.FolderID)
+		return query + fmt.Sprintf(` AND folder_id IN (
+			WITH RECURSIVE subtree AS (
+				SELECT id FROM folders WHERE id = $%d
+				UNION
+				SELECT f.id FROM folders f JOIN subtree s ON f.parent_id = s.id
+			)
+			SELECT id FROM subtree
+		)`, len(params)), params
+	}
+}
+
+// GetFilesToRewrap gets up to batchSize encrypted files with an ID after
+// afterID, in ID order, whose data key is not wrapped under keyID
+func (r *FileRepository) GetFilesToRewrap(keyID string, afterID string, batchSize int) ([]models.File, error) {
+	files := []models.File{}
+	query := `
+		SELECT id, user_id, encrypted_key, encryption_key_id, encryption_version
+		FROM files
+		WHERE encryption_version > 0 AND encryption_key_id <> $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+
+	err := r.db.DB.Select(&files, query, keyID, afterID, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get files to rewrap: %w", err)
+	}
+
+	return files, nil
+}
+
+// UpdateFileKey replaces the wrapped data key of a file. The update only
+// applies if the file is still wrapped under oldKeyID, and reports whether it did.
+func (r *FileRepository) UpdateFileKey(id string, oldKeyID string, encryptedKey []byte, keyID string) (bool, error) {
+	query := `
+		UPDATE files
+		SET encrypted_key = $1, encryption_key_id = $2
+		WHERE id = $3 AND encryption_key_id = $4
+	`
+
+	result, err := r.db.DB.Exec(query, encryptedKey, keyID, id, oldKeyID)
+	if err != nil {
+		return false, fmt.Errorf("failed to update file key: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// DeleteFile deletes a file that was moved to the trash before
+// deletedBefore from the database, along with its previous versions, and
+// reports whether it did. A file restored in the meantime is kept. It
+// returns the storage paths of the content the file and its versions did
+// not share through blobs, and the blobs they were the last references to,
+// whose content can now be deleted.
+func (r *FileRepository) DeleteFile(id string, userID int64, deletedBefore time.Time) (bool, []string, []models.Blob, error) {
+	return r.deleteFile(id, userID, "deleted_at IS NOT NULL AND deleted_at < $3", deletedBefore)
+}
+
+// DeleteExpiredFile deletes an expired file like DeleteFile. A file whose
+// expiration was lifted in the meantime is kept.
+func (r *FileRepository) DeleteExpiredFile(id string, userID int64) (bool, []string, []models.Blob, error) {
+	return r.deleteFile(id, userID, "expires_at IS NOT NULL AND expires_at < NOW()")
+}
+
+// deleteFile deletes a file if it still matches condition, see DeleteFile
+func (r *FileRepository) deleteFile(id string, userID int64, condition string, args ...interface{}) (bool, []string, []models.Blob, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return false, nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the file so it is neither restored nor given a version while it
+	// is being deleted
+	var file models.File
+	query := `
+		SELECT storage_path, blob_hash, size
+		FROM files
+		WHERE id = $1 AND user_id = $2 AND ` + condition + `
+		FOR UPDATE
+	`
+	err = tx.Get(&file, query, append([]interface{}{id, userID}, args...)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil, nil, nil
+	}
+	if err != nil {
+		return false, nil, nil, fmt.Errorf("failed to get file: %w", err)
+	}
+
+	var versions []models.FileVersion
+	err = tx.Select(&versions, `SELECT storage_path, blob_hash, size FROM file_versions WHERE file_id = $1`, id)
+	if err != nil {
+		return false, nil, nil, fmt.Errorf("failed to get file versions: %w", err)
+	}
+
+	var storagePaths []string
+	hashes := []string{file.BlobHash}
+	size := file.Size
+	if file.BlobHash == "" {
+		storagePaths = append(storagePaths, file.StoragePath)
+	}
+	for _, version := range versions {
+		if version.BlobHash == "" {
+			storagePaths = append(storagePaths, version.StoragePath)
+		}
+		hashes = append(hashes, version.BlobHash)
+		size += version.Size
+	}
+
+	// Previous versions are deleted along with the file
+	_, err = tx.Exec(`DELETE FROM files WHERE id = $1`, id)
+	if err != nil {
+		return false, nil, nil, fmt.Errorf("failed to delete file: %w", err)
+	}
+
+	err = releaseUsage(tx, userID, size, 1)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	released, err := releaseBlobs(tx, nonEmpty(hashes))
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, nil, nil, fmt.Errorf("failed to commit file deletion: %w", err)
+	}
+
+	return true, storagePaths, released, nil
+}
+
+// TrashFile moves a file of the user to the trash
+func (r *FileRepository) TrashFile(id string, userID int64, deletedAt time.Time) error {
+	query := `
+		UPDATE files
+		SET deleted_at = $1
+		WHERE id = $2 AND user_id = $3 AND deleted_at IS NULL
+	`
+
+	result, err := r.db.DB.Exec(query, deletedAt, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to trash file: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("file not found or not owned by user")
+	}
+
+	return nil
+}
+
+// GetTrashedFiles gets the files of a user that are in the trash, most
+// recently deleted first
+func (r *FileRepository) GetTrashedFiles(userID int64, limit, offset int) ([]models.File, error) {
+	files := []models.File{}
+	query := `
+		SELECT id, user_id, name, size, content_type, 
+		       public_url, is_public, expires_at, created_at, updated_at, file_request_id,
+		       COALESCE(folder_id, '') AS folder_id, version, deleted_at, sha256, md5
+		FROM files
+		WHERE user_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY deleted_at DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	err := r.db.DB.Select(&files, query, userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed files: %w", err)
+	}
+
+	return files, nil
+}
+
+// GetTrashedFile gets a file of the user that is in the trash
+func (r *FileRepository) GetTrashedFile(id string, userID int64) (*models.File, error) {
+	var file models.File
+	query := `
+		SELECT id, user_id, name, size, content_type, 
+		       public_url, is_public, expires_at, created_at, updated_at, file_request_id,
+		       COALESCE(folder_id, '') AS folder_id, version, deleted_at, sha256, md5
+		FROM files
+		WHERE id = $1 AND user_id = $2 AND deleted_at IS NOT NULL
+	`
+
+	err := r.db.DB.Get(&file, query, id, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed file: %w", err)
+	}
+
+	return &file, nil
+}
+
+// RestoreFile takes a file of the user out of the trash under the given name
+func (r *FileRepository) RestoreFile(id string, userID int64, name string) error {
+	query := `
+		UPDATE files
+		SET deleted_at = NULL, name = $1
+		WHERE id = $2 AND user_id = $3 AND deleted_at IS NOT NULL
+	`
+
+	result, err := r.db.DB.Exec(query, name, id, userID)
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to restore file: %w", ErrNameTaken)
+		}
+		return fmt.Errorf("failed to restore file: %w", err)
 	}
 
 	count, err := result.RowsAffected()
@@ -156,21 +501,173 @@ func (r *FileRepository) DeleteFile(id string, userID int64) error {
 	return nil
 }
 
-// SearchFiles searches for files by various criteria
+// GetFilesToPurge gets files that were moved to the trash before deletedBefore
+func (r *FileRepository) GetFilesToPurge(deletedBefore time.Time, batchSize int) ([]models.File, error) {
+	files := []models.File{}
+	query := `
+		SELECT id, user_id, name, size, content_type, storage_path, 
+		       public_url, is_public, expires_at, created_at, updated_at, deleted_at, blob_hash
+		FROM files
+		WHERE deleted_at < $1
+		LIMIT $2
+	`
+
+	err := r.db.DB.Select(&files, query, deletedBefore, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get files to purge: %w", err)
+	}
+
+	return files, nil
+}
+
+// GetStoredFiles gets up to batchSize files with an ID after afterID, in ID
+// order and including trashed files, with where and how their content is stored
+func (r *FileRepository) GetStoredFiles(afterID string, batchSize int) ([]models.File, error) {
+	files := []models.File{}
+	query := `
+		SELECT id, user_id, storage_path, encrypted_key, encryption_key_id, encryption_version,
+		       COALESCE(version_created_at, created_at) AS version_created_at, blob_hash,
+		       sha256, md5
+		FROM files
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+
+	err := r.db.DB.Select(&files, query, afterID, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stored files: %w", err)
+	}
+
+	return files, nil
+}
+
+// IsStoragePathReferenced reports whether a file, file version or blob
+// refers to the object at storagePath
+func (r *FileRepository) IsStoragePathReferenced(storagePath string) (bool, error) {
+	var referenced bool
+	query := `
+		SELECT EXISTS (SELECT 1 FROM files WHERE storage_path = $1)
+		    OR EXISTS (SELECT 1 FROM file_versions WHERE storage_path = $1)
+		    OR EXISTS (SELECT 1 FROM blobs WHERE storage_path = $1)
+	`
+
+	err := r.db.DB.Get(&referenced, query, storagePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to check storage path: %w", err)
+	}
+
+	return referenced, nil
+}
+
+// GetStoredObjects gets up to batchSize distinct storage paths after
+// afterPath, in path order, that a file, file version or blob refers to
+func (r *FileRepository) GetStoredObjects(afterPath string, batchSize int) ([]models.StoredObject, error) {
+	objects := []models.StoredObject{}
+	query := `
+		SELECT storage_path, MAX(content_type) AS content_type
+		FROM (
+			SELECT storage_path, content_type FROM files
+			UNION ALL
+			SELECT storage_path, content_type FROM file_versions
+			UNION ALL
+			SELECT storage_path, '' FROM blobs
+		) refs
+		WHERE storage_path > $1
+		GROUP BY storage_path
+		ORDER BY storage_path
+		LIMIT $2
+	`
+
+	err := r.db.DB.Select(&objects, query, afterPath, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stored objects: %w", err)
+	}
+
+	return objects, nil
+}
+
+// MoveStoragePath points every file, file version and blob stored at
+// oldPath to newPath and newURL. The tables are updated in a single
+// statement, so content moving between them concurrently is not missed. It
+// returns the number of rows updated and the updated files.
+func (r *FileRepository) MoveStoragePath(oldPath, newPath, newURL string) (int, []models.File, error) {
+	query := `
+		WITH f AS (
+			UPDATE files SET storage_path = $2, public_url = $3
+			WHERE storage_path = $1
+			RETURNING id, user_id
+		), v AS (
+			UPDATE file_versions SET storage_path = $2, public_url = $3
+			WHERE storage_path = $1
+			RETURNING id
+		), b AS (
+			UPDATE blobs SET storage_path = $2, public_url = $3
+			WHERE storage_path = $1
+			RETURNING hash
+		)
+		SELECT id, user_id FROM f
+		UNION ALL
+		SELECT id, 0 FROM v
+		UNION ALL
+		SELECT hash, 0 FROM b
+	`
+
+	rows, err := r.db.DB.Queryx(query, oldPath, newPath, newURL)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to move storage path: %w", err)
+	}
+	defer rows.Close()
+
+	moved := 0
+	files := []models.File{}
+	for rows.Next() {
+		var file models.File
+		err = rows.Scan(&file.ID, &file.UserID)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to scan moved row: %w", err)
+		}
+
+		moved++
+		if file.UserID != 0 {
+			files = append(files, file)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to move storage path: %w", err)
+	}
+
+	return moved, files, nil
+}
+
+// SearchFiles searches for files by various criteria. Files in the trash
+// are left out.
 func (r *FileRepository) SearchFiles(userID int64, search *models.SearchFilesRequest) ([]models.File, error) {
 	files := []models.File{}
 
 	// Base query with user filter
 	query := `
 		SELECT id, user_id, name, size, content_type, 
-		       public_url, is_public, expires_at, created_at, updated_at
+		       public_url, is_public, expires_at, created_at, updated_at, file_request_id,
+		       COALESCE(folder_id, '') AS folder_id, version, sha256, md5
 		FROM files
-		WHERE user_id = $1
+		WHERE user_id = $1 AND deleted_at IS NULL
 	`
 
 	// Build dynamic query based on search params
 	params := []interface{}{userID}
-	paramCount := 2 // Starting from 2 because $1 is already used for userID
+
+	// Limit to a folder if provided
+	if search.FolderID != "" {
+		query, params = addFolderScope(query, params, &models.FolderScope{
+			FolderID:  search.FolderID,
+			Recursive: search.Recursive,
+		})
+	}
+
+	paramCount := len(params) + 1
 
 	// Add name search if provided
 	if search.Query != "" {
@@ -224,19 +721,39 @@ func (r *FileRepository) SearchFiles(userID int64, search *models.SearchFilesReq
 	return files, nil
 }
 
-// CreateShareLink creates a share link for a file
-func (r *FileRepository) CreateShareLink(fileID string, expiresAt time.Time) (*models.SharedFile, error) {
+// CreateShareLink creates a share link for a file. The link is password
+// protected when password is not empty, and limited to maxDownloads
+// downloads unless it is 0.
+func (r *FileRepository) CreateShareLink(fileID string, expiresAt time.Time, password string, maxDownloads int, burnAfterReading bool) (*models.SharedFile, error) {
 	sharedFile := models.SharedFile{
-		ID:        uuid.New().String(),
-		FileID:    fileID,
-		ShareURL:  uuid.New().String(), // Use UUID as unique share URL path
-		ExpiresAt: expiresAt,
-		CreatedAt: time.Now(),
+		ID:               uuid.New().String(),
+		FileID:           fileID,
+		ShareURL:         uuid.New().String(), // Use UUID as unique share URL path
+		ExpiresAt:        expiresAt,
+		CreatedAt:        time.Now(),
+		MaxDownloads:     maxDownloads,
+		BurnAfterReading: burnAfterReading,
+	}
+
+	// Burn after reading links are single use
+	if burnAfterReading {
+		sharedFile.MaxDownloads = 1
+	}
+
+	if password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %w", err)
+		}
+		sharedFile.PasswordHash = string(hashedPassword)
 	}
 
 	query := `
-		INSERT INTO shared_files (id, file_id, share_url, expires_at, created_at)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO shared_files (
+			id, file_id, share_url, expires_at, created_at, password_hash,
+			max_downloads, burn_after_reading
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 	`
 
 	_, err := r.db.DB.Exec(
@@ -246,22 +763,30 @@ func (r *FileRepository) CreateShareLink(fileID string, expiresAt time.Time) (*m
 		sharedFile.ShareURL,
 		sharedFile.ExpiresAt,
 		sharedFile.CreatedAt,
+		sharedFile.PasswordHash,
+		sharedFile.MaxDownloads,
+		sharedFile.BurnAfterReading,
 	)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create share link: %w", err)
 	}
 
+	setShareLinkFields(&sharedFile)
+
 	return &sharedFile, nil
 }
 
-// GetSharedFile gets a shared file by share URL
+// GetSharedFile gets a shared file by share URL. Links to files in the
+// trash are not returned.
 func (r *FileRepository) GetSharedFile(shareURL string) (*models.SharedFile, error) {
 	var sharedFile models.SharedFile
 	query := `
-		SELECT id, file_id, share_url, expires_at, created_at
-		FROM shared_files
-		WHERE share_url = $1
+		SELECT sf.id, sf.file_id, sf.share_url, sf.expires_at, sf.created_at, sf.password_hash,
+		       sf.max_downloads, sf.download_count, sf.burn_after_reading
+		FROM shared_files sf
+		JOIN files f ON f.id = sf.file_id
+		WHERE sf.share_url = $1 AND f.deleted_at IS NULL
 	`
 
 	err := r.db.DB.Get(&sharedFile, query, shareURL)
@@ -269,48 +794,229 @@ func (r *FileRepository) GetSharedFile(shareURL string) (*models.SharedFile, err
 		return nil, fmt.Errorf("failed to get shared file: %w", err)
 	}
 
+	setShareLinkFields(&sharedFile)
+
 	return &sharedFile, nil
 }
 
-// GetExpiredFiles gets all expired files
-func (r *FileRepository) GetExpiredFiles(batchSize int) ([]models.File, error) {
-	files := []models.File{}
+// ConsumeShareDownload counts a download of a share link. It returns false
+// without counting if the link has no downloads left. The check and the
+// increment happen in a single statement, so concurrent downloads can never
+// exceed the limit.
+func (r *FileRepository) ConsumeShareDownload(id string) (bool, error) {
 	query := `
-		SELECT id, user_id, name, size, content_type, storage_path, 
-		       public_url, is_public, expires_at, created_at, updated_at
-		FROM files
-		WHERE expires_at IS NOT NULL AND expires_at < NOW()
-		LIMIT $1
+		UPDATE shared_files
+		SET download_count = download_count + 1
+		WHERE id = $1 AND (max_downloads = 0 OR download_count < max_downloads)
 	`
 
-	err := r.db.DB.Select(&files, query, batchSize)
+	result, err := r.db.DB.Exec(query, id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get expired files: %w", err)
+		return false, fmt.Errorf("failed to count share download: %w", err)
 	}
 
-	return files, nil
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// setShareLinkFields fills in whether a link is password protected and the
+// remaining download count of a limited link
+func setShareLinkFields(sharedFile *models.SharedFile) {
+	sharedFile.PasswordProtected = sharedFile.PasswordHash != ""
+
+	if sharedFile.MaxDownloads == 0 {
+		sharedFile.RemainingDownloads = nil
+		return
+	}
+
+	remaining := sharedFile.MaxDownloads - sharedFile.DownloadCount
+	if remaining < 0 {
+		remaining = 0
+	}
+	sharedFile.RemainingDownloads = &remaining
 }
 
-// DeleteExpiredFiles deletes expired files
-func (r *FileRepository) DeleteExpiredFiles(batchSize int) (int, error) {
+// GetSharesByUserID gets all share links of a user's files
+func (r *FileRepository) GetSharesByUserID(userID int64) ([]models.SharedFile, error) {
+	shares := []models.SharedFile{}
 	query := `
-		DELETE FROM files
-		WHERE id IN (
-			SELECT id FROM files
-			WHERE expires_at IS NOT NULL AND expires_at < NOW()
-			LIMIT $1
-		)
+		SELECT sf.id, sf.file_id, sf.share_url, sf.expires_at, sf.created_at, sf.password_hash,
+		       sf.max_downloads, sf.download_count, sf.burn_after_reading
+		FROM shared_files sf
+		JOIN files f ON f.id = sf.file_id
+		WHERE f.user_id = $1
+		ORDER BY sf.created_at DESC
 	`
 
-	result, err := r.db.DB.Exec(query, batchSize)
+	err := r.db.DB.Select(&shares, query, userID)
 	if err != nil {
-		return 0, fmt.Errorf("failed to delete expired files: %w", err)
+		return nil, fmt.Errorf("failed to get shares by user ID: %w", err)
+	}
+
+	for i := range shares {
+		setShareLinkFields(&shares[i])
+	}
+
+	return shares, nil
+}
+
+// GetSharesByFileID gets all share links of a file
+func (r *FileRepository) GetSharesByFileID(fileID string) ([]models.SharedFile, error) {
+	shares := []models.SharedFile{}
+	query := `
+		SELECT id, file_id, share_url, expires_at, created_at, password_hash,
+		       max_downloads, download_count, burn_after_reading
+		FROM shared_files
+		WHERE file_id = $1
+		ORDER BY created_at DESC
+	`
+
+	err := r.db.DB.Select(&shares, query, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get shares by file ID: %w", err)
+	}
+
+	for i := range shares {
+		setShareLinkFields(&shares[i])
+	}
+
+	return shares, nil
+}
+
+// GetShareByID gets a share link by ID if it belongs to one of the user's files
+func (r *FileRepository) GetShareByID(id string, userID int64) (*models.SharedFile, error) {
+	var sharedFile models.SharedFile
+	query := `
+		SELECT sf.id, sf.file_id, sf.share_url, sf.expires_at, sf.created_at, sf.password_hash,
+		       sf.max_downloads, sf.download_count, sf.burn_after_reading
+		FROM shared_files sf
+		JOIN files f ON f.id = sf.file_id
+		WHERE sf.id = $1 AND f.user_id = $2
+	`
+
+	err := r.db.DB.Get(&sharedFile, query, id, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share by ID: %w", err)
+	}
+
+	setShareLinkFields(&sharedFile)
+
+	return &sharedFile, nil
+}
+
+// UpdateShareLink updates the expiry and download limits of a share link.
+// When password is not nil the link password is replaced, or removed if it
+// is empty, and any password lockout is lifted.
+func (r *FileRepository) UpdateShareLink(sharedFile *models.SharedFile, password *string) error {
+	if password != nil {
+		sharedFile.PasswordHash = ""
+		if *password != "" {
+			hashedPassword, err := bcrypt.GenerateFromPassword([]byte(*password), bcrypt.DefaultCost)
+			if err != nil {
+				return fmt.Errorf("failed to hash password: %w", err)
+			}
+			sharedFile.PasswordHash = string(hashedPassword)
+		}
+	}
+
+	query := `
+		UPDATE shared_files
+		SET expires_at = $1, password_hash = $2, max_downloads = $3, burn_after_reading = $4,
+		    failed_attempts = CASE WHEN $5 THEN 0 ELSE failed_attempts END,
+		    locked_until = CASE WHEN $5 THEN NULL ELSE locked_until END
+		WHERE id = $6
+	`
+
+	result, err := r.db.DB.Exec(
+		query,
+		sharedFile.ExpiresAt,
+		sharedFile.PasswordHash,
+		sharedFile.MaxDownloads,
+		sharedFile.BurnAfterReading,
+		password != nil,
+		sharedFile.ID,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to update share link: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("share link not found")
+	}
+
+	setShareLinkFields(sharedFile)
+
+	return nil
+}
+
+// DeleteShareLink deletes a share link if it belongs to one of the user's files
+func (r *FileRepository) DeleteShareLink(id string, userID int64) error {
+	query := `
+		DELETE FROM shared_files sf
+		USING files f
+		WHERE f.id = sf.file_id AND sf.id = $1 AND f.user_id = $2
+	`
+
+	result, err := r.db.DB.Exec(query, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete share link: %w", err)
 	}
 
 	count, err := result.RowsAffected()
 	if err != nil {
-		return 0, fmt.Errorf("failed to get rows affected: %w", err)
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("share link not found or not owned by user")
 	}
 
-	return int(count), nil
+	return nil
+}
+
+// VerifySharePassword checks if the provided password opens a share link
+func (r *FileRepository) VerifySharePassword(sharedFile *models.SharedFile, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(sharedFile.PasswordHash), []byte(password)) == nil
+}
+
+// ClaimSharePasswordAttempt counts a password attempt on a share link and
+// reports whether it may go ahead, which it may not while the link is locked
+// after too many attempts
+func (r *FileRepository) ClaimSharePasswordAttempt(id string, maxAttempts int, lockout time.Duration) (bool, error) {
+	return claimAttempt(r.db, "shared_files", id, maxAttempts, lockout)
+}
+
+// ResetFailedShareAttempts clears the password attempt counter of a share link
+func (r *FileRepository) ResetFailedShareAttempts(id string) error {
+	return resetFailedAttempts(r.db, "shared_files", id)
+}
+
+// GetExpiredFiles gets all expired files. Files without an expiry store the
+// zero time, which does not count as expired.
+func (r *FileRepository) GetExpiredFiles(batchSize int) ([]models.File, error) {
+	files := []models.File{}
+	query := `
+		SELECT id, user_id, name, size, content_type, storage_path, 
+		       public_url, is_public, expires_at, created_at, updated_at, blob_hash
+		FROM files
+		WHERE expires_at IS NOT NULL AND expires_at > $1 AND expires_at < NOW()
+		LIMIT $2
+	`
+
+	err := r.db.DB.Select(&files, query, time.Time{}, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired files: %w", err)
+	}
+
+	return files, nil
 }
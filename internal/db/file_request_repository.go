@@ -0,0 +1,191 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FileRequestRepository handles file request link database operations
+type FileRequestRepository struct {
+	db *Database
+}
+
+// NewFileRequestRepository creates a new file request repository
+func NewFileRequestRepository(db *Database) *FileRequestRepository {
+	return &FileRequestRepository{db: db}
+}
+
+// CreateFileRequest adds a new file request link. The link is password
+// protected when password is not empty.
+func (r *FileRequestRepository) CreateFileRequest(request *models.FileRequest, password string) error {
+	request.ID = uuid.New().String()
+	request.Token = uuid.New().String()
+	request.CreatedAt = time.Now()
+
+	// A nil array would be stored as NULL
+	if request.AllowedContentTypes == nil {
+		request.AllowedContentTypes = pq.StringArray{}
+	}
+
+	if password != "" {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return fmt.Errorf("failed to hash password: %w", err)
+		}
+		request.PasswordHash = string(hashedPassword)
+	}
+
+	query := `
+		INSERT INTO file_requests (
+			id, user_id, token, title, password_hash, expires_at,
+			max_file_size, allowed_content_types, max_files, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+
+	_, err := r.db.DB.Exec(
+		query,
+		request.ID,
+		request.UserID,
+		request.Token,
+		request.Title,
+		request.PasswordHash,
+		request.ExpiresAt,
+		request.MaxFileSize,
+		request.AllowedContentTypes,
+		request.MaxFiles,
+		request.CreatedAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create file request: %w", err)
+	}
+
+	request.PasswordProtected = request.PasswordHash != ""
+
+	return nil
+}
+
+// GetFileRequestByToken gets a file request link by its public token
+func (r *FileRequestRepository) GetFileRequestByToken(token string) (*models.FileRequest, error) {
+	var request models.FileRequest
+	query := `
+		SELECT id, user_id, token, title, password_hash, expires_at, max_file_size,
+		       allowed_content_types, max_files, file_count, created_at
+		FROM file_requests
+		WHERE token = $1
+	`
+
+	err := r.db.DB.Get(&request, query, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file request: %w", err)
+	}
+
+	request.PasswordProtected = request.PasswordHash != ""
+
+	return &request, nil
+}
+
+// GetFileRequestsByUserID gets all file request links of a user
+func (r *FileRequestRepository) GetFileRequestsByUserID(userID int64) ([]models.FileRequest, error) {
+	requests := []models.FileRequest{}
+	query := `
+		SELECT id, user_id, token, title, password_hash, expires_at, max_file_size,
+		       allowed_content_types, max_files, file_count, created_at
+		FROM file_requests
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+
+	err := r.db.DB.Select(&requests, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file requests by user ID: %w", err)
+	}
+
+	for i := range requests {
+		requests[i].PasswordProtected = requests[i].PasswordHash != ""
+	}
+
+	return requests, nil
+}
+
+// DeleteFileRequest deletes a file request link. Files already uploaded
+// through it are kept.
+func (r *FileRequestRepository) DeleteFileRequest(id string, userID int64) error {
+	query := `DELETE FROM file_requests WHERE id = $1 AND user_id = $2`
+
+	result, err := r.db.DB.Exec(query, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete file request: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("file request not found or not owned by user")
+	}
+
+	return nil
+}
+
+// VerifyFileRequestPassword checks if the provided password opens a file request link
+func (r *FileRequestRepository) VerifyFileRequestPassword(request *models.FileRequest, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(request.PasswordHash), []byte(password)) == nil
+}
+
+// ClaimFileRequestPasswordAttempt counts a password attempt on a file request link and
+// reports whether it may go ahead, which it may not while the link is locked
+// after too many attempts
+func (r *FileRequestRepository) ClaimFileRequestPasswordAttempt(id string, maxAttempts int, lockout time.Duration) (bool, error) {
+	return claimAttempt(r.db, "file_requests", id, maxAttempts, lockout)
+}
+
+// ResetFailedFileRequestAttempts clears the password attempt counter of a file request link
+func (r *FileRequestRepository) ResetFailedFileRequestAttempts(id string) error {
+	return resetFailedAttempts(r.db, "file_requests", id)
+}
+
+// ReserveFileRequestSlot claims one of the files a file request link accepts.
+// It returns false if the link has already received its maximum number of
+// files. The check and the increment happen in a single statement, so
+// concurrent uploads can never exceed the limit.
+func (r *FileRequestRepository) ReserveFileRequestSlot(id string) (bool, error) {
+	query := `
+		UPDATE file_requests
+		SET file_count = file_count + 1
+		WHERE id = $1 AND (max_files = 0 OR file_count < max_files)
+	`
+
+	result, err := r.db.DB.Exec(query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to reserve file request slot: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// ReleaseFileRequestSlot gives back a slot claimed by an upload that failed
+func (r *FileRequestRepository) ReleaseFileRequestSlot(id string) error {
+	query := `UPDATE file_requests SET file_count = file_count - 1 WHERE id = $1 AND file_count > 0`
+
+	_, err := r.db.DB.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to release file request slot: %w", err)
+	}
+
+	return nil
+}
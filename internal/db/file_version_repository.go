@@ -0,0 +1,436 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// FileVersionRepository handles file version and version retention database
+// operations. The current version of a file lives in the files table and
+// its previous versions in file_versions.
+type FileVersionRepository struct {
+	db *Database
+}
+
+// NewFileVersionRepository creates a new file version repository
+func NewFileVersionRepository(db *Database) *FileVersionRepository {
+	return &FileVersionRepository{db: db}
+}
+
+// GetFileVersions gets the previous versions of a file, newest first
+func (r *FileVersionRepository) GetFileVersions(fileID string) ([]models.FileVersion, error) {
+	versions := []models.FileVersion{}
+	query := `
+		SELECT id, file_id, version, size, content_type, storage_path, public_url,
+		       encrypted_key, encryption_key_id, encryption_version, created_at, replaced_at,
+		       blob_hash, sha256, md5
+		FROM file_versions
+		WHERE file_id = $1
+		ORDER BY version DESC
+	`
+
+	err := r.db.DB.Select(&versions, query, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+// GetFileVersion gets a previous version of a file by number
+func (r *FileVersionRepository) GetFileVersion(fileID string, version int) (*models.FileVersion, error) {
+	var fileVersion models.FileVersion
+	query := `
+		SELECT id, file_id, version, size, content_type, storage_path, public_url,
+		       encrypted_key, encryption_key_id, encryption_version, created_at, replaced_at,
+		       blob_hash, sha256, md5
+		FROM file_versions
+		WHERE file_id = $1 AND version = $2
+	`
+
+	err := r.db.DB.Get(&fileVersion, query, fileID, version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file version: %w", err)
+	}
+
+	return &fileVersion, nil
+}
+
+// AddFileVersion makes content the current version of a file owned by the
+// user. The content being replaced is kept as a previous version. It returns
+// the number of the new version.
+func (r *FileVersionRepository) AddFileVersion(fileID string, userID int64, content *models.FileVersion, limit models.StorageQuota) (int, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	err = lockFile(tx, fileID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	err = archiveCurrentVersion(tx, fileID, now)
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := setCurrentVersion(tx, fileID, content, now)
+	if err != nil {
+		return 0, err
+	}
+
+	// The replaced content is kept, so the new content adds to the usage
+	err = chargeUsage(tx, userID, content.Size, 0, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit file version: %w", err)
+	}
+
+	return version, nil
+}
+
+// RestoreFileVersion makes a previous version the current version of a file
+// owned by the user, under a new version number. The content being replaced
+// is kept as a previous version. It returns the number of the new version.
+func (r *FileVersionRepository) RestoreFileVersion(fileID string, userID int64, version int) (int, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	err = lockFile(tx, fileID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	var restored models.FileVersion
+	query := `
+		SELECT id, file_id, version, size, content_type, storage_path, public_url,
+		       encrypted_key, encryption_key_id, encryption_version, created_at, replaced_at,
+		       blob_hash, sha256, md5
+		FROM file_versions
+		WHERE file_id = $1 AND version = $2
+	`
+
+	err = tx.Get(&restored, query, fileID, version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get file version: %w", err)
+	}
+
+	err = archiveCurrentVersion(tx, fileID, now)
+	if err != nil {
+		return 0, err
+	}
+
+	newVersion, err := setCurrentVersion(tx, fileID, &restored, now)
+	if err != nil {
+		return 0, err
+	}
+
+	// The restored content now belongs to the current version
+	_, err = tx.Exec(`DELETE FROM file_versions WHERE id = $1`, restored.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete restored file version: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, fmt.Errorf("failed to commit file version: %w", err)
+	}
+
+	return newVersion, nil
+}
+
+// lockFile locks the row of a file owned by the user until the end of the
+// transaction, so concurrent version changes are applied one at a time
+func lockFile(tx *sqlx.Tx, fileID string, userID int64) error {
+	var id string
+	err := tx.Get(&id, `SELECT id FROM files WHERE id = $1 AND user_id = $2 AND deleted_at IS NULL FOR UPDATE`, fileID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to lock file: %w", err)
+	}
+
+	return nil
+}
+
+// archiveCurrentVersion copies the current version of a file into its
+// previous versions
+func archiveCurrentVersion(tx *sqlx.Tx, fileID string, replacedAt time.Time) error {
+	query := `
+		INSERT INTO file_versions (
+			id, file_id, version, size, content_type, storage_path, public_url,
+			encrypted_key, encryption_key_id, encryption_version, created_at, replaced_at,
+			blob_hash, sha256, md5
+		)
+		SELECT $1, id, version, size, content_type, storage_path, public_url,
+		       encrypted_key, encryption_key_id, encryption_version,
+		       COALESCE(version_created_at, created_at), $2, blob_hash, sha256, md5
+		FROM files
+		WHERE id = $3
+	`
+
+	_, err := tx.Exec(query, uuid.New().String(), replacedAt, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to archive file version: %w", err)
+	}
+
+	return nil
+}
+
+// setCurrentVersion replaces the content of a file and increments its
+// version number, returning the new number
+func setCurrentVersion(tx *sqlx.Tx, fileID string, content *models.FileVersion, now time.Time) (int, error) {
+	var version int
+	query := `
+		UPDATE files
+		SET version = version + 1, size = $1, content_type = $2, storage_path = $3,
+		    public_url = $4, encrypted_key = $5, encryption_key_id = $6,
+		    encryption_version = $7, blob_hash = $8, sha256 = $9, md5 = $10,
+		    version_created_at = $11, updated_at = $11
+		WHERE id = $12
+		RETURNING version
+	`
+
+	err := tx.Get(
+		&version,
+		query,
+		content.Size,
+		content.ContentType,
+		content.StoragePath,
+		content.PublicURL,
+		content.EncryptedKey,
+		content.EncryptionKeyID,
+		content.EncryptionVersion,
+		content.BlobHash,
+		content.SHA256,
+		content.MD5,
+		now,
+		fileID,
+	)
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to update file version: %w", err)
+	}
+
+	return version, nil
+}
+
+// DeleteFileVersion deletes a previous version of a file under the same row
+// lock as RestoreFileVersion, so a version is either restored or deleted,
+// never both. It returns false if the version is already gone, for example
+// because it was restored. Otherwise it returns the version's blob if the
+// version was its last reference, in which case the blob content can be
+// deleted. Content stored outside blobs must only be deleted after this
+// returns.
+func (r *FileVersionRepository) DeleteFileVersion(fileID, id string) (bool, []models.Blob, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var locked string
+	err = tx.Get(&locked, `SELECT id FROM files WHERE id = $1 FOR UPDATE`, fileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to lock file: %w", err)
+	}
+
+	var deleted []struct {
+		BlobHash string `db:"blob_hash"`
+		Size     int64  `db:"size"`
+		UserID   int64  `db:"user_id"`
+	}
+	query := `
+		DELETE FROM file_versions v
+		USING files f
+		WHERE v.id = $1 AND v.file_id = $2 AND f.id = v.file_id
+		RETURNING v.blob_hash, v.size, f.user_id
+	`
+
+	err = tx.Select(&deleted, query, id, fileID)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to delete file version: %w", err)
+	}
+
+	if len(deleted) == 0 {
+		return false, nil, nil
+	}
+
+	var hashes []string
+	for _, version := range deleted {
+		hashes = append(hashes, version.BlobHash)
+
+		err = releaseUsage(tx, version.UserID, version.Size, 0)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	released, err := releaseBlobs(tx, nonEmpty(hashes))
+	if err != nil {
+		return false, nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to commit file version deletion: %w", err)
+	}
+
+	return true, released, nil
+}
+
+// GetVersionsToPrune gets previous file versions that fall outside the
+// retention policy of their owner. Owners without a policy of their own get
+// the default limits; a limit of 0 is no limit.
+func (r *FileVersionRepository) GetVersionsToPrune(defaultKeepLast, defaultKeepDays, batchSize int) ([]models.FileVersion, error) {
+	versions := []models.FileVersion{}
+	query := `
+		SELECT v.id, v.file_id, v.version, v.storage_path, v.blob_hash
+		FROM (
+			SELECT fv.id, fv.file_id, fv.version, fv.storage_path, fv.blob_hash, fv.replaced_at, f.user_id,
+			       ROW_NUMBER() OVER (PARTITION BY fv.file_id ORDER BY fv.version DESC) AS position
+			FROM file_versions fv
+			JOIN files f ON f.id = fv.file_id
+		) v
+		LEFT JOIN version_retention r ON r.user_id = v.user_id
+		WHERE (COALESCE(r.keep_last, $1) > 0 AND v.position > COALESCE(r.keep_last, $1))
+		   OR (COALESCE(r.keep_days, $2) > 0 AND v.replaced_at < NOW() - COALESCE(r.keep_days, $2) * INTERVAL '1 day')
+		LIMIT $3
+	`
+
+	err := r.db.DB.Select(&versions, query, defaultKeepLast, defaultKeepDays, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file versions to prune: %w", err)
+	}
+
+	return versions, nil
+}
+
+// GetStoredVersions gets up to batchSize previous file versions with an ID
+// after afterID, in ID order
+func (r *FileVersionRepository) GetStoredVersions(afterID string, batchSize int) ([]models.FileVersion, error) {
+	versions := []models.FileVersion{}
+	query := `
+		SELECT id, file_id, version, size, content_type, storage_path, public_url,
+		       encrypted_key, encryption_key_id, encryption_version, created_at, replaced_at,
+		       blob_hash, sha256, md5
+		FROM file_versions
+		WHERE id > $1
+		ORDER BY id
+		LIMIT $2
+	`
+
+	err := r.db.DB.Select(&versions, query, afterID, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stored file versions: %w", err)
+	}
+
+	return versions, nil
+}
+
+// GetVersionsToRewrap gets up to batchSize encrypted file versions with an
+// ID after afterID, in ID order, whose data key is not wrapped under keyID
+func (r *FileVersionRepository) GetVersionsToRewrap(keyID string, afterID string, batchSize int) ([]models.FileVersion, error) {
+	versions := []models.FileVersion{}
+	query := `
+		SELECT id, file_id, version, encrypted_key, encryption_key_id, encryption_version
+		FROM file_versions
+		WHERE encryption_version > 0 AND encryption_key_id <> $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+
+	err := r.db.DB.Select(&versions, query, keyID, afterID, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file versions to rewrap: %w", err)
+	}
+
+	return versions, nil
+}
+
+// UpdateVersionKey replaces the wrapped data key of a file version. The
+// update only applies if the version is still wrapped under oldKeyID, and
+// reports whether it did.
+func (r *FileVersionRepository) UpdateVersionKey(id string, oldKeyID string, encryptedKey []byte, keyID string) (bool, error) {
+	query := `
+		UPDATE file_versions
+		SET encrypted_key = $1, encryption_key_id = $2
+		WHERE id = $3 AND encryption_key_id = $4
+	`
+
+	result, err := r.db.DB.Exec(query, encryptedKey, keyID, id, oldKeyID)
+	if err != nil {
+		return false, fmt.Errorf("failed to update file version key: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// GetRetentionPolicy gets the version retention policy a user has set
+func (r *FileVersionRepository) GetRetentionPolicy(userID int64) (*models.VersionRetention, error) {
+	var policy models.VersionRetention
+	query := `SELECT user_id, keep_last, keep_days FROM version_retention WHERE user_id = $1`
+
+	err := r.db.DB.Get(&policy, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get version retention policy: %w", err)
+	}
+
+	return &policy, nil
+}
+
+// SetRetentionPolicy saves the version retention policy of a user
+func (r *FileVersionRepository) SetRetentionPolicy(policy *models.VersionRetention) error {
+	query := `
+		INSERT INTO version_retention (user_id, keep_last, keep_days, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE
+		SET keep_last = EXCLUDED.keep_last, keep_days = EXCLUDED.keep_days, updated_at = EXCLUDED.updated_at
+	`
+
+	_, err := r.db.DB.Exec(query, policy.UserID, policy.KeepLast, policy.KeepDays, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to set version retention policy: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteRetentionPolicy removes the version retention policy of a user, who
+// then gets the default policy
+func (r *FileVersionRepository) DeleteRetentionPolicy(userID int64) error {
+	query := `DELETE FROM version_retention WHERE user_id = $1`
+
+	_, err := r.db.DB.Exec(query, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete version retention policy: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrNameTaken is returned when a folder already holds a file or folder
+	// with the same name
+	ErrNameTaken = errors.New("name already taken in folder")
+
+	// ErrFolderCycle is returned when a folder would be moved into itself or
+	// one of its subfolders
+	ErrFolderCycle = errors.New("folder cannot be moved into itself")
+)
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// FolderRepository handles folder database operations
+type FolderRepository struct {
+	db *Database
+}
+
+// NewFolderRepository creates a new folder repository
+func NewFolderRepository(db *Database) *FolderRepository {
+	return &FolderRepository{db: db}
+}
+
+// CreateFolder adds a new folder to the database
+func (r *FolderRepository) CreateFolder(folder *models.Folder) error {
+	folder.ID = uuid.New().String()
+
+	now := time.Now()
+	folder.CreatedAt = now
+	folder.UpdatedAt = now
+
+	query := `
+		INSERT INTO folders (id, user_id, parent_id, name, created_at, updated_at)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+	`
+
+	_, err := r.db.DB.Exec(
+		query,
+		folder.ID,
+		folder.UserID,
+		folder.ParentID,
+		folder.Name,
+		folder.CreatedAt,
+		folder.UpdatedAt,
+	)
+
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to create folder: %w", ErrNameTaken)
+		}
+		return fmt.Errorf("failed to create folder: %w", err)
+	}
+
+	return nil
+}
+
+// GetFolderByID gets a folder owned by a user
+func (r *FolderRepository) GetFolderByID(id string, userID int64) (*models.Folder, error) {
+	var folder models.Folder
+	query := `
+		SELECT id, user_id, COALESCE(parent_id, '') AS parent_id, name, created_at, updated_at
+		FROM folders
+		WHERE id = $1 AND user_id = $2
+	`
+
+	err := r.db.DB.Get(&folder, query, id, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get folder by ID: %w", err)
+	}
+
+	return &folder, nil
+}
+
+// GetFolderByName gets the folder with the given name in a parent folder
+func (r *FolderRepository) GetFolderByName(userID int64, parentID, name string) (*models.Folder, error) {
+	var folder models.Folder
+	query := `
+		SELECT id, user_id, COALESCE(parent_id, '') AS parent_id, name, created_at, updated_at
+		FROM folders
+		WHERE user_id = $1 AND COALESCE(parent_id, '') = $2 AND name = $3
+	`
+
+	err := r.db.DB.Get(&folder, query, userID, parentID, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get folder by name: %w", err)
+	}
+
+	return &folder, nil
+}
+
+// GetSubfolders gets the folders directly in a parent folder, sorted by name
+func (r *FolderRepository) GetSubfolders(userID int64, parentID string) ([]models.Folder, error) {
+	folders := []models.Folder{}
+	query := `
+		SELECT id, user_id, COALESCE(parent_id, '') AS parent_id, name, created_at, updated_at
+		FROM folders
+		WHERE user_id = $1 AND COALESCE(parent_id, '') = $2
+		ORDER BY name
+	`
+
+	err := r.db.DB.Select(&folders, query, userID, parentID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subfolders: %w", err)
+	}
+
+	return folders, nil
+}
+
+// GetFolderAncestors gets a folder and all folders above it, starting with
+// the folder in the root folder
+func (r *FolderRepository) GetFolderAncestors(id string, userID int64) ([]models.Folder, error) {
+	folders := []models.Folder{}
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT id, user_id, parent_id, name, created_at, updated_at, 0 AS depth, ARRAY[id] AS path
+			FROM folders
+			WHERE id = $1 AND user_id = $2
+			UNION ALL
+			SELECT f.id, f.user_id, f.parent_id, f.name, f.created_at, f.updated_at, a.depth + 1, a.path || f.id
+			FROM folders f
+			JOIN ancestors a ON f.id = a.parent_id
+			WHERE NOT f.id = ANY(a.path)
+		)
+		SELECT id, user_id, COALESCE(parent_id, '') AS parent_id, name, created_at, updated_at
+		FROM ancestors
+		ORDER BY depth DESC
+	`
+
+	err := r.db.DB.Select(&folders, query, id, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get folder ancestors: %w", err)
+	}
+
+	return folders, nil
+}
+
+// isInSubtree reports whether folderID is rootID or one of the folders below it
+func isInSubtree(tx *sqlx.Tx, rootID, folderID string) (bool, error) {
+	var inSubtree bool
+	query := `
+		WITH RECURSIVE subtree AS (
+			SELECT id FROM folders WHERE id = $1
+			UNION
+			SELECT f.id FROM folders f JOIN subtree s ON f.parent_id = s.id
+		)
+		SELECT EXISTS (SELECT 1 FROM subtree WHERE id = $2)
+	`
+
+	err := tx.Get(&inSubtree, query, rootID, folderID)
+	if err != nil {
+		return false, fmt.Errorf("failed to check folder subtree: %w", err)
+	}
+
+	return inSubtree, nil
+}
+
+// lockFolders locks all folders of a user until the end of the transaction,
+// in a fixed order, so folder moves of the user are applied one at a time
+func lockFolders(tx *sqlx.Tx, userID int64) error {
+	_, err := tx.Exec(`SELECT id FROM folders WHERE user_id = $1 ORDER BY id FOR UPDATE`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to lock folders: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateFolder saves the name and parent of a folder. Moves are checked
+// for cycles under a lock on the user's folders, so concurrent moves cannot
+// make a folder its own ancestor; ErrFolderCycle is returned if the new
+// parent is the folder itself or below it.
+func (r *FolderRepository) UpdateFolder(folder *models.Folder) error {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if folder.ParentID != "" {
+		err = lockFolders(tx, folder.UserID)
+		if err != nil {
+			return err
+		}
+
+		inSubtree, err := isInSubtree(tx, folder.ID, folder.ParentID)
+		if err != nil {
+			return err
+		}
+		if inSubtree {
+			return ErrFolderCycle
+		}
+	}
+
+	folder.UpdatedAt = time.Now()
+
+	query := `
+		UPDATE folders
+		SET name = $1, parent_id = NULLIF($2, ''), updated_at = $3
+		WHERE id = $4 AND user_id = $5
+	`
+
+	result, err := tx.Exec(
+		query,
+		folder.Name,
+		folder.ParentID,
+		folder.UpdatedAt,
+		folder.ID,
+		folder.UserID,
+	)
+
+	if err != nil {
+		if isUniqueViolation(err) {
+			return fmt.Errorf("failed to update folder: %w", ErrNameTaken)
+		}
+		return fmt.Errorf("failed to update folder: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("folder not found or not owned by user")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit folder update: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteFolder deletes a folder along with its subfolders. Files in the
+// subtree are expected to be moved to the trash first; files left in the
+// subtree, trashed or not, are moved to the root folder.
+func (r *FolderRepository) DeleteFolder(id string, userID int64) error {
+	query := `DELETE FROM folders WHERE id = $1 AND user_id = $2`
+
+	result, err := r.db.DB.Exec(query, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete folder: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("folder not found or not owned by user")
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestUpdateFolderRejectsCyclesUnderLock(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	repo := NewFolderRepository(database)
+
+	// Another move made the new parent a subfolder before the lock was taken
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT id FROM folders WHERE user_id = \\$1 ORDER BY id FOR UPDATE").WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("WITH RECURSIVE subtree").WithArgs("folder-1", "folder-2").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	err := repo.UpdateFolder(&models.Folder{ID: "folder-1", UserID: 1, Name: "a", ParentID: "folder-2"})
+	if !errors.Is(err, ErrFolderCycle) {
+		t.Fatalf("expected ErrFolderCycle, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateFolderMovesInTransaction(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	repo := NewFolderRepository(database)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("SELECT id FROM folders WHERE user_id = \\$1 ORDER BY id FOR UPDATE").WithArgs(int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery("WITH RECURSIVE subtree").WithArgs("folder-1", "folder-2").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE folders").
+		WithArgs("a", "folder-2", sqlmock.AnyArg(), "folder-1", int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := repo.UpdateFolder(&models.Folder{ID: "folder-1", UserID: 1, Name: "a", ParentID: "folder-2"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
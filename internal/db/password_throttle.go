@@ -0,0 +1,56 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Password protected links (share links and file requests) count password
+// attempts in failed_attempts and lock themselves until locked_until once
+// too many were tried. These helpers implement that for any such table; the
+// table name is always a constant chosen by the caller.
+
+// maxLockoutDoublings caps how often the lockout of a row doubles
+const maxLockoutDoublings = 6
+
+// claimAttempt counts a password attempt on a row unless it is locked, and
+// reports whether the attempt may go ahead. Attempts are counted before the
+// password is checked, in a single conditional update, so concurrent
+// attempts cannot get past the limit. Every maxAttempts attempts the row is
+// locked, for twice as long as the previous time, until the counter is reset
+// by a correct password.
+func claimAttempt(d *Database, table, id string, maxAttempts int, lockout time.Duration) (bool, error) {
+	query := fmt.Sprintf(`
+		UPDATE %s
+		SET failed_attempts = failed_attempts + 1,
+		    locked_until = CASE WHEN (failed_attempts + 1) %% $2 = 0
+		        THEN NOW() + POWER(2, LEAST((failed_attempts + 1) / $2 - 1, $4)) * $3 * INTERVAL '1 second'
+		        ELSE locked_until END
+		WHERE id = $1 AND (locked_until IS NULL OR locked_until <= NOW())
+	`, table)
+
+	result, err := d.DB.Exec(query, id, maxAttempts, lockout.Seconds(), maxLockoutDoublings)
+	if err != nil {
+		return false, fmt.Errorf("failed to record password attempt: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	return count > 0, nil
+}
+
+// resetFailedAttempts clears the password attempt counter of a row, and the
+// lockout the attempt that got the password right may have started
+func resetFailedAttempts(d *Database, table, id string) error {
+	query := fmt.Sprintf(`UPDATE %s SET failed_attempts = 0, locked_until = NULL WHERE id = $1 AND failed_attempts > 0`, table)
+
+	_, err := d.DB.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to reset failed password attempts: %w", err)
+	}
+
+	return nil
+}
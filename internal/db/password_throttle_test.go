@@ -0,0 +1,35 @@
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestClaimAttempt(t *testing.T) {
+	database, mock := newMockDatabase(t)
+
+	mock.ExpectExec("UPDATE shared_files SET failed_attempts = failed_attempts \\+ 1").
+		WithArgs("share-1", 5, float64(900), maxLockoutDoublings).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// A locked link is not updated, so the attempt is not allowed
+	mock.ExpectExec("UPDATE shared_files SET failed_attempts = failed_attempts \\+ 1").
+		WithArgs("share-1", 5, float64(900), maxLockoutDoublings).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	for _, want := range []bool{true, false} {
+		allowed, err := claimAttempt(database, "shared_files", "share-1", 5, 15*time.Minute)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if allowed != want {
+			t.Errorf("expected allowed to be %v, got %v", want, allowed)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
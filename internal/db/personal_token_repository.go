@@ -0,0 +1,141 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrPersonalTokenNotFound is returned when a personal access token to
+// revoke does not exist, is not owned by the user or is already revoked
+var ErrPersonalTokenNotFound = errors.New("personal access token not found")
+
+// PersonalTokenRepository handles database operations for personal access
+// tokens
+type PersonalTokenRepository struct {
+	db *Database
+}
+
+// NewPersonalTokenRepository creates a new personal access token repository
+func NewPersonalTokenRepository(db *Database) *PersonalTokenRepository {
+	return &PersonalTokenRepository{db: db}
+}
+
+// CreatePersonalToken saves a new personal access token
+func (r *PersonalTokenRepository) CreatePersonalToken(token *models.PersonalAccessToken) error {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	if token.Scopes == nil {
+		token.Scopes = pq.StringArray{}
+	}
+
+	token.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO personal_access_tokens (
+			id, user_id, name, token_hash, token_hint, scopes, expires_at, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	_, err := r.db.DB.Exec(
+		query,
+		token.ID,
+		token.UserID,
+		token.Name,
+		token.TokenHash,
+		token.TokenHint,
+		token.Scopes,
+		token.ExpiresAt,
+		token.CreatedAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create personal access token: %w", err)
+	}
+
+	return nil
+}
+
+// GetUserPersonalTokens gets the personal access tokens of a user that have
+// not been revoked, newest first. Expired tokens are included so users can
+// see why a pipeline stopped working.
+func (r *PersonalTokenRepository) GetUserPersonalTokens(userID int64) ([]models.PersonalAccessToken, error) {
+	tokens := []models.PersonalAccessToken{}
+	query := `
+		SELECT id, user_id, name, token_hash, token_hint, scopes, expires_at,
+		       last_used_at, created_at, revoked_at
+		FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`
+
+	err := r.db.DB.Select(&tokens, query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get personal access tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+// GetActivePersonalToken gets the personal access token stored under a hash
+// if it has neither expired nor been revoked
+func (r *PersonalTokenRepository) GetActivePersonalToken(tokenHash string) (*models.PersonalAccessToken, error) {
+	var token models.PersonalAccessToken
+	query := `
+		SELECT id, user_id, name, token_hash, token_hint, scopes, expires_at,
+		       last_used_at, created_at, revoked_at
+		FROM personal_access_tokens
+		WHERE token_hash = $1 AND revoked_at IS NULL
+		  AND (expires_at IS NULL OR expires_at > $2)
+	`
+
+	err := r.db.DB.Get(&token, query, tokenHash, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get personal access token: %w", err)
+	}
+
+	return &token, nil
+}
+
+// TouchPersonalToken records that a personal access token was just used
+func (r *PersonalTokenRepository) TouchPersonalToken(id string) error {
+	query := `UPDATE personal_access_tokens SET last_used_at = $1 WHERE id = $2`
+
+	_, err := r.db.DB.Exec(query, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to update personal access token: %w", err)
+	}
+
+	return nil
+}
+
+// RevokePersonalToken revokes a personal access token of a user
+func (r *PersonalTokenRepository) RevokePersonalToken(id string, userID int64) error {
+	query := `
+		UPDATE personal_access_tokens SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL
+	`
+
+	result, err := r.db.DB.Exec(query, time.Now(), id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke personal access token: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return ErrPersonalTokenNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned when a refresh token does not
+	// exist, has expired or was revoked
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid")
+
+	// ErrRefreshTokenReused is returned when a refresh token that was
+	// already exchanged is used again
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// RefreshTokenRepository handles database operations for refresh tokens
+type RefreshTokenRepository struct {
+	db *Database
+}
+
+// NewRefreshTokenRepository creates a new refresh token repository
+func NewRefreshTokenRepository(db *Database) *RefreshTokenRepository {
+	return &RefreshTokenRepository{db: db}
+}
+
+// CreateRefreshToken saves a refresh token. A token without a family starts
+// a new family.
+func (r *RefreshTokenRepository) CreateRefreshToken(token *models.RefreshToken) error {
+	if token.ID == "" {
+		token.ID = uuid.New().String()
+	}
+	if token.FamilyID == "" {
+		token.FamilyID = uuid.New().String()
+	}
+	token.CreatedAt = time.Now()
+
+	query := `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	_, err := r.db.DB.Exec(query, token.ID, token.UserID, token.FamilyID, token.TokenHash, token.ExpiresAt, token.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// RotateRefreshToken marks the token with tokenHash used and saves next in
+// its family, for its user, extending the session of the family. If the
+// token was used before, its whole family and session are revoked and
+// ErrRefreshTokenReused is returned, with next naming the family.
+func (r *RefreshTokenRepository) RotateRefreshToken(tokenHash string, next *models.RefreshToken) error {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current models.RefreshToken
+	query := `
+		SELECT id, user_id, family_id, token_hash, expires_at, created_at, used_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`
+
+	err = tx.Get(&current, query, tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrRefreshTokenInvalid
+		}
+		return fmt.Errorf("failed to get refresh token: %w", err)
+	}
+
+	now := time.Now()
+
+	if current.RevokedAt != nil || !now.Before(current.ExpiresAt) {
+		return ErrRefreshTokenInvalid
+	}
+
+	next.UserID = current.UserID
+	next.FamilyID = current.FamilyID
+
+	if current.UsedAt != nil {
+		err = revokeSession(tx, current.FamilyID, now)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit refresh token revocation: %w", err)
+		}
+
+		return ErrRefreshTokenReused
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET used_at = $1 WHERE id = $2`, now, current.ID)
+	if err != nil {
+		return fmt.Errorf("failed to use refresh token: %w", err)
+	}
+
+	next.ID = uuid.New().String()
+	next.CreatedAt = now
+
+	query = `
+		INSERT INTO refresh_tokens (id, user_id, family_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	_, err = tx.Exec(query, next.ID, next.UserID, next.FamilyID, next.TokenHash, next.ExpiresAt, next.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create refresh token: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE sessions SET last_seen_at = $1, expires_at = $2 WHERE id = $3`, now, next.ExpiresAt, next.FamilyID)
+	if err != nil {
+		return fmt.Errorf("failed to extend session: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit refresh token: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeRefreshTokenFamily revokes the family of the refresh token with
+// tokenHash, if it belongs to the user
+func (r *RefreshTokenRepository) RevokeRefreshTokenFamily(tokenHash string, userID int64) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = $1
+		WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $2 AND user_id = $3)
+		  AND revoked_at IS NULL
+	`
+
+	_, err := r.db.DB.Exec(query, time.Now(), tokenHash, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token family: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteExpiredRefreshTokens deletes the expired refresh tokens of a user
+func (r *RefreshTokenRepository) DeleteExpiredRefreshTokens(userID int64) error {
+	query := `DELETE FROM refresh_tokens WHERE user_id = $1 AND expires_at < $2`
+
+	_, err := r.db.DB.Exec(query, userID, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to delete expired refresh tokens: %w", err)
+	}
+
+	return nil
+}
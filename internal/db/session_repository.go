@@ -0,0 +1,186 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+// ErrSessionNotFound is returned when a session to revoke does not exist,
+// is not owned by the user or is already revoked
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionRepository handles database operations for login sessions
+type SessionRepository struct {
+	db *Database
+}
+
+// NewSessionRepository creates a new session repository
+func NewSessionRepository(db *Database) *SessionRepository {
+	return &SessionRepository{db: db}
+}
+
+// CreateSession saves a new session
+func (r *SessionRepository) CreateSession(session *models.Session) error {
+	if session.ID == "" {
+		session.ID = uuid.New().String()
+	}
+
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+
+	query := `
+		INSERT INTO sessions (
+			id, user_id, ip_address, user_agent, device_label, created_at, last_seen_at, expires_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	_, err := r.db.DB.Exec(
+		query,
+		session.ID,
+		session.UserID,
+		session.IPAddress,
+		session.UserAgent,
+		session.DeviceLabel,
+		session.CreatedAt,
+		session.LastSeenAt,
+		session.ExpiresAt,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+
+	return nil
+}
+
+// GetUserSessions gets the sessions of a user that have not expired or been
+// revoked, most recently seen first
+func (r *SessionRepository) GetUserSessions(userID int64) ([]models.Session, error) {
+	sessions := []models.Session{}
+	query := `
+		SELECT id, user_id, ip_address, user_agent, device_label, created_at,
+		       last_seen_at, expires_at, revoked_at
+		FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_seen_at DESC
+	`
+
+	err := r.db.DB.Select(&sessions, query, userID, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+
+	return sessions, nil
+}
+
+// TouchSession records that a session was just used and reports whether it
+// has been revoked. Sessions of logins from before sessions were tracked
+// have no row and are never revoked this way.
+func (r *SessionRepository) TouchSession(id string) (bool, error) {
+	var revoked bool
+	query := `
+		UPDATE sessions SET last_seen_at = $1
+		WHERE id = $2
+		RETURNING revoked_at IS NOT NULL
+	`
+
+	err := r.db.DB.Get(&revoked, query, time.Now(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update session: %w", err)
+	}
+
+	return revoked, nil
+}
+
+// RevokeSession revokes a session of a user along with its refresh tokens
+func (r *SessionRepository) RevokeSession(id string, userID int64) error {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`, time.Now(), id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return ErrSessionNotFound
+	}
+
+	err = revokeSession(tx, id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit session revocation: %w", err)
+	}
+
+	return nil
+}
+
+// RevokeUserSessions revokes all sessions of a user along with their
+// refresh tokens, returning the IDs of the sessions revoked
+func (r *SessionRepository) RevokeUserSessions(userID int64) ([]string, error) {
+	tx, err := r.db.DB.Beginx()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	var ids []string
+	err = tx.Select(&ids, `UPDATE sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL RETURNING id`, now, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke sessions: %w", err)
+	}
+
+	// Refresh tokens issued before sessions were tracked have no session
+	_, err = tx.Exec(`UPDATE refresh_tokens SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`, now, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("failed to commit session revocation: %w", err)
+	}
+
+	return ids, nil
+}
+
+// revokeSession revokes a session and the refresh tokens of its family
+func revokeSession(tx *sqlx.Tx, id string, now time.Time) error {
+	_, err := tx.Exec(`UPDATE sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`, now, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session: %w", err)
+	}
+
+	_, err = tx.Exec(`UPDATE refresh_tokens SET revoked_at = $1 WHERE family_id = $2 AND revoked_at IS NULL`, now, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh token family: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+)
+
+// ShareAccessRepository handles the share link access log
+type ShareAccessRepository struct {
+	db *Database
+}
+
+// NewShareAccessRepository creates a new share access repository
+func NewShareAccessRepository(db *Database) *ShareAccessRepository {
+	return &ShareAccessRepository{db: db}
+}
+
+// CreateShareAccess records an access to a share link
+func (r *ShareAccessRepository) CreateShareAccess(access *models.ShareAccess) error {
+	if access.AccessedAt.IsZero() {
+		access.AccessedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO share_accesses (
+			share_id, accessed_at, ip_address, user_agent, referrer, success, reason
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+
+	err := r.db.DB.QueryRow(
+		query,
+		access.ShareID,
+		access.AccessedAt,
+		access.IPAddress,
+		access.UserAgent,
+		access.Referrer,
+		access.Success,
+		access.Reason,
+	).Scan(&access.ID)
+
+	if err != nil {
+		return fmt.Errorf("failed to create share access: %w", err)
+	}
+
+	return nil
+}
+
+// GetShareAccesses gets the accesses to a share link, most recent first
+func (r *ShareAccessRepository) GetShareAccesses(shareID string, limit, offset int) ([]models.ShareAccess, error) {
+	accesses := []models.ShareAccess{}
+	query := `
+		SELECT id, share_id, accessed_at, ip_address, user_agent, referrer, success, reason
+		FROM share_accesses
+		WHERE share_id = $1
+		ORDER BY accessed_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	err := r.db.DB.Select(&accesses, query, shareID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share accesses: %w", err)
+	}
+
+	return accesses, nil
+}
+
+// CountShareAccesses counts the accesses to a share link
+func (r *ShareAccessRepository) CountShareAccesses(shareID string) (int, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM share_accesses WHERE share_id = $1`
+
+	err := r.db.DB.Get(&count, query, shareID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count share accesses: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetShareAccessDailyCounts counts the accesses to a share link per day (UTC)
+// for the most recent days
+func (r *ShareAccessRepository) GetShareAccessDailyCounts(shareID string, days int) ([]models.ShareAccessDailyCount, error) {
+	counts := []models.ShareAccessDailyCount{}
+	query := `
+		SELECT to_char(accessed_at AT TIME ZONE 'UTC', 'YYYY-MM-DD') AS day,
+		       COUNT(*) AS total,
+		       COUNT(*) FILTER (WHERE success) AS succeeded,
+		       COUNT(*) FILTER (WHERE NOT success) AS denied
+		FROM share_accesses
+		WHERE share_id = $1
+		GROUP BY day
+		ORDER BY day DESC
+		LIMIT $2
+	`
+
+	err := r.db.DB.Select(&counts, query, shareID, days)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share access counts: %w", err)
+	}
+
+	return counts, nil
+}
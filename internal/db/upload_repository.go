@@ -0,0 +1,137 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"file-sharing-platform/internal/models"
+
+	"github.com/google/uuid"
+)
+
+// UploadRepository handles resumable upload session database operations
+type UploadRepository struct {
+	db *Database
+}
+
+// NewUploadRepository creates a new upload repository
+func NewUploadRepository(db *Database) *UploadRepository {
+	return &UploadRepository{db: db}
+}
+
+// CreateUploadSession adds a new upload session to the database
+func (r *UploadRepository) CreateUploadSession(session *models.UploadSession) error {
+	if session.ID == "" {
+		session.ID = uuid.New().String()
+	}
+
+	now := time.Now()
+	session.CreatedAt = now
+	session.UpdatedAt = now
+
+	query := `
+		INSERT INTO upload_sessions (
+			id, user_id, file_name, content_type, size, upload_offset,
+			expires_at, created_at, updated_at, folder_id, expected_sha256, expected_md5
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+	`
+
+	_, err := r.db.DB.Exec(
+		query,
+		session.ID,
+		session.UserID,
+		session.FileName,
+		session.ContentType,
+		session.Size,
+		session.Offset,
+		session.ExpiresAt,
+		session.CreatedAt,
+		session.UpdatedAt,
+		session.FolderID,
+		session.ExpectedSHA256,
+		session.ExpectedMD5,
+	)
+
+	if err != nil {
+		return fmt.Errorf("failed to create upload session: %w", err)
+	}
+
+	return nil
+}
+
+// GetUploadSession retrieves an upload session owned by a user
+func (r *UploadRepository) GetUploadSession(id string, userID int64) (*models.UploadSession, error) {
+	var session models.UploadSession
+	query := `
+		SELECT id, user_id, file_name, content_type, size, upload_offset,
+		       expires_at, created_at, updated_at, folder_id, expected_sha256, expected_md5
+		FROM upload_sessions
+		WHERE id = $1 AND user_id = $2
+	`
+
+	err := r.db.DB.Get(&session, query, id, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get upload session: %w", err)
+	}
+
+	return &session, nil
+}
+
+// UpdateUploadOffset advances the offset of an upload session. The update
+// only applies if the stored offset still equals expectedOffset, so two
+// clients racing on the same session cannot both move it forward.
+func (r *UploadRepository) UpdateUploadOffset(id string, expectedOffset, newOffset int64, expiresAt time.Time) error {
+	query := `
+		UPDATE upload_sessions
+		SET upload_offset = $1, expires_at = $2, updated_at = $3
+		WHERE id = $4 AND upload_offset = $5
+	`
+
+	result, err := r.db.DB.Exec(query, newOffset, expiresAt, time.Now(), id, expectedOffset)
+	if err != nil {
+		return fmt.Errorf("failed to update upload offset: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("upload session not found or offset changed")
+	}
+
+	return nil
+}
+
+// DeleteUploadSession deletes an upload session
+func (r *UploadRepository) DeleteUploadSession(id string) error {
+	query := `DELETE FROM upload_sessions WHERE id = $1`
+
+	_, err := r.db.DB.Exec(query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete upload session: %w", err)
+	}
+
+	return nil
+}
+
+// GetExpiredUploadSessions gets upload sessions that have been abandoned
+func (r *UploadRepository) GetExpiredUploadSessions(batchSize int) ([]models.UploadSession, error) {
+	sessions := []models.UploadSession{}
+	query := `
+		SELECT id, user_id, file_name, content_type, size, upload_offset,
+		       expires_at, created_at, updated_at, folder_id, expected_sha256, expected_md5
+		FROM upload_sessions
+		WHERE expires_at < NOW()
+		LIMIT $1
+	`
+
+	err := r.db.DB.Select(&sessions, query, batchSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired upload sessions: %w", err)
+	}
+
+	return sessions, nil
+}
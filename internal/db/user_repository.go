@@ -7,9 +7,15 @@ import (
 
 	"file-sharing-platform/internal/models"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// ErrQuotaExceeded is returned when storing more would take a user over
+// their storage quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
 // VerifyPassword checks if the provided password is correct
 func (r *UserRepository) VerifyPassword(user *models.User, password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) == nil
@@ -45,7 +51,7 @@ func (r *UserRepository) CreateUser(email, password string) (*models.User, error
 	query := `
 		INSERT INTO users (email, password, created_at, updated_at)
 		VALUES ($1, $2, $3, $4)
-		RETURNING id, email, created_at, updated_at
+		RETURNING id, email, token_generation, created_at, updated_at
 	`
 
 	err = r.db.DB.QueryRowx(
@@ -70,7 +76,7 @@ func (r *UserRepository) CreateUser(email, password string) (*models.User, error
 func (r *UserRepository) GetUserByEmail(email string) (*models.User, error) {
 	var user models.User
 	query := `
-		SELECT id, email, password, created_at, updated_at
+		SELECT id, email, password, token_generation, created_at, updated_at
 		FROM users
 		WHERE email = $1
 	`
@@ -87,7 +93,7 @@ func (r *UserRepository) GetUserByEmail(email string) (*models.User, error) {
 func (r *UserRepository) GetUserByID(id int64) (*models.User, error) {
 	var user models.User
 	query := `
-		SELECT id, email, created_at, updated_at
+		SELECT id, email, token_generation, created_at, updated_at
 		FROM users
 		WHERE id = $1
 	`
@@ -118,3 +124,160 @@ func (r *UserRepository) Authenticate(email, password string) (*models.User, err
 
 	return user, nil
 }
+
+// GetTokenGeneration gets the token generation of a user. Access tokens
+// issued for an earlier generation are no longer valid.
+func (r *UserRepository) GetTokenGeneration(id int64) (int64, error) {
+	var generation int64
+	query := `SELECT token_generation FROM users WHERE id = $1`
+
+	err := r.db.DB.Get(&generation, query, id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get token generation: %w", err)
+	}
+
+	return generation, nil
+}
+
+// IncrementTokenGeneration bumps the token generation of a user, returning
+// the new generation
+func (r *UserRepository) IncrementTokenGeneration(id int64) (int64, error) {
+	var generation int64
+	query := `
+		UPDATE users
+		SET token_generation = token_generation + 1, updated_at = $1
+		WHERE id = $2
+		RETURNING token_generation
+	`
+
+	err := r.db.DB.Get(&generation, query, time.Now(), id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to increment token generation: %w", err)
+	}
+
+	return generation, nil
+}
+
+// IsAdmin reports whether a user is an admin
+func (r *UserRepository) IsAdmin(id int64) (bool, error) {
+	var isAdmin bool
+	query := `SELECT is_admin FROM users WHERE id = $1`
+
+	err := r.db.DB.Get(&isAdmin, query, id)
+	if err != nil {
+		return false, fmt.Errorf("failed to get user role: %w", err)
+	}
+
+	return isAdmin, nil
+}
+
+// GrantAdmin makes the users with the given emails admins
+func (r *UserRepository) GrantAdmin(emails []string) error {
+	query := `UPDATE users SET is_admin = TRUE WHERE email = ANY($1) AND NOT is_admin`
+
+	_, err := r.db.DB.Exec(query, pq.Array(emails))
+	if err != nil {
+		return fmt.Errorf("failed to grant admin: %w", err)
+	}
+
+	return nil
+}
+
+// GetUsage gets the storage usage of a user, with the quota the user has
+// been given, if any
+func (r *UserRepository) GetUsage(id int64) (*models.StorageUsage, error) {
+	var usage models.StorageUsage
+	query := `
+		SELECT used_bytes, used_files, has_quota, quota_bytes, quota_files
+		FROM users
+		WHERE id = $1
+	`
+
+	err := r.db.DB.Get(&usage, query, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage usage: %w", err)
+	}
+
+	return &usage, nil
+}
+
+// SetQuota sets the storage quota of a user. A nil limit is no limit.
+func (r *UserRepository) SetQuota(id int64, quotaBytes, quotaFiles *int64) error {
+	return r.updateQuota(id, true, quotaBytes, quotaFiles)
+}
+
+// ResetQuota makes the default quota apply to a user again
+func (r *UserRepository) ResetQuota(id int64) error {
+	return r.updateQuota(id, false, nil, nil)
+}
+
+// updateQuota sets whether a user has a storage quota of their own and what
+// it is
+func (r *UserRepository) updateQuota(id int64, hasQuota bool, quotaBytes, quotaFiles *int64) error {
+	query := `
+		UPDATE users
+		SET has_quota = $1, quota_bytes = $2, quota_files = $3, updated_at = $4
+		WHERE id = $5
+	`
+
+	result, err := r.db.DB.Exec(query, hasQuota, quotaBytes, quotaFiles, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to set storage quota: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("user not found")
+	}
+
+	return nil
+}
+
+// chargeUsage adds stored bytes and files to the usage of a user, failing
+// with ErrQuotaExceeded if that would take the user over limit
+func chargeUsage(tx *sqlx.Tx, userID int64, bytes, files int64, limit models.StorageQuota) error {
+	query := `
+		UPDATE users
+		SET used_bytes = used_bytes + $1::BIGINT, used_files = used_files + $2::BIGINT
+		WHERE id = $3
+		  AND ($4::BIGINT IS NULL OR used_bytes + $1::BIGINT <= $4::BIGINT)
+		  AND ($5::BIGINT IS NULL OR used_files + $2::BIGINT <= $5::BIGINT)
+	`
+
+	result, err := tx.Exec(query, bytes, files, userID, limit.Bytes, limit.Files)
+	if err != nil {
+		return fmt.Errorf("failed to update storage usage: %w", err)
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected: %w", err)
+	}
+
+	if count == 0 {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// releaseUsage removes deleted bytes and files from the usage of a user
+func releaseUsage(tx *sqlx.Tx, userID int64, bytes, files int64) error {
+	query := `
+		UPDATE users
+		SET used_bytes = GREATEST(used_bytes - $1::BIGINT, 0),
+		    used_files = GREATEST(used_files - $2::BIGINT, 0)
+		WHERE id = $3
+	`
+
+	_, err := tx.Exec(query, bytes, files, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update storage usage: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/db"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminMiddleware only lets admins through. It must run after AuthMiddleware.
+func AdminMiddleware(userRepo *db.UserRepository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := auth.GetUserIDFromContext(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		isAdmin, err := userRepo.IsAdmin(userID)
+		if err != nil || !isAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
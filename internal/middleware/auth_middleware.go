@@ -2,14 +2,18 @@ package middleware
 
 import (
 	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/service"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-// AuthMiddleware extracts and validates JWT, then stores user ID in context
-func AuthMiddleware(jwtAuth *auth.JWTAuth) gin.HandlerFunc {
+// AuthMiddleware extracts and validates the bearer token, rejecting revoked
+// tokens, then stores user ID and token claims in context. Personal access
+// tokens are accepted alongside JWTs; for those the granted scopes are
+// stored instead of claims.
+func AuthMiddleware(tokenService *service.TokenService, personalTokenService *service.PersonalTokenService) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -19,15 +23,59 @@ func AuthMiddleware(jwtAuth *auth.JWTAuth) gin.HandlerFunc {
 		}
 
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		claims, err := auth.ValidateToken(tokenString)
+
+		if auth.IsPersonalToken(tokenString) {
+			token, err := personalTokenService.Authenticate(c.Request.Context(), tokenString)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+				c.Abort()
+				return
+			}
+
+			c.Set("userID", token.UserID)
+			c.Set("scopes", []string(token.Scopes))
+			c.Next()
+			return
+		}
+
+		claims, err := tokenService.Authenticate(c.Request.Context(), tokenString)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		// Store user ID in gin.Context
+		// Store user ID and claims in gin.Context
 		c.Set("userID", claims.UserID)
+		c.Set("claims", claims)
+		c.Next()
+	}
+}
+
+// RequireScope rejects requests made with a personal access token that was
+// not granted scope. Access tokens of login sessions have every scope.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !auth.HasScope(c, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Token is missing the " + scope + " scope"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireSession rejects requests made with a personal access token, for
+// routes that manage the account itself such as sessions and tokens
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := auth.GetClaimsFromContext(c); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Personal access tokens cannot be used here"})
+			c.Abort()
+			return
+		}
+
 		c.Next()
 	}
 }
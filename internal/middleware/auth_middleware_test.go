@@ -0,0 +1,80 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"file-sharing-platform/internal/auth"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// authenticateAs returns a handler setting up the context as AuthMiddleware
+// does for a login session, a personal access token with scopes, or neither
+func authenticateAs(kind string, scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch kind {
+		case "session":
+			c.Set("userID", int64(1))
+			c.Set("claims", &auth.JWTClaims{UserID: 1})
+		case "token":
+			c.Set("userID", int64(1))
+			c.Set("scopes", scopes)
+		}
+		c.Next()
+	}
+}
+
+// statusOf serves a request through handlers and returns the status
+func statusOf(handlers ...gin.HandlerFunc) int {
+	router := gin.New()
+	router.GET("/", append(handlers, func(c *gin.Context) { c.Status(http.StatusOK) })...)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	return rr.Code
+}
+
+func TestRequireScope(t *testing.T) {
+	tests := []struct {
+		name string
+		auth gin.HandlerFunc
+		want int
+	}{
+		{"login session", authenticateAs("session"), http.StatusOK},
+		{"token with the scope", authenticateAs("token", auth.ScopeFilesRead, auth.ScopeFilesWrite), http.StatusOK},
+		{"token without the scope", authenticateAs("token", auth.ScopeFilesRead), http.StatusForbidden},
+		{"token without scopes", authenticateAs("token"), http.StatusForbidden},
+		{"not authenticated", authenticateAs(""), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if got := statusOf(tt.auth, RequireScope(auth.ScopeFilesWrite)); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRequireSession(t *testing.T) {
+	tests := []struct {
+		name string
+		auth gin.HandlerFunc
+		want int
+	}{
+		{"login session", authenticateAs("session"), http.StatusOK},
+		{"token with every scope", authenticateAs("token", auth.ScopeFilesRead, auth.ScopeFilesWrite, auth.ScopeSharesManage), http.StatusForbidden},
+		{"not authenticated", authenticateAs(""), http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		if got := statusOf(tt.auth, RequireSession()); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,69 +1,72 @@
 package middleware
 
 import (
-	"context"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"time"
 
 	"file-sharing-platform/internal/auth"
-	"file-sharing-platform/pkg/cache"
+	"file-sharing-platform/pkg/ratelimit"
+
+	"github.com/gin-gonic/gin"
 )
 
-type RateLimiter struct {
-	cache         cache.Cache
-	maxRequests   int
-	windowSeconds int
-}
+// RatePolicy limits how often a client may call a group of routes. Requests
+// are counted per user once authenticated and per client IP otherwise.
+type RatePolicy struct {
+	// Name keeps the counts of policies apart
+	Name string
 
-func NewRateLimiter(cache cache.Cache, maxRequests, windowSeconds int) *RateLimiter {
-	return &RateLimiter{
-		cache:         cache,
-		maxRequests:   maxRequests,
-		windowSeconds: windowSeconds,
-	}
+	// Limit is the number of requests allowed per Window. 0 disables the
+	// policy.
+	Limit  int
+	Window time.Duration
 }
 
-func (rl *RateLimiter) Limit(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Extract user ID or use IP address as fallback
-		var identifier string
-		userID, err := auth.GetUserIDFromRequest(r)
-		if err == nil {
-			identifier = strconv.FormatInt(userID, 10)
-		} else {
-			identifier = r.RemoteAddr
+// RateLimit limits requests with policy, counting them with limiter.
+// Responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers; requests over the limit get 429 with Retry-After. If the limiter
+// fails, requests are let through rather than taking the API down with it.
+func RateLimit(limiter ratelimit.Limiter, policy RatePolicy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if policy.Limit <= 0 {
+			c.Next()
+			return
 		}
 
-		// Check rate limit
-		key := "ratelimit:" + identifier
-
-		// Get current count
-		var countStr string
-		err = rl.cache.Get(context.Background(), key, &countStr)
-		var count int
-		if err == nil {
-			count, _ = strconv.Atoi(countStr)
+		key := policy.Name + ":ip:" + c.ClientIP()
+		if userID, err := auth.GetUserIDFromContext(c); err == nil {
+			key = policy.Name + ":user:" + strconv.FormatInt(userID, 10)
 		}
 
-		// Check if limit exceeded
-		if count >= rl.maxRequests {
-			w.Header().Set("Retry-After", strconv.Itoa(rl.windowSeconds))
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		result, err := limiter.Allow(c.Request.Context(), key, policy.Limit, policy.Window)
+		if err != nil {
+			log.Printf("Rate limiter unavailable: %v", err)
+			c.Next()
 			return
 		}
 
-		// Increment counter
-		expiration := time.Duration(rl.windowSeconds) * time.Second
-		if count == 0 {
-			// First request in window, set expiration
-			rl.cache.Set(context.Background(), key, strconv.Itoa(count+1), expiration)
-		} else {
-			// Increment existing counter
-			rl.cache.Set(context.Background(), key, strconv.Itoa(count+1), expiration)
+		reset := strconv.Itoa(seconds(result.Reset))
+		c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, seconds(policy.Window)))
+		c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+		c.Header("RateLimit-Reset", reset)
+
+		if !result.Allowed {
+			c.Header("Retry-After", reset)
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Rate limit exceeded"})
+			c.Abort()
+			return
 		}
 
-		// Call next handler
-		next.ServeHTTP(w, r)
-	})
+		c.Next()
+	}
+}
+
+// seconds rounds a duration up to whole seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
 }
@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // User represents a user in the system
@@ -10,6 +12,9 @@ type User struct {
 	Email    string `db:"email" json:"email"`
 	Password string `db:"password" json:"-"` // Hashed password, not returned in JSON
 
+	// TokenGeneration is bumped to invalidate all access tokens of the user
+	TokenGeneration int64 `db:"token_generation" json:"-"`
+
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
 	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
 }
@@ -27,6 +32,196 @@ type File struct {
 	ExpiresAt   time.Time `db:"expires_at" json:"expires_at,omitempty"`
 	CreatedAt   time.Time `db:"created_at" json:"created_at"`
 	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+
+	// Checksums of the file content, computed while it was uploaded
+	Checksums
+
+	// Encryption at rest: the file's data key wrapped by a master key, the ID
+	// of that master key and the encryption format version (0 when the file
+	// is stored unencrypted)
+	EncryptedKey      []byte `db:"encrypted_key" json:"-"`
+	EncryptionKeyID   string `db:"encryption_key_id" json:"-"`
+	EncryptionVersion int    `db:"encryption_version" json:"-"`
+
+	// FileRequestID is the file request link the file was uploaded through,
+	// empty for files uploaded by their owner
+	FileRequestID string `db:"file_request_id" json:"file_request_id,omitempty"`
+
+	// FolderID is the folder holding the file, empty for the root folder
+	FolderID string `db:"folder_id" json:"folder_id,omitempty"`
+
+	// Version is the number of the current version of the file, starting at
+	// 1, and VersionCreatedAt the time it was uploaded
+	Version          int       `db:"version" json:"version"`
+	VersionCreatedAt time.Time `db:"version_created_at" json:"-"`
+
+	// DeletedAt is when the file was moved to the trash, nil for files that
+	// are not in the trash
+	DeletedAt *time.Time `db:"deleted_at" json:"deleted_at,omitempty"`
+
+	// BlobHash is the SHA-256 hash of the file's content when it is stored
+	// as a deduplicated blob, empty when the file has content of its own
+	BlobHash string `db:"blob_hash" json:"-"`
+}
+
+// Checksums are the hex encoded checksums of a file's content. MD5 is only
+// computed when enabled, for comparison with S3 ETags; both are empty for
+// files uploaded before checksums were recorded.
+type Checksums struct {
+	SHA256 string `db:"sha256" json:"sha256,omitempty"`
+	MD5    string `db:"md5" json:"md5,omitempty"`
+}
+
+// ScrubOptions control how file storage is reconciled with the database
+type ScrubOptions struct {
+	// OrphanAction is what happens to objects no row refers to:
+	// "quarantine" or "delete"
+	OrphanAction string
+
+	// DryRun only reports what would be done with orphaned objects
+	DryRun bool
+
+	// VerifyChecksums reads back all content with a recorded checksum
+	VerifyChecksums bool
+
+	// GracePeriod is how old an unreferenced object must be to count as
+	// orphaned, so uploads still being saved are left alone
+	GracePeriod time.Duration
+
+	// BatchSize is the number of rows read at a time
+	BatchSize int
+}
+
+// StoredObject is an object in storage that rows refer to
+type StoredObject struct {
+	StoragePath string `db:"storage_path"`
+	ContentType string `db:"content_type"`
+}
+
+// StorageReference identifies a row referring to an object in storage
+type StorageReference struct {
+	// Kind is "file", "version" or "blob"
+	Kind        string `json:"kind"`
+	ID          string `json:"id"`
+	FileID      string `json:"file_id,omitempty"`
+	StoragePath string `json:"storage_path"`
+}
+
+// ScrubReport is the outcome of reconciling file storage with the database
+type ScrubReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	DryRun     bool      `json:"dry_run"`
+
+	ObjectsListed   int `json:"objects_listed"`
+	ObjectsVerified int `json:"objects_verified"`
+
+	// MissingObjects are rows whose content is gone from storage
+	MissingObjects []StorageReference `json:"missing_objects"`
+
+	// CorruptObjects are rows whose content does not match its checksum
+	CorruptObjects []StorageReference `json:"corrupt_objects"`
+
+	// OrphanObjects are stored objects no row refers to
+	OrphanObjects []string `json:"orphan_objects"`
+
+	Quarantined int `json:"quarantined"`
+	Deleted     int `json:"deleted"`
+	Failed      int `json:"failed"`
+}
+
+// Blob represents deduplicated content, shared by all files and file
+// versions with the same SHA-256 hash. Its content is deleted from storage
+// once no file or file version refers to it anymore.
+type Blob struct {
+	Hash        string    `db:"hash"`
+	StoragePath string    `db:"storage_path"`
+	PublicURL   string    `db:"public_url"`
+	RefCount    int       `db:"ref_count"`
+	CreatedAt   time.Time `db:"created_at"`
+
+	// Encryption at rest: every file referring to the blob holds a copy of
+	// its wrapped data key
+	EncryptedKey      []byte `db:"encrypted_key"`
+	EncryptionKeyID   string `db:"encryption_key_id"`
+	EncryptionVersion int    `db:"encryption_version"`
+}
+
+// FileVersion represents a version of a file. Previous versions are stored
+// in their own rows; the current version is the file itself.
+type FileVersion struct {
+	ID          string     `db:"id" json:"-"`
+	FileID      string     `db:"file_id" json:"file_id"`
+	Version     int        `db:"version" json:"version"`
+	Size        int64      `db:"size" json:"size"`
+	ContentType string     `db:"content_type" json:"content_type"`
+	StoragePath string     `db:"storage_path" json:"-"`
+	PublicURL   string     `db:"public_url" json:"-"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	ReplacedAt  *time.Time `db:"replaced_at" json:"replaced_at,omitempty"`
+	Current     bool       `db:"-" json:"current"`
+
+	Checksums
+
+	EncryptedKey      []byte `db:"encrypted_key" json:"-"`
+	EncryptionKeyID   string `db:"encryption_key_id" json:"-"`
+	EncryptionVersion int    `db:"encryption_version" json:"-"`
+
+	// BlobHash is the hash of the version's blob, see File.BlobHash
+	BlobHash string `db:"blob_hash" json:"-"`
+}
+
+// VersionRetention represents how long the previous versions of a user's
+// files are kept: the last KeepLast versions of each file, and only those
+// replaced less than KeepDays days ago. A limit of 0 is no limit.
+type VersionRetention struct {
+	UserID    int64 `db:"user_id" json:"-"`
+	KeepLast  int   `db:"keep_last" json:"keep_last"`
+	KeepDays  int   `db:"keep_days" json:"keep_days"`
+	IsDefault bool  `db:"-" json:"is_default"`
+}
+
+// StorageQuota limits how much a user can store. A nil limit is no limit;
+// a limit of 0 allows nothing.
+type StorageQuota struct {
+	Bytes *int64
+	Files *int64
+}
+
+// StorageUsage is how much a user stores and is allowed to store. Trashed
+// files and previous file versions count until they are purged. A null
+// quota is no limit.
+type StorageUsage struct {
+	UsedBytes  int64  `db:"used_bytes" json:"used_bytes"`
+	UsedFiles  int64  `db:"used_files" json:"used_files"`
+	QuotaBytes *int64 `db:"-" json:"quota_bytes"`
+	QuotaFiles *int64 `db:"-" json:"quota_files"`
+	IsDefault  bool   `db:"-" json:"is_default"`
+
+	// The user's own quota, which applies instead of the default quota when
+	// HasQuota is set
+	HasQuota       bool   `db:"has_quota" json:"-"`
+	UserQuotaBytes *int64 `db:"quota_bytes" json:"-"`
+	UserQuotaFiles *int64 `db:"quota_files" json:"-"`
+}
+
+// Folder represents a folder in a user's file tree. ParentID is empty for
+// folders in the root folder.
+type Folder struct {
+	ID        string    `db:"id" json:"id"`
+	UserID    int64     `db:"user_id" json:"user_id"`
+	ParentID  string    `db:"parent_id" json:"parent_id,omitempty"`
+	Name      string    `db:"name" json:"name"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// FolderScope restricts a file listing or search to the files directly in a
+// folder, or to the folder's whole subtree when Recursive is set. An empty
+// FolderID is the root folder.
+type FolderScope struct {
+	FolderID  string
+	Recursive bool
 }
 
 // SharedFile represents a file share link
@@ -36,49 +231,318 @@ type SharedFile struct {
 	ShareURL  string    `db:"share_url" json:"share_url"`
 	ExpiresAt time.Time `db:"expires_at" json:"expires_at,omitempty"`
 	CreatedAt time.Time `db:"created_at" json:"created_at"`
+
+	// PasswordHash is the bcrypt hash of the link password, empty when the
+	// link is not password protected
+	PasswordHash      string `db:"password_hash" json:"-"`
+	PasswordProtected bool   `db:"-" json:"password_protected"`
+
+	// Download limits: MaxDownloads is 0 for unlimited links, and burn after
+	// reading links allow a single download. RemainingDownloads is nil for
+	// unlimited links.
+	MaxDownloads       int  `db:"max_downloads" json:"max_downloads"`
+	DownloadCount      int  `db:"download_count" json:"download_count"`
+	BurnAfterReading   bool `db:"burn_after_reading" json:"burn_after_reading"`
+	RemainingDownloads *int `db:"-" json:"remaining_downloads,omitempty"`
+}
+
+// FileRequest represents an upload-only link that lets anyone send files
+// to its owner. Zero limits mean no limit.
+type FileRequest struct {
+	ID                  string         `db:"id" json:"id"`
+	UserID              int64          `db:"user_id" json:"user_id"`
+	Token               string         `db:"token" json:"-"`
+	URL                 string         `db:"-" json:"url"`
+	Title               string         `db:"title" json:"title"`
+	PasswordHash        string         `db:"password_hash" json:"-"`
+	PasswordProtected   bool           `db:"-" json:"password_protected"`
+	ExpiresAt           time.Time      `db:"expires_at" json:"expires_at,omitempty"`
+	MaxFileSize         int64          `db:"max_file_size" json:"max_file_size"`
+	AllowedContentTypes pq.StringArray `db:"allowed_content_types" json:"allowed_content_types"`
+	MaxFiles            int            `db:"max_files" json:"max_files"`
+	FileCount           int            `db:"file_count" json:"file_count"`
+	CreatedAt           time.Time      `db:"created_at" json:"created_at"`
 }
 
-// AuthRequest represents authentication request data
+// ShareAccess represents one attempt to use a share link. Reason tells what
+// happened, such as "download" or "invalid_password".
+type ShareAccess struct {
+	ID         int64     `db:"id" json:"id"`
+	ShareID    string    `db:"share_id" json:"share_id"`
+	AccessedAt time.Time `db:"accessed_at" json:"accessed_at"`
+	IPAddress  string    `db:"ip_address" json:"ip_address"`
+	UserAgent  string    `db:"user_agent" json:"user_agent"`
+	Referrer   string    `db:"referrer" json:"referrer"`
+	Success    bool      `db:"success" json:"success"`
+	Reason     string    `db:"reason" json:"reason"`
+}
+
+// ShareAccessDailyCount represents the number of accesses to a share link on one day (UTC)
+type ShareAccessDailyCount struct {
+	Day       string `db:"day" json:"day"`
+	Total     int    `db:"total" json:"total"`
+	Succeeded int    `db:"succeeded" json:"succeeded"`
+	Denied    int    `db:"denied" json:"denied"`
+}
+
+// UploadSession represents an in-progress resumable upload
+type UploadSession struct {
+	ID          string    `db:"id" json:"id"`
+	UserID      int64     `db:"user_id" json:"user_id"`
+	FileName    string    `db:"file_name" json:"file_name"`
+	ContentType string    `db:"content_type" json:"content_type"`
+	Size        int64     `db:"size" json:"size"`
+	Offset      int64     `db:"upload_offset" json:"offset"`
+	FolderID    string    `db:"folder_id" json:"folder_id,omitempty"`
+	ExpiresAt   time.Time `db:"expires_at" json:"expires_at"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+
+	// ExpectedSHA256 and ExpectedMD5 are the checksums the client announced
+	// for the complete file, empty when not given
+	ExpectedSHA256 string `db:"expected_sha256" json:"-"`
+	ExpectedMD5    string `db:"expected_md5" json:"-"`
+}
+
+// AuthRequest represents authentication request data. DeviceLabel names
+// the session in the session list; it is derived from the user agent when
+// left out.
 type AuthRequest struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Email       string `json:"email" binding:"required,email"`
+	Password    string `json:"password" binding:"required,min=6"`
+	DeviceLabel string `json:"device_label" binding:"max=255"`
 }
 
 // RegisterRequest represents user registration data
 type RegisterRequest struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Email       string `json:"email" binding:"required,email"`
+	Password    string `json:"password" binding:"required,min=6"`
+	DeviceLabel string `json:"device_label" binding:"max=255"`
 }
 
-// AuthResponse represents authentication response data
+// AuthResponse represents authentication response data. Token is a
+// short-lived access token; RefreshToken gets a new pair once it expires.
 type AuthResponse struct {
-	Token     string `json:"token"`
-	ExpiresAt int64  `json:"expires_at"`
+	Token            string `json:"token"`
+	ExpiresAt        int64  `json:"expires_at"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresAt int64  `json:"refresh_expires_at"`
+	SessionID        string `json:"session_id"`
+}
+
+// Session is a login of a user on a device. It lasts as long as its refresh
+// tokens are exchanged before they expire.
+type Session struct {
+	ID          string     `db:"id" json:"id"`
+	UserID      int64      `db:"user_id" json:"-"`
+	IPAddress   string     `db:"ip_address" json:"ip_address"`
+	UserAgent   string     `db:"user_agent" json:"user_agent"`
+	DeviceLabel string     `db:"device_label" json:"device_label"`
+	CreatedAt   time.Time  `db:"created_at" json:"created_at"`
+	LastSeenAt  time.Time  `db:"last_seen_at" json:"last_seen_at"`
+	ExpiresAt   time.Time  `db:"expires_at" json:"expires_at"`
+	RevokedAt   *time.Time `db:"revoked_at" json:"-"`
+
+	// Current marks the session the request was made from
+	Current bool `db:"-" json:"current"`
+}
+
+// LogoutRequest represents a request to log out. The refresh token of the
+// login, if sent, is revoked along with the access token.
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// RefreshRequest represents a request to exchange a refresh token for new
+// tokens
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshToken is a stored refresh token. Only a hash of the token is kept.
+// Every refresh marks the token used and issues a new token of the same
+// family, so a used token showing up again means it was stolen.
+type RefreshToken struct {
+	ID        string     `db:"id"`
+	UserID    int64      `db:"user_id"`
+	FamilyID  string     `db:"family_id"`
+	TokenHash string     `db:"token_hash"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+// PersonalAccessToken is a long-lived token a user creates for scripts and
+// CI pipelines to call the API with. Only a hash of the token is kept; the
+// token itself is returned once, when it is created.
+type PersonalAccessToken struct {
+	ID         string         `db:"id" json:"id"`
+	UserID     int64          `db:"user_id" json:"-"`
+	Name       string         `db:"name" json:"name"`
+	TokenHash  string         `db:"token_hash" json:"-"`
+	TokenHint  string         `db:"token_hint" json:"token_hint"` // Start of the token, e.g. "fsp_AbCdEf"
+	Scopes     pq.StringArray `db:"scopes" json:"scopes"`
+	ExpiresAt  *time.Time     `db:"expires_at" json:"expires_at"`
+	LastUsedAt *time.Time     `db:"last_used_at" json:"last_used_at"`
+	CreatedAt  time.Time      `db:"created_at" json:"created_at"`
+	RevokedAt  *time.Time     `db:"revoked_at" json:"-"`
+
+	// Token is set only in the response to creating the token
+	Token string `db:"-" json:"token,omitempty"`
+}
+
+// CreatePersonalTokenRequest represents a request to create a personal
+// access token
+type CreatePersonalTokenRequest struct {
+	Name      string   `json:"name" binding:"required,max=255"`
+	Scopes    []string `json:"scopes" binding:"required,min=1"` // e.g. "files:read", "files:write", "shares:manage"
+	ExpiresIn string   `json:"expires_in"`                      // Duration string like "720h", empty for no expiry
 }
 
 // FileUploadResponse represents the response after a file upload
 type FileUploadResponse struct {
 	FileID    string `json:"file_id"`
 	PublicURL string `json:"public_url"`
+	Checksums
 }
 
 // ShareFileRequest represents a request to share a file
 type ShareFileRequest struct {
-	ExpiresIn string `json:"expires_in"` // Duration string like "24h", "7d"
+	ExpiresIn        string `json:"expires_in"`                              // Duration string like "24h", "7d"
+	Password         string `json:"password"`                                // Optional password required to open the link
+	MaxDownloads     int    `json:"max_downloads" binding:"omitempty,min=0"` // 0 for unlimited
+	BurnAfterReading bool   `json:"burn_after_reading"`                      // Allow a single download
 }
 
 // ShareFileResponse represents the response for a file share request
 type ShareFileResponse struct {
-	ShareURL  string    `json:"share_url"`
-	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	ShareURL           string    `json:"share_url"`
+	ExpiresAt          time.Time `json:"expires_at,omitempty"`
+	PasswordProtected  bool      `json:"password_protected"`
+	BurnAfterReading   bool      `json:"burn_after_reading"`
+	RemainingDownloads *int      `json:"remaining_downloads,omitempty"`
+}
+
+// UpdateShareRequest represents changes to a share link. Fields left out
+// are not changed.
+type UpdateShareRequest struct {
+	ExpiresIn        *string `json:"expires_in"`                              // New lifetime from now, "" for no expiry
+	Password         *string `json:"password"`                                // New password, "" to remove it
+	MaxDownloads     *int    `json:"max_downloads" binding:"omitempty,min=0"` // 0 for unlimited
+	BurnAfterReading *bool   `json:"burn_after_reading"`
+}
+
+// CreateFileRequestRequest represents a request to create a file request link
+type CreateFileRequestRequest struct {
+	Title               string   `json:"title" binding:"required,max=255"`
+	Password            string   `json:"password"`
+	ExpiresIn           string   `json:"expires_in"`                              // Duration string like "24h"
+	MaxFileSize         int64    `json:"max_file_size" binding:"omitempty,min=0"` // Bytes
+	AllowedContentTypes []string `json:"allowed_content_types"`                   // e.g. "application/pdf", "image/*"
+	MaxFiles            int      `json:"max_files" binding:"omitempty,min=0"`
+}
+
+// ListShareAccessesRequest represents a request for a page of a share link's access log
+type ListShareAccessesRequest struct {
+	Limit  int `form:"limit,default=50"`
+	Offset int `form:"offset,default=0"`
+}
+
+// ShareAccessesResponse represents a page of a share link's access log
+type ShareAccessesResponse struct {
+	Accesses    []ShareAccess           `json:"accesses"`
+	Total       int                     `json:"total"`
+	DailyCounts []ShareAccessDailyCount `json:"daily_counts"`
+}
+
+// UnlockShareRequest represents a password submitted to open a share link
+type UnlockShareRequest struct {
+	Password string `form:"password" json:"password" binding:"required"`
+}
+
+// CreateFolderRequest represents a request to create a folder
+type CreateFolderRequest struct {
+	Name     string `json:"name" binding:"required,max=255"`
+	ParentID string `json:"parent_id"` // Empty for the root folder
+}
+
+// UpdateFolderRequest represents a request to rename or move a folder.
+// Fields left out are not changed.
+type UpdateFolderRequest struct {
+	Name     *string `json:"name" binding:"omitempty,max=255"`
+	ParentID *string `json:"parent_id"` // "" to move the folder to the root folder
+}
+
+// VersionRetentionRequest represents a request to change the version
+// retention policy of a user
+type VersionRetentionRequest struct {
+	KeepLast int `json:"keep_last" binding:"min=0"`
+	KeepDays int `json:"keep_days" binding:"min=0"`
+}
+
+// SetQuotaRequest represents a request by an admin to set the storage quota
+// of a user. A limit left out or null is no limit; 0 allows nothing.
+type SetQuotaRequest struct {
+	QuotaBytes *int64 `json:"quota_bytes" binding:"omitempty,min=0"`
+	QuotaFiles *int64 `json:"quota_files" binding:"omitempty,min=0"`
+}
+
+// MoveFileRequest represents a request to move a file to another folder
+type MoveFileRequest struct {
+	FolderID string `json:"folder_id"` // Empty for the root folder
+}
+
+// ListFilesRequest represents a request for a page of a user's files. When
+// FolderID is set only the files in that folder are listed, or in its whole
+// subtree with Recursive.
+type ListFilesRequest struct {
+	FolderID  string `form:"folder_id"`
+	Recursive bool   `form:"recursive"`
+	Limit     int    `form:"limit,default=20"`
+	Offset    int    `form:"offset,default=0"`
+}
+
+// ListTrashRequest represents a request for a page of the user's trash
+type ListTrashRequest struct {
+	Limit  int `form:"limit,default=20"`
+	Offset int `form:"offset,default=0"`
+}
+
+// ListFolderRequest represents a request for a folder's contents with a
+// page of its files
+type ListFolderRequest struct {
+	Limit  int `form:"limit,default=100"`
+	Offset int `form:"offset,default=0"`
+}
+
+// FolderContents represents a folder with the folders and files directly in
+// it. Folder is nil for the root folder.
+type FolderContents struct {
+	Path    string   `json:"path"`
+	Folder  *Folder  `json:"folder"`
+	Folders []Folder `json:"folders"`
+	Files   []File   `json:"files"`
+}
+
+// PathEntry represents what a path in a user's file tree points to: a
+// folder with its contents or a file
+type PathEntry struct {
+	Type   string          `json:"type"` // "folder" or "file"
+	Folder *FolderContents `json:"folder,omitempty"`
+	File   *File           `json:"file,omitempty"`
 }
 
-// SearchFilesRequest represents a request to search for files
+// SearchFilesRequest represents a request to search for files. When
+// FolderID is set the search is limited to that folder, or to its whole
+// subtree with Recursive.
 type SearchFilesRequest struct {
 	Query     string `form:"q"`
 	FileType  string `form:"type"`
 	StartDate string `form:"start_date"`
 	EndDate   string `form:"end_date"`
+	FolderID  string `form:"folder_id"`
+	Recursive bool   `form:"recursive"`
 	Limit     int    `form:"limit,default=20"`
 	Offset    int    `form:"offset,default=0"`
 }
@@ -0,0 +1,319 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/websocket"
+)
+
+var (
+	// ErrFileRequestNotFound is returned when a file request link does not exist
+	ErrFileRequestNotFound = errors.New("file request not found")
+
+	// ErrFileRequestExpired is returned when a file request link has expired
+	ErrFileRequestExpired = errors.New("file request has expired")
+
+	// ErrFileRequestFull is returned when a file request link has received
+	// its maximum number of files
+	ErrFileRequestFull = errors.New("file request does not accept more files")
+
+	// ErrInvalidFileRequestPassword is returned when a wrong file request password is submitted
+	ErrInvalidFileRequestPassword = errors.New("invalid file request password")
+
+	// ErrFileRequestLocked is returned when a file request link is temporarily
+	// locked after too many wrong passwords
+	ErrFileRequestLocked = errors.New("file request is temporarily locked")
+
+	// ErrFileTooLarge is returned when an upload exceeds the size allowed by a file request
+	ErrFileTooLarge = errors.New("file is too large")
+
+	// ErrContentTypeNotAllowed is returned when a file request does not accept a file's type
+	ErrContentTypeNotAllowed = errors.New("content type not allowed")
+)
+
+// FileRequestService handles upload-only links through which people without
+// an account can send files to a user
+type FileRequestService struct {
+	requestRepo     *db.FileRequestRepository
+	fileService     *FileService
+	notificationHub *websocket.NotificationHub
+	baseURL         string
+	maxFileSize     int64
+}
+
+// NewFileRequestService creates a new file request service. Files uploaded
+// through a link are never larger than maxFileSize bytes, even when the link
+// itself sets no limit or a higher one.
+func NewFileRequestService(requestRepo *db.FileRequestRepository, fileService *FileService, notificationHub *websocket.NotificationHub, baseURL string, maxFileSize int64) *FileRequestService {
+	return &FileRequestService{
+		requestRepo:     requestRepo,
+		fileService:     fileService,
+		notificationHub: notificationHub,
+		baseURL:         baseURL,
+		maxFileSize:     maxFileSize,
+	}
+}
+
+// fileRequestNotification is the WebSocket message sent to the owner of a
+// file request link when a file is uploaded through it
+type fileRequestNotification struct {
+	Type          string `json:"type"`
+	FileRequestID string `json:"file_request_id"`
+	Title         string `json:"title"`
+	FileID        string `json:"file_id"`
+	FileName      string `json:"file_name"`
+	Size          int64  `json:"size"`
+}
+
+// CreateFileRequest creates a file request link for a user
+func (s *FileRequestService) CreateFileRequest(ctx context.Context, userID int64, req *models.CreateFileRequestRequest) (*models.FileRequest, error) {
+	request := &models.FileRequest{
+		UserID:      userID,
+		Title:       req.Title,
+		MaxFileSize: req.MaxFileSize,
+		MaxFiles:    req.MaxFiles,
+	}
+
+	if req.ExpiresIn != "" {
+		duration, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiration format: %w", err)
+		}
+		request.ExpiresAt = time.Now().Add(duration)
+	}
+
+	for _, contentType := range req.AllowedContentTypes {
+		contentType = strings.ToLower(strings.TrimSpace(contentType))
+		if contentType != "" {
+			request.AllowedContentTypes = append(request.AllowedContentTypes, contentType)
+		}
+	}
+
+	err := s.requestRepo.CreateFileRequest(request, req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	s.formatURL(request)
+
+	return request, nil
+}
+
+// ListFileRequests gets the file request links of a user
+func (s *FileRequestService) ListFileRequests(ctx context.Context, userID int64) ([]models.FileRequest, error) {
+	requests, err := s.requestRepo.GetFileRequestsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range requests {
+		s.formatURL(&requests[i])
+	}
+
+	return requests, nil
+}
+
+// DeleteFileRequest closes a file request link. Files received through it are kept.
+func (s *FileRequestService) DeleteFileRequest(ctx context.Context, id string, userID int64) error {
+	err := s.requestRepo.DeleteFileRequest(id, userID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFileRequestNotFound, err)
+	}
+
+	return nil
+}
+
+// GetOpenFileRequest gets a file request link by token, checking that it
+// still accepts files
+func (s *FileRequestService) GetOpenFileRequest(ctx context.Context, token string) (*models.FileRequest, error) {
+	request, err := s.requestRepo.GetFileRequestByToken(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFileRequestNotFound, err)
+	}
+
+	if !request.ExpiresAt.IsZero() && time.Now().After(request.ExpiresAt) {
+		return nil, ErrFileRequestExpired
+	}
+
+	if request.MaxFiles > 0 && request.FileCount >= request.MaxFiles {
+		return nil, ErrFileRequestFull
+	}
+
+	return request, nil
+}
+
+// UploadLimit returns the size in bytes a file uploaded through a file
+// request link may have: the limit of the link, capped by the limit of the
+// server
+func (s *FileRequestService) UploadLimit(request *models.FileRequest) int64 {
+	if request.MaxFileSize > 0 && request.MaxFileSize < s.maxFileSize {
+		return request.MaxFileSize
+	}
+
+	return s.maxFileSize
+}
+
+// Upload stores a file sent through a file request link in the owner's files
+// and notifies the owner. size is the declared size of the file, -1 if it is
+// not known; content longer than allowed is rejected while it is streamed.
+// The password is checked before any content is read, and files sent
+// without a type get the type detected from their first bytes.
+func (s *FileRequestService) Upload(ctx context.Context, token, password, fileName string, size int64, contentType string, content io.Reader) (*models.File, error) {
+	request, err := s.GetOpenFileRequest(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkPassword(request, password)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := s.UploadLimit(request)
+	if size > limit {
+		return nil, ErrFileTooLarge
+	}
+	content = &sizeLimitedReader{r: content, remaining: limit}
+
+	// Detect the type of files sent without one
+	if contentType == "" || contentType == "application/octet-stream" {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(content, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		contentType = http.DetectContentType(head[:n])
+		content = io.MultiReader(bytes.NewReader(head[:n]), content)
+	}
+
+	if !ContentTypeAllowed(contentType, request.AllowedContentTypes) {
+		return nil, ErrContentTypeNotAllowed
+	}
+
+	// Claim a slot first so concurrent uploads cannot exceed the limit
+	reserved, err := s.requestRepo.ReserveFileRequestSlot(request.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !reserved {
+		return nil, ErrFileRequestFull
+	}
+
+	file, err := s.fileService.UploadRequestedFile(ctx, request, fileName, size, contentType, content)
+	if err != nil {
+		_ = s.requestRepo.ReleaseFileRequestSlot(request.ID)
+		if errors.Is(err, ErrFileTooLarge) {
+			return nil, ErrFileTooLarge
+		}
+		return nil, err
+	}
+
+	if s.notificationHub != nil {
+		message, err := json.Marshal(fileRequestNotification{
+			Type:          "file_request_upload",
+			FileRequestID: request.ID,
+			Title:         request.Title,
+			FileID:        file.ID,
+			FileName:      file.Name,
+			Size:          file.Size,
+		})
+		if err == nil {
+			s.notificationHub.NotifyUser(request.UserID, string(message))
+		}
+	}
+
+	return file, nil
+}
+
+// checkPassword checks the password of a file request link. Attempts are
+// counted per link, and the link is locked for a while after too many wrong ones.
+func (s *FileRequestService) checkPassword(request *models.FileRequest, password string) error {
+	if request.PasswordHash == "" {
+		return nil
+	}
+
+	allowed, err := s.requestRepo.ClaimFileRequestPasswordAttempt(request.ID, maxSharePasswordAttempts, sharePasswordLockout)
+	if err != nil {
+		return err
+	}
+
+	if !allowed {
+		return ErrFileRequestLocked
+	}
+
+	if !s.requestRepo.VerifyFileRequestPassword(request, password) {
+		return ErrInvalidFileRequestPassword
+	}
+
+	_ = s.requestRepo.ResetFailedFileRequestAttempts(request.ID)
+
+	return nil
+}
+
+// formatURL sets the complete public URL of a file request link
+func (s *FileRequestService) formatURL(request *models.FileRequest) {
+	request.URL = fmt.Sprintf("%s/request/%s", s.baseURL, request.Token)
+}
+
+// ContentTypeAllowed reports whether contentType matches one of the allowed
+// media types. Patterns like "image/*" match a whole top-level type, and an
+// empty list allows everything.
+func ContentTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range allowed {
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sizeLimitedReader fails with ErrFileTooLarge once more than remaining bytes
+// have been read, so a client cannot send more than it declared
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+// Read reads from the underlying reader
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrFileTooLarge
+	}
+
+	// Read one byte past the limit to detect oversized content
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, ErrFileTooLarge
+	}
+
+	return n, err
+}
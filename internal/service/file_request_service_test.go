@@ -0,0 +1,65 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"file-sharing-platform/internal/models"
+)
+
+func TestContentTypeAllowed(t *testing.T) {
+	tests := []struct {
+		contentType string
+		allowed     []string
+		want        bool
+	}{
+		{"application/pdf", nil, true},
+		{"application/pdf", []string{"application/pdf"}, true},
+		{"application/pdf; charset=binary", []string{"application/pdf"}, true},
+		{"image/png", []string{"image/*"}, true},
+		{"imagex/png", []string{"image/*"}, false},
+		{"text/plain", []string{"application/pdf", "image/*"}, false},
+		{"not a type", []string{"image/*"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := ContentTypeAllowed(tt.contentType, tt.allowed); got != tt.want {
+			t.Errorf("ContentTypeAllowed(%q, %v) = %v, want %v", tt.contentType, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestSizeLimitedReader(t *testing.T) {
+	data, err := io.ReadAll(&sizeLimitedReader{r: strings.NewReader("hello"), remaining: 5})
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected content within the limit to pass, got %q, %v", data, err)
+	}
+
+	_, err = io.Copy(io.Discard, &sizeLimitedReader{r: bytes.NewReader(make([]byte, 6)), remaining: 5})
+	if !errors.Is(err, ErrFileTooLarge) {
+		t.Fatalf("expected ErrFileTooLarge, got %v", err)
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	s := NewFileRequestService(nil, nil, nil, "", 100)
+
+	tests := []struct {
+		linkLimit int64
+		want      int64
+	}{
+		{0, 100},
+		{10, 10},
+		{100, 100},
+		{1000, 100},
+	}
+
+	for _, tt := range tests {
+		if got := s.UploadLimit(&models.FileRequest{MaxFileSize: tt.linkLimit}); got != tt.want {
+			t.Errorf("UploadLimit with a link limit of %d = %d, want %d", tt.linkLimit, got, tt.want)
+		}
+	}
+}
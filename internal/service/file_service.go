@@ -2,8 +2,18 @@ package service
 
 import (
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"file-sharing-platform/internal/db"
@@ -12,53 +22,226 @@ import (
 	"file-sharing-platform/pkg/storage"
 )
 
+// Share link password throttling: after maxSharePasswordAttempts wrong
+// passwords a link refuses further attempts for sharePasswordLockout, twice as
+// long every time it locks again
+const (
+	maxSharePasswordAttempts = 5
+	sharePasswordLockout     = 15 * time.Minute
+)
+
+var (
+	// ErrInvalidSharePassword is returned when a wrong share link password is submitted
+	ErrInvalidSharePassword = errors.New("invalid share link password")
+
+	// ErrShareLocked is returned when a share link is temporarily locked after
+	// too many wrong passwords
+	ErrShareLocked = errors.New("share link is temporarily locked")
+
+	// ErrShareExpired is returned when a share link has expired
+	ErrShareExpired = errors.New("share link has expired")
+
+	// ErrShareExhausted is returned when a share link has no downloads left
+	ErrShareExhausted = errors.New("share link has no downloads left")
+
+	// ErrShareNotFound is returned when a share link does not exist or does
+	// not belong to the user
+	ErrShareNotFound = errors.New("share link not found")
+
+	// ErrInvalidExpiration is returned when a share link lifetime is not a
+	// valid duration
+	ErrInvalidExpiration = errors.New("invalid expiration format")
+
+	// ErrChecksumMismatch is returned when uploaded content does not match
+	// the checksum the client expected
+	ErrChecksumMismatch = errors.New("content does not match expected checksum")
+)
+
+// defaultFilePage is the number of files listed when no limit is given.
+// Only unscoped first pages of this size are cached.
+const defaultFilePage = 20
+
+// maxNameSuffix is the highest " (n)" suffix tried when picking a free name
+// for a file uploaded through a file request link
+const maxNameSuffix = 100
+
 // FileService handles file operations
 type FileService struct {
 	fileRepo     *db.FileRepository
+	folderRepo   *db.FolderRepository
+	versionRepo  *db.FileVersionRepository
+	blobRepo     *db.BlobRepository
 	storage      storage.FileStorage
 	cache        *cache.FileCache
+	quotas       *QuotaService
 	baseShareURL string
+	dedup        bool
+	md5          bool
 }
 
-// NewFileService creates a new file service
-func NewFileService(fileRepo *db.FileRepository, storage storage.FileStorage, cache *cache.FileCache, baseShareURL string) *FileService {
+// NewFileService creates a new file service. When dedup is set, uploads
+// with identical content share a single stored blob. When md5 is set, an MD5
+// checksum is recorded for uploads next to the SHA-256 checksum. Uploads
+// are checked against the storage quotas of their owners.
+func NewFileService(fileRepo *db.FileRepository, folderRepo *db.FolderRepository, versionRepo *db.FileVersionRepository, blobRepo *db.BlobRepository, storage storage.FileStorage, cache *cache.FileCache, quotas *QuotaService, baseShareURL string, dedup, md5 bool) *FileService {
 	return &FileService{
 		fileRepo:     fileRepo,
+		folderRepo:   folderRepo,
+		versionRepo:  versionRepo,
+		blobRepo:     blobRepo,
 		storage:      storage,
 		cache:        cache,
+		quotas:       quotas,
 		baseShareURL: baseShareURL,
+		dedup:        dedup,
+		md5:          md5,
 	}
 }
 
-// UploadFile uploads a file
-func (s *FileService) UploadFile(ctx context.Context, userID int64, fileName string, fileSize int64, contentType string, fileContent io.Reader) (*models.File, error) {
-	// Upload the file to storage
-	storagePath, publicURL, err := s.storage.Upload(fileContent, fileName, contentType)
+// UploadFile uploads a file into a folder of the user, the root folder when
+// folderID is empty. The upload is rejected if its content does not match
+// the expected checksums that are set. fileSize is the size of the content
+// if known before it is read, -1 otherwise; the size of the file is that of
+// the content read.
+func (s *FileService) UploadFile(ctx context.Context, userID int64, folderID string, fileName string, fileSize int64, contentType string, fileContent io.Reader, expected models.Checksums) (*models.File, error) {
+	err := s.checkDestination(userID, folderID, fileName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload file: %w", err)
+		return nil, err
 	}
 
-	// Create file metadata in database
-	file := &models.File{
+	return s.createFile(ctx, &models.File{
 		UserID:      userID,
+		FolderID:    folderID,
 		Name:        fileName,
 		Size:        fileSize,
 		ContentType: contentType,
-		StoragePath: storagePath,
-		PublicURL:   publicURL,
-		IsPublic:    false,
+	}, fileContent, expected)
+}
+
+// UploadRequestedFile uploads a file sent through a file request link into
+// the root folder of the link's owner. The file is renamed if the name is
+// already taken.
+func (s *FileService) UploadRequestedFile(ctx context.Context, request *models.FileRequest, fileName string, fileSize int64, contentType string, fileContent io.Reader) (*models.File, error) {
+	err := validateName(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName, err = s.availableName(request.UserID, "", fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.createFile(ctx, &models.File{
+		UserID:        request.UserID,
+		Name:          fileName,
+		Size:          fileSize,
+		ContentType:   contentType,
+		FileRequestID: request.ID,
+	}, fileContent, models.Checksums{})
+}
+
+// checkDestination checks that a file called name can be added to a folder
+// of the user
+func (s *FileService) checkDestination(userID int64, folderID, name string) error {
+	err := validateName(name)
+	if err != nil {
+		return err
+	}
+
+	err = s.checkFolder(userID, folderID)
+	if err != nil {
+		return err
+	}
+
+	exists, err := s.fileRepo.FileNameExists(userID, folderID, name)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		return ErrNameTaken
 	}
 
+	return nil
+}
+
+// checkFolder checks that a folder exists and belongs to the user. The root
+// folder, an empty folderID, always does.
+func (s *FileService) checkFolder(userID int64, folderID string) error {
+	if folderID == "" {
+		return nil
+	}
+
+	_, err := s.folderRepo.GetFolderByID(folderID, userID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFolderNotFound, err)
+	}
+
+	return nil
+}
+
+// availableName returns name, or name with a " (n)" suffix before its
+// extension if the folder already holds a file called name
+func (s *FileService) availableName(userID int64, folderID, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	candidate := name
+	for i := 1; i <= maxNameSuffix; i++ {
+		exists, err := s.fileRepo.FileNameExists(userID, folderID, candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !exists {
+			return candidate, nil
+		}
+
+		candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+	}
+
+	return "", ErrNameTaken
+}
+
+// createFile stores the content of a new file and saves its metadata. The
+// upload is cut off as soon as it goes over the owner's storage quota.
+func (s *FileService) createFile(ctx context.Context, file *models.File, fileContent io.Reader, expected models.Checksums) (*models.File, error) {
+	limit, remaining, err := s.quotas.checkQuota(ctx, file.UserID, file.Size, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	// Upload the file to storage
+	reader := newQuotaReader(fileContent, remaining)
+	content, checksums, err := s.storeContent(reader, file.Name, file.ContentType, expected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", quotaError(reader, err))
+	}
+
+	file.Size = reader.read
+	file.StoragePath = content.StoragePath
+	file.PublicURL = content.PublicURL
+	file.IsPublic = false
+	file.EncryptedKey = content.EncryptedKey
+	file.EncryptionKeyID = content.EncryptionKeyID
+	file.EncryptionVersion = content.EncryptionVersion
+	file.BlobHash = content.Hash
+	file.Checksums = checksums
+
 	// Save to database
-	err = s.fileRepo.CreateFile(file)
+	err = s.fileRepo.CreateFile(file, limit)
 	if err != nil {
 		// Try to cleanup the storage if database insertion fails
-		_ = s.storage.Delete(storagePath)
-		return nil, fmt.Errorf("failed to save file metadata: %w", err)
+		s.discardContent(content)
+		if errors.Is(err, db.ErrNameTaken) {
+			return nil, ErrNameTaken
+		}
+		return nil, fmt.Errorf("failed to save file metadata: %w", quotaError(reader, err))
 	}
 
 	// Invalidate user files cache
-	_ = s.cache.InvalidateUserFiles(ctx, userID)
+	_ = s.cache.InvalidateUserFiles(ctx, file.UserID)
 
 	// Cache the new file
 	_ = s.cache.SetFile(ctx, file)
@@ -66,15 +249,24 @@ func (s *FileService) UploadFile(ctx context.Context, userID int64, fileName str
 	return file, nil
 }
 
-// GetUserFiles gets files for a user
-func (s *FileService) GetUserFiles(ctx context.Context, userID int64, limit, offset int) ([]models.File, error) {
+// GetUserFiles gets files for a user, limited to a folder or folder subtree
+// when scope is not nil
+func (s *FileService) GetUserFiles(ctx context.Context, userID int64, scope *models.FolderScope, limit, offset int) ([]models.File, error) {
 	// Try to get from cache first
 	if limit == 0 {
-		limit = 20 // Default limit
+		limit = defaultFilePage
 	}
 
-	// Only use cache for first page
-	if offset == 0 {
+	if scope != nil {
+		err := s.checkFolder(userID, scope.FolderID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Only use cache for the default first page of all files
+	cacheable := scope == nil && offset == 0 && limit == defaultFilePage
+	if cacheable {
 		files, found := s.cache.GetUserFiles(ctx, userID)
 		if found {
 			return files, nil
@@ -82,13 +274,13 @@ func (s *FileService) GetUserFiles(ctx context.Context, userID int64, limit, off
 	}
 
 	// Get from database if not in cache
-	files, err := s.fileRepo.GetFilesByUserID(userID, limit, offset)
+	files, err := s.fileRepo.GetFilesByUserID(userID, scope, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get user files: %w", err)
 	}
 
 	// Cache the files for first page
-	if offset == 0 {
+	if cacheable {
 		_ = s.cache.SetUserFiles(ctx, userID, files)
 	}
 
@@ -115,6 +307,305 @@ func (s *FileService) GetFile(ctx context.Context, fileID string) (*models.File,
 	return file, nil
 }
 
+// OpenFile opens a file owned by the user for reading. It returns
+// ErrFileNotFound if the file does not exist or belongs to another user.
+func (s *FileService) OpenFile(ctx context.Context, fileID string, userID int64) (*models.File, io.ReadSeekCloser, error) {
+	file, err := s.GetFile(ctx, fileID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, ErrFileNotFound
+		}
+		return nil, nil, fmt.Errorf("failed to get file: %w", err)
+	}
+
+	// Check ownership
+	if file.UserID != userID {
+		return nil, nil, ErrFileNotFound
+	}
+
+	reader, err := s.openContent(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return file, reader, nil
+}
+
+// OpenSharedFile opens a file by share URL for reading. When countDownload
+// is set the download counts against the link's download limit.
+func (s *FileService) OpenSharedFile(ctx context.Context, shareID string, countDownload bool) (*models.File, io.ReadSeekCloser, error) {
+	sharedFile, err := s.GetShareLink(ctx, shareID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := s.GetFile(ctx, sharedFile.FileID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get shared file: %w", err)
+	}
+
+	reader, err := s.openContent(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	if countDownload {
+		granted, err := s.fileRepo.ConsumeShareDownload(sharedFile.ID)
+		if err != nil {
+			reader.Close()
+			return nil, nil, err
+		}
+		if !granted {
+			reader.Close()
+			return nil, nil, ErrShareExhausted
+		}
+
+		// The owner's share listing shows download counts
+		_ = s.cache.InvalidateUserShares(ctx, file.UserID)
+	}
+
+	return file, reader, nil
+}
+
+// storeContent uploads file content, encrypting it when the storage supports
+// per-file keys, and returns where it is stored along with the checksums of
+// the content. The SHA-256 checksum is always computed, the MD5 checksum
+// when enabled or expected. If the content does not match the expected
+// checksums it is deleted again and ErrChecksumMismatch is returned.
+//
+// With deduplication the content is stored as a blob, see storeBlob. The
+// returned Hash is only set for deduplicated content, which must be given up
+// with discardContent or by deleting the rows referring to it.
+func (s *FileService) storeContent(content io.Reader, fileName, contentType string, expected models.Checksums) (*models.Blob, models.Checksums, error) {
+	if s.dedup {
+		return s.storeBlob(content, contentType, expected)
+	}
+
+	content, sum := s.hashContent(content, expected)
+
+	blob := &models.Blob{}
+	var checksums models.Checksums
+
+	var err error
+	if keyed, ok := s.storage.(storage.KeyedStorage); ok {
+		var fileKey *storage.FileKey
+		blob.StoragePath, blob.PublicURL, fileKey, err = keyed.UploadWithKey(content, fileName, contentType)
+		setBlobKey(blob, fileKey)
+	} else {
+		blob.StoragePath, blob.PublicURL, err = s.storage.Upload(content, fileName, contentType)
+	}
+	if err != nil {
+		return nil, checksums, err
+	}
+
+	checksums = sum()
+
+	if !checksumsMatch(expected, checksums) {
+		_ = s.storage.Delete(blob.StoragePath)
+		return nil, checksums, ErrChecksumMismatch
+	}
+
+	return blob, checksums, nil
+}
+
+// storeBlob stores deduplicated content as a blob at a path derived from
+// its SHA-256 hash. The content is spooled to a temporary file while it is
+// hashed, so content that is already stored, or does not match the
+// expected checksums, is never uploaded.
+func (s *FileService) storeBlob(content io.Reader, contentType string, expected models.Checksums) (*models.Blob, models.Checksums, error) {
+	var checksums models.Checksums
+
+	spool, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return nil, checksums, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	content, sum := s.hashContent(content, expected)
+
+	_, err = io.Copy(spool, content)
+	if err != nil {
+		return nil, checksums, err
+	}
+
+	checksums = sum()
+
+	if !checksumsMatch(expected, checksums) {
+		return nil, checksums, ErrChecksumMismatch
+	}
+
+	blob := &models.Blob{Hash: checksums.SHA256}
+	_, err = s.blobRepo.AcquireBlob(blob, func(blob *models.Blob) error {
+		_, err := spool.Seek(0, io.SeekStart)
+		if err != nil {
+			return fmt.Errorf("failed to read spool file: %w", err)
+		}
+
+		return s.uploadBlob(blob, spool, contentType)
+	})
+	if err != nil {
+		return nil, checksums, err
+	}
+
+	return blob, checksums, nil
+}
+
+// uploadBlob uploads the content of a new blob to the path of its hash,
+// encrypting it when the storage supports per-file keys
+func (s *FileService) uploadBlob(blob *models.Blob, content io.Reader, contentType string) error {
+	blob.StoragePath = blobPath(blob.Hash)
+
+	var err error
+	switch store := s.storage.(type) {
+	case storage.KeyedStorage:
+		var fileKey *storage.FileKey
+		blob.PublicURL, fileKey, err = store.UploadWithKeyTo(blob.StoragePath, content, contentType)
+		setBlobKey(blob, fileKey)
+	case storage.PathStorage:
+		blob.PublicURL, err = store.UploadTo(blob.StoragePath, content, contentType)
+	default:
+		err = storage.ErrPathUploadNotSupported
+	}
+
+	return err
+}
+
+// blobPath returns the storage path of the blob with a SHA-256 hash, spread
+// over directories by the first two characters of the hash
+func blobPath(hash string) string {
+	return fmt.Sprintf("blobs/%s/%s", hash[:2], hash)
+}
+
+// setBlobKey records the data key content was encrypted with, if any
+func setBlobKey(blob *models.Blob, fileKey *storage.FileKey) {
+	if fileKey != nil {
+		blob.EncryptedKey = fileKey.WrappedKey
+		blob.EncryptionKeyID = fileKey.KeyID
+		blob.EncryptionVersion = fileKey.Version
+	}
+}
+
+// hashContent returns a reader passing content through while computing its
+// checksums, and a function returning the checksums once it has been read
+func (s *FileService) hashContent(content io.Reader, expected models.Checksums) (io.Reader, func() models.Checksums) {
+	sha256Hash := sha256.New()
+	hashers := []io.Writer{sha256Hash}
+
+	var md5Hash hash.Hash
+	if s.md5 || expected.MD5 != "" {
+		md5Hash = md5.New()
+		hashers = append(hashers, md5Hash)
+	}
+
+	sum := func() models.Checksums {
+		checksums := models.Checksums{SHA256: hex.EncodeToString(sha256Hash.Sum(nil))}
+		if md5Hash != nil {
+			checksums.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+		}
+		return checksums
+	}
+
+	return io.TeeReader(content, io.MultiWriter(hashers...)), sum
+}
+
+// checksumsMatch reports whether actual matches the expected checksums.
+// Checksums that are not expected are not compared.
+func checksumsMatch(expected, actual models.Checksums) bool {
+	if expected.SHA256 != "" && !strings.EqualFold(expected.SHA256, actual.SHA256) {
+		return false
+	}
+
+	if expected.MD5 != "" && !strings.EqualFold(expected.MD5, actual.MD5) {
+		return false
+	}
+
+	return true
+}
+
+// discardContent gives up content stored by storeContent that ended up not
+// being used. Deduplicated content is only deleted if nothing else refers
+// to its blob.
+func (s *FileService) discardContent(content *models.Blob) {
+	if content.Hash == "" {
+		_ = s.storage.Delete(content.StoragePath)
+		return
+	}
+
+	released, err := s.blobRepo.ReleaseBlob(content.Hash)
+	if err == nil && released != nil {
+		s.deleteBlobs([]models.Blob{*released})
+	}
+}
+
+// deleteBlobs deletes the content of blobs that lost their last reference,
+// unless the same content was stored again since. The blobs are already
+// gone from the database, so content that cannot be deleted is left behind
+// in storage.
+func (s *FileService) deleteBlobs(blobs []models.Blob) {
+	for i := range blobs {
+		_ = s.blobRepo.DeleteBlobContent(&blobs[i], s.deleteObject)
+	}
+}
+
+// openContent opens the content of a file, decrypting it if it was stored
+// encrypted
+func (s *FileService) openContent(file *models.File) (io.ReadSeekCloser, error) {
+	keyed, ok := s.storage.(storage.KeyedStorage)
+	if !ok {
+		return s.storage.Open(file.StoragePath)
+	}
+
+	// Key material is not cached, so read it from the database
+	stored, err := s.fileRepo.GetFileByID(file.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Files uploaded before encryption was enabled are stored as-is
+	if stored.EncryptionVersion == 0 {
+		return s.storage.Open(stored.StoragePath)
+	}
+
+	return keyed.OpenWithKey(stored.StoragePath, &storage.FileKey{
+		WrappedKey: stored.EncryptedKey,
+		KeyID:      stored.EncryptionKeyID,
+		Version:    stored.EncryptionVersion,
+	})
+}
+
+// openVersionContent opens the content of a previous file version,
+// decrypting it if it was stored encrypted
+func (s *FileService) openVersionContent(version *models.FileVersion) (io.ReadSeekCloser, error) {
+	return s.openStoredContent(version.StoragePath, version.EncryptedKey, version.EncryptionKeyID, version.EncryptionVersion)
+}
+
+// openStoredContent opens the object at storagePath, decrypting it with the
+// given key material if it was stored encrypted
+func (s *FileService) openStoredContent(storagePath string, encryptedKey []byte, keyID string, encryptionVersion int) (io.ReadSeekCloser, error) {
+	keyed, ok := s.storage.(storage.KeyedStorage)
+	if !ok || encryptionVersion == 0 {
+		return s.storage.Open(storagePath)
+	}
+
+	return keyed.OpenWithKey(storagePath, &storage.FileKey{
+		WrappedKey: encryptedKey,
+		KeyID:      keyID,
+		Version:    encryptionVersion,
+	})
+}
+
+// deleteObject deletes an object from storage. Objects that are already
+// gone count as deleted, so an interrupted cleanup can be run again.
+func (s *FileService) deleteObject(storagePath string) error {
+	err := s.storage.Delete(storagePath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
 // UpdateFile updates a file
 func (s *FileService) UpdateFile(ctx context.Context, fileID string, userID int64, updates map[string]interface{}) (*models.File, error) {
 	// Get the file
@@ -130,6 +621,10 @@ func (s *FileService) UpdateFile(ctx context.Context, fileID string, userID int6
 
 	// Apply updates
 	if name, ok := updates["name"].(string); ok {
+		err = validateName(name)
+		if err != nil {
+			return nil, err
+		}
 		file.Name = name
 	}
 
@@ -147,6 +642,9 @@ func (s *FileService) UpdateFile(ctx context.Context, fileID string, userID int6
 	// Update in database
 	err = s.fileRepo.UpdateFile(file)
 	if err != nil {
+		if errors.Is(err, db.ErrNameTaken) {
+			return nil, ErrNameTaken
+		}
 		return nil, fmt.Errorf("failed to update file: %w", err)
 	}
 
@@ -157,40 +655,164 @@ func (s *FileService) UpdateFile(ctx context.Context, fileID string, userID int6
 	return file, nil
 }
 
-// DeleteFile deletes a file
-func (s *FileService) DeleteFile(ctx context.Context, fileID string, userID int64) error {
-	// Get the file first
-	file, err := s.fileRepo.GetFileByID(fileID)
+// TrashFile moves a file of the user to the trash. The file keeps its
+// content and share links until it is purged, but is hidden everywhere else.
+func (s *FileService) TrashFile(ctx context.Context, fileID string, userID int64) error {
+	err := s.fileRepo.TrashFile(fileID, userID, time.Now())
 	if err != nil {
-		return fmt.Errorf("failed to get file: %w", err)
+		return fmt.Errorf("%w: %v", ErrFileNotFound, err)
 	}
 
-	// Check ownership
-	if file.UserID != userID {
-		return fmt.Errorf("not authorized to delete this file")
+	// Invalidate caches, share links stop working while the file is trashed
+	_ = s.cache.InvalidateFile(ctx, fileID)
+	_ = s.cache.InvalidateUserFiles(ctx, userID)
+	_ = s.cache.InvalidateUserShares(ctx, userID)
+
+	return nil
+}
+
+// ListTrash gets a page of the files of the user that are in the trash
+func (s *FileService) ListTrash(ctx context.Context, userID int64, limit, offset int) ([]models.File, error) {
+	if limit <= 0 {
+		limit = defaultFilePage
+	}
+
+	files, err := s.fileRepo.GetTrashedFiles(userID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get trashed files: %w", err)
 	}
 
-	// Delete from storage
-	err = s.storage.Delete(file.StoragePath)
+	return files, nil
+}
+
+// RestoreFile takes a file of the user out of the trash, back into the
+// folder it was deleted from, or the root folder if that folder is gone. If
+// the folder meanwhile holds another file with the same name, the restored
+// file gets a " (n)" suffix.
+func (s *FileService) RestoreFile(ctx context.Context, fileID string, userID int64) (*models.File, error) {
+	file, err := s.fileRepo.GetTrashedFile(fileID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFileNotFound, err)
+	}
+
+	name, err := s.availableName(userID, file.FolderID, file.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.fileRepo.RestoreFile(fileID, userID, name)
+	if err != nil {
+		if errors.Is(err, db.ErrNameTaken) {
+			return nil, ErrNameTaken
+		}
+		return nil, fmt.Errorf("failed to restore file: %w", err)
+	}
+
+	file.Name = name
+	file.DeletedAt = nil
+
+	// Invalidate caches
+	_ = s.cache.InvalidateUserFiles(ctx, userID)
+	_ = s.cache.InvalidateUserShares(ctx, userID)
+
+	return file, nil
+}
+
+// PurgeTrash permanently deletes up to batchSize files that were moved to
+// the trash more than retention ago
+func (s *FileService) PurgeTrash(ctx context.Context, retention time.Duration, batchSize int) (int, error) {
+	deletedBefore := time.Now().Add(-retention)
+	files, err := s.fileRepo.GetFilesToPurge(deletedBefore, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get files to purge: %w", err)
+	}
+
+	purged := 0
+
+	for i := range files {
+		deleted, err := s.purgeFile(ctx, &files[i], func(id string, userID int64) (bool, []string, []models.Blob, error) {
+			return s.fileRepo.DeleteFile(id, userID, deletedBefore)
+		})
+		if err != nil {
+			// Keep the file so it is retried on the next run
+			continue
+		}
+		if deleted {
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+// purgeFile permanently deletes a file with its previous versions and share
+// links through deleteRow, which deletes the row if the file still
+// qualifies, and reports whether it did
+func (s *FileService) purgeFile(ctx context.Context, file *models.File, deleteRow func(id string, userID int64) (bool, []string, []models.Blob, error)) (bool, error) {
+	// The content is only deleted once the file is gone, as a concurrent
+	// restore may have taken it out of the trash
+	deleted, storagePaths, released, err := deleteRow(file.ID, file.UserID)
 	if err != nil {
-		return fmt.Errorf("failed to delete file from storage: %w", err)
+		return false, fmt.Errorf("failed to delete file metadata: %w", err)
+	}
+	if !deleted {
+		return false, nil
+	}
+
+	// Content that fails to delete is left for the storage scrub as an orphan
+	for _, storagePath := range storagePaths {
+		_ = s.deleteObject(storagePath)
 	}
 
-	// Delete from database
-	err = s.fileRepo.DeleteFile(fileID, userID)
+	s.deleteBlobs(released)
+
+	// Invalidate caches, share links are deleted along with the file
+	_ = s.cache.InvalidateFile(ctx, file.ID)
+	_ = s.cache.InvalidateUserFiles(ctx, file.UserID)
+	_ = s.cache.InvalidateUserShares(ctx, file.UserID)
+
+	return true, nil
+}
+
+// MoveFile moves a file to another folder of the user, the root folder when
+// folderID is empty
+func (s *FileService) MoveFile(ctx context.Context, fileID string, userID int64, folderID string) (*models.File, error) {
+	file, err := s.fileRepo.GetFileByID(fileID)
+	if err != nil || file.UserID != userID {
+		return nil, ErrFileNotFound
+	}
+
+	err = s.checkFolder(userID, folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.fileRepo.MoveFile(fileID, userID, folderID)
 	if err != nil {
-		return fmt.Errorf("failed to delete file metadata: %w", err)
+		if errors.Is(err, db.ErrNameTaken) {
+			return nil, ErrNameTaken
+		}
+		return nil, fmt.Errorf("failed to move file: %w", err)
 	}
 
+	file.FolderID = folderID
+
 	// Invalidate caches
 	_ = s.cache.InvalidateFile(ctx, fileID)
 	_ = s.cache.InvalidateUserFiles(ctx, userID)
 
-	return nil
+	return file, nil
 }
 
 // SearchFiles searches for files
 func (s *FileService) SearchFiles(ctx context.Context, userID int64, search *models.SearchFilesRequest) ([]models.File, error) {
+	if search.FolderID != "" {
+		err := s.checkFolder(userID, search.FolderID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Search is always from DB as it's dynamic
 	files, err := s.fileRepo.SearchFiles(userID, search)
 	if err != nil {
@@ -201,7 +823,7 @@ func (s *FileService) SearchFiles(ctx context.Context, userID int64, search *mod
 }
 
 // ShareFile creates a share link for a file
-func (s *FileService) ShareFile(ctx context.Context, fileID string, userID int64, expiresIn string) (*models.SharedFile, error) {
+func (s *FileService) ShareFile(ctx context.Context, fileID string, userID int64, req *models.ShareFileRequest) (*models.SharedFile, error) {
 	// Get the file
 	file, err := s.GetFile(ctx, fileID)
 	if err != nil {
@@ -215,8 +837,8 @@ func (s *FileService) ShareFile(ctx context.Context, fileID string, userID int64
 
 	// Parse expiration duration
 	var expiresAt time.Time
-	if expiresIn != "" {
-		duration, err := time.ParseDuration(expiresIn)
+	if req.ExpiresIn != "" {
+		duration, err := time.ParseDuration(req.ExpiresIn)
 		if err != nil {
 			return nil, fmt.Errorf("invalid expiration format: %w", err)
 		}
@@ -224,19 +846,154 @@ func (s *FileService) ShareFile(ctx context.Context, fileID string, userID int64
 	}
 
 	// Create share link
-	sharedFile, err := s.fileRepo.CreateShareLink(fileID, expiresAt)
+	sharedFile, err := s.fileRepo.CreateShareLink(fileID, expiresAt, req.Password, req.MaxDownloads, req.BurnAfterReading)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create share link: %w", err)
 	}
 
-	// Format the complete share URL
-	sharedFile.ShareURL = fmt.Sprintf("%s/shared/%s", s.baseShareURL, sharedFile.ShareURL)
+	_ = s.cache.InvalidateUserShares(ctx, userID)
+
+	s.formatShareURL(sharedFile)
+
+	return sharedFile, nil
+}
+
+// ListShares gets the share links of all of a user's files
+func (s *FileService) ListShares(ctx context.Context, userID int64) ([]models.SharedFile, error) {
+	// Try to get from cache first
+	shares, found := s.cache.GetUserShares(ctx, userID)
+	if found {
+		return shares, nil
+	}
+
+	shares, err := s.fileRepo.GetSharesByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share links: %w", err)
+	}
+
+	for i := range shares {
+		s.formatShareURL(&shares[i])
+	}
+
+	_ = s.cache.SetUserShares(ctx, userID, shares)
+
+	return shares, nil
+}
+
+// ListFileShares gets the share links of a file
+func (s *FileService) ListFileShares(ctx context.Context, fileID string, userID int64) ([]models.SharedFile, error) {
+	file, err := s.GetFile(ctx, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+
+	// Check ownership
+	if file.UserID != userID {
+		return nil, fmt.Errorf("not authorized to view shares of this file")
+	}
+
+	shares, err := s.fileRepo.GetSharesByFileID(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get share links: %w", err)
+	}
+
+	for i := range shares {
+		s.formatShareURL(&shares[i])
+	}
+
+	return shares, nil
+}
+
+// UpdateShare applies the changes set in req to a share link of one of the
+// user's files. Burn after reading links allow a single download; turning
+// burn after reading off without a new max_downloads makes the link
+// unlimited again.
+func (s *FileService) UpdateShare(ctx context.Context, shareID string, userID int64, req *models.UpdateShareRequest) (*models.SharedFile, error) {
+	sharedFile, err := s.getOwnShare(shareID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply updates
+	if req.ExpiresIn != nil {
+		sharedFile.ExpiresAt = time.Time{}
+		if *req.ExpiresIn != "" {
+			duration, err := time.ParseDuration(*req.ExpiresIn)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidExpiration, err)
+			}
+			sharedFile.ExpiresAt = time.Now().Add(duration)
+		}
+	}
+
+	if req.MaxDownloads != nil {
+		sharedFile.MaxDownloads = *req.MaxDownloads
+	}
+
+	if req.BurnAfterReading != nil {
+		// Lift the single download limit burn after reading set
+		if sharedFile.BurnAfterReading && !*req.BurnAfterReading && req.MaxDownloads == nil {
+			sharedFile.MaxDownloads = 0
+		}
+		sharedFile.BurnAfterReading = *req.BurnAfterReading
+	}
+
+	// Burn after reading links are single use
+	if sharedFile.BurnAfterReading {
+		sharedFile.MaxDownloads = 1
+	}
+
+	err = s.fileRepo.UpdateShareLink(sharedFile, req.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update share link: %w", err)
+	}
+
+	_ = s.cache.InvalidateUserShares(ctx, userID)
+
+	s.formatShareURL(sharedFile)
+
+	return sharedFile, nil
+}
+
+// getOwnShare gets a share link of one of the user's files, returning
+// ErrShareNotFound if there is none
+func (s *FileService) getOwnShare(shareID string, userID int64) (*models.SharedFile, error) {
+	sharedFile, err := s.fileRepo.GetShareByID(shareID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
 
 	return sharedFile, nil
 }
 
-// GetSharedFile gets a file by share URL
-func (s *FileService) GetSharedFile(ctx context.Context, shareID string) (*models.File, error) {
+// RevokeShare deletes a share link so it can no longer be used
+func (s *FileService) RevokeShare(ctx context.Context, shareID string, userID int64) error {
+	_, err := s.getOwnShare(shareID, userID)
+	if err != nil {
+		return err
+	}
+
+	err = s.fileRepo.DeleteShareLink(shareID, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke share link: %w", err)
+	}
+
+	_ = s.cache.InvalidateUserShares(ctx, userID)
+
+	return nil
+}
+
+// formatShareURL turns the token of a share link into its complete URL
+func (s *FileService) formatShareURL(sharedFile *models.SharedFile) {
+	sharedFile.ShareURL = fmt.Sprintf("%s/share/%s", s.baseShareURL, sharedFile.ShareURL)
+}
+
+// GetShareLink gets a share link by share URL, checking that it has neither
+// expired nor run out of downloads
+func (s *FileService) GetShareLink(ctx context.Context, shareID string) (*models.SharedFile, error) {
 	// Get the shared file record
 	sharedFile, err := s.fileRepo.GetSharedFile(shareID)
 	if err != nil {
@@ -245,16 +1002,62 @@ func (s *FileService) GetSharedFile(ctx context.Context, shareID string) (*model
 
 	// Check if expired
 	if !sharedFile.ExpiresAt.IsZero() && time.Now().After(sharedFile.ExpiresAt) {
-		return nil, fmt.Errorf("share link has expired")
+		return nil, ErrShareExpired
+	}
+
+	// Check if the download limit is used up
+	if sharedFile.RemainingDownloads != nil && *sharedFile.RemainingDownloads == 0 {
+		return nil, ErrShareExhausted
+	}
+
+	return sharedFile, nil
+}
+
+// UnlockShareLink checks the password of a share link. Attempts are counted
+// per link, and the link is locked for a while after too many wrong ones.
+func (s *FileService) UnlockShareLink(ctx context.Context, shareID string, password string) (*models.SharedFile, error) {
+	sharedFile, err := s.GetShareLink(ctx, shareID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sharedFile.PasswordHash == "" {
+		return sharedFile, nil
+	}
+
+	allowed, err := s.fileRepo.ClaimSharePasswordAttempt(sharedFile.ID, maxSharePasswordAttempts, sharePasswordLockout)
+	if err != nil {
+		return nil, err
+	}
+
+	if !allowed {
+		return nil, ErrShareLocked
+	}
+
+	if !s.fileRepo.VerifySharePassword(sharedFile, password) {
+		return nil, ErrInvalidSharePassword
+	}
+
+	_ = s.fileRepo.ResetFailedShareAttempts(sharedFile.ID)
+
+	return sharedFile, nil
+}
+
+// GetSharedFile gets a file by share URL along with the number of downloads
+// the link has left, which is nil for links without a download limit
+func (s *FileService) GetSharedFile(ctx context.Context, shareID string) (*models.File, *int, error) {
+	sharedFile, err := s.GetShareLink(ctx, shareID)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Get the file
 	file, err := s.GetFile(ctx, sharedFile.FileID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get shared file: %w", err)
+		return nil, nil, fmt.Errorf("failed to get shared file: %w", err)
 	}
 
-	return file, nil
+	return file, sharedFile.RemainingDownloads, nil
 }
 
 // CleanupExpiredFiles deletes expired files
@@ -267,30 +1070,206 @@ func (s *FileService) CleanupExpiredFiles(ctx context.Context, batchSize int) (i
 
 	deletedCount := 0
 
-	// Delete each file from storage
-	for _, file := range files {
-		err := s.storage.Delete(file.StoragePath)
+	for i := range files {
+		deleted, err := s.purgeFile(ctx, &files[i], s.fileRepo.DeleteExpiredFile)
 		if err != nil {
 			// Log the error but continue with others
 			continue
 		}
+		if deleted {
+			deletedCount++
+		}
+	}
+
+	return deletedCount, nil
+}
+
+// BackfillBlobs moves the content of files and file versions stored while
+// deduplication was disabled into blobs, walking the rows with a SHA-256
+// checksum in ID order in batches of batchSize. Content that duplicates an
+// existing blob is deleted; the first copy of any content becomes the blob,
+// where it is already stored. It returns the number of rows moved.
+func (s *FileService) BackfillBlobs(ctx context.Context, batchSize int) (int, error) {
+	moved := 0
+
+	for _, table := range []string{"files", "file_versions"} {
+		afterID := ""
+		for {
+			if ctx.Err() != nil {
+				return moved, ctx.Err()
+			}
 
-		// Invalidate cache
-		_ = s.cache.InvalidateFile(ctx, file.ID)
-		_ = s.cache.InvalidateUserFiles(ctx, file.UserID)
+			ids, err := s.blobRepo.GetContentWithoutBlob(table, afterID, batchSize)
+			if err != nil {
+				return moved, err
+			}
+			if len(ids) == 0 {
+				break
+			}
 
-		deletedCount++
+			for _, id := range ids {
+				afterID = id
+
+				duplicate, err := s.blobRepo.MoveToBlob(table, id)
+				if err != nil {
+					return moved, err
+				}
+
+				if duplicate != "" {
+					_ = s.deleteObject(duplicate)
+				}
+				if table == "files" {
+					_ = s.cache.InvalidateFile(ctx, id)
+				}
+
+				moved++
+			}
+		}
 	}
 
-	// Delete from database
-	if len(files) > 0 {
-		count, err := s.fileRepo.DeleteExpiredFiles(batchSize)
+	return moved, nil
+}
+
+// RewrapFileKeys re-wraps the data keys of files and previous file versions
+// that are not yet wrapped under the current master key. Only key material
+// in the database changes; file contents are left as they are.
+//
+// Rows are walked in key order in batches of batchSize. A key that cannot be
+// re-wrapped is skipped, so it does not hold up the others, and is retried on
+// the next run; the first such error is returned with the number of keys
+// that failed once the walk is done.
+func (s *FileService) RewrapFileKeys(ctx context.Context, batchSize int) (int, error) {
+	keyed, ok := s.storage.(storage.KeyedStorage)
+	if !ok {
+		return 0, nil
+	}
+
+	currentKeyID, err := keyed.CurrentKeyID()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get current key ID: %w", err)
+	}
+
+	rewrapped := 0
+	failed := 0
+	var firstErr error
+
+	// skip records a key that could not be re-wrapped
+	skip := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+		failed++
+	}
+
+	afterID := ""
+	for ctx.Err() == nil {
+		files, err := s.fileRepo.GetFilesToRewrap(currentKeyID, afterID, batchSize)
 		if err != nil {
-			return deletedCount, fmt.Errorf("failed to delete expired files from database: %w", err)
+			return rewrapped, err
+		}
+
+		for _, file := range files {
+			newKey, err := keyed.RewrapKey(&storage.FileKey{
+				WrappedKey: file.EncryptedKey,
+				KeyID:      file.EncryptionKeyID,
+				Version:    file.EncryptionVersion,
+			})
+			if err != nil {
+				skip(fmt.Errorf("failed to rewrap key of file %s: %w", file.ID, err))
+				continue
+			}
+
+			// A file re-wrapped or replaced in the meantime is left alone
+			updated, err := s.fileRepo.UpdateFileKey(file.ID, file.EncryptionKeyID, newKey.WrappedKey, newKey.KeyID)
+			if err != nil {
+				return rewrapped, err
+			}
+			if updated {
+				rewrapped++
+			}
 		}
 
-		return count, nil
+		if len(files) < batchSize {
+			break
+		}
+		afterID = files[len(files)-1].ID
 	}
 
-	return deletedCount, nil
+	// Previous versions have data keys of their own
+	afterID = ""
+	for ctx.Err() == nil {
+		versions, err := s.versionRepo.GetVersionsToRewrap(currentKeyID, afterID, batchSize)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		for _, version := range versions {
+			newKey, err := keyed.RewrapKey(&storage.FileKey{
+				WrappedKey: version.EncryptedKey,
+				KeyID:      version.EncryptionKeyID,
+				Version:    version.EncryptionVersion,
+			})
+			if err != nil {
+				skip(fmt.Errorf("failed to rewrap key of version %d of file %s: %w", version.Version, version.FileID, err))
+				continue
+			}
+
+			updated, err := s.versionRepo.UpdateVersionKey(version.ID, version.EncryptionKeyID, newKey.WrappedKey, newKey.KeyID)
+			if err != nil {
+				return rewrapped, err
+			}
+			if updated {
+				rewrapped++
+			}
+		}
+
+		if len(versions) < batchSize {
+			break
+		}
+		afterID = versions[len(versions)-1].ID
+	}
+
+	// Blobs keep the data key handed to new files with the same content
+	afterHash := ""
+	for ctx.Err() == nil {
+		blobs, err := s.blobRepo.GetBlobsToRewrap(currentKeyID, afterHash, batchSize)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		for _, blob := range blobs {
+			newKey, err := keyed.RewrapKey(&storage.FileKey{
+				WrappedKey: blob.EncryptedKey,
+				KeyID:      blob.EncryptionKeyID,
+				Version:    blob.EncryptionVersion,
+			})
+			if err != nil {
+				skip(fmt.Errorf("failed to rewrap key of blob %s: %w", blob.Hash, err))
+				continue
+			}
+
+			updated, err := s.blobRepo.UpdateBlobKey(blob.Hash, blob.EncryptionKeyID, newKey.WrappedKey, newKey.KeyID)
+			if err != nil {
+				return rewrapped, err
+			}
+			if updated {
+				rewrapped++
+			}
+		}
+
+		if len(blobs) < batchSize {
+			break
+		}
+		afterHash = blobs[len(blobs)-1].Hash
+	}
+
+	if ctx.Err() != nil {
+		return rewrapped, ctx.Err()
+	}
+
+	if failed > 0 {
+		return rewrapped, fmt.Errorf("%d keys could not be re-wrapped: %w", failed, firstErr)
+	}
+
+	return rewrapped, nil
 }
@@ -0,0 +1,378 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/cache"
+	"file-sharing-platform/pkg/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestChecksumsMatch(t *testing.T) {
+	actual := models.Checksums{
+		SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		MD5:    "d41d8cd98f00b204e9800998ecf8427e",
+	}
+
+	tests := []struct {
+		name     string
+		expected models.Checksums
+		want     bool
+	}{
+		{"nothing expected", models.Checksums{}, true},
+		{"sha256 matches", models.Checksums{SHA256: actual.SHA256}, true},
+		{"sha256 matches in upper case", models.Checksums{SHA256: "E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855"}, true},
+		{"both match", actual, true},
+		{"sha256 differs", models.Checksums{SHA256: "0000000000000000000000000000000000000000000000000000000000000000"}, false},
+		{"md5 differs", models.Checksums{SHA256: actual.SHA256, MD5: "00000000000000000000000000000000"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := checksumsMatch(tt.expected, actual); got != tt.want {
+			t.Errorf("%s: checksumsMatch() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// rewrapStorage re-wraps keys under the key "new", failing for keys wrapped
+// as "broken"
+type rewrapStorage struct {
+	storage.FileStorage
+}
+
+func (s *rewrapStorage) UploadWithKey(fileContent io.Reader, fileName, contentType string) (string, string, *storage.FileKey, error) {
+	return "", "", nil, errors.New("not supported")
+}
+
+func (s *rewrapStorage) UploadWithKeyTo(storagePath string, fileContent io.Reader, contentType string) (string, *storage.FileKey, error) {
+	return "", nil, errors.New("not supported")
+}
+
+func (s *rewrapStorage) OpenWithKey(storagePath string, key *storage.FileKey) (io.ReadSeekCloser, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *rewrapStorage) CurrentKeyID() (string, error) {
+	return "new", nil
+}
+
+func (s *rewrapStorage) RewrapKey(key *storage.FileKey) (*storage.FileKey, error) {
+	if string(key.WrappedKey) == "broken" {
+		return nil, errors.New("unwrap failed")
+	}
+
+	return &storage.FileKey{WrappedKey: []byte("rewrapped"), KeyID: "new", Version: key.Version}, nil
+}
+
+func TestRewrapFileKeysSkipsFailedKeys(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileCache := cache.NewFileCache(cache.NewMemoryCache(), time.Hour)
+	fileService := NewFileService(db.NewFileRepository(database), nil, db.NewFileVersionRepository(database), db.NewBlobRepository(database), &rewrapStorage{}, fileCache, nil, "http://localhost", false, false)
+
+	fileColumns := []string{"id", "user_id", "encrypted_key", "encryption_key_id", "encryption_version"}
+	mock.ExpectQuery("FROM files").WithArgs("new", "", 2).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow("file-1", 1, []byte("broken"), "old", 1).
+			AddRow("file-2", 1, []byte("wrapped"), "old", 1))
+	mock.ExpectExec("UPDATE files").WithArgs([]byte("rewrapped"), "new", "file-2", "old").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// The walk goes on after the file that failed instead of fetching it again
+	mock.ExpectQuery("FROM files").WithArgs("new", "file-2", 2).
+		WillReturnRows(sqlmock.NewRows(fileColumns).
+			AddRow("file-3", 1, []byte("wrapped"), "old", 1))
+	// A file re-wrapped in the meantime is not counted
+	mock.ExpectExec("UPDATE files").WithArgs([]byte("rewrapped"), "new", "file-3", "old").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	mock.ExpectQuery("FROM file_versions").WithArgs("new", "", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectQuery("FROM blobs").WithArgs("new", "", 2).
+		WillReturnRows(sqlmock.NewRows([]string{"hash"}))
+
+	count, err := fileService.RewrapFileKeys(context.Background(), 2)
+	if count != 1 {
+		t.Errorf("expected 1 key re-wrapped, got %d", count)
+	}
+	if err == nil || !strings.Contains(err.Error(), "file-1") {
+		t.Errorf("expected the failed key to be reported, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestStoreContentDeduplicatesWithoutWriting(t *testing.T) {
+	database, mock := newMockDatabase(t)
+
+	dir := t.TempDir()
+	store, err := storage.NewLocalStorage(dir, "http://localhost")
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	fileCache := cache.NewFileCache(cache.NewMemoryCache(), time.Hour)
+	fileService := NewFileService(db.NewFileRepository(database), nil, nil, db.NewBlobRepository(database), store, fileCache, nil, "http://localhost", true, false)
+
+	const hash = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	blobColumns := []string{"hash", "storage_path", "public_url", "ref_count", "created_at", "encrypted_key", "encryption_key_id", "encryption_version"}
+
+	// The first upload stores the content under its hash
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs(hash).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("UPDATE blobs").WithArgs(hash).WillReturnRows(sqlmock.NewRows(blobColumns))
+	mock.ExpectExec("INSERT INTO blobs").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	blob, _, err := fileService.storeContent(strings.NewReader("hello"), "file.txt", "text/plain", models.Checksums{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if blob.StoragePath != "blobs/2c/"+hash || !exists(store, blob.StoragePath) {
+		t.Fatalf("expected the content to be stored under its hash, got %+v", blob)
+	}
+
+	// A duplicate is never written to storage
+	before := countFiles(t, dir)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs(hash).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("UPDATE blobs").WithArgs(hash).
+		WillReturnRows(sqlmock.NewRows(blobColumns).AddRow(hash, blob.StoragePath, blob.PublicURL, 2, time.Now(), nil, "", 0))
+	mock.ExpectCommit()
+
+	duplicate, checksums, err := fileService.storeContent(strings.NewReader("hello"), "copy.txt", "text/plain", models.Checksums{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if duplicate.StoragePath != blob.StoragePath || duplicate.Hash != hash || checksums.SHA256 != hash {
+		t.Errorf("expected the existing blob, got %+v", duplicate)
+	}
+
+	// Content not matching its checksum is never written either
+	_, _, err = fileService.storeContent(strings.NewReader("hello"), "file.txt", "text/plain", models.Checksums{SHA256: strings.Repeat("0", 64)})
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+
+	if after := countFiles(t, dir); after != before {
+		t.Errorf("expected no content to be written, got %d files instead of %d", after, before)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// countFiles counts the files stored under dir
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to list stored files: %v", err)
+	}
+
+	return count
+}
+
+// expectTrashedFile expects report.pdf of user 1 to be looked up in the trash
+func expectTrashedFile(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery("FROM files").WithArgs("file-1", int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "name", "deleted_at"}).
+			AddRow("file-1", 1, "report.pdf", time.Now()))
+}
+
+func TestRestoreFileRenamesOnNameConflict(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileService, _ := newTestFileService(t, database)
+
+	// A live file took the name while the file was in the trash
+	expectTrashedFile(mock)
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(int64(1), "", "report.pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(int64(1), "", "report (1).pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE files").WithArgs("report (1).pdf", "file-1", int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	file, err := fileService.RestoreFile(context.Background(), "file-1", 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if file.Name != "report (1).pdf" || file.DeletedAt != nil {
+		t.Errorf("expected the file to be restored as report (1).pdf, got %+v", file)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRestoreFileReportsNameTakenMeanwhile(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileService, _ := newTestFileService(t, database)
+
+	// The name was free when checked, but taken before the file was restored
+	expectTrashedFile(mock)
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(int64(1), "", "report.pdf").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec("UPDATE files").WithArgs("report.pdf", "file-1", int64(1)).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "idx_files_unique_live_name"})
+
+	_, err := fileService.RestoreFile(context.Background(), "file-1", 1)
+	if !errors.Is(err, ErrNameTaken) {
+		t.Errorf("expected ErrNameTaken, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// expectFileDeleted expects a trashed file to be locked and read back while
+// it is deleted
+func expectFileDeleted(mock sqlmock.Sqlmock, fileID, storagePath, blobHash string, size int64) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT storage_path, blob_hash, size\\s+FROM files").WithArgs(fileID, int64(1), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"storage_path", "blob_hash", "size"}).AddRow(storagePath, blobHash, size))
+}
+
+func TestPurgeTrashReleasesUsage(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileService, store := newTestFileService(t, database)
+
+	content := storeObject(t, store, "current")
+	version := storeObject(t, store, "old")
+	blob := storeObject(t, store, "shared")
+
+	mock.ExpectQuery("FROM files").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "storage_path", "blob_hash"}).
+			AddRow("file-1", 1, content, "").
+			AddRow("file-2", 1, "", "hash"))
+
+	// A file with content of its own and a previous version
+	expectFileDeleted(mock, "file-1", content, "", 7)
+	mock.ExpectQuery("FROM file_versions").WithArgs("file-1").
+		WillReturnRows(sqlmock.NewRows([]string{"storage_path", "blob_hash", "size"}).AddRow(version, "", 3))
+	mock.ExpectExec("DELETE FROM files").WithArgs("file-1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users").WithArgs(int64(10), int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	// A deduplicated file whose previous version has the same content, the
+	// last references to its blob
+	expectFileDeleted(mock, "file-2", blob, "hash", 6)
+	mock.ExpectQuery("FROM file_versions").WithArgs("file-2").
+		WillReturnRows(sqlmock.NewRows([]string{"storage_path", "blob_hash", "size"}).AddRow(blob, "hash", 6))
+	mock.ExpectExec("DELETE FROM files").WithArgs("file-2").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE users").WithArgs(int64(12), int64(1), int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("UPDATE blobs").WithArgs("hash").
+		WillReturnRows(sqlmock.NewRows([]string{"ref_count"}).AddRow(1))
+	mock.ExpectQuery("UPDATE blobs").WithArgs("hash").
+		WillReturnRows(sqlmock.NewRows([]string{"ref_count"}).AddRow(0))
+	mock.ExpectQuery("DELETE FROM blobs").WithArgs("hash").
+		WillReturnRows(sqlmock.NewRows([]string{"hash", "storage_path"}).AddRow("hash", blob))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("pg_advisory_xact_lock").WithArgs("hash").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT EXISTS").WithArgs("hash", blob).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectRollback()
+
+	count, err := fileService.PurgeTrash(context.Background(), time.Hour, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("expected 2 files purged, got %d", count)
+	}
+
+	for _, storagePath := range []string{content, version, blob} {
+		if exists(store, storagePath) {
+			t.Errorf("expected %s to be deleted", storagePath)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPurgeTrashKeepsUsageOfFilesLeftBehind(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileService, store := newTestFileService(t, database)
+
+	content := storeObject(t, store, "content")
+
+	mock.ExpectQuery("FROM files").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "storage_path", "blob_hash"}).
+			AddRow("file-1", 1, content, ""))
+	expectFileDeleted(mock, "file-1", content, "", 7)
+	mock.ExpectQuery("FROM file_versions").WithArgs("file-1").
+		WillReturnRows(sqlmock.NewRows([]string{"storage_path", "blob_hash", "size"}))
+	mock.ExpectExec("DELETE FROM files").WithArgs("file-1").WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	// The usage and content are only released along with the row, which is
+	// retried on the next run
+	count, err := fileService.PurgeTrash(context.Background(), time.Hour, 10)
+	if err != nil || count != 0 {
+		t.Errorf("expected no files purged, got %d, %v", count, err)
+	}
+
+	if !exists(store, content) {
+		t.Errorf("expected the content to be kept while its file exists")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPurgeTrashKeepsRestoredFiles(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileService, store := newTestFileService(t, database)
+
+	content := storeObject(t, store, "content")
+
+	mock.ExpectQuery("FROM files").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "storage_path", "blob_hash"}).
+			AddRow("file-1", 1, content, ""))
+
+	// The file was restored while the purge was waiting for the lock
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT storage_path, blob_hash, size\\s+FROM files").WithArgs("file-1", int64(1), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"storage_path", "blob_hash", "size"}))
+	mock.ExpectRollback()
+
+	count, err := fileService.PurgeTrash(context.Background(), time.Hour, 10)
+	if err != nil || count != 0 {
+		t.Errorf("expected no files purged, got %d, %v", count, err)
+	}
+
+	if !exists(store, content) {
+		t.Errorf("expected the content of the restored file to be kept")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+)
+
+// maxFolderPage is the largest page of files returned with a folder's contents
+const maxFolderPage = 500
+
+// deleteBatchSize is the number of files deleted at a time when a folder is
+// deleted with its contents
+const deleteBatchSize = 100
+
+var (
+	// ErrFolderNotFound is returned when a folder does not exist or does not
+	// belong to the user
+	ErrFolderNotFound = errors.New("folder not found")
+
+	// ErrFileNotFound is returned when a file does not exist or does not
+	// belong to the user
+	ErrFileNotFound = errors.New("file not found")
+
+	// ErrPathNotFound is returned when a path does not lead to a folder or file
+	ErrPathNotFound = errors.New("path not found")
+
+	// ErrNameTaken is returned when a folder already holds a file or folder
+	// with the same name
+	ErrNameTaken = errors.New("name already taken in folder")
+
+	// ErrInvalidName is returned for file and folder names that cannot be
+	// used in a path
+	ErrInvalidName = errors.New("invalid name")
+
+	// ErrFolderCycle is returned when a folder would be moved into itself or
+	// one of its subfolders
+	ErrFolderCycle = errors.New("folder cannot be moved into itself")
+)
+
+// FolderService handles the folder tree of users' files
+type FolderService struct {
+	folderRepo  *db.FolderRepository
+	fileRepo    *db.FileRepository
+	fileService *FileService
+}
+
+// NewFolderService creates a new folder service
+func NewFolderService(folderRepo *db.FolderRepository, fileRepo *db.FileRepository, fileService *FileService) *FolderService {
+	return &FolderService{
+		folderRepo:  folderRepo,
+		fileRepo:    fileRepo,
+		fileService: fileService,
+	}
+}
+
+// CreateFolder creates a folder for a user
+func (s *FolderService) CreateFolder(ctx context.Context, userID int64, req *models.CreateFolderRequest) (*models.Folder, error) {
+	err := validateName(req.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.fileService.checkFolder(userID, req.ParentID)
+	if err != nil {
+		return nil, err
+	}
+
+	folder := &models.Folder{
+		UserID:   userID,
+		ParentID: req.ParentID,
+		Name:     req.Name,
+	}
+
+	err = s.folderRepo.CreateFolder(folder)
+	if err != nil {
+		if errors.Is(err, db.ErrNameTaken) {
+			return nil, ErrNameTaken
+		}
+		return nil, err
+	}
+
+	return folder, nil
+}
+
+// GetFolderContents gets a folder of the user with its subfolders and a page
+// of its files. An empty folderID is the root folder.
+func (s *FolderService) GetFolderContents(ctx context.Context, folderID string, userID int64, req *models.ListFolderRequest) (*models.FolderContents, error) {
+	contents := &models.FolderContents{Path: "/"}
+
+	if folderID != "" {
+		ancestors, err := s.folderRepo.GetFolderAncestors(folderID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if len(ancestors) == 0 {
+			return nil, ErrFolderNotFound
+		}
+
+		names := make([]string, len(ancestors))
+		for i, ancestor := range ancestors {
+			names[i] = ancestor.Name
+		}
+
+		contents.Path = "/" + strings.Join(names, "/")
+		contents.Folder = &ancestors[len(ancestors)-1]
+	}
+
+	return s.fillContents(contents, folderID, userID, req)
+}
+
+// fillContents adds the subfolders and a page of the files of a folder to contents
+func (s *FolderService) fillContents(contents *models.FolderContents, folderID string, userID int64, req *models.ListFolderRequest) (*models.FolderContents, error) {
+	limit := req.Limit
+	if limit <= 0 || limit > maxFolderPage {
+		limit = maxFolderPage
+	}
+
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	folders, err := s.folderRepo.GetSubfolders(userID, folderID)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.fileRepo.GetFilesByUserID(userID, &models.FolderScope{FolderID: folderID}, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	contents.Folders = folders
+	contents.Files = files
+
+	return contents, nil
+}
+
+// UpdateFolder renames a folder of the user or moves it to another parent
+func (s *FolderService) UpdateFolder(ctx context.Context, folderID string, userID int64, req *models.UpdateFolderRequest) (*models.Folder, error) {
+	folder, err := s.folderRepo.GetFolderByID(folderID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrFolderNotFound, err)
+	}
+
+	if req.Name != nil {
+		err = validateName(*req.Name)
+		if err != nil {
+			return nil, err
+		}
+		folder.Name = *req.Name
+	}
+
+	if req.ParentID != nil && *req.ParentID != folder.ParentID {
+		parentID := *req.ParentID
+		if parentID != "" {
+			err = s.fileService.checkFolder(userID, parentID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		folder.ParentID = parentID
+	}
+
+	err = s.folderRepo.UpdateFolder(folder)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNameTaken):
+			return nil, ErrNameTaken
+		case errors.Is(err, db.ErrFolderCycle):
+			// A folder cannot become its own descendant
+			return nil, ErrFolderCycle
+		}
+		return nil, err
+	}
+
+	return folder, nil
+}
+
+// DeleteFolder deletes a folder of the user along with all folders in it.
+// The files in them are moved to the trash, and restored to the root folder.
+func (s *FolderService) DeleteFolder(ctx context.Context, folderID string, userID int64) error {
+	_, err := s.folderRepo.GetFolderByID(folderID, userID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrFolderNotFound, err)
+	}
+
+	// Trash the files first so they can still be restored
+	scope := &models.FolderScope{FolderID: folderID, Recursive: true}
+	for {
+		files, err := s.fileRepo.GetFilesByUserID(userID, scope, deleteBatchSize, 0)
+		if err != nil {
+			return err
+		}
+
+		if len(files) == 0 {
+			break
+		}
+
+		for _, file := range files {
+			err = s.fileService.TrashFile(ctx, file.ID, userID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return s.folderRepo.DeleteFolder(folderID, userID)
+}
+
+// ResolvePath looks up a slash separated path in the user's file tree. A
+// path leading to a folder returns the folder's contents, with a page of its
+// files. When a folder and a file in the same folder share the last name
+// of the path, the folder is returned.
+func (s *FolderService) ResolvePath(ctx context.Context, userID int64, path string, req *models.ListFolderRequest) (*models.PathEntry, error) {
+	var names []string
+	for _, name := range strings.Split(path, "/") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	contents := &models.FolderContents{Path: "/" + strings.Join(names, "/")}
+
+	folderID := ""
+	for i, name := range names {
+		folder, err := s.folderRepo.GetFolderByName(userID, folderID, name)
+		if err == nil {
+			folderID = folder.ID
+			contents.Folder = folder
+			continue
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+
+		// Only the last name of the path can be a file
+		if i < len(names)-1 {
+			return nil, ErrPathNotFound
+		}
+
+		file, err := s.fileRepo.GetFileByName(userID, folderID, name)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, ErrPathNotFound
+			}
+			return nil, err
+		}
+
+		return &models.PathEntry{Type: "file", File: file}, nil
+	}
+
+	contents, err := s.fillContents(contents, folderID, userID, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.PathEntry{Type: "folder", Folder: contents}, nil
+}
+
+// validateName checks that a file or folder name can be used in a path
+func validateName(name string) error {
+	if strings.TrimSpace(name) == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return ErrInvalidName
+	}
+
+	return nil
+}
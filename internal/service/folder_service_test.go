@@ -0,0 +1,22 @@
+package service
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestValidateName(t *testing.T) {
+	valid := []string{"report.pdf", "My Folder", ".hidden", "a..b"}
+	for _, name := range valid {
+		if err := validateName(name); err != nil {
+			t.Errorf("validateName(%q) = %v, want nil", name, err)
+		}
+	}
+
+	invalid := []string{"", "   ", ".", "..", "a/b", "nul\x00"}
+	for _, name := range invalid {
+		if err := validateName(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("validateName(%q) = %v, want ErrInvalidName", name, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/cache"
+	"file-sharing-platform/pkg/storage"
+)
+
+// ErrCopyMismatch is returned when a copied object does not read back the
+// same as its source
+var ErrCopyMismatch = errors.New("copied object does not match source")
+
+// Outcomes of migrating an object
+const (
+	// MigrationCopied means the object was copied and its rows updated
+	MigrationCopied = "copied"
+
+	// MigrationSkipped means the object is not in the source storage,
+	// usually because it was migrated before
+	MigrationSkipped = "skipped"
+
+	// MigrationGone means the rows referring to the object were deleted
+	// while it was copied, so the copy was dropped
+	MigrationGone = "gone"
+)
+
+// MigrationService moves stored objects from one storage backend to
+// another. Objects are copied as stored, so encrypted content stays
+// encrypted under the same keys. Rows are only pointed at a copy once it
+// has been verified, and objects already moved are skipped, so a migration
+// can be interrupted and run again at any time.
+type MigrationService struct {
+	fileRepo     *db.FileRepository
+	from         storage.FileStorage
+	to           storage.FileStorage
+	cache        *cache.FileCache
+	deleteSource bool
+}
+
+// NewMigrationService creates a service migrating objects from one storage
+// backend to another. When deleteSource is set, objects are deleted from
+// the source once nothing refers to them anymore.
+func NewMigrationService(fileRepo *db.FileRepository, from, to storage.FileStorage, cache *cache.FileCache, deleteSource bool) *MigrationService {
+	return &MigrationService{
+		fileRepo:     fileRepo,
+		from:         from,
+		to:           to,
+		cache:        cache,
+		deleteSource: deleteSource,
+	}
+}
+
+// GetObjectsToMigrate gets up to batchSize objects after afterPath, in path
+// order, that rows refer to. Objects already migrated are included; they
+// are skipped by MigrateObject.
+func (s *MigrationService) GetObjectsToMigrate(ctx context.Context, afterPath string, batchSize int) ([]models.StoredObject, error) {
+	return s.fileRepo.GetStoredObjects(afterPath, batchSize)
+}
+
+// MigrateObject copies an object to the target storage, verifies the copy
+// and points the rows referring to it at the copy. It returns what happened
+// to the object.
+func (s *MigrationService) MigrateObject(ctx context.Context, object models.StoredObject) (string, error) {
+	source, err := s.from.Open(object.StoragePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return MigrationSkipped, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open source object: %w", err)
+	}
+	defer source.Close()
+
+	contentType := object.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	hasher := sha256.New()
+	newPath, newURL, err := s.to.Upload(io.TeeReader(source, hasher), path.Base(object.StoragePath), contentType)
+	if err != nil {
+		return "", fmt.Errorf("failed to copy object: %w", err)
+	}
+
+	err = s.verifyCopy(newPath, hasher.Sum(nil))
+	if err != nil {
+		_ = s.to.Delete(newPath)
+		return "", err
+	}
+
+	moved, files, err := s.fileRepo.MoveStoragePath(object.StoragePath, newPath, newURL)
+	if err != nil {
+		_ = s.to.Delete(newPath)
+		return "", err
+	}
+
+	if moved == 0 {
+		_ = s.to.Delete(newPath)
+		return MigrationGone, nil
+	}
+
+	for _, file := range files {
+		_ = s.cache.InvalidateFile(ctx, file.ID)
+		_ = s.cache.InvalidateUserFiles(ctx, file.UserID)
+	}
+
+	if s.deleteSource {
+		err = s.deleteSourceObject(object.StoragePath)
+		if err != nil {
+			return MigrationCopied, err
+		}
+	}
+
+	return MigrationCopied, nil
+}
+
+// verifyCopy reads back a copied object and compares its SHA-256 hash with
+// the hash of the source
+func (s *MigrationService) verifyCopy(storagePath string, sum []byte) error {
+	copied, err := s.to.Open(storagePath)
+	if err != nil {
+		return fmt.Errorf("failed to open copied object: %w", err)
+	}
+	defer copied.Close()
+
+	hasher := sha256.New()
+	_, err = io.Copy(hasher, copied)
+	if err != nil {
+		return fmt.Errorf("failed to read copied object: %w", err)
+	}
+
+	if !bytes.Equal(hasher.Sum(nil), sum) {
+		return ErrCopyMismatch
+	}
+
+	return nil
+}
+
+// deleteSourceObject deletes a migrated object from the source storage,
+// unless a row started referring to it again while it was migrated
+func (s *MigrationService) deleteSourceObject(storagePath string) error {
+	referenced, err := s.fileRepo.IsStoragePathReferenced(storagePath)
+	if err != nil {
+		return err
+	}
+
+	if referenced {
+		return nil
+	}
+
+	err = s.from.Delete(storagePath)
+	if err != nil {
+		return fmt.Errorf("failed to delete source object: %w", err)
+	}
+
+	return nil
+}
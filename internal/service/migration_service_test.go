@@ -0,0 +1,38 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/storage"
+)
+
+// unavailableStorage is storage whose objects cannot be opened
+type unavailableStorage struct {
+	storage.FileStorage
+}
+
+func (unavailableStorage) Open(storagePath string) (io.ReadSeekCloser, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestMigrateObjectSkipsOnlyMissingObjects(t *testing.T) {
+	database, _ := newMockDatabase(t)
+	fileService, source := newTestFileService(t, database)
+	_, target := newTestFileService(t, database)
+
+	migrationService := NewMigrationService(fileService.fileRepo, source, target, fileService.cache, false)
+	outcome, err := migrationService.MigrateObject(context.Background(), models.StoredObject{StoragePath: "missing.txt"})
+	if err != nil || outcome != MigrationSkipped {
+		t.Errorf("expected a missing object to be skipped, got %q, %v", outcome, err)
+	}
+
+	migrationService = NewMigrationService(fileService.fileRepo, unavailableStorage{source}, target, fileService.cache, false)
+	outcome, err = migrationService.MigrateObject(context.Background(), models.StoredObject{StoragePath: "missing.txt"})
+	if err == nil || outcome == MigrationSkipped {
+		t.Errorf("expected an unreadable object to fail, got %q, %v", outcome, err)
+	}
+}
@@ -0,0 +1,154 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/cache"
+)
+
+// personalTokenSeenInterval is how often the last used time of a personal
+// access token is recorded while it is used
+const personalTokenSeenInterval = time.Minute
+
+var (
+	// ErrInvalidScope is returned when a personal access token is requested
+	// with a scope that does not exist
+	ErrInvalidScope = errors.New("invalid scope")
+
+	// ErrInvalidPersonalToken is returned when a personal access token is
+	// unknown, expired or revoked
+	ErrInvalidPersonalToken = errors.New("invalid personal access token")
+
+	// ErrPersonalTokenNotFound is returned when a personal access token does
+	// not exist, was revoked or does not belong to the user
+	ErrPersonalTokenNotFound = errors.New("personal access token not found")
+)
+
+// PersonalTokenService handles personal access tokens, which let scripts and
+// CI pipelines call the API without a user's password. Each token grants a
+// set of scopes and is checked against the database on every request, so
+// revoking one takes effect right away.
+type PersonalTokenService struct {
+	tokenRepo *db.PersonalTokenRepository
+	cache     cache.Cache
+}
+
+// NewPersonalTokenService creates a new personal access token service
+func NewPersonalTokenService(tokenRepo *db.PersonalTokenRepository, cache cache.Cache) *PersonalTokenService {
+	return &PersonalTokenService{
+		tokenRepo: tokenRepo,
+		cache:     cache,
+	}
+}
+
+// CreateToken creates a personal access token for a user. The returned
+// token is the only time the token itself is available.
+func (s *PersonalTokenService) CreateToken(ctx context.Context, userID int64, req *models.CreatePersonalTokenRequest) (*models.PersonalAccessToken, error) {
+	scopes, err := normalizeScopes(req.Scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &models.PersonalAccessToken{
+		UserID: userID,
+		Name:   strings.TrimSpace(req.Name),
+		Scopes: scopes,
+	}
+
+	if req.ExpiresIn != "" {
+		duration, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid expiration format: %s", req.ExpiresIn)
+		}
+		expiresAt := time.Now().Add(duration)
+		token.ExpiresAt = &expiresAt
+	}
+
+	token.Token, token.TokenHash, token.TokenHint, err = auth.NewPersonalToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.tokenRepo.CreatePersonalToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// ListTokens lists the personal access tokens of a user
+func (s *PersonalTokenService) ListTokens(ctx context.Context, userID int64) ([]models.PersonalAccessToken, error) {
+	return s.tokenRepo.GetUserPersonalTokens(userID)
+}
+
+// RevokeToken revokes a personal access token of a user
+func (s *PersonalTokenService) RevokeToken(ctx context.Context, userID int64, id string) error {
+	err := s.tokenRepo.RevokePersonalToken(id, userID)
+	if errors.Is(err, db.ErrPersonalTokenNotFound) {
+		return ErrPersonalTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Authenticate looks up a personal access token presented as a bearer token
+// and records that it was used
+func (s *PersonalTokenService) Authenticate(ctx context.Context, tokenString string) (*models.PersonalAccessToken, error) {
+	token, err := s.tokenRepo.GetActivePersonalToken(auth.HashToken(tokenString))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPersonalToken, err)
+	}
+
+	var seen bool
+	key := personalTokenSeenKey(token.ID)
+	if s.cache.Get(ctx, key, &seen) != nil || !seen {
+		_ = s.tokenRepo.TouchPersonalToken(token.ID)
+		_ = s.cache.Set(ctx, key, true, personalTokenSeenInterval)
+	}
+
+	return token, nil
+}
+
+// normalizeScopes checks that all scopes exist and returns them sorted,
+// without duplicates
+func normalizeScopes(scopes []string) ([]string, error) {
+	seen := make(map[string]bool)
+	normalized := []string{}
+
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		if !auth.IsScope(scope) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidScope, scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			normalized = append(normalized, scope)
+		}
+	}
+
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidScope)
+	}
+
+	sort.Strings(normalized)
+
+	return normalized, nil
+}
+
+// personalTokenSeenKey is the cache key set while the last used time of a
+// personal access token is recent enough
+func personalTokenSeenKey(tokenID string) string {
+	return fmt.Sprintf("personal_token_seen:%s", tokenID)
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/pkg/cache"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestNormalizeScopes(t *testing.T) {
+	scopes, err := normalizeScopes([]string{"shares:manage", " Files:Read ", "files:read"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"files:read", "shares:manage"}
+	if !reflect.DeepEqual(scopes, want) {
+		t.Fatalf("expected %v, got %v", want, scopes)
+	}
+
+	for _, invalid := range [][]string{{"files:delete"}, {"files:read", ""}, {}} {
+		if _, err := normalizeScopes(invalid); !errors.Is(err, ErrInvalidScope) {
+			t.Errorf("normalizeScopes(%q): expected ErrInvalidScope, got %v", invalid, err)
+		}
+	}
+}
+
+func TestRevokeTokenMapsErrors(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	tokenService := NewPersonalTokenService(db.NewPersonalTokenRepository(database), cache.NewMemoryCache())
+
+	mock.ExpectExec("UPDATE personal_access_tokens").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE personal_access_tokens").WillReturnError(errors.New("connection reset"))
+
+	err := tokenService.RevokeToken(context.Background(), 1, "token-1")
+	if !errors.Is(err, ErrPersonalTokenNotFound) {
+		t.Errorf("expected a missing token to be not found, got %v", err)
+	}
+
+	err = tokenService.RevokeToken(context.Background(), 1, "token-1")
+	if err == nil || errors.Is(err, ErrPersonalTokenNotFound) {
+		t.Errorf("expected a database error to be returned as is, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
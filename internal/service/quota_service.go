@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+)
+
+// ErrQuotaExceeded is returned when an upload would take a user over their
+// storage quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// QuotaService handles per-user storage quotas. Usage is kept up to date by
+// the repositories as files and versions are added and deleted; the service
+// resolves which quota applies and checks uploads against it.
+type QuotaService struct {
+	userRepo     *db.UserRepository
+	defaultQuota models.StorageQuota
+}
+
+// NewQuotaService creates a new quota service. Users without a quota of
+// their own get defaultQuota.
+func NewQuotaService(userRepo *db.UserRepository, defaultQuota models.StorageQuota) *QuotaService {
+	return &QuotaService{
+		userRepo:     userRepo,
+		defaultQuota: defaultQuota,
+	}
+}
+
+// GetUsage gets the storage usage of a user and the quota that applies
+func (s *QuotaService) GetUsage(ctx context.Context, userID int64) (*models.StorageUsage, error) {
+	usage, err := s.userRepo.GetUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	usage.IsDefault = !usage.HasQuota
+	if usage.HasQuota {
+		usage.QuotaBytes = usage.UserQuotaBytes
+		usage.QuotaFiles = usage.UserQuotaFiles
+	} else {
+		usage.QuotaBytes = s.defaultQuota.Bytes
+		usage.QuotaFiles = s.defaultQuota.Files
+	}
+
+	return usage, nil
+}
+
+// SetQuota sets the storage quota of a user. A nil limit is no limit.
+// Lowering a quota below the current usage only blocks further uploads.
+func (s *QuotaService) SetQuota(ctx context.Context, userID int64, req *models.SetQuotaRequest) (*models.StorageUsage, error) {
+	err := s.userRepo.SetQuota(userID, req.QuotaBytes, req.QuotaFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetUsage(ctx, userID)
+}
+
+// ResetQuota makes the default quota apply to a user again
+func (s *QuotaService) ResetQuota(ctx context.Context, userID int64) (*models.StorageUsage, error) {
+	err := s.userRepo.ResetQuota(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetUsage(ctx, userID)
+}
+
+// checkQuota checks that a user can store size more bytes and files more
+// files. It returns the quota to enforce when the upload is saved and the
+// number of bytes the upload may stream, -1 when there is no byte limit.
+func (s *QuotaService) checkQuota(ctx context.Context, userID int64, size, files int64) (models.StorageQuota, int64, error) {
+	usage, err := s.GetUsage(ctx, userID)
+	if err != nil {
+		return models.StorageQuota{}, 0, fmt.Errorf("failed to check storage quota: %w", err)
+	}
+
+	limit := models.StorageQuota{Bytes: usage.QuotaBytes, Files: usage.QuotaFiles}
+
+	if limit.Files != nil && usage.UsedFiles+files > *limit.Files {
+		return limit, 0, ErrQuotaExceeded
+	}
+
+	if limit.Bytes == nil {
+		return limit, -1, nil
+	}
+
+	remaining := *limit.Bytes - usage.UsedBytes
+	if size > remaining {
+		return limit, 0, ErrQuotaExceeded
+	}
+
+	return limit, remaining, nil
+}
+
+// quotaReader reads content being uploaded and fails with ErrQuotaExceeded
+// once more than remaining bytes were read, so an upload whose size was not
+// known or not honest is cut off mid-stream. A negative remaining is no
+// limit. It counts the bytes read, the size of the content stored.
+type quotaReader struct {
+	reader    io.Reader
+	remaining int64
+	exceeded  bool
+	read      int64
+}
+
+// newQuotaReader wraps reader to fail once more than remaining bytes are read
+func newQuotaReader(reader io.Reader, remaining int64) *quotaReader {
+	return &quotaReader{reader: reader, remaining: remaining}
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if r.remaining < 0 {
+		r.read += int64(n)
+		return n, err
+	}
+
+	if int64(n) > r.remaining {
+		r.exceeded = true
+		return 0, ErrQuotaExceeded
+	}
+	r.remaining -= int64(n)
+	r.read += int64(n)
+
+	return n, err
+}
+
+// quotaError maps errors of saving an upload to ErrQuotaExceeded when the
+// upload went over quota, whether while streaming or when it was saved
+func quotaError(reader *quotaReader, err error) error {
+	if reader.exceeded || errors.Is(err, db.ErrQuotaExceeded) {
+		return ErrQuotaExceeded
+	}
+
+	return err
+}
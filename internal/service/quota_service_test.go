@@ -0,0 +1,72 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestQuotaReader(t *testing.T) {
+	data, err := io.ReadAll(newQuotaReader(strings.NewReader("hello"), 5))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected content within the quota to pass, got %q, %v", data, err)
+	}
+
+	data, err = io.ReadAll(newQuotaReader(strings.NewReader("hello"), -1))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("expected content without a quota to pass, got %q, %v", data, err)
+	}
+
+	reader := newQuotaReader(bytes.NewReader(make([]byte, 6)), 5)
+	_, err = io.Copy(io.Discard, reader)
+	if !errors.Is(err, ErrQuotaExceeded) || !reader.exceeded {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if !errors.Is(quotaError(reader, errors.New("upload failed")), ErrQuotaExceeded) {
+		t.Fatalf("expected an upload cut off by the quota to report ErrQuotaExceeded")
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	zero, ten := int64(0), int64(10)
+
+	tests := []struct {
+		name      string
+		hasQuota  bool
+		quota     *int64
+		remaining int64
+		err       error
+	}{
+		{"default quota", false, nil, 6, nil},
+		{"no limit of its own", true, nil, -1, nil},
+		{"limit of its own", true, &ten, 6, nil},
+		{"zero blocks uploads", true, &zero, 0, ErrQuotaExceeded},
+	}
+
+	for _, tt := range tests {
+		database, mock := newMockDatabase(t)
+		quotaService := NewQuotaService(db.NewUserRepository(database), models.StorageQuota{Bytes: &ten})
+
+		mock.ExpectQuery("SELECT used_bytes").WithArgs(int64(1)).
+			WillReturnRows(sqlmock.NewRows([]string{"used_bytes", "used_files", "has_quota", "quota_bytes", "quota_files"}).
+				AddRow(4, 1, tt.hasQuota, tt.quota, nil))
+
+		_, remaining, err := quotaService.checkQuota(context.Background(), 1, 1, 1)
+		if err != tt.err || (err == nil && remaining != tt.remaining) {
+			t.Errorf("%s: got %d, %v, want %d, %v", tt.name, remaining, err, tt.remaining, tt.err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/storage"
+)
+
+// Actions taken on objects no row refers to
+const (
+	ScrubQuarantine = "quarantine"
+	ScrubDelete     = "delete"
+)
+
+// ScrubService reconciles file storage with the database. It reports rows
+// whose content is missing or corrupt, and quarantines or deletes objects
+// left behind in storage, e.g. by uploads whose metadata could not be saved
+// or by cleanups that failed halfway.
+type ScrubService struct {
+	fileService *FileService
+}
+
+// NewScrubService creates a new scrub service
+func NewScrubService(fileService *FileService) *ScrubService {
+	return &ScrubService{
+		fileService: fileService,
+	}
+}
+
+// scrubObject is a listed object and what the scrub found out about it
+type scrubObject struct {
+	info       storage.ObjectInfo
+	referenced bool
+	verified   bool
+}
+
+// Scrub lists the storage, walks the files, file versions and blobs that
+// refer to it and handles the objects nothing refers to. It can run while
+// the server is in use: content created after the listing started is not
+// reported missing, objects younger than the grace period are never
+// orphaned, and each orphan is checked again right before it is touched.
+func (s *ScrubService) Scrub(ctx context.Context, opts models.ScrubOptions) (*models.ScrubReport, error) {
+	listable, ok := s.fileService.storage.(storage.ListableStorage)
+	if !ok {
+		return nil, storage.ErrListingNotSupported
+	}
+
+	if opts.OrphanAction != ScrubQuarantine && opts.OrphanAction != ScrubDelete {
+		return nil, fmt.Errorf("unknown orphan action: %s", opts.OrphanAction)
+	}
+
+	report := &models.ScrubReport{
+		StartedAt:      time.Now(),
+		DryRun:         opts.DryRun,
+		MissingObjects: []models.StorageReference{},
+		CorruptObjects: []models.StorageReference{},
+		OrphanObjects:  []string{},
+	}
+
+	objects := make(map[string]*scrubObject)
+	err := listable.List(func(object storage.ObjectInfo) error {
+		objects[object.Path] = &scrubObject{info: object}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.ObjectsListed = len(objects)
+
+	err = s.checkFiles(ctx, opts, objects, report)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkVersions(ctx, opts, objects, report)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.checkBlobs(ctx, opts, objects, report)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.handleOrphans(ctx, opts, listable, objects, report)
+	if err != nil {
+		return nil, err
+	}
+
+	report.FinishedAt = time.Now()
+
+	return report, nil
+}
+
+// checkFiles checks the current content of all files, trashed ones included
+func (s *ScrubService) checkFiles(ctx context.Context, opts models.ScrubOptions, objects map[string]*scrubObject, report *models.ScrubReport) error {
+	afterID := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		files, err := s.fileService.fileRepo.GetStoredFiles(afterID, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			ref := models.StorageReference{Kind: "file", ID: file.ID, FileID: file.ID, StoragePath: file.StoragePath}
+			object := s.checkReference(ref, file.VersionCreatedAt, objects, report)
+
+			if opts.VerifyChecksums {
+				s.verify(ref, object, file.Checksums, report, func() (io.ReadSeekCloser, error) {
+					return s.fileService.openStoredContent(file.StoragePath, file.EncryptedKey, file.EncryptionKeyID, file.EncryptionVersion)
+				})
+			}
+		}
+
+		if len(files) < opts.BatchSize {
+			return nil
+		}
+		afterID = files[len(files)-1].ID
+	}
+}
+
+// checkVersions checks the content of all previous file versions
+func (s *ScrubService) checkVersions(ctx context.Context, opts models.ScrubOptions, objects map[string]*scrubObject, report *models.ScrubReport) error {
+	afterID := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		versions, err := s.fileService.versionRepo.GetStoredVersions(afterID, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for i := range versions {
+			version := &versions[i]
+			ref := models.StorageReference{Kind: "version", ID: version.ID, FileID: version.FileID, StoragePath: version.StoragePath}
+			object := s.checkReference(ref, version.CreatedAt, objects, report)
+
+			if opts.VerifyChecksums {
+				s.verify(ref, object, version.Checksums, report, func() (io.ReadSeekCloser, error) {
+					return s.fileService.openVersionContent(version)
+				})
+			}
+		}
+
+		if len(versions) < opts.BatchSize {
+			return nil
+		}
+		afterID = versions[len(versions)-1].ID
+	}
+}
+
+// checkBlobs checks the content of all deduplicated blobs, whose hash is
+// the SHA-256 checksum of their content
+func (s *ScrubService) checkBlobs(ctx context.Context, opts models.ScrubOptions, objects map[string]*scrubObject, report *models.ScrubReport) error {
+	afterHash := ""
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		blobs, err := s.fileService.blobRepo.GetBlobs(afterHash, opts.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, blob := range blobs {
+			ref := models.StorageReference{Kind: "blob", ID: blob.Hash, StoragePath: blob.StoragePath}
+			object := s.checkReference(ref, blob.CreatedAt, objects, report)
+
+			if opts.VerifyChecksums {
+				s.verify(ref, object, models.Checksums{SHA256: blob.Hash}, report, func() (io.ReadSeekCloser, error) {
+					return s.fileService.openStoredContent(blob.StoragePath, blob.EncryptedKey, blob.EncryptionKeyID, blob.EncryptionVersion)
+				})
+			}
+		}
+
+		if len(blobs) < opts.BatchSize {
+			return nil
+		}
+		afterHash = blobs[len(blobs)-1].Hash
+	}
+}
+
+// checkReference marks the object a row refers to as referenced and returns
+// it. Content created before the listing started that was not listed is
+// reported missing once looking it up directly fails as well.
+func (s *ScrubService) checkReference(ref models.StorageReference, createdAt time.Time, objects map[string]*scrubObject, report *models.ScrubReport) *scrubObject {
+	object, ok := objects[ref.StoragePath]
+	if ok {
+		object.referenced = true
+		return object
+	}
+
+	if !createdAt.Before(report.StartedAt) {
+		return nil
+	}
+
+	reader, err := s.fileService.storage.Open(ref.StoragePath)
+	if err == nil {
+		reader.Close()
+		return nil
+	}
+
+	report.MissingObjects = append(report.MissingObjects, ref)
+	return nil
+}
+
+// verify reads back a listed object and compares it with the checksums
+// recorded for it. Objects shared by several rows are read only once, and
+// rows without checksums are skipped.
+func (s *ScrubService) verify(ref models.StorageReference, object *scrubObject, expected models.Checksums, report *models.ScrubReport, open func() (io.ReadSeekCloser, error)) {
+	if object == nil || object.verified || expected.SHA256 == "" {
+		return
+	}
+	object.verified = true
+	report.ObjectsVerified++
+
+	actual, err := readChecksums(open, expected.MD5 != "")
+	if err != nil || !checksumsMatch(expected, actual) {
+		report.CorruptObjects = append(report.CorruptObjects, ref)
+	}
+}
+
+// readChecksums computes the checksums of content, the MD5 checksum only if
+// withMD5 is set
+func readChecksums(open func() (io.ReadSeekCloser, error), withMD5 bool) (models.Checksums, error) {
+	var checksums models.Checksums
+
+	reader, err := open()
+	if err != nil {
+		return checksums, err
+	}
+	defer reader.Close()
+
+	sha256Hash := sha256.New()
+	hashers := []io.Writer{sha256Hash}
+
+	var md5Hash hash.Hash
+	if withMD5 {
+		md5Hash = md5.New()
+		hashers = append(hashers, md5Hash)
+	}
+
+	_, err = io.Copy(io.MultiWriter(hashers...), reader)
+	if err != nil {
+		return checksums, err
+	}
+
+	checksums.SHA256 = hex.EncodeToString(sha256Hash.Sum(nil))
+	if md5Hash != nil {
+		checksums.MD5 = hex.EncodeToString(md5Hash.Sum(nil))
+	}
+
+	return checksums, nil
+}
+
+// handleOrphans quarantines or deletes listed objects that no row refers to
+// and that are older than the grace period
+func (s *ScrubService) handleOrphans(ctx context.Context, opts models.ScrubOptions, listable storage.ListableStorage, objects map[string]*scrubObject, report *models.ScrubReport) error {
+	cutoff := report.StartedAt.Add(-opts.GracePeriod)
+
+	for path, object := range objects {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if object.referenced || !object.info.ModTime.Before(cutoff) {
+			continue
+		}
+
+		// A row may have started referring to the object while the tables
+		// were walked, e.g. when a version was restored
+		referenced, err := s.fileService.fileRepo.IsStoragePathReferenced(path)
+		if err != nil {
+			return err
+		}
+		if referenced {
+			continue
+		}
+
+		report.OrphanObjects = append(report.OrphanObjects, path)
+		if opts.DryRun {
+			continue
+		}
+
+		switch opts.OrphanAction {
+		case ScrubQuarantine:
+			_, err = listable.Quarantine(path)
+			if err == nil {
+				report.Quarantined++
+			}
+		case ScrubDelete:
+			err = s.fileService.deleteObject(path)
+			if err == nil {
+				report.Deleted++
+			}
+		}
+		if err != nil {
+			report.Failed++
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/cache"
+	"file-sharing-platform/pkg/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// newTestScrubService creates a scrub service on the mock database checking
+// a temporary directory, which it returns as well
+func newTestScrubService(t *testing.T, database *db.Database) (*ScrubService, *storage.LocalStorage, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	store, err := storage.NewLocalStorage(dir, "http://localhost")
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	fileCache := cache.NewFileCache(cache.NewMemoryCache(), time.Hour)
+	fileService := NewFileService(db.NewFileRepository(database), db.NewFolderRepository(database), db.NewFileVersionRepository(database), db.NewBlobRepository(database), store, fileCache, nil, "http://localhost", false, false)
+
+	return NewScrubService(fileService), store, dir
+}
+
+// storeOldObject stores content last modified two days ago and returns its
+// storage path
+func storeOldObject(t *testing.T, store storage.FileStorage, dir, content string) string {
+	t.Helper()
+
+	storagePath := storeObject(t, store, content)
+	modTime := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, storagePath), modTime, modTime); err != nil {
+		t.Fatalf("failed to age object: %v", err)
+	}
+
+	return storagePath
+}
+
+// expectStoredContent expects the scrub to walk files, file versions and
+// blobs referring to the given storage paths
+func expectStoredContent(mock sqlmock.Sqlmock, filePaths, versionPaths, blobPaths []string) {
+	created := time.Now().Add(-72 * time.Hour)
+
+	files := sqlmock.NewRows([]string{"id", "user_id", "storage_path", "version_created_at", "blob_hash", "sha256", "md5"})
+	for i, path := range filePaths {
+		files.AddRow(fmt.Sprintf("file-%d", i+1), 1, path, created, "", "", "")
+	}
+	mock.ExpectQuery("FROM files").WithArgs("", 100).WillReturnRows(files)
+
+	versions := sqlmock.NewRows([]string{"id", "file_id", "version", "storage_path", "created_at", "blob_hash", "sha256", "md5"})
+	for i, path := range versionPaths {
+		versions.AddRow(fmt.Sprintf("version-%d", i+1), "file-1", 1, path, created, "", "", "")
+	}
+	mock.ExpectQuery("FROM file_versions").WithArgs("", 100).WillReturnRows(versions)
+
+	blobs := sqlmock.NewRows([]string{"hash", "storage_path", "created_at"})
+	for i, path := range blobPaths {
+		blobs.AddRow(fmt.Sprintf("hash-%d", i+1), path, created)
+	}
+	mock.ExpectQuery("FROM blobs").WithArgs("", 100).WillReturnRows(blobs)
+}
+
+// expectReferenceCheck expects an orphan to be checked again before it is
+// touched
+func expectReferenceCheck(mock sqlmock.Sqlmock, storagePath string, referenced bool) {
+	mock.ExpectQuery("SELECT EXISTS").WithArgs(storagePath).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(referenced))
+}
+
+func TestScrubDeletesOrphans(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	scrubService, store, dir := newTestScrubService(t, database)
+
+	file := storeOldObject(t, store, dir, "file")
+	version := storeOldObject(t, store, dir, "version")
+	blob := storeOldObject(t, store, dir, "blob")
+	orphan := storeOldObject(t, store, dir, "orphan")
+
+	expectStoredContent(mock, []string{file, "2024/01/01/missing.txt"}, []string{version}, []string{blob})
+	expectReferenceCheck(mock, orphan, false)
+
+	report, err := scrubService.Scrub(context.Background(), models.ScrubOptions{OrphanAction: ScrubDelete, BatchSize: 100, GracePeriod: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+
+	if report.ObjectsListed != 4 {
+		t.Errorf("expected 4 objects listed, got %d", report.ObjectsListed)
+	}
+	if len(report.OrphanObjects) != 1 || report.OrphanObjects[0] != orphan || report.Deleted != 1 {
+		t.Errorf("expected %s to be deleted as an orphan, got %v (%d deleted)", orphan, report.OrphanObjects, report.Deleted)
+	}
+	if len(report.MissingObjects) != 1 || report.MissingObjects[0].ID != "file-2" {
+		t.Errorf("expected the content of file-2 to be missing, got %v", report.MissingObjects)
+	}
+
+	if exists(store, orphan) {
+		t.Error("expected the orphan to be deleted")
+	}
+	for _, path := range []string{file, version, blob} {
+		if !exists(store, path) {
+			t.Errorf("expected referenced object %s to be kept", path)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrubLeavesNewObjectsAlone(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	scrubService, store, _ := newTestScrubService(t, database)
+
+	// Stored just now, e.g. by an upload whose metadata is being saved
+	recent := storeObject(t, store, "recent")
+
+	expectStoredContent(mock, nil, nil, nil)
+
+	report, err := scrubService.Scrub(context.Background(), models.ScrubOptions{OrphanAction: ScrubDelete, BatchSize: 100, GracePeriod: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+
+	if len(report.OrphanObjects) != 0 || !exists(store, recent) {
+		t.Errorf("expected an object within the grace period to be left alone, got orphans %v", report.OrphanObjects)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrubDryRunTouchesNothing(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	scrubService, store, dir := newTestScrubService(t, database)
+
+	orphan := storeOldObject(t, store, dir, "orphan")
+
+	expectStoredContent(mock, nil, nil, nil)
+	expectReferenceCheck(mock, orphan, false)
+
+	report, err := scrubService.Scrub(context.Background(), models.ScrubOptions{OrphanAction: ScrubQuarantine, DryRun: true, BatchSize: 100, GracePeriod: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+
+	if len(report.OrphanObjects) != 1 || report.Quarantined != 0 || report.Deleted != 0 {
+		t.Errorf("expected the orphan to be reported only, got %v (%d quarantined, %d deleted)", report.OrphanObjects, report.Quarantined, report.Deleted)
+	}
+	if !exists(store, orphan) {
+		t.Error("expected a dry run to keep the orphan in place")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrubRechecksOrphansBeforeTouchingThem(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	scrubService, store, dir := newTestScrubService(t, database)
+
+	// Referred to by a version restored while the tables were walked
+	restored := storeOldObject(t, store, dir, "restored")
+
+	expectStoredContent(mock, nil, nil, nil)
+	expectReferenceCheck(mock, restored, true)
+
+	report, err := scrubService.Scrub(context.Background(), models.ScrubOptions{OrphanAction: ScrubQuarantine, BatchSize: 100, GracePeriod: 24 * time.Hour})
+	if err != nil {
+		t.Fatalf("Scrub failed: %v", err)
+	}
+
+	if len(report.OrphanObjects) != 0 || report.Quarantined != 0 {
+		t.Errorf("expected an object referred to again to be kept, got %v (%d quarantined)", report.OrphanObjects, report.Quarantined)
+	}
+	if !exists(store, restored) {
+		t.Error("expected the object to stay in place")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
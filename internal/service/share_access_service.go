@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/websocket"
+	"file-sharing-platform/pkg/cache"
+)
+
+// Share access outcomes recorded in the access log
+const (
+	ShareAccessDownload         = "download"
+	ShareAccessPartial          = "partial_download"
+	ShareAccessUnlocked         = "unlocked"
+	ShareAccessExpired          = "expired"
+	ShareAccessExhausted        = "exhausted"
+	ShareAccessPasswordRequired = "password_required"
+	ShareAccessInvalidPassword  = "invalid_password"
+	ShareAccessLocked           = "locked"
+	ShareAccessError            = "error"
+)
+
+const (
+	// maxShareAccessPage is the largest page of the access log returned at once
+	maxShareAccessPage = 100
+
+	// shareAccessDays is the number of days daily access counts are returned for
+	shareAccessDays = 90
+
+	// maxShareAccessHeader is the length user agents and referrers are cut to
+	maxShareAccessHeader = 512
+
+	// partialDownloadInterval is how long further partial downloads of a link
+	// by the same client are left out of the log after one is recorded
+	partialDownloadInterval = 10 * time.Minute
+)
+
+// ShareAccessService keeps the access log of share links and tells owners
+// when their links are used
+type ShareAccessService struct {
+	accessRepo      *db.ShareAccessRepository
+	fileRepo        *db.FileRepository
+	notificationHub *websocket.NotificationHub
+	cache           cache.Cache
+}
+
+// NewShareAccessService creates a new share access service
+func NewShareAccessService(accessRepo *db.ShareAccessRepository, fileRepo *db.FileRepository, notificationHub *websocket.NotificationHub, cache cache.Cache) *ShareAccessService {
+	return &ShareAccessService{
+		accessRepo:      accessRepo,
+		fileRepo:        fileRepo,
+		notificationHub: notificationHub,
+		cache:           cache,
+	}
+}
+
+// shareAccessNotification is the WebSocket message sent to the owner of a
+// share link when it is used
+type shareAccessNotification struct {
+	Type       string    `json:"type"`
+	ShareID    string    `json:"share_id"`
+	FileID     string    `json:"file_id"`
+	FileName   string    `json:"file_name"`
+	Success    bool      `json:"success"`
+	Reason     string    `json:"reason"`
+	IPAddress  string    `json:"ip_address"`
+	AccessedAt time.Time `json:"accessed_at"`
+}
+
+// RecordAccess adds an access to the share link with the given token to its
+// log and notifies the owner. Accesses to unknown links are not recorded.
+// Clients fetch large files in many range requests, so partial downloads
+// are recorded once per link and client every partialDownloadInterval.
+func (s *ShareAccessService) RecordAccess(ctx context.Context, shareToken string, access *models.ShareAccess) error {
+	sharedFile, err := s.fileRepo.GetSharedFile(shareToken)
+	if err != nil {
+		return nil
+	}
+
+	if access.Reason == ShareAccessPartial {
+		key := partialDownloadKey(sharedFile.ID, access.IPAddress)
+
+		var seen bool
+		if s.cache.Get(ctx, key, &seen) == nil && seen {
+			return nil
+		}
+		_ = s.cache.Set(ctx, key, true, partialDownloadInterval)
+	}
+
+	file, err := s.fileRepo.GetFileByID(sharedFile.FileID)
+	if err != nil {
+		return fmt.Errorf("failed to get shared file: %w", err)
+	}
+
+	access.ShareID = sharedFile.ID
+	access.UserAgent = truncate(access.UserAgent, maxShareAccessHeader)
+	access.Referrer = truncate(access.Referrer, maxShareAccessHeader)
+
+	err = s.accessRepo.CreateShareAccess(access)
+	if err != nil {
+		return err
+	}
+
+	if s.notificationHub != nil {
+		message, err := json.Marshal(shareAccessNotification{
+			Type:       "share_access",
+			ShareID:    sharedFile.ID,
+			FileID:     file.ID,
+			FileName:   file.Name,
+			Success:    access.Success,
+			Reason:     access.Reason,
+			IPAddress:  access.IPAddress,
+			AccessedAt: access.AccessedAt,
+		})
+		if err == nil {
+			s.notificationHub.NotifyUser(file.UserID, string(message))
+		}
+	}
+
+	return nil
+}
+
+// partialDownloadKey is the cache key set while partial downloads of a share
+// link by a client are not recorded
+func partialDownloadKey(shareID, ipAddress string) string {
+	return fmt.Sprintf("share_partial_seen:%s:%s", shareID, ipAddress)
+}
+
+// ListAccesses gets a page of the access log of one of the user's share
+// links, along with per-day counts
+func (s *ShareAccessService) ListAccesses(ctx context.Context, shareID string, userID int64, req *models.ListShareAccessesRequest) (*models.ShareAccessesResponse, error) {
+	_, err := s.fileRepo.GetShareByID(shareID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrShareNotFound, err)
+	}
+
+	limit := req.Limit
+	if limit <= 0 || limit > maxShareAccessPage {
+		limit = maxShareAccessPage
+	}
+
+	offset := req.Offset
+	if offset < 0 {
+		offset = 0
+	}
+
+	accesses, err := s.accessRepo.GetShareAccesses(shareID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := s.accessRepo.CountShareAccesses(shareID)
+	if err != nil {
+		return nil, err
+	}
+
+	dailyCounts, err := s.accessRepo.GetShareAccessDailyCounts(shareID, shareAccessDays)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ShareAccessesResponse{
+		Accesses:    accesses,
+		Total:       total,
+		DailyCounts: dailyCounts,
+	}, nil
+}
+
+// ShareAccessReason maps an error from opening or unlocking a share link to
+// the reason recorded in the access log
+func ShareAccessReason(err error) string {
+	switch {
+	case errors.Is(err, ErrShareExpired):
+		return ShareAccessExpired
+	case errors.Is(err, ErrShareExhausted):
+		return ShareAccessExhausted
+	case errors.Is(err, ErrInvalidSharePassword):
+		return ShareAccessInvalidPassword
+	case errors.Is(err, ErrShareLocked):
+		return ShareAccessLocked
+	default:
+		return ShareAccessError
+	}
+}
+
+// truncate cuts s to at most n bytes, dropping invalid UTF-8 the database
+// would reject
+func truncate(s string, n int) string {
+	if len(s) > n {
+		s = s[:n]
+	}
+	return strings.ToValidUTF8(s, "")
+}
@@ -0,0 +1,405 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/cache"
+)
+
+// tokenGenerationTTL is how long the token generation of a user is cached.
+// Instances that do not share a cache notice a logout of all sessions at
+// most this late.
+const tokenGenerationTTL = time.Minute
+
+// sessionSeenInterval is how often the last seen time of a session is
+// recorded while its access tokens are used
+const sessionSeenInterval = time.Minute
+
+var (
+	// ErrInvalidRefreshToken is returned when a refresh token cannot be
+	// exchanged because it is unknown, expired, revoked or was used before
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+	// ErrTokenRevoked is returned when an access token was revoked by
+	// logging out
+	ErrTokenRevoked = errors.New("token has been revoked")
+
+	// ErrSessionNotFound is returned when a session does not exist, has
+	// ended or does not belong to the user
+	ErrSessionNotFound = errors.New("session not found")
+)
+
+// TokenService issues the tokens of a login session: a short-lived access
+// token and a refresh token exchanged for new tokens once the access token
+// expires. Each refresh token can be exchanged once; replaying one revokes
+// the session it belongs to.
+//
+// Access tokens can be revoked before they expire: one at a time by their
+// ID, with their whole session, or all tokens of a user at once by bumping
+// the user's token generation. Revoked token and session IDs are kept in
+// the cache until the tokens would have expired anyway.
+type TokenService struct {
+	userRepo    *db.UserRepository
+	refreshRepo *db.RefreshTokenRepository
+	sessionRepo *db.SessionRepository
+	jwtAuth     *auth.JWTAuth
+	cache       cache.Cache
+	refreshTTL  time.Duration
+}
+
+// NewTokenService creates a new token service. Refresh tokens expire after
+// refreshTTL unless exchanged first. Revoked tokens are tracked in cache,
+// which must be shared by all instances for revocations to reach them.
+func NewTokenService(userRepo *db.UserRepository, refreshRepo *db.RefreshTokenRepository, sessionRepo *db.SessionRepository, jwtAuth *auth.JWTAuth, cache cache.Cache, refreshTTL time.Duration) *TokenService {
+	return &TokenService{
+		userRepo:    userRepo,
+		refreshRepo: refreshRepo,
+		sessionRepo: sessionRepo,
+		jwtAuth:     jwtAuth,
+		cache:       cache,
+		refreshTTL:  refreshTTL,
+	}
+}
+
+// IssueTokens starts a session for a user who just logged in from client
+// and issues its tokens
+func (s *TokenService) IssueTokens(ctx context.Context, user *models.User, client *models.Session) (*models.AuthResponse, error) {
+	// Keep the table from growing with every refresh
+	_ = s.refreshRepo.DeleteExpiredRefreshTokens(user.ID)
+
+	refreshToken, tokenHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := time.Now().Add(s.refreshTTL)
+
+	session := &models.Session{
+		UserID:      user.ID,
+		IPAddress:   client.IPAddress,
+		UserAgent:   client.UserAgent,
+		DeviceLabel: client.DeviceLabel,
+		ExpiresAt:   expiresAt,
+	}
+	if session.DeviceLabel == "" {
+		session.DeviceLabel = deviceLabel(session.UserAgent)
+	}
+
+	err = s.sessionRepo.CreateSession(session)
+	if err != nil {
+		return nil, err
+	}
+
+	stored := &models.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  session.ID,
+		TokenHash: tokenHash,
+		ExpiresAt: expiresAt,
+	}
+
+	err = s.refreshRepo.CreateRefreshToken(stored)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.respond(user, refreshToken, stored)
+}
+
+// Refresh exchanges a refresh token for new tokens of the same session
+func (s *TokenService) Refresh(ctx context.Context, refreshToken string) (*models.AuthResponse, error) {
+	nextToken, nextHash, err := auth.NewRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	next := &models.RefreshToken{
+		TokenHash: nextHash,
+		ExpiresAt: time.Now().Add(s.refreshTTL),
+	}
+
+	err = s.refreshRepo.RotateRefreshToken(auth.HashToken(refreshToken), next)
+	if err != nil {
+		if errors.Is(err, db.ErrRefreshTokenReused) {
+			// The session was revoked; its access tokens go with it
+			_ = s.markSessionRevoked(ctx, next.FamilyID)
+			return nil, ErrInvalidRefreshToken
+		}
+		if errors.Is(err, db.ErrRefreshTokenInvalid) {
+			return nil, ErrInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	user, err := s.userRepo.GetUserByID(next.UserID)
+	if err != nil {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	return s.respond(user, nextToken, next)
+}
+
+// Authenticate validates an access token and checks that neither it nor its
+// session has been revoked
+func (s *TokenService) Authenticate(ctx context.Context, tokenString string) (*auth.JWTClaims, error) {
+	claims, err := s.jwtAuth.ValidateToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.ID != "" && s.isMarked(ctx, revokedTokenKey(claims.ID)) {
+		return nil, ErrTokenRevoked
+	}
+
+	if claims.SessionID != "" && s.isMarked(ctx, revokedSessionKey(claims.SessionID)) {
+		return nil, ErrTokenRevoked
+	}
+
+	generation, err := s.tokenGeneration(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Generation != generation {
+		return nil, ErrTokenRevoked
+	}
+
+	// The session is looked up in the database as well while it is not
+	// marked as seen, so its revocation is noticed even if it could not be
+	// marked in the cache
+	if claims.SessionID != "" && !s.isMarked(ctx, sessionSeenKey(claims.SessionID)) {
+		revoked, err := s.sessionRepo.TouchSession(claims.SessionID)
+		if err != nil {
+			return nil, err
+		}
+
+		if revoked {
+			_ = s.markSessionRevoked(ctx, claims.SessionID)
+			return nil, ErrTokenRevoked
+		}
+
+		_ = s.cache.Set(ctx, sessionSeenKey(claims.SessionID), true, sessionSeenInterval)
+	}
+
+	return claims, nil
+}
+
+// Logout revokes an access token along with its session and, if given, the
+// refresh token of the same login
+func (s *TokenService) Logout(ctx context.Context, claims *auth.JWTClaims, refreshToken string) error {
+	if claims.SessionID != "" {
+		err := s.RevokeSession(ctx, claims.UserID, claims.SessionID)
+		if err != nil && !errors.Is(err, ErrSessionNotFound) {
+			return err
+		}
+	}
+
+	if refreshToken != "" {
+		err := s.refreshRepo.RevokeRefreshTokenFamily(auth.HashToken(refreshToken), claims.UserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Tokens issued before tokens had IDs can only be revoked all at once
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+
+	err := s.cache.Set(ctx, revokedTokenKey(claims.ID), true, ttl)
+	if err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+
+	return nil
+}
+
+// LogoutAll revokes all sessions and tokens of a user
+func (s *TokenService) LogoutAll(ctx context.Context, userID int64) error {
+	sessionIDs, err := s.sessionRepo.RevokeUserSessions(userID)
+	if err != nil {
+		return err
+	}
+
+	// The generation bump below revokes their access tokens as well
+	for _, id := range sessionIDs {
+		_ = s.markSessionRevoked(ctx, id)
+	}
+
+	generation, err := s.userRepo.IncrementTokenGeneration(userID)
+	if err != nil {
+		return err
+	}
+
+	_ = s.cache.Set(ctx, tokenGenerationKey(userID), generation, tokenGenerationTTL)
+
+	return nil
+}
+
+// ListSessions lists the active sessions of a user, marking the session
+// with ID currentID as current
+func (s *TokenService) ListSessions(ctx context.Context, userID int64, currentID string) ([]models.Session, error) {
+	sessions, err := s.sessionRepo.GetUserSessions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+
+	return sessions, nil
+}
+
+// RevokeSession ends a session of a user. Its refresh tokens stop working
+// and so do its access tokens, right away.
+func (s *TokenService) RevokeSession(ctx context.Context, userID int64, sessionID string) error {
+	err := s.sessionRepo.RevokeSession(sessionID, userID)
+	if errors.Is(err, db.ErrSessionNotFound) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Without the mark its access tokens still work until the session is
+	// next looked up in the database
+	err = s.markSessionRevoked(ctx, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke session tokens: %w", err)
+	}
+
+	return nil
+}
+
+// markSessionRevoked rejects the access tokens of a session until they
+// would have expired anyway
+func (s *TokenService) markSessionRevoked(ctx context.Context, sessionID string) error {
+	if sessionID == "" {
+		return nil
+	}
+
+	return s.cache.Set(ctx, revokedSessionKey(sessionID), true, s.jwtAuth.TokenDuration())
+}
+
+// isMarked reports whether a flag is set in the cache
+func (s *TokenService) isMarked(ctx context.Context, key string) bool {
+	var marked bool
+	return s.cache.Get(ctx, key, &marked) == nil && marked
+}
+
+// tokenGeneration gets the current token generation of a user
+func (s *TokenService) tokenGeneration(ctx context.Context, userID int64) (int64, error) {
+	var generation int64
+	if s.cache.Get(ctx, tokenGenerationKey(userID), &generation) == nil {
+		return generation, nil
+	}
+
+	generation, err := s.userRepo.GetTokenGeneration(userID)
+	if err != nil {
+		return 0, err
+	}
+
+	_ = s.cache.Set(ctx, tokenGenerationKey(userID), generation, tokenGenerationTTL)
+
+	return generation, nil
+}
+
+// respond creates an access token for the user to go with a refresh token
+func (s *TokenService) respond(user *models.User, refreshToken string, stored *models.RefreshToken) (*models.AuthResponse, error) {
+	token, expiresAt, err := s.jwtAuth.GenerateToken(user, stored.FamilyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.AuthResponse{
+		Token:            token,
+		ExpiresAt:        expiresAt.Unix(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: stored.ExpiresAt.Unix(),
+		SessionID:        stored.FamilyID,
+	}, nil
+}
+
+// revokedTokenKey is the cache key marking an access token as revoked
+func revokedTokenKey(tokenID string) string {
+	return fmt.Sprintf("revoked_token:%s", tokenID)
+}
+
+// revokedSessionKey is the cache key marking the access tokens of a session
+// as revoked
+func revokedSessionKey(sessionID string) string {
+	return fmt.Sprintf("revoked_session:%s", sessionID)
+}
+
+// sessionSeenKey is the cache key set while the last seen time of a session
+// is recent enough
+func sessionSeenKey(sessionID string) string {
+	return fmt.Sprintf("session_seen:%s", sessionID)
+}
+
+// tokenGenerationKey is the cache key holding the token generation of a user
+func tokenGenerationKey(userID int64) string {
+	return fmt.Sprintf("token_generation:%d", userID)
+}
+
+// Markers in user agents and the browser or OS they identify, most specific
+// first
+var (
+	browserNames = [][2]string{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	}
+	osNames = [][2]string{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	}
+)
+
+// deviceLabel derives a label such as "Firefox on Linux" from a user agent
+func deviceLabel(userAgent string) string {
+	browser := matchName(userAgent, browserNames)
+	os := matchName(userAgent, osNames)
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return os
+	default:
+		return "Unknown device"
+	}
+}
+
+// matchName returns the name of the first marker found in userAgent
+func matchName(userAgent string, names [][2]string) string {
+	for _, name := range names {
+		if strings.Contains(userAgent, name[0]) {
+			return name[1]
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,268 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/auth"
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/pkg/cache"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// failingCache is a cache that cannot be written to
+type failingCache struct {
+	cache.Cache
+}
+
+func (c *failingCache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	return errors.New("cache unavailable")
+}
+
+// newTestTokenService creates a token service on the mock database
+func newTestTokenService(database *db.Database, tokenCache cache.Cache) *TokenService {
+	return NewTokenService(db.NewUserRepository(database), db.NewRefreshTokenRepository(database), db.NewSessionRepository(database), auth.NewJWTAuth("secret", time.Hour), tokenCache, time.Hour)
+}
+
+// issueToken issues an access token of user 1 in session-1
+func issueToken(t *testing.T, tokenService *TokenService, generation int64) string {
+	t.Helper()
+
+	token, _, err := tokenService.jwtAuth.GenerateToken(&models.User{ID: 1, TokenGeneration: generation}, "session-1")
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+
+	return token
+}
+
+// expectSessionTouched expects session-1 to be looked up as it is used
+func expectSessionTouched(mock sqlmock.Sqlmock, revoked bool) {
+	mock.ExpectQuery("UPDATE sessions SET last_seen_at").WithArgs(sqlmock.AnyArg(), "session-1").
+		WillReturnRows(sqlmock.NewRows([]string{"revoked"}).AddRow(revoked))
+}
+
+func TestDeviceLabel(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "Chrome on Windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "Edge on Windows"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", "Firefox on Linux"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Mobile/15E148 Safari/604.1", "Safari on iOS"},
+		{"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"curl/8.4.0", "curl"},
+		{"", "Unknown device"},
+	}
+
+	for _, tt := range tests {
+		if got := deviceLabel(tt.userAgent); got != tt.want {
+			t.Errorf("deviceLabel(%q) = %q, want %q", tt.userAgent, got, tt.want)
+		}
+	}
+}
+
+func TestAuthenticateChecksRevokedSessionsInDatabase(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	tokenCache := cache.NewMemoryCache()
+	tokenService := newTestTokenService(database, tokenCache)
+	token := issueToken(t, tokenService, 0)
+
+	// The session was revoked, but marking it in the cache failed
+	mock.ExpectQuery("SELECT token_generation FROM users").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(0))
+	expectSessionTouched(mock, true)
+
+	_, err := tokenService.Authenticate(context.Background(), token)
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected the token of the revoked session to be rejected, got %v", err)
+	}
+
+	// From then on the cache knows
+	_, err = tokenService.Authenticate(context.Background(), token)
+	if !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("expected the token to stay rejected, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRevokeSessionErrors(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	tokenService := newTestTokenService(database, &failingCache{Cache: cache.NewMemoryCache()})
+
+	// Unknown session
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := tokenService.RevokeSession(context.Background(), 1, "session-1")
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	// Database error
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	err = tokenService.RevokeSession(context.Background(), 1, "session-1")
+	if err == nil || errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected the database error, got %v", err)
+	}
+
+	// Revoked, but its access tokens could not be marked
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = tokenService.RevokeSession(context.Background(), 1, "session-1")
+	if err == nil || errors.Is(err, ErrSessionNotFound) {
+		t.Errorf("expected the cache error, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// claimsOf validates a token issued by the token service
+func claimsOf(t *testing.T, tokenService *TokenService, token string) *auth.JWTClaims {
+	t.Helper()
+
+	claims, err := tokenService.jwtAuth.ValidateToken(token)
+	if err != nil {
+		t.Fatalf("failed to validate token: %v", err)
+	}
+
+	return claims
+}
+
+func TestLogoutRevokesTokenByID(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	tokenService := newTestTokenService(database, cache.NewMemoryCache())
+
+	user := &models.User{ID: 1}
+	loggedOut, _, _ := tokenService.jwtAuth.GenerateToken(user, "")
+	other, _, _ := tokenService.jwtAuth.GenerateToken(user, "")
+
+	err := tokenService.Logout(context.Background(), claimsOf(t, tokenService, loggedOut), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, err := tokenService.Authenticate(context.Background(), loggedOut); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected the logged out token to be revoked, got %v", err)
+	}
+
+	// Other tokens of the user are not affected
+	mock.ExpectQuery("SELECT token_generation FROM users").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(0))
+
+	if _, err := tokenService.Authenticate(context.Background(), other); err != nil {
+		t.Errorf("expected the other token to still work, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogoutRevokesSession(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	tokenService := newTestTokenService(database, cache.NewMemoryCache())
+
+	loggedOut := issueToken(t, tokenService, 0)
+	sameSession := issueToken(t, tokenService, 0)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), "session-1", int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE sessions SET revoked_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").WithArgs(sqlmock.AnyArg(), "session-1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE refresh_tokens").WithArgs(sqlmock.AnyArg(), auth.HashToken("refresh"), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := tokenService.Logout(context.Background(), claimsOf(t, tokenService, loggedOut), "refresh")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Every access token of the session goes with it
+	for _, token := range []string{loggedOut, sameSession} {
+		if _, err := tokenService.Authenticate(context.Background(), token); !errors.Is(err, ErrTokenRevoked) {
+			t.Errorf("expected the token to be revoked, got %v", err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogoutAllRevokesEveryToken(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	tokenService := newTestTokenService(database, cache.NewMemoryCache())
+
+	user := &models.User{ID: 1}
+	before, _, _ := tokenService.jwtAuth.GenerateToken(user, "")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE sessions SET revoked_at").WithArgs(sqlmock.AnyArg(), int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("session-1"))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at").WithArgs(sqlmock.AnyArg(), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectQuery("UPDATE users").WithArgs(sqlmock.AnyArg(), int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(1))
+
+	err := tokenService.LogoutAll(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Tokens issued before carry the old generation
+	if _, err := tokenService.Authenticate(context.Background(), before); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected the earlier token to be revoked, got %v", err)
+	}
+
+	user.TokenGeneration = 1
+	after, _, _ := tokenService.jwtAuth.GenerateToken(user, "")
+	if _, err := tokenService.Authenticate(context.Background(), after); err != nil {
+		t.Errorf("expected a token issued after to work, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAuthenticateChecksGenerationInDatabase(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	tokenService := newTestTokenService(database, cache.NewMemoryCache())
+
+	token, _, _ := tokenService.jwtAuth.GenerateToken(&models.User{ID: 1}, "")
+
+	// The generation was bumped by another instance and is not cached here
+	mock.ExpectQuery("SELECT token_generation FROM users").WithArgs(int64(1)).
+		WillReturnRows(sqlmock.NewRows([]string{"token_generation"}).AddRow(3))
+
+	if _, err := tokenService.Authenticate(context.Background(), token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected the token to be revoked, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,373 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+)
+
+var (
+	// ErrOffsetMismatch is returned when a chunk does not start at the current upload offset
+	ErrOffsetMismatch = errors.New("upload offset mismatch")
+
+	// ErrUploadExpired is returned for an upload session that received no
+	// data within the session TTL and is waiting to be cleaned up
+	ErrUploadExpired = errors.New("upload expired")
+)
+
+// UploadService handles resumable uploads. Chunks are appended to a staging
+// file on local disk and the session offset is persisted after every chunk,
+// so an interrupted upload can continue after a reconnect or server restart.
+// Once the last byte arrives the staged file is handed to FileService.
+type UploadService struct {
+	uploadRepo  *db.UploadRepository
+	fileService *FileService
+	stagingPath string
+	sessionTTL  time.Duration
+
+	locksMutex sync.Mutex
+	locks      map[string]*uploadLock
+}
+
+// uploadLock is a per-session mutex, dropped once no request references it
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewUploadService creates a new upload service
+func NewUploadService(uploadRepo *db.UploadRepository, fileService *FileService, stagingPath string, sessionTTL time.Duration) (*UploadService, error) {
+	err := os.MkdirAll(stagingPath, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload staging directory: %w", err)
+	}
+
+	return &UploadService{
+		uploadRepo:  uploadRepo,
+		fileService: fileService,
+		stagingPath: stagingPath,
+		sessionTTL:  sessionTTL,
+		locks:       make(map[string]*uploadLock),
+	}, nil
+}
+
+// CreateUpload starts a new upload session for a file to be added to a
+// folder of the user, the root folder when folderID is empty. The completed
+// upload is rejected if it does not match the expected checksums that are set.
+func (s *UploadService) CreateUpload(ctx context.Context, userID int64, folderID, fileName, contentType string, size int64, expected models.Checksums) (*models.UploadSession, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid upload size: %d", size)
+	}
+
+	// Fail before any bytes are sent rather than once the upload completes
+	err := s.fileService.checkDestination(userID, folderID, fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = s.fileService.quotas.checkQuota(ctx, userID, size, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &models.UploadSession{
+		UserID:      userID,
+		FolderID:    folderID,
+		FileName:    fileName,
+		ContentType: contentType,
+		Size:        size,
+		ExpiresAt:   time.Now().Add(s.sessionTTL),
+
+		ExpectedSHA256: expected.SHA256,
+		ExpectedMD5:    expected.MD5,
+	}
+
+	err = s.uploadRepo.CreateUploadSession(session)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create upload session: %w", err)
+	}
+
+	// Create the empty staging file up front so a HEAD right after
+	// creation sees a consistent state
+	file, err := os.Create(s.stagedPath(session.ID))
+	if err != nil {
+		_ = s.uploadRepo.DeleteUploadSession(session.ID)
+		return nil, fmt.Errorf("failed to create staging file: %w", err)
+	}
+	file.Close()
+
+	return session, nil
+}
+
+// GetUpload gets an upload session owned by the user, failing with
+// ErrUploadExpired once it has expired
+func (s *UploadService) GetUpload(ctx context.Context, uploadID string, userID int64) (*models.UploadSession, error) {
+	session, err := s.getUpload(uploadID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if expired(session) {
+		return nil, ErrUploadExpired
+	}
+
+	return session, nil
+}
+
+// getUpload gets an upload session owned by the user, expired or not
+func (s *UploadService) getUpload(uploadID string, userID int64) (*models.UploadSession, error) {
+	session, err := s.uploadRepo.GetUploadSession(uploadID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("upload not found: %w", err)
+	}
+
+	return session, nil
+}
+
+// expired reports whether an upload session is past its TTL
+func expired(session *models.UploadSession) bool {
+	return !time.Now().Before(session.ExpiresAt)
+}
+
+// WriteChunk appends a chunk to an upload starting at offset. It returns the
+// updated session and, once all bytes have been received, the finished file.
+// Bytes that made it to disk before a read error are kept so the client can
+// resume from the new offset. An expired session takes no more chunks.
+func (s *UploadService) WriteChunk(ctx context.Context, uploadID string, userID int64, offset int64, chunk io.Reader) (*models.UploadSession, *models.File, error) {
+	session, err := s.lockUpload(ctx, uploadID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer s.unlock(session.ID)
+
+	if expired(session) {
+		return nil, nil, ErrUploadExpired
+	}
+
+	if offset != session.Offset {
+		return session, nil, ErrOffsetMismatch
+	}
+
+	written, writeErr := s.appendChunk(session, chunk)
+
+	if written > 0 {
+		newOffset := session.Offset + written
+		expiresAt := time.Now().Add(s.sessionTTL)
+
+		err = s.uploadRepo.UpdateUploadOffset(session.ID, session.Offset, newOffset, expiresAt)
+		if err != nil {
+			return session, nil, fmt.Errorf("failed to save upload offset: %w", err)
+		}
+
+		session.Offset = newOffset
+		session.ExpiresAt = expiresAt
+	}
+
+	if writeErr != nil {
+		return session, nil, fmt.Errorf("failed to write chunk: %w", writeErr)
+	}
+
+	if session.Offset < session.Size {
+		return session, nil, nil
+	}
+
+	file, err := s.finalize(ctx, session)
+	if err != nil {
+		return session, nil, err
+	}
+
+	return session, file, nil
+}
+
+// CancelUpload discards an upload session and its staged data
+func (s *UploadService) CancelUpload(ctx context.Context, uploadID string, userID int64) error {
+	session, err := s.lockUpload(ctx, uploadID, userID)
+	if err != nil {
+		return err
+	}
+	defer s.unlock(session.ID)
+
+	return s.discard(session.ID)
+}
+
+// CleanupExpiredUploads removes upload sessions that have not received data
+// within the session TTL. Each session is locked first, so a chunk being
+// written when the session expired is not cut off.
+func (s *UploadService) CleanupExpiredUploads(ctx context.Context, batchSize int) (int, error) {
+	sessions, err := s.uploadRepo.GetExpiredUploadSessions(batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get expired upload sessions: %w", err)
+	}
+
+	deletedCount := 0
+
+	for _, session := range sessions {
+		discarded, err := s.discardExpired(session.ID, session.UserID)
+		if err != nil {
+			// Log the error but continue with others
+			continue
+		}
+
+		if discarded {
+			deletedCount++
+		}
+	}
+
+	return deletedCount, nil
+}
+
+// discardExpired discards an upload session if it is still expired once its
+// lock is held, and reports whether it was
+func (s *UploadService) discardExpired(uploadID string, userID int64) (bool, error) {
+	s.lock(uploadID)
+	defer s.unlock(uploadID)
+
+	session, err := s.getUpload(uploadID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if !expired(session) {
+		return false, nil
+	}
+
+	err = s.discard(session.ID)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// appendChunk writes the chunk to the staging file at the session offset,
+// never past the declared upload size
+func (s *UploadService) appendChunk(session *models.UploadSession, chunk io.Reader) (int64, error) {
+	file, err := os.OpenFile(s.stagedPath(session.ID), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open staging file: %w", err)
+	}
+	defer file.Close()
+
+	// Drop any bytes written after the last persisted offset, e.g. by a
+	// request that was cut off before the offset was saved
+	err = file.Truncate(session.Offset)
+	if err != nil {
+		return 0, fmt.Errorf("failed to truncate staging file: %w", err)
+	}
+
+	_, err = file.Seek(session.Offset, io.SeekStart)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek staging file: %w", err)
+	}
+
+	written, copyErr := io.Copy(file, io.LimitReader(chunk, session.Size-session.Offset))
+
+	// Make sure the bytes are on disk before the offset is persisted
+	err = file.Sync()
+	if err != nil {
+		return 0, fmt.Errorf("failed to sync staging file: %w", err)
+	}
+
+	return written, copyErr
+}
+
+// finalize moves a completed upload into file storage. An upload that does
+// not match its expected checksums cannot be resumed, so it is discarded.
+func (s *UploadService) finalize(ctx context.Context, session *models.UploadSession) (*models.File, error) {
+	staged, err := os.Open(s.stagedPath(session.ID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open staging file: %w", err)
+	}
+	defer staged.Close()
+
+	expected := models.Checksums{SHA256: session.ExpectedSHA256, MD5: session.ExpectedMD5}
+
+	file, err := s.fileService.UploadFile(ctx, session.UserID, session.FolderID, session.FileName, session.Size, session.ContentType, staged, expected)
+	if err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			_ = s.discard(session.ID)
+		}
+		return nil, fmt.Errorf("failed to finalize upload: %w", err)
+	}
+
+	_ = s.discard(session.ID)
+
+	return file, nil
+}
+
+// discard deletes the staged data and the session record
+func (s *UploadService) discard(uploadID string) error {
+	err := os.Remove(s.stagedPath(uploadID))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete staging file: %w", err)
+	}
+
+	err = s.uploadRepo.DeleteUploadSession(uploadID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// lockUpload acquires the mutex serializing writes to an upload session and
+// returns the session as stored once the lock is held. The session is looked
+// up first so unknown IDs never get a mutex.
+func (s *UploadService) lockUpload(ctx context.Context, uploadID string, userID int64) (*models.UploadSession, error) {
+	_, err := s.getUpload(uploadID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock(uploadID)
+
+	// Re-read now that no other request can move the offset
+	session, err := s.getUpload(uploadID, userID)
+	if err != nil {
+		s.unlock(uploadID)
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// lock acquires the mutex of an upload session
+func (s *UploadService) lock(uploadID string) {
+	s.locksMutex.Lock()
+	lock, ok := s.locks[uploadID]
+	if !ok {
+		lock = &uploadLock{}
+		s.locks[uploadID] = lock
+	}
+	lock.refs++
+	s.locksMutex.Unlock()
+
+	lock.Lock()
+}
+
+// unlock releases the mutex acquired by lock or lockUpload
+func (s *UploadService) unlock(uploadID string) {
+	s.locksMutex.Lock()
+	defer s.locksMutex.Unlock()
+
+	lock := s.locks[uploadID]
+	lock.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(s.locks, uploadID)
+	}
+}
+
+// stagedPath returns the staging file path for an upload
+func (s *UploadService) stagedPath(uploadID string) string {
+	return filepath.Join(s.stagingPath, uploadID)
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var uploadColumns = []string{"id", "user_id", "file_name", "content_type", "size", "upload_offset", "expires_at"}
+
+// newTestUploadService creates an upload service on the mock database
+// staging uploads in a temporary directory
+func newTestUploadService(t *testing.T, database *db.Database) *UploadService {
+	t.Helper()
+
+	fileService, _ := newTestFileService(t, database)
+	uploadService, err := NewUploadService(db.NewUploadRepository(database), fileService, t.TempDir(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create upload service: %v", err)
+	}
+
+	return uploadService
+}
+
+// expectUpload expects an upload session to be looked up
+func expectUpload(mock sqlmock.Sqlmock, offset int64, expiresAt time.Time) {
+	mock.ExpectQuery("FROM upload_sessions").WithArgs("upload-1", int64(1)).
+		WillReturnRows(sqlmock.NewRows(uploadColumns).
+			AddRow("upload-1", 1, "file.txt", "text/plain", 10, offset, expiresAt))
+}
+
+func TestExpiredUploadsTakeNoChunks(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	uploadService := newTestUploadService(t, database)
+
+	expiresAt := time.Now().Add(-time.Minute)
+
+	expectUpload(mock, 3, expiresAt)
+	_, err := uploadService.GetUpload(context.Background(), "upload-1", 1)
+	if !errors.Is(err, ErrUploadExpired) {
+		t.Errorf("expected the expired upload to be reported, got %v", err)
+	}
+
+	expectUpload(mock, 3, expiresAt)
+	expectUpload(mock, 3, expiresAt)
+	session, _, err := uploadService.WriteChunk(context.Background(), "upload-1", 1, 3, strings.NewReader("chunk"))
+	if !errors.Is(err, ErrUploadExpired) || session != nil {
+		t.Errorf("expected the chunk to be refused, got %+v, %v", session, err)
+	}
+
+	if _, err := os.Stat(uploadService.stagedPath("upload-1")); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be staged, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCleanupExpiredUploadsWaitsForChunks(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	uploadService := newTestUploadService(t, database)
+
+	mock.ExpectQuery("FROM upload_sessions").
+		WillReturnRows(sqlmock.NewRows(uploadColumns).
+			AddRow("upload-1", 1, "file.txt", "text/plain", 10, 3, time.Now().Add(-time.Minute)))
+
+	// A chunk is being written while the session expires
+	uploadService.lock("upload-1")
+
+	done := make(chan int)
+	go func() {
+		count, _ := uploadService.CleanupExpiredUploads(context.Background(), 10)
+		done <- count
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("expected the cleanup to wait for the chunk")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The chunk moved the session's expiry forward
+	expectUpload(mock, 8, time.Now().Add(time.Hour))
+	uploadService.unlock("upload-1")
+
+	if count := <-done; count != 0 {
+		t.Errorf("expected the resumed upload to be kept, got %d removed", count)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCleanupExpiredUploadsDiscardsSessions(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	uploadService := newTestUploadService(t, database)
+
+	staged := uploadService.stagedPath("upload-1")
+	if err := os.WriteFile(staged, []byte("abc"), 0644); err != nil {
+		t.Fatalf("failed to stage upload: %v", err)
+	}
+
+	expiresAt := time.Now().Add(-time.Minute)
+	mock.ExpectQuery("FROM upload_sessions").
+		WillReturnRows(sqlmock.NewRows(uploadColumns).
+			AddRow("upload-1", 1, "file.txt", "text/plain", 10, 3, expiresAt))
+	expectUpload(mock, 3, expiresAt)
+	mock.ExpectExec("DELETE FROM upload_sessions").WithArgs("upload-1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	count, err := uploadService.CleanupExpiredUploads(context.Background(), 10)
+	if err != nil || count != 1 {
+		t.Fatalf("expected 1 upload removed, got %d, %v", count, err)
+	}
+
+	if _, err := os.Stat(staged); !os.IsNotExist(err) {
+		t.Errorf("expected the staged data to be deleted, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,278 @@
+package service
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/internal/models"
+)
+
+// ErrVersionNotFound is returned when a file has no version with the requested number
+var ErrVersionNotFound = errors.New("file version not found")
+
+// VersionService handles the version history of files and prunes previous
+// versions according to each user's retention policy
+type VersionService struct {
+	versionRepo   *db.FileVersionRepository
+	fileService   *FileService
+	defaultPolicy models.VersionRetention
+}
+
+// NewVersionService creates a new version service. Users without a
+// retention policy of their own keep the last defaultKeepLast previous
+// versions of a file, replaced less than defaultKeepDays days ago.
+func NewVersionService(versionRepo *db.FileVersionRepository, fileService *FileService, defaultKeepLast, defaultKeepDays int) *VersionService {
+	return &VersionService{
+		versionRepo: versionRepo,
+		fileService: fileService,
+		defaultPolicy: models.VersionRetention{
+			KeepLast:  defaultKeepLast,
+			KeepDays:  defaultKeepDays,
+			IsDefault: true,
+		},
+	}
+}
+
+// UploadVersion uploads new content for a file owned by the user. The
+// content it replaces is kept as a previous version. The upload is rejected
+// if its content does not match the expected checksums that are set.
+// fileSize, -1 when it is not known in advance, only serves to refuse
+// content over quota before it is read.
+func (s *VersionService) UploadVersion(ctx context.Context, fileID string, userID int64, fileSize int64, contentType string, fileContent io.Reader, expected models.Checksums) (*models.File, error) {
+	file, err := s.getOwnedFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The replaced content is kept, so only the new content counts
+	limit, remaining, err := s.fileService.quotas.checkQuota(ctx, userID, fileSize, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := newQuotaReader(fileContent, remaining)
+	stored, checksums, err := s.fileService.storeContent(reader, file.Name, contentType, expected)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload file: %w", quotaError(reader, err))
+	}
+
+	content := &models.FileVersion{
+		Size:              reader.read,
+		ContentType:       contentType,
+		StoragePath:       stored.StoragePath,
+		PublicURL:         stored.PublicURL,
+		EncryptedKey:      stored.EncryptedKey,
+		EncryptionKeyID:   stored.EncryptionKeyID,
+		EncryptionVersion: stored.EncryptionVersion,
+		BlobHash:          stored.Hash,
+		Checksums:         checksums,
+	}
+
+	_, err = s.versionRepo.AddFileVersion(fileID, userID, content, limit)
+	if err != nil {
+		// Try to cleanup the storage if the version could not be saved
+		s.fileService.discardContent(stored)
+		return nil, fmt.Errorf("failed to save file version: %w", quotaError(reader, err))
+	}
+
+	return s.refreshFile(ctx, fileID, userID)
+}
+
+// ListVersions lists the versions of a file owned by the user, newest
+// first, starting with the current version
+func (s *VersionService) ListVersions(ctx context.Context, fileID string, userID int64) ([]models.FileVersion, error) {
+	file, err := s.getOwnedFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	previous, err := s.versionRepo.GetFileVersions(fileID)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]models.FileVersion, 0, len(previous)+1)
+	versions = append(versions, models.FileVersion{
+		FileID:      file.ID,
+		Version:     file.Version,
+		Size:        file.Size,
+		ContentType: file.ContentType,
+		CreatedAt:   file.VersionCreatedAt,
+		Current:     true,
+		Checksums:   file.Checksums,
+	})
+	versions = append(versions, previous...)
+
+	return versions, nil
+}
+
+// OpenVersion opens a version of a file owned by the user for reading. The
+// returned file describes the requested version rather than the current one.
+func (s *VersionService) OpenVersion(ctx context.Context, fileID string, userID int64, version int) (*models.File, io.ReadSeekCloser, error) {
+	file, err := s.getOwnedFile(fileID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if version == file.Version {
+		return s.fileService.OpenFile(ctx, fileID, userID)
+	}
+
+	fileVersion, err := s.getVersion(fileID, version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := s.fileService.openVersionContent(fileVersion)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file version: %w", err)
+	}
+
+	file.Version = fileVersion.Version
+	file.Size = fileVersion.Size
+	file.ContentType = fileVersion.ContentType
+	file.UpdatedAt = fileVersion.CreatedAt
+	file.Checksums = fileVersion.Checksums
+
+	return file, reader, nil
+}
+
+// RestoreVersion makes a previous version the current version of a file
+// owned by the user. The restored content gets a new version number and the
+// content it replaces is kept as a previous version.
+func (s *VersionService) RestoreVersion(ctx context.Context, fileID string, userID int64, version int) (*models.File, error) {
+	file, err := s.getOwnedFile(fileID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == file.Version {
+		return file, nil
+	}
+
+	_, err = s.versionRepo.RestoreFileVersion(fileID, userID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, fmt.Errorf("failed to restore file version: %w", err)
+	}
+
+	return s.refreshFile(ctx, fileID, userID)
+}
+
+// GetRetentionPolicy gets the version retention policy that applies to a user
+func (s *VersionService) GetRetentionPolicy(ctx context.Context, userID int64) (*models.VersionRetention, error) {
+	policy, err := s.versionRepo.GetRetentionPolicy(userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			defaultPolicy := s.defaultPolicy
+			return &defaultPolicy, nil
+		}
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// SetRetentionPolicy sets the version retention policy of a user. Previous
+// versions outside the new policy are removed on the next pruning run.
+func (s *VersionService) SetRetentionPolicy(ctx context.Context, userID int64, req *models.VersionRetentionRequest) (*models.VersionRetention, error) {
+	policy := &models.VersionRetention{
+		UserID:   userID,
+		KeepLast: req.KeepLast,
+		KeepDays: req.KeepDays,
+	}
+
+	err := s.versionRepo.SetRetentionPolicy(policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// ResetRetentionPolicy returns a user to the default version retention policy
+func (s *VersionService) ResetRetentionPolicy(ctx context.Context, userID int64) (*models.VersionRetention, error) {
+	err := s.versionRepo.DeleteRetentionPolicy(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultPolicy := s.defaultPolicy
+	return &defaultPolicy, nil
+}
+
+// PruneVersions deletes up to batchSize previous file versions that fall
+// outside their owner's retention policy, along with their stored content
+func (s *VersionService) PruneVersions(ctx context.Context, batchSize int) (int, error) {
+	versions, err := s.versionRepo.GetVersionsToPrune(s.defaultPolicy.KeepLast, s.defaultPolicy.KeepDays, batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+
+	for _, version := range versions {
+		// The content is only deleted once the version is gone, as a
+		// concurrent restore may have made it the current version
+		deleted, released, err := s.versionRepo.DeleteFileVersion(version.FileID, version.ID)
+		if err != nil {
+			return pruned, err
+		}
+		if !deleted {
+			continue
+		}
+
+		// Deduplicated content is released along with the version. Content
+		// that fails to delete is left for the storage scrub as an orphan.
+		if version.BlobHash == "" {
+			_ = s.fileService.deleteObject(version.StoragePath)
+		}
+
+		s.fileService.deleteBlobs(released)
+		pruned++
+	}
+
+	return pruned, nil
+}
+
+// getOwnedFile gets a file from the database, checking that the user owns it
+func (s *VersionService) getOwnedFile(fileID string, userID int64) (*models.File, error) {
+	file, err := s.fileService.fileRepo.GetFileByID(fileID)
+	if err != nil || file.UserID != userID {
+		return nil, ErrFileNotFound
+	}
+
+	return file, nil
+}
+
+// getVersion gets a previous version of a file
+func (s *VersionService) getVersion(fileID string, version int) (*models.FileVersion, error) {
+	fileVersion, err := s.versionRepo.GetFileVersion(fileID, version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	return fileVersion, nil
+}
+
+// refreshFile drops a file whose content changed from the cache and reads it back
+func (s *VersionService) refreshFile(ctx context.Context, fileID string, userID int64) (*models.File, error) {
+	_ = s.fileService.cache.InvalidateFile(ctx, fileID)
+	_ = s.fileService.cache.InvalidateUserFiles(ctx, userID)
+
+	file, err := s.fileService.fileRepo.GetFileByID(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file: %w", err)
+	}
+
+	return file, nil
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"file-sharing-platform/internal/db"
+	"file-sharing-platform/pkg/cache"
+	"file-sharing-platform/pkg/storage"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+// newMockDatabase creates a database backed by sqlmock
+func newMockDatabase(t *testing.T) (*db.Database, sqlmock.Sqlmock) {
+	t.Helper()
+
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("failed to create mock database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &db.Database{DB: sqlx.NewDb(conn, "postgres")}, mock
+}
+
+// newTestFileService creates a file service on the mock database storing
+// files in a temporary directory
+func newTestFileService(t *testing.T, database *db.Database) (*FileService, *storage.LocalStorage) {
+	t.Helper()
+
+	store, err := storage.NewLocalStorage(t.TempDir(), "http://localhost")
+	if err != nil {
+		t.Fatalf("failed to create storage: %v", err)
+	}
+
+	fileCache := cache.NewFileCache(cache.NewMemoryCache(), time.Hour)
+	fileService := NewFileService(db.NewFileRepository(database), db.NewFolderRepository(database), db.NewFileVersionRepository(database), db.NewBlobRepository(database), store, fileCache, nil, "http://localhost", false, false)
+
+	return fileService, store
+}
+
+// storeObject stores content and returns its storage path
+func storeObject(t *testing.T, store storage.FileStorage, content string) string {
+	t.Helper()
+
+	storagePath, _, err := store.Upload(strings.NewReader(content), "file.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("failed to store file: %v", err)
+	}
+
+	return storagePath
+}
+
+// exists reports whether an object is still in storage
+func exists(store storage.FileStorage, storagePath string) bool {
+	reader, err := store.Open(storagePath)
+	if err != nil {
+		return false
+	}
+	reader.Close()
+
+	return true
+}
+
+func TestPruneVersionsSkipsRestoredVersions(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileService, store := newTestFileService(t, database)
+	versionService := NewVersionService(db.NewFileVersionRepository(database), fileService, 1, 0)
+
+	restored := storeObject(t, store, "restored")
+	pruned := storeObject(t, store, "pruned")
+
+	mock.ExpectQuery("FROM file_versions").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_id", "version", "storage_path", "blob_hash"}).
+			AddRow("version-1", "file-1", 1, restored, "").
+			AddRow("version-2", "file-2", 1, pruned, ""))
+
+	// The first version was restored while it was waiting for the lock
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM files WHERE id = \\$1 FOR UPDATE").WithArgs("file-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("file-1"))
+	mock.ExpectQuery("DELETE FROM file_versions").WithArgs("version-1", "file-1").
+		WillReturnRows(sqlmock.NewRows([]string{"blob_hash", "size", "user_id"}))
+	mock.ExpectRollback()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM files WHERE id = \\$1 FOR UPDATE").WithArgs("file-2").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("file-2"))
+	mock.ExpectQuery("DELETE FROM file_versions").WithArgs("version-2", "file-2").
+		WillReturnRows(sqlmock.NewRows([]string{"blob_hash", "size", "user_id"}).AddRow("", 6, 1))
+	mock.ExpectExec("UPDATE users").WithArgs(int64(6), int64(0), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	count, err := versionService.PruneVersions(context.Background(), 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 version pruned, got %d", count)
+	}
+
+	if !exists(store, restored) {
+		t.Errorf("expected the content of the restored version to be kept")
+	}
+	if exists(store, pruned) {
+		t.Errorf("expected the content of the pruned version to be deleted")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPruneVersionsKeepsContentUntilDeleted(t *testing.T) {
+	database, mock := newMockDatabase(t)
+	fileService, store := newTestFileService(t, database)
+	versionService := NewVersionService(db.NewFileVersionRepository(database), fileService, 1, 0)
+
+	content := storeObject(t, store, "content")
+
+	mock.ExpectQuery("FROM file_versions").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "file_id", "version", "storage_path", "blob_hash"}).
+			AddRow("version-1", "file-1", 1, content, ""))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM files WHERE id = \\$1 FOR UPDATE").WithArgs("file-1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow("file-1"))
+	mock.ExpectQuery("DELETE FROM file_versions").WithArgs("version-1", "file-1").
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+
+	_, err := versionService.PruneVersions(context.Background(), 10)
+	if err == nil {
+		t.Fatalf("expected the failed deletion to be returned")
+	}
+
+	if !exists(store, content) {
+		t.Errorf("expected the content to be kept while its version exists")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
@@ -5,21 +5,37 @@ import (
 	"log"
 	"net/http"
 	"sync"
-
-	"file-sharing-platform/internal/auth"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+const (
+	// writeWait is the time allowed to write a message to a client
+	writeWait = 10 * time.Second
+
+	// sendBufferSize is the number of messages queued for a client. Messages
+	// to a client that falls further behind are dropped.
+	sendBufferSize = 16
+)
+
+// client is a WebSocket connection of a user. Messages are queued on send
+// and written by the connection's own writer goroutine, so a slow client
+// never holds up whoever sends the notification.
+type client struct {
+	conn *websocket.Conn
+	send chan []byte
+}
+
 type NotificationHub struct {
-	clients  map[int64][]*websocket.Conn
+	clients  map[int64][]*client
 	mu       sync.RWMutex
 	upgrader websocket.Upgrader
 }
 
 func NewNotificationHub() *NotificationHub {
 	return &NotificationHub{
-		clients: make(map[int64][]*websocket.Conn),
+		clients: make(map[int64][]*client),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -31,14 +47,9 @@ func NewNotificationHub() *NotificationHub {
 	}
 }
 
-func (hub *NotificationHub) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
-	// Get user ID from JWT token
-	userID, err := auth.GetUserIDFromRequest(r)
-	if err != nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
-		return
-	}
-
+// HandleWebSocket upgrades a request of an authenticated user to a
+// WebSocket receiving the user's notifications
+func (hub *NotificationHub) HandleWebSocket(w http.ResponseWriter, r *http.Request, userID int64) {
 	// Upgrade HTTP connection to WebSocket
 	conn, err := hub.upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -46,30 +57,39 @@ func (hub *NotificationHub) HandleWebSocket(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	c := &client{
+		conn: conn,
+		send: make(chan []byte, sendBufferSize),
+	}
+
 	// Register client
-	hub.registerClient(userID, conn)
+	hub.registerClient(userID, c)
 
-	// Start listening for close events
-	go hub.listenForClose(userID, conn)
+	// Start writing queued messages and listening for close events
+	go c.writeMessages()
+	go hub.listenForClose(userID, c)
 }
 
-func (hub *NotificationHub) registerClient(userID int64, conn *websocket.Conn) {
+func (hub *NotificationHub) registerClient(userID int64, c *client) {
 	hub.mu.Lock()
 	defer hub.mu.Unlock()
 
-	hub.clients[userID] = append(hub.clients[userID], conn)
+	hub.clients[userID] = append(hub.clients[userID], c)
 }
 
-func (hub *NotificationHub) unregisterClient(userID int64, conn *websocket.Conn) {
+// unregisterClient removes a connection and closes its queue, which stops
+// its writer goroutine
+func (hub *NotificationHub) unregisterClient(userID int64, c *client) {
 	hub.mu.Lock()
 	defer hub.mu.Unlock()
 
 	// Find and remove the connection
-	conns := hub.clients[userID]
-	for i, c := range conns {
-		if c == conn {
+	clients := hub.clients[userID]
+	for i, other := range clients {
+		if other == c {
 			// Remove this connection
-			hub.clients[userID] = append(conns[:i], conns[i+1:]...)
+			hub.clients[userID] = append(clients[:i], clients[i+1:]...)
+			close(c.send)
 			break
 		}
 	}
@@ -80,13 +100,13 @@ func (hub *NotificationHub) unregisterClient(userID int64, conn *websocket.Conn)
 	}
 }
 
-func (hub *NotificationHub) listenForClose(userID int64, conn *websocket.Conn) {
-	defer conn.Close()
-	defer hub.unregisterClient(userID, conn)
+func (hub *NotificationHub) listenForClose(userID int64, c *client) {
+	defer c.conn.Close()
+	defer hub.unregisterClient(userID, c)
 
 	// Simple listener for close messages
 	for {
-		_, _, err := conn.ReadMessage()
+		_, _, err := c.conn.ReadMessage()
 		if err != nil {
 			// Connection closed or error
 			break
@@ -94,16 +114,33 @@ func (hub *NotificationHub) listenForClose(userID int64, conn *websocket.Conn) {
 	}
 }
 
+// writeMessages writes the messages queued for the client until its queue
+// is closed. A write that does not finish in time closes the connection,
+// which ends the listener and unregisters the client.
+func (c *client) writeMessages() {
+	for message := range c.send {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+		err := c.conn.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			log.Println("Error sending WebSocket message:", err)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// NotifyUser queues a message for every connection of the user without
+// waiting for it to be written. Connections that are too far behind miss
+// the message.
 func (hub *NotificationHub) NotifyUser(userID int64, message string) {
 	hub.mu.RLock()
-	conns := hub.clients[userID]
-	hub.mu.RUnlock()
+	defer hub.mu.RUnlock()
 
-	for _, conn := range conns {
-		err := conn.WriteMessage(websocket.TextMessage, []byte(message))
-		if err != nil {
-			log.Println("Error sending WebSocket message:", err)
-			// We'll let the listen goroutine handle connection cleanup
+	for _, c := range hub.clients[userID] {
+		select {
+		case c.send <- []byte(message):
+		default:
+			log.Println("Dropping WebSocket message for a slow client")
 		}
 	}
 }
@@ -0,0 +1,133 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"file-sharing-platform/internal/service"
+)
+
+// KeyRotationWorker is a worker that re-wraps file data keys under the
+// current master key after a key rotation. It runs every interval, and when
+// triggered by an admin.
+type KeyRotationWorker struct {
+	fileService  *service.FileService
+	interval     time.Duration
+	batchSize    int
+	triggerChan  chan struct{}
+	stopChan     chan struct{}
+	wg           sync.WaitGroup
+	isRunning    bool
+	runningMutex sync.Mutex
+}
+
+// NewKeyRotationWorker creates a new key rotation worker
+func NewKeyRotationWorker(fileService *service.FileService, interval time.Duration, batchSize int) *KeyRotationWorker {
+	return &KeyRotationWorker{
+		fileService: fileService,
+		interval:    interval,
+		batchSize:   batchSize,
+		triggerChan: make(chan struct{}, 1),
+		stopChan:    make(chan struct{}),
+	}
+}
+
+// Start starts the worker
+func (w *KeyRotationWorker) Start() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if w.isRunning {
+		return
+	}
+
+	w.isRunning = true
+	w.wg.Add(1)
+
+	go w.run()
+
+	log.Println("Key rotation worker started")
+}
+
+// Stop stops the worker
+func (w *KeyRotationWorker) Stop() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if !w.isRunning {
+		return
+	}
+
+	close(w.stopChan)
+	w.wg.Wait()
+	w.isRunning = false
+
+	log.Println("Key rotation worker stopped")
+}
+
+// Trigger makes the worker re-wrap keys now instead of at the next interval.
+// It returns false if the worker is not running. A run already pending is
+// not queued twice.
+func (w *KeyRotationWorker) Trigger() bool {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if !w.isRunning {
+		return false
+	}
+
+	select {
+	case w.triggerChan <- struct{}{}:
+	default:
+	}
+
+	return true
+}
+
+// run runs the worker
+func (w *KeyRotationWorker) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// Run once on startup
+	w.rewrapKeys()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.rewrapKeys()
+		case <-w.triggerChan:
+			w.rewrapKeys()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// rewrapKeys re-wraps all file keys not yet wrapped under the current
+// master key, until done or the worker is stopped
+func (w *KeyRotationWorker) rewrapKeys() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		select {
+		case <-w.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	count, err := w.fileService.RewrapFileKeys(ctx, w.batchSize)
+	if err != nil {
+		log.Printf("Error re-wrapping file keys: %v", err)
+	}
+
+	if count > 0 {
+		log.Printf("Re-wrapped %d file keys under the current master key", count)
+	}
+}
@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"file-sharing-platform/internal/models"
+	"file-sharing-platform/internal/service"
+)
+
+// ScrubWorker is a worker that periodically reconciles file storage with
+// the database and logs what it finds
+type ScrubWorker struct {
+	scrubService *service.ScrubService
+	options      models.ScrubOptions
+	interval     time.Duration
+	stopChan     chan struct{}
+	wg           sync.WaitGroup
+	isRunning    bool
+	runningMutex sync.Mutex
+}
+
+// NewScrubWorker creates a new storage scrub worker
+func NewScrubWorker(scrubService *service.ScrubService, options models.ScrubOptions, interval time.Duration) *ScrubWorker {
+	return &ScrubWorker{
+		scrubService: scrubService,
+		options:      options,
+		interval:     interval,
+		stopChan:     make(chan struct{}),
+	}
+}
+
+// Start starts the worker
+func (w *ScrubWorker) Start() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if w.isRunning {
+		return
+	}
+
+	w.isRunning = true
+	w.wg.Add(1)
+
+	go w.run()
+
+	log.Println("Storage scrub worker started")
+}
+
+// Stop stops the worker, interrupting a scrub in progress
+func (w *ScrubWorker) Stop() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if !w.isRunning {
+		return
+	}
+
+	close(w.stopChan)
+	w.wg.Wait()
+	w.isRunning = false
+
+	log.Println("Storage scrub worker stopped")
+}
+
+// run runs the worker
+func (w *ScrubWorker) run() {
+	defer w.wg.Done()
+
+	// A scrub can take long on large stores, so it is cancelled on stop
+	// rather than bounded by a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-w.stopChan
+		cancel()
+	}()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// Run once on startup
+	w.scrub(ctx)
+
+	for {
+		select {
+		case <-ticker.C:
+			w.scrub(ctx)
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// scrub runs a scrub and logs its findings
+func (w *ScrubWorker) scrub(ctx context.Context) {
+	report, err := w.scrubService.Scrub(ctx, w.options)
+	if err != nil {
+		log.Printf("Error scrubbing storage: %v", err)
+		return
+	}
+
+	for _, ref := range report.MissingObjects {
+		log.Printf("Storage scrub: %s %s refers to missing object %s", ref.Kind, ref.ID, ref.StoragePath)
+	}
+
+	for _, ref := range report.CorruptObjects {
+		log.Printf("Storage scrub: %s %s has corrupt content at %s", ref.Kind, ref.ID, ref.StoragePath)
+	}
+
+	for _, path := range report.OrphanObjects {
+		if report.DryRun {
+			log.Printf("Storage scrub: orphaned object %s (dry run, would %s)", path, w.options.OrphanAction)
+		} else {
+			log.Printf("Storage scrub: orphaned object %s", path)
+		}
+	}
+
+	log.Printf(
+		"Storage scrub finished in %s: %d objects listed, %d verified, %d missing, %d corrupt, %d orphaned, %d quarantined, %d deleted, %d failed",
+		report.FinishedAt.Sub(report.StartedAt).Round(time.Second),
+		report.ObjectsListed,
+		report.ObjectsVerified,
+		len(report.MissingObjects),
+		len(report.CorruptObjects),
+		len(report.OrphanObjects),
+		report.Quarantined,
+		report.Deleted,
+		report.Failed,
+	)
+}
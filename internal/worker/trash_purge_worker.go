@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"file-sharing-platform/internal/service"
+)
+
+// TrashPurgeWorker is a worker that permanently deletes files that have been
+// in the trash for longer than the retention window
+type TrashPurgeWorker struct {
+	fileService  *service.FileService
+	retention    time.Duration
+	interval     time.Duration
+	batchSize    int
+	stopChan     chan struct{}
+	wg           sync.WaitGroup
+	isRunning    bool
+	runningMutex sync.Mutex
+}
+
+// NewTrashPurgeWorker creates a new trash purge worker
+func NewTrashPurgeWorker(fileService *service.FileService, retention, interval time.Duration, batchSize int) *TrashPurgeWorker {
+	return &TrashPurgeWorker{
+		fileService: fileService,
+		retention:   retention,
+		interval:    interval,
+		batchSize:   batchSize,
+		stopChan:    make(chan struct{}),
+	}
+}
+
+// Start starts the worker
+func (w *TrashPurgeWorker) Start() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if w.isRunning {
+		return
+	}
+
+	w.isRunning = true
+	w.wg.Add(1)
+
+	go w.run()
+
+	log.Println("Trash purge worker started")
+}
+
+// Stop stops the worker
+func (w *TrashPurgeWorker) Stop() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if !w.isRunning {
+		return
+	}
+
+	close(w.stopChan)
+	w.wg.Wait()
+	w.isRunning = false
+
+	log.Println("Trash purge worker stopped")
+}
+
+// run runs the worker
+func (w *TrashPurgeWorker) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// Run once on startup
+	w.purgeTrash()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.purgeTrash()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// purgeTrash purges trashed files until none are left to purge
+func (w *TrashPurgeWorker) purgeTrash() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	total := 0
+	for {
+		count, err := w.fileService.PurgeTrash(ctx, w.retention, w.batchSize)
+		total += count
+		if err != nil {
+			log.Printf("Error purging trash: %v", err)
+			break
+		}
+
+		// A short batch means nothing is left, or the rest failed and is
+		// retried on the next run
+		if count < w.batchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Purged %d files from the trash", total)
+	}
+}
@@ -0,0 +1,100 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"file-sharing-platform/internal/service"
+)
+
+// UploadCleanupWorker is a worker that removes abandoned upload sessions
+type UploadCleanupWorker struct {
+	uploadService *service.UploadService
+	interval      time.Duration
+	batchSize     int
+	stopChan      chan struct{}
+	wg            sync.WaitGroup
+	isRunning     bool
+	runningMutex  sync.Mutex
+}
+
+// NewUploadCleanupWorker creates a new upload cleanup worker
+func NewUploadCleanupWorker(uploadService *service.UploadService, interval time.Duration, batchSize int) *UploadCleanupWorker {
+	return &UploadCleanupWorker{
+		uploadService: uploadService,
+		interval:      interval,
+		batchSize:     batchSize,
+		stopChan:      make(chan struct{}),
+	}
+}
+
+// Start starts the worker
+func (w *UploadCleanupWorker) Start() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if w.isRunning {
+		return
+	}
+
+	w.isRunning = true
+	w.wg.Add(1)
+
+	go w.run()
+
+	log.Println("Upload cleanup worker started")
+}
+
+// Stop stops the worker
+func (w *UploadCleanupWorker) Stop() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if !w.isRunning {
+		return
+	}
+
+	close(w.stopChan)
+	w.wg.Wait()
+	w.isRunning = false
+
+	log.Println("Upload cleanup worker stopped")
+}
+
+// run runs the worker
+func (w *UploadCleanupWorker) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// Run once on startup
+	w.cleanupUploads()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.cleanupUploads()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// cleanupUploads removes expired upload sessions
+func (w *UploadCleanupWorker) cleanupUploads() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	count, err := w.uploadService.CleanupExpiredUploads(ctx, w.batchSize)
+	if err != nil {
+		log.Printf("Error cleaning up expired uploads: %v", err)
+		return
+	}
+
+	if count > 0 {
+		log.Printf("Cleaned up %d abandoned uploads", count)
+	}
+}
@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"file-sharing-platform/internal/service"
+)
+
+// VersionPruneWorker is a worker that deletes previous file versions that
+// fall outside their owner's retention policy
+type VersionPruneWorker struct {
+	versionService *service.VersionService
+	interval       time.Duration
+	batchSize      int
+	stopChan       chan struct{}
+	wg             sync.WaitGroup
+	isRunning      bool
+	runningMutex   sync.Mutex
+}
+
+// NewVersionPruneWorker creates a new version prune worker
+func NewVersionPruneWorker(versionService *service.VersionService, interval time.Duration, batchSize int) *VersionPruneWorker {
+	return &VersionPruneWorker{
+		versionService: versionService,
+		interval:       interval,
+		batchSize:      batchSize,
+		stopChan:       make(chan struct{}),
+	}
+}
+
+// Start starts the worker
+func (w *VersionPruneWorker) Start() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if w.isRunning {
+		return
+	}
+
+	w.isRunning = true
+	w.wg.Add(1)
+
+	go w.run()
+
+	log.Println("Version prune worker started")
+}
+
+// Stop stops the worker
+func (w *VersionPruneWorker) Stop() {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	if !w.isRunning {
+		return
+	}
+
+	close(w.stopChan)
+	w.wg.Wait()
+	w.isRunning = false
+
+	log.Println("Version prune worker stopped")
+}
+
+// run runs the worker
+func (w *VersionPruneWorker) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	// Run once on startup
+	w.pruneVersions()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.pruneVersions()
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+// pruneVersions prunes previous file versions until none are left to prune
+func (w *VersionPruneWorker) pruneVersions() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	total := 0
+	for {
+		count, err := w.versionService.PruneVersions(ctx, w.batchSize)
+		total += count
+		if err != nil {
+			log.Printf("Error pruning file versions: %v", err)
+			break
+		}
+
+		// A short batch means nothing is left, or the rest failed and is
+		// retried on the next run
+		if count < w.batchSize {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Printf("Pruned %d file versions", total)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"file-sharing-platform/internal/models"
@@ -102,6 +103,7 @@ func (c *RedisCache) Close() error {
 
 // MemoryCache implements Cache for in-memory caching
 type MemoryCache struct {
+	mu   sync.Mutex
 	data map[string]cacheItem
 }
 
@@ -129,6 +131,9 @@ func (c *MemoryCache) Set(ctx context.Context, key string, value interface{}, ex
 		return fmt.Errorf("failed to marshal value: %w", err)
 	}
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.data[key] = cacheItem{
 		value:      data,
 		expiration: time.Now().Add(expiration),
@@ -139,16 +144,18 @@ func (c *MemoryCache) Set(ctx context.Context, key string, value interface{}, ex
 
 // Get gets a value from memory cache
 func (c *MemoryCache) Get(ctx context.Context, key string, dest interface{}) error {
+	c.mu.Lock()
 	item, ok := c.data[key]
-	if !ok {
-		return fmt.Errorf("key not found in cache")
-	}
-
-	// Check if expired
-	if time.Now().After(item.expiration) {
+	if ok && time.Now().After(item.expiration) {
 		delete(c.data, key)
+		c.mu.Unlock()
 		return fmt.Errorf("key not found in cache (expired)")
 	}
+	c.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("key not found in cache")
+	}
 
 	err := json.Unmarshal(item.value, dest)
 	if err != nil {
@@ -160,6 +167,9 @@ func (c *MemoryCache) Get(ctx context.Context, key string, dest interface{}) err
 
 // Delete deletes a value from memory cache
 func (c *MemoryCache) Delete(ctx context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	delete(c.data, key)
 	return nil
 }
@@ -181,6 +191,9 @@ func (c *MemoryCache) cleanupLoop() {
 
 // cleanup removes expired items
 func (c *MemoryCache) cleanup() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	now := time.Now()
 
 	for key, item := range c.data {
@@ -253,3 +266,28 @@ func (c *FileCache) InvalidateUserFiles(ctx context.Context, userID int64) error
 	key := fmt.Sprintf("user_files:%d", userID)
 	return c.cache.Delete(ctx, key)
 }
+
+// GetUserShares gets a user's share links from cache
+func (c *FileCache) GetUserShares(ctx context.Context, userID int64) ([]models.SharedFile, bool) {
+	var shares []models.SharedFile
+
+	key := fmt.Sprintf("user_shares:%d", userID)
+	err := c.cache.Get(ctx, key, &shares)
+	if err != nil {
+		return nil, false
+	}
+
+	return shares, true
+}
+
+// SetUserShares sets a user's share links in cache
+func (c *FileCache) SetUserShares(ctx context.Context, userID int64, shares []models.SharedFile) error {
+	key := fmt.Sprintf("user_shares:%d", userID)
+	return c.cache.Set(ctx, key, shares, c.expiration)
+}
+
+// InvalidateUserShares removes a user's share links from cache
+func (c *FileCache) InvalidateUserShares(ctx context.Context, userID int64) error {
+	key := fmt.Sprintf("user_shares:%d", userID)
+	return c.cache.Delete(ctx, key)
+}
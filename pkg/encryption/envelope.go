@@ -0,0 +1,73 @@
+// pkg/encryption/envelope.go
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// StreamVersion identifies content encrypted with the segmented stream format
+// under a wrapped per-file data key. Zero means the content is not encrypted.
+const StreamVersion = 1
+
+// wrapAAD binds wrapped data keys to their purpose
+var wrapAAD = []byte("file-sharing-platform data key v1")
+
+// GenerateDataKey returns a new random 32 byte data key
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// WrapKey encrypts a data key with the key of this Encryption
+func (e *Encryption) WrapKey(dataKey []byte) ([]byte, error) {
+	aead, err := e.keyWrapAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prepend nonce to the wrapped key
+	return aead.Seal(nonce, nonce, dataKey, wrapAAD), nil
+}
+
+// UnwrapKey decrypts a data key wrapped with WrapKey
+func (e *Encryption) UnwrapKey(wrapped []byte) ([]byte, error) {
+	aead, err := e.keyWrapAEAD()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped key too short")
+	}
+
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], wrapAAD)
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key")
+	}
+
+	return dataKey, nil
+}
+
+// keyWrapAEAD returns the AES-GCM cipher used to wrap data keys
+func (e *Encryption) keyWrapAEAD() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(e.key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
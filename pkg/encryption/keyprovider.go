@@ -0,0 +1,117 @@
+// pkg/encryption/keyprovider.go
+package encryption
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DefaultKeyID is the ID of the master key configured directly through the
+// environment, and of keys wrapped before key IDs were recorded
+const DefaultKeyID = "default"
+
+// KeyProvider wraps and unwraps per-file data keys with master keys that it
+// manages. Every wrapped key is tagged with the ID of the master key used, so
+// master keys can be rotated while older wrapped keys stay readable.
+type KeyProvider interface {
+	// WrapKey wraps a data key under the current master key and returns the
+	// wrapped key together with the master key ID
+	WrapKey(dataKey []byte) ([]byte, string, error)
+
+	// UnwrapKey unwraps a data key that was wrapped under keyID
+	UnwrapKey(wrapped []byte, keyID string) ([]byte, error)
+
+	// CurrentKeyID returns the ID of the master key new data keys are wrapped with
+	CurrentKeyID() (string, error)
+}
+
+// Keyring is a KeyProvider backed by master keys held in process memory
+type Keyring struct {
+	currentKeyID string
+	keys         map[string]*Encryption
+}
+
+// NewKeyring creates a keyring from master keys by ID. New data keys are
+// wrapped with the key identified by currentKeyID.
+func NewKeyring(currentKeyID string, keys map[string][]byte) (*Keyring, error) {
+	keyring := &Keyring{
+		currentKeyID: currentKeyID,
+		keys:         make(map[string]*Encryption, len(keys)),
+	}
+
+	for id, key := range keys {
+		enc, err := NewEncryption(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %q: %w", id, err)
+		}
+		keyring.keys[id] = enc
+	}
+
+	if _, ok := keyring.keys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("current master key %q not in keyring", currentKeyID)
+	}
+
+	return keyring, nil
+}
+
+// keyringFile is the on-disk format of a keyring, with base64 encoded keys:
+//
+//	{"current_key_id": "2024-06", "keys": {"default": "...", "2024-06": "..."}}
+type keyringFile struct {
+	CurrentKeyID string            `json:"current_key_id"`
+	Keys         map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads a keyring from a JSON file. To rotate, add a new key to
+// the file, point current_key_id at it and keep the old keys until every
+// file has been re-wrapped.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+
+	var file keyringFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode master key %q: %w", id, err)
+		}
+		keys[id] = key
+	}
+
+	return NewKeyring(file.CurrentKeyID, keys)
+}
+
+// WrapKey wraps a data key under the current master key
+func (k *Keyring) WrapKey(dataKey []byte) ([]byte, string, error) {
+	wrapped, err := k.keys[k.currentKeyID].WrapKey(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return wrapped, k.currentKeyID, nil
+}
+
+// UnwrapKey unwraps a data key with the master key identified by keyID
+func (k *Keyring) UnwrapKey(wrapped []byte, keyID string) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+
+	return key.UnwrapKey(wrapped)
+}
+
+// CurrentKeyID returns the ID of the current master key
+func (k *Keyring) CurrentKeyID() (string, error) {
+	return k.currentKeyID, nil
+}
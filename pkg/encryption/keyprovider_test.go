@@ -0,0 +1,148 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestKeyringRotation(t *testing.T) {
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	oldRing, err := NewKeyring("old", map[string][]byte{"old": oldKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataKey, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, keyID, err := oldRing.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "old" {
+		t.Fatalf("expected key ID old, got %s", keyID)
+	}
+
+	// Rotate through a keyring file holding both keys
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	contents, _ := json.Marshal(keyringFile{
+		CurrentKeyID: "new",
+		Keys: map[string]string{
+			"old": base64.StdEncoding.EncodeToString(oldKey),
+			"new": base64.StdEncoding.EncodeToString(newKey),
+		},
+	})
+	if err := os.WriteFile(path, contents, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newRing, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := newRing.UnwrapKey(wrapped, keyID)
+	if err != nil {
+		t.Fatalf("failed to unwrap with old key: %v", err)
+	}
+
+	rewrapped, newKeyID, err := newRing.WrapKey(unwrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newKeyID != "new" {
+		t.Fatalf("expected key ID new, got %s", newKeyID)
+	}
+
+	final, err := newRing.UnwrapKey(rewrapped, newKeyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(final, dataKey) {
+		t.Errorf("data key changed during rewrap")
+	}
+
+	if _, err := newRing.UnwrapKey(rewrapped, "old"); err == nil {
+		t.Errorf("expected unwrap with the wrong master key to fail")
+	}
+}
+
+// vaultStub mimics the Vault transit encrypt, decrypt and key read endpoints
+func vaultStub(t *testing.T, token string, version *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/transit/encrypt/files":
+			fmt.Fprintf(w, `{"data":{"ciphertext":"vault:v%d:%s"}}`, *version, body["plaintext"])
+		case r.Method == http.MethodPost && r.URL.Path == "/v1/transit/decrypt/files":
+			parts := strings.SplitN(body["ciphertext"], ":", 3)
+			fmt.Fprintf(w, `{"data":{"plaintext":"%s"}}`, parts[2])
+		case r.Method == http.MethodGet && r.URL.Path == "/v1/transit/keys/files":
+			fmt.Fprintf(w, `{"data":{"latest_version":%d}}`, *version)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultTransit(t *testing.T) {
+	version := 1
+	server := vaultStub(t, "secret", &version)
+	defer server.Close()
+
+	vault := NewVaultTransit(server.URL, "secret", "transit", "files")
+
+	dataKey, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, keyID, err := vault.WrapKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyID != "files:v1" {
+		t.Errorf("expected key ID files:v1, got %s", keyID)
+	}
+
+	unwrapped, err := vault.UnwrapKey(wrapped, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Errorf("unwrapped key does not match")
+	}
+
+	// Rotating the key in Vault changes the current key ID
+	version = 2
+	current, err := vault.CurrentKeyID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != "files:v2" {
+		t.Errorf("expected current key ID files:v2, got %s", current)
+	}
+
+	if _, _, err := NewVaultTransit(server.URL, "wrong", "transit", "files").WrapKey(dataKey); err == nil {
+		t.Errorf("expected wrap with a bad token to fail")
+	}
+}
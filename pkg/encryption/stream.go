@@ -0,0 +1,526 @@
+// pkg/encryption/stream.go
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Streaming format
+//
+// An encrypted stream is a header followed by one or more segments:
+//
+//	header:  magic "FSE1" | segment size (uint32, big endian) | salt (16 bytes)
+//	segment: AES-256-GCM(plaintext chunk) with a 16 byte tag
+//
+// Every segment except the last holds exactly segment size bytes of
+// plaintext; the last one holds the remainder and may be empty. A per-stream
+// key and 7 byte nonce prefix are derived from the master key and the salt
+// with HKDF-SHA256. Segment i is sealed with the nonce
+//
+//	prefix (7 bytes) | i (uint32, big endian) | final flag (1 byte)
+//
+// and the header as associated data. Reordering, dropping or appending
+// segments, truncating the stream at a segment boundary, or editing the
+// header all cause authentication to fail. Because segments are independent,
+// any byte range can be decrypted by reading only the segments it spans.
+
+const (
+	// DefaultSegmentSize is the plaintext size of each encrypted segment
+	DefaultSegmentSize = 64 * 1024
+
+	// maxSegmentSize bounds the segment size accepted from a stream header
+	maxSegmentSize = 16 << 20
+
+	streamMagic      = "FSE1"
+	streamSaltSize   = 16
+	streamHeaderSize = len(streamMagic) + 4 + streamSaltSize
+	noncePrefixSize  = 7
+	tagSize          = 16
+	streamInfo       = "file-sharing-platform stream v1"
+)
+
+// ErrAuthentication is returned when an encrypted segment fails to verify
+var ErrAuthentication = errors.New("encrypted stream failed authentication")
+
+// ErrTruncated is returned when an encrypted stream ends before its final segment
+var ErrTruncated = errors.New("encrypted stream is truncated")
+
+// streamCipher holds the per-stream key material
+type streamCipher struct {
+	aead        cipher.AEAD
+	noncePrefix []byte
+	header      []byte
+	segmentSize int
+}
+
+// newStreamCipher derives the stream key and nonce prefix for a header
+func newStreamCipher(key, header []byte) (*streamCipher, error) {
+	if len(header) != streamHeaderSize || string(header[:len(streamMagic)]) != streamMagic {
+		return nil, errors.New("invalid encrypted stream header")
+	}
+
+	segmentSize := binary.BigEndian.Uint32(header[len(streamMagic):])
+	if segmentSize == 0 || segmentSize > maxSegmentSize {
+		return nil, fmt.Errorf("invalid segment size: %d", segmentSize)
+	}
+
+	salt := header[len(streamMagic)+4:]
+	derived := make([]byte, 32+noncePrefixSize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, key, salt, []byte(streamInfo)), derived)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive stream key: %w", err)
+	}
+
+	block, err := aes.NewCipher(derived[:32])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamCipher{
+		aead:        aead,
+		noncePrefix: derived[32:],
+		header:      header,
+		segmentSize: int(segmentSize),
+	}, nil
+}
+
+// nonce returns the nonce for segment index, marking the final segment
+func (c *streamCipher) nonce(index uint32, final bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, c.noncePrefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if final {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptedSegmentSize is the ciphertext size of a full segment
+func (c *streamCipher) encryptedSegmentSize() int {
+	return c.segmentSize + tagSize
+}
+
+// newStreamHeader creates a header with a fresh random salt
+func newStreamHeader(segmentSize int) ([]byte, error) {
+	header := make([]byte, streamHeaderSize)
+	copy(header, streamMagic)
+	binary.BigEndian.PutUint32(header[len(streamMagic):], uint32(segmentSize))
+
+	_, err := io.ReadFull(rand.Reader, header[len(streamMagic)+4:])
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// readStreamHeader reads the header from src and sets up the stream cipher
+func (e *Encryption) readStreamHeader(src io.Reader) (*streamCipher, error) {
+	header := make([]byte, streamHeaderSize)
+	_, err := io.ReadFull(src, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read encrypted stream header: %w", err)
+	}
+
+	return newStreamCipher(e.key, header)
+}
+
+// EncryptedSize returns the size of the encrypted stream for a plaintext of
+// the given size
+func EncryptedSize(plaintextSize int64) int64 {
+	segments := (plaintextSize + DefaultSegmentSize - 1) / DefaultSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+
+	return int64(streamHeaderSize) + plaintextSize + segments*tagSize
+}
+
+// EncryptReader returns a reader that yields the encrypted stream of src
+func (e *Encryption) EncryptReader(src io.Reader) (io.Reader, error) {
+	header, err := newStreamHeader(DefaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newStreamCipher(e.key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		cipher:  c,
+		src:     bufio.NewReader(src),
+		plain:   make([]byte, c.segmentSize),
+		sealed:  make([]byte, 0, c.encryptedSegmentSize()),
+		pending: header,
+	}, nil
+}
+
+// encryptReader encrypts src one segment at a time as it is read
+type encryptReader struct {
+	cipher  *streamCipher
+	src     *bufio.Reader
+	plain   []byte
+	sealed  []byte
+	pending []byte
+	index   uint32
+	done    bool
+	err     error
+}
+
+// Read implements io.Reader
+func (r *encryptReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.sealNext()
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// sealNext reads and encrypts the next segment
+func (r *encryptReader) sealNext() error {
+	n, err := io.ReadFull(r.src, r.plain)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	// A full segment is only final if nothing follows it
+	final := n < len(r.plain)
+	if !final {
+		_, err = r.src.Peek(1)
+		if err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if !final && r.index == ^uint32(0) {
+		return errors.New("encrypted stream has too many segments")
+	}
+
+	r.sealed = r.cipher.aead.Seal(r.sealed[:0], r.cipher.nonce(r.index, final), r.plain[:n], r.cipher.header)
+	r.pending = r.sealed
+	r.index++
+	r.done = final
+
+	return nil
+}
+
+// EncryptWriter returns a writer that encrypts everything written to it into
+// dst. Close must be called to write the final segment; it does not close dst.
+func (e *Encryption) EncryptWriter(dst io.Writer) (io.WriteCloser, error) {
+	header, err := newStreamHeader(DefaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := newStreamCipher(e.key, header)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = dst.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		cipher: c,
+		dst:    dst,
+		plain:  make([]byte, 0, c.segmentSize),
+		sealed: make([]byte, 0, c.encryptedSegmentSize()),
+	}, nil
+}
+
+// encryptWriter buffers one segment of plaintext. A full segment is only
+// sealed once more data arrives, since until then it might be the final one.
+type encryptWriter struct {
+	cipher *streamCipher
+	dst    io.Writer
+	plain  []byte
+	sealed []byte
+	index  uint32
+	closed bool
+}
+
+// Write implements io.Writer
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encrypt writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		if len(w.plain) == w.cipher.segmentSize {
+			err := w.flush(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.plain[len(w.plain):w.cipher.segmentSize], p)
+		w.plain = w.plain[:len(w.plain)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the final segment
+func (w *encryptWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.flush(true)
+}
+
+// flush seals and writes the buffered segment
+func (w *encryptWriter) flush(final bool) error {
+	if !final && w.index == ^uint32(0) {
+		return errors.New("encrypted stream has too many segments")
+	}
+
+	w.sealed = w.cipher.aead.Seal(w.sealed[:0], w.cipher.nonce(w.index, final), w.plain, w.cipher.header)
+	w.index++
+	w.plain = w.plain[:0]
+
+	_, err := w.dst.Write(w.sealed)
+	return err
+}
+
+// DecryptReader returns a reader that decrypts the encrypted stream in src.
+// Data is only returned after its segment has been authenticated, and a
+// stream that ends before its final segment yields ErrTruncated.
+func (e *Encryption) DecryptReader(src io.Reader) (io.Reader, error) {
+	c, err := e.readStreamHeader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		cipher: c,
+		src:    bufio.NewReader(src),
+		sealed: make([]byte, c.encryptedSegmentSize()),
+	}, nil
+}
+
+// decryptReader decrypts src one segment at a time as it is read
+type decryptReader struct {
+	cipher *streamCipher
+	src    *bufio.Reader
+	sealed []byte
+	plain  []byte
+	index  uint32
+	done   bool
+	err    error
+}
+
+// Read implements io.Reader
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+		r.err = r.openNext()
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// openNext reads and decrypts the next segment
+func (r *decryptReader) openNext() error {
+	n, err := io.ReadFull(r.src, r.sealed)
+	if err == io.EOF {
+		return ErrTruncated
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	final := n < len(r.sealed)
+	if !final {
+		_, err = r.src.Peek(1)
+		if err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if n < tagSize {
+		return ErrTruncated
+	}
+
+	plain, err := r.cipher.aead.Open(r.sealed[:0], r.cipher.nonce(r.index, final), r.sealed[:n], r.cipher.header)
+	if err != nil {
+		return ErrAuthentication
+	}
+
+	r.plain = plain
+	r.index++
+	r.done = final
+
+	return nil
+}
+
+// DecryptSeeker returns a seekable reader over the plaintext of the encrypted
+// stream in src. Reads only fetch and decrypt the segments covering the
+// requested range, so it can back ranged downloads of large files.
+func (e *Encryption) DecryptSeeker(src io.ReadSeeker) (io.ReadSeeker, error) {
+	total, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = src.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := e.readStreamHeader(src)
+	if err != nil {
+		return nil, err
+	}
+
+	encSegment := int64(c.encryptedSegmentSize())
+	body := total - int64(streamHeaderSize)
+	segments := (body + encSegment - 1) / encSegment
+	if segments == 0 || body-(segments-1)*encSegment < tagSize {
+		return nil, ErrTruncated
+	}
+	if segments-1 > int64(^uint32(0)) {
+		return nil, errors.New("encrypted stream has too many segments")
+	}
+
+	return &decryptSeeker{
+		cipher:   c,
+		src:      src,
+		body:     body,
+		segments: segments,
+		size:     body - segments*tagSize,
+		sealed:   make([]byte, encSegment),
+		loaded:   -1,
+	}, nil
+}
+
+// decryptSeeker is a random-access plaintext view of an encrypted stream
+type decryptSeeker struct {
+	cipher   *streamCipher
+	src      io.ReadSeeker
+	body     int64
+	segments int64
+	size     int64
+	offset   int64
+	sealed   []byte
+	plain    []byte
+	loaded   int64
+}
+
+// Read implements io.Reader
+func (s *decryptSeeker) Read(p []byte) (int, error) {
+	if s.offset >= s.size {
+		return 0, io.EOF
+	}
+
+	segmentSize := int64(s.cipher.segmentSize)
+	index := s.offset / segmentSize
+	if index != s.loaded {
+		err := s.load(index)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, s.plain[s.offset-index*segmentSize:])
+	s.offset += int64(n)
+	return n, nil
+}
+
+// load reads and decrypts a single segment
+func (s *decryptSeeker) load(index int64) error {
+	encSegment := int64(len(s.sealed))
+	start := index * encSegment
+	length := encSegment
+	if start+length > s.body {
+		length = s.body - start
+	}
+
+	_, err := s.src.Seek(int64(streamHeaderSize)+start, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.ReadFull(s.src, s.sealed[:length])
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrTruncated
+		}
+		return err
+	}
+
+	final := index == s.segments-1
+	plain, err := s.cipher.aead.Open(s.plain[:0], s.cipher.nonce(uint32(index), final), s.sealed[:length], s.cipher.header)
+	if err != nil {
+		s.loaded = -1
+		return ErrAuthentication
+	}
+
+	s.plain = plain
+	s.loaded = index
+	return nil
+}
+
+// Seek implements io.Seeker over the plaintext
+func (s *decryptSeeker) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = s.offset + offset
+	case io.SeekEnd:
+		abs = s.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if abs < 0 {
+		return 0, fmt.Errorf("negative position: %d", abs)
+	}
+
+	s.offset = abs
+	return abs, nil
+}
@@ -0,0 +1,176 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func newTestEncryption(t *testing.T) *Encryption {
+	t.Helper()
+
+	enc, err := NewEncryption(bytes.Repeat([]byte{0x42}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc
+}
+
+func testPlaintext(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	return data
+}
+
+func encryptAll(t *testing.T, enc *Encryption, plaintext []byte) []byte {
+	t.Helper()
+
+	reader, err := enc.EncryptReader(bytes.NewReader(plaintext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ciphertext
+}
+
+var testSizes = []int{
+	0,
+	1,
+	DefaultSegmentSize - 1,
+	DefaultSegmentSize,
+	DefaultSegmentSize + 1,
+	3 * DefaultSegmentSize,
+	3*DefaultSegmentSize + 1234,
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	enc := newTestEncryption(t)
+
+	for _, size := range testSizes {
+		plaintext := testPlaintext(size)
+
+		ciphertext := encryptAll(t, enc, plaintext)
+		if int64(len(ciphertext)) != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted size %d, EncryptedSize says %d", size, len(ciphertext), EncryptedSize(int64(size)))
+		}
+
+		// The writer must produce the same layout as the reader
+		var buf bytes.Buffer
+		writer, err := enc.EncryptWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for chunk := plaintext; len(chunk) > 0; {
+			n := min(len(chunk), 10000)
+			if _, err := writer.Write(chunk[:n]); err != nil {
+				t.Fatal(err)
+			}
+			chunk = chunk[n:]
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, encrypted := range [][]byte{ciphertext, buf.Bytes()} {
+			reader, err := enc.DecryptReader(bytes.NewReader(encrypted))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("size %d: decrypt failed: %v", size, err)
+			}
+			if !bytes.Equal(decrypted, plaintext) {
+				t.Errorf("size %d: decrypted content does not match", size)
+			}
+		}
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	enc := newTestEncryption(t)
+	plaintext := testPlaintext(3*DefaultSegmentSize + 100)
+	ciphertext := encryptAll(t, enc, plaintext)
+
+	segment := DefaultSegmentSize + tagSize
+
+	cases := map[string][]byte{
+		"flipped bit": func() []byte {
+			c := bytes.Clone(ciphertext)
+			c[streamHeaderSize+segment+10] ^= 1
+			return c
+		}(),
+		"dropped final segment":   ciphertext[:streamHeaderSize+3*segment],
+		"truncated final segment": ciphertext[:len(ciphertext)-1],
+		"swapped segments": func() []byte {
+			c := bytes.Clone(ciphertext)
+			first := bytes.Clone(c[streamHeaderSize : streamHeaderSize+segment])
+			copy(c[streamHeaderSize:], c[streamHeaderSize+segment:streamHeaderSize+2*segment])
+			copy(c[streamHeaderSize+segment:], first)
+			return c
+		}(),
+		"modified header": func() []byte {
+			c := bytes.Clone(ciphertext)
+			c[len(streamMagic)+4] ^= 1
+			return c
+		}(),
+	}
+
+	for name, tampered := range cases {
+		reader, err := enc.DecryptReader(bytes.NewReader(tampered))
+		if err != nil {
+			continue
+		}
+		_, err = io.ReadAll(reader)
+		if !errors.Is(err, ErrAuthentication) && !errors.Is(err, ErrTruncated) {
+			t.Errorf("%s: expected authentication or truncation error, got %v", name, err)
+		}
+	}
+}
+
+func TestDecryptSeekerRanges(t *testing.T) {
+	enc := newTestEncryption(t)
+
+	for _, size := range testSizes {
+		plaintext := testPlaintext(size)
+		ciphertext := encryptAll(t, enc, plaintext)
+
+		seeker, err := enc.DecryptSeeker(bytes.NewReader(ciphertext))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if end != int64(size) {
+			t.Errorf("size %d: seeker reports size %d", size, end)
+		}
+
+		ranges := [][2]int{{0, size}, {size / 2, size}, {size / 3, size / 3 * 2}}
+		if size > DefaultSegmentSize+5 {
+			// A range spanning a segment boundary
+			ranges = append(ranges, [2]int{DefaultSegmentSize - 5, DefaultSegmentSize + 5})
+		}
+
+		for _, r := range ranges {
+			if _, err := seeker.Seek(int64(r[0]), io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, r[1]-r[0])
+			if _, err := io.ReadFull(seeker, got); err != nil {
+				t.Fatalf("size %d range %v: %v", size, r, err)
+			}
+			if !bytes.Equal(got, plaintext[r[0]:r[1]]) {
+				t.Errorf("size %d range %v: content does not match", size, r)
+			}
+		}
+	}
+}
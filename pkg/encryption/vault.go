@@ -0,0 +1,136 @@
+// pkg/encryption/vault.go
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultTransit is a KeyProvider that delegates wrapping to a HashiCorp Vault
+// transit secrets engine (or anything speaking its HTTP API). Master keys
+// never leave Vault. Key IDs have the form "<key name>:v<version>", so
+// rotating the transit key in Vault makes older wrapped keys eligible for
+// re-wrapping.
+type VaultTransit struct {
+	address string
+	token   string
+	mount   string
+	keyName string
+	client  *http.Client
+}
+
+// NewVaultTransit creates a Vault transit key provider
+func NewVaultTransit(address, token, mount, keyName string) *VaultTransit {
+	return &VaultTransit{
+		address: strings.TrimRight(address, "/"),
+		token:   token,
+		mount:   strings.Trim(mount, "/"),
+		keyName: keyName,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// WrapKey encrypts a data key with the latest version of the transit key
+func (v *VaultTransit) WrapKey(dataKey []byte) ([]byte, string, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+
+	err := v.call(http.MethodPost, "encrypt/"+v.keyName, map[string]string{
+		"plaintext": base64.StdEncoding.EncodeToString(dataKey),
+	}, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Vault ciphertexts look like "vault:v3:..."
+	parts := strings.SplitN(resp.Data.Ciphertext, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, "", fmt.Errorf("unexpected Vault ciphertext format")
+	}
+
+	return []byte(resp.Data.Ciphertext), v.keyName + ":" + parts[1], nil
+}
+
+// UnwrapKey decrypts a data key. Vault reads the key version from the
+// ciphertext itself.
+func (v *VaultTransit) UnwrapKey(wrapped []byte, keyID string) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+
+	err := v.call(http.MethodPost, "decrypt/"+v.keyName, map[string]string{
+		"ciphertext": string(wrapped),
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode Vault plaintext: %w", err)
+	}
+
+	return dataKey, nil
+}
+
+// CurrentKeyID returns the ID of the latest version of the transit key
+func (v *VaultTransit) CurrentKeyID() (string, error) {
+	var resp struct {
+		Data struct {
+			LatestVersion int `json:"latest_version"`
+		} `json:"data"`
+	}
+
+	err := v.call(http.MethodGet, "keys/"+v.keyName, nil, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:v%d", v.keyName, resp.Data.LatestVersion), nil
+}
+
+// call performs a request against the transit engine
+func (v *VaultTransit) call(method, path string, body interface{}, dest interface{}) error {
+	var payload bytes.Buffer
+	if body != nil {
+		err := json.NewEncoder(&payload).Encode(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode Vault request: %w", err)
+		}
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/%s", v.address, v.mount, path)
+	req, err := http.NewRequest(method, url, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to create Vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call Vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault returned status %d for %s", resp.StatusCode, path)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(dest)
+	if err != nil {
+		return fmt.Errorf("failed to decode Vault response: %w", err)
+	}
+
+	return nil
+}
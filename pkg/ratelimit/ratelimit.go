@@ -0,0 +1,235 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Limiter counts requests per key with a sliding window: the count of the
+// current fixed window is added to the count of the previous one, weighted
+// by how much of the previous window still overlaps the sliding window.
+// This smooths out bursts at window boundaries without keeping a log of
+// every request.
+type Limiter interface {
+	// Allow counts a request for key if it fits within limit requests per
+	// window and reports whether it does
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (*Result, error)
+}
+
+// Result is the outcome of counting a request
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// Reset is how long until the current window ends, or for a denied
+	// request how long until it would be allowed
+	Reset time.Duration
+}
+
+// evaluate decides whether a request fits in the sliding window given the
+// counts of the previous and current fixed windows and how far into the
+// current window it arrives
+func evaluate(previous, current, limit int, window, elapsed time.Duration) *Result {
+	weight := float64(window-elapsed) / float64(window)
+	weighted := float64(previous)*weight + float64(current)
+
+	result := &Result{Limit: limit}
+	if weighted+1 <= float64(limit) {
+		result.Allowed = true
+		result.Remaining = limit - int(math.Ceil(weighted+1))
+		if result.Remaining < 0 {
+			result.Remaining = 0
+		}
+		result.Reset = window - elapsed
+		return result
+	}
+
+	result.Reset = retryAfter(previous, current, limit, window, elapsed)
+	return result
+}
+
+// retryAfter is how long until the weighted count has decayed enough to
+// allow one more request
+func retryAfter(previous, current, limit int, window, elapsed time.Duration) time.Duration {
+	room := float64(limit - 1)
+
+	// Still within the current window, once enough of the previous window
+	// has slid out
+	if float64(current) <= room && previous > 0 {
+		at := float64(window) - (room-float64(current))*float64(window)/float64(previous)
+		return time.Duration(math.Ceil(at)) - elapsed
+	}
+
+	// In the next window, once enough of the current window has slid out
+	if current == 0 {
+		return window - elapsed
+	}
+	at := float64(window) - room*float64(window)/float64(current)
+	if at < 0 {
+		at = 0
+	}
+	return window - elapsed + time.Duration(math.Ceil(at))
+}
+
+// windowStart returns the index of the fixed window now falls in and how far
+// into that window it is
+func windowStart(now time.Time, window time.Duration) (int64, time.Duration) {
+	nanos := now.UnixNano()
+	index := nanos / int64(window)
+	return index, time.Duration(nanos - index*int64(window))
+}
+
+// slidingWindowScript atomically reads the previous window count and counts
+// the request in the current window if it fits. It returns whether the
+// request was counted and both window counts.
+var slidingWindowScript = redis.NewScript(`
+local previous = tonumber(redis.call('GET', KEYS[1]) or '0')
+local current = tonumber(redis.call('GET', KEYS[2]) or '0')
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local elapsed = tonumber(ARGV[3])
+
+local weight = (window - elapsed) / window
+if previous * weight + current + 1 > limit then
+	return {0, previous, current}
+end
+
+current = redis.call('INCR', KEYS[2])
+redis.call('PEXPIRE', KEYS[2], window * 2)
+return {1, previous, current}
+`)
+
+// RedisLimiter implements Limiter with counters in Redis, so limits hold
+// across all server instances
+type RedisLimiter struct {
+	client *redis.Client
+}
+
+// NewRedisLimiter creates a new Redis limiter
+func NewRedisLimiter(redisURL string) (*RedisLimiter, error) {
+	options, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Redis URL: %w", err)
+	}
+
+	client := redis.NewClient(options)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.Ping(ctx).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return &RedisLimiter{client: client}, nil
+}
+
+// Allow counts a request for key in Redis
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (*Result, error) {
+	// The script works in milliseconds; truncating here keeps the weight it
+	// computes identical to the one evaluate computes
+	window = window.Truncate(time.Millisecond)
+	index, elapsed := windowStart(time.Now(), window)
+	elapsed = elapsed.Truncate(time.Millisecond)
+
+	keys := []string{
+		fmt.Sprintf("ratelimit:%s:%d", key, index-1),
+		fmt.Sprintf("ratelimit:%s:%d", key, index),
+	}
+
+	values, err := slidingWindowScript.Run(ctx, l.client, keys, limit, window.Milliseconds(), elapsed.Milliseconds()).Int64Slice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to count request: %w", err)
+	}
+
+	allowed, previous, current := values[0] == 1, int(values[1]), int(values[2])
+	if allowed {
+		// Evaluate as before the request was counted
+		current--
+	}
+
+	return evaluate(previous, current, limit, window, elapsed), nil
+}
+
+// Close closes the Redis connection
+func (l *RedisLimiter) Close() error {
+	return l.client.Close()
+}
+
+// MemoryLimiter implements Limiter with counters in memory, for a single
+// server instance
+type MemoryLimiter struct {
+	mu          sync.Mutex
+	counters    map[string]*counter
+	lastCleanup time.Time
+	now         func() time.Time
+}
+
+// counter holds the counts of the current and previous fixed window of a key
+type counter struct {
+	index    int64
+	window   time.Duration
+	previous int
+	current  int
+}
+
+// NewMemoryLimiter creates a new in-memory limiter
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		counters:    make(map[string]*counter),
+		lastCleanup: time.Now(),
+		now:         time.Now,
+	}
+}
+
+// Allow counts a request for key in memory
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (*Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	index, elapsed := windowStart(now, window)
+
+	c, ok := l.counters[key]
+	if !ok || c.window != window {
+		c = &counter{index: index, window: window}
+		l.counters[key] = c
+	}
+
+	switch {
+	case c.index == index-1:
+		c.previous, c.current = c.current, 0
+	case c.index < index-1:
+		c.previous, c.current = 0, 0
+	}
+	c.index = index
+
+	result := evaluate(c.previous, c.current, limit, window, elapsed)
+	if result.Allowed {
+		c.current++
+	}
+
+	if now.Sub(l.lastCleanup) >= time.Minute {
+		l.cleanup(now)
+		l.lastCleanup = now
+	}
+
+	return result, nil
+}
+
+// cleanup removes counters whose windows no longer count
+func (l *MemoryLimiter) cleanup(now time.Time) {
+	for key, c := range l.counters {
+		index, _ := windowStart(now, c.window)
+		if c.index < index-1 {
+			delete(l.counters, key)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	ctx := context.Background()
+	window := time.Minute
+	now := time.Unix(0, 0).Add(100 * window)
+
+	limiter := NewMemoryLimiter()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		result, err := limiter.Allow(ctx, "user", 3, window)
+		if err != nil || !result.Allowed {
+			t.Fatalf("request %d: expected to be allowed, got %+v, %v", i, result, err)
+		}
+		if result.Remaining != 2-i {
+			t.Fatalf("request %d: expected %d remaining, got %d", i, 2-i, result.Remaining)
+		}
+	}
+
+	result, _ := limiter.Allow(ctx, "user", 3, window)
+	if result.Allowed {
+		t.Fatalf("expected the fourth request to be denied")
+	}
+	if result.Reset <= 0 || result.Reset > 2*window {
+		t.Fatalf("expected a retry within two windows, got %v", result.Reset)
+	}
+
+	// Other keys are counted separately
+	result, _ = limiter.Allow(ctx, "other", 3, window)
+	if !result.Allowed {
+		t.Fatalf("expected a request for another key to be allowed")
+	}
+
+	// Half way into the next window half of the previous count still weighs
+	now = now.Add(window + window/2)
+	result, _ = limiter.Allow(ctx, "user", 3, window)
+	if !result.Allowed || result.Remaining != 0 {
+		t.Fatalf("expected one request with none remaining, got %+v", result)
+	}
+
+	result, _ = limiter.Allow(ctx, "user", 3, window)
+	if result.Allowed {
+		t.Fatalf("expected the weighted count to deny the request")
+	}
+
+	// Two windows later nothing weighs
+	now = now.Add(2 * window)
+	result, _ = limiter.Allow(ctx, "user", 3, window)
+	if !result.Allowed || result.Remaining != 2 {
+		t.Fatalf("expected a fresh window, got %+v", result)
+	}
+}
+
+func TestRetryAfterAllowsRequest(t *testing.T) {
+	window := time.Minute
+
+	tests := []struct {
+		previous, current, limit int
+		elapsed                  time.Duration
+	}{
+		{0, 5, 5, 10 * time.Second},
+		{5, 0, 5, 10 * time.Second},
+		{4, 3, 5, 30 * time.Second},
+		{10, 10, 10, 59 * time.Second},
+	}
+
+	for _, tt := range tests {
+		result := evaluate(tt.previous, tt.current, tt.limit, window, tt.elapsed)
+		if result.Allowed {
+			t.Fatalf("%+v: expected to be denied", tt)
+		}
+
+		// Move forward by the retry delay, rolling windows over as needed
+		at := tt.elapsed + result.Reset
+		previous, current := tt.previous, tt.current
+		if at >= window {
+			at -= window
+			previous, current = current, 0
+		}
+
+		if !evaluate(previous, current, tt.limit, window, at).Allowed {
+			t.Fatalf("%+v: expected a request after %v to be allowed", tt, result.Reset)
+		}
+		if at >= time.Second && evaluate(previous, current, tt.limit, window, at-time.Second).Allowed {
+			t.Fatalf("%+v: expected a request a second before %v to be denied", tt, result.Reset)
+		}
+	}
+}
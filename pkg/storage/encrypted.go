@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"file-sharing-platform/pkg/encryption"
+)
+
+// ErrFileKeyRequired is returned when encrypted storage is used without a file key
+var ErrFileKeyRequired = errors.New("encrypted storage requires a file key")
+
+// FileKey is the per-file key material that must be stored with a file so its
+// content can be decrypted again
+type FileKey struct {
+	// WrappedKey is the file's data key encrypted under the master key
+	WrappedKey []byte
+
+	// KeyID identifies the master key that wrapped the data key
+	KeyID string
+
+	// Version identifies the encryption format, see encryption.StreamVersion
+	Version int
+}
+
+// KeyedStorage is implemented by storage that encrypts each file under its
+// own data key. Callers must keep the returned FileKey and pass it back to
+// read the file.
+type KeyedStorage interface {
+	FileStorage
+
+	// UploadWithKey encrypts and uploads a file and returns its path, public URL and key
+	UploadWithKey(fileContent io.Reader, fileName, contentType string) (string, string, *FileKey, error)
+
+	// UploadWithKeyTo encrypts and uploads a file to storagePath and returns
+	// its public URL and key
+	UploadWithKeyTo(storagePath string, fileContent io.Reader, contentType string) (string, *FileKey, error)
+
+	// OpenWithKey opens an encrypted file for reading its plaintext
+	OpenWithKey(storagePath string, key *FileKey) (io.ReadSeekCloser, error)
+
+	// CurrentKeyID returns the ID of the master key new files are wrapped with
+	CurrentKeyID() (string, error)
+
+	// RewrapKey re-wraps a file key under the current master key. The file
+	// content is untouched since the data key itself does not change.
+	RewrapKey(key *FileKey) (*FileKey, error)
+}
+
+// EncryptedStorage is a FileStorage decorator that encrypts content at rest
+// using envelope encryption: each file gets a random data key, and only the
+// data key wrapped by a master key is kept, next to the file metadata.
+type EncryptedStorage struct {
+	backend FileStorage
+	keys    encryption.KeyProvider
+}
+
+// NewEncryptedStorage creates encrypted storage on top of backend
+func NewEncryptedStorage(backend FileStorage, keys encryption.KeyProvider) *EncryptedStorage {
+	return &EncryptedStorage{
+		backend: backend,
+		keys:    keys,
+	}
+}
+
+// Upload always fails: encrypted uploads must go through UploadWithKey so
+// the data key is not lost
+func (s *EncryptedStorage) Upload(fileContent io.Reader, fileName, contentType string) (string, string, error) {
+	return "", "", ErrFileKeyRequired
+}
+
+// UploadTo always fails like Upload
+func (s *EncryptedStorage) UploadTo(storagePath string, fileContent io.Reader, contentType string) (string, error) {
+	return "", ErrFileKeyRequired
+}
+
+// UploadWithKey encrypts a file under a new data key and uploads it
+func (s *EncryptedStorage) UploadWithKey(fileContent io.Reader, fileName, contentType string) (string, string, *FileKey, error) {
+	encrypted, key, err := s.encrypt(fileContent)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	storagePath, publicURL, err := s.backend.Upload(encrypted, fileName, contentType)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	return storagePath, publicURL, key, nil
+}
+
+// UploadWithKeyTo encrypts a file under a new data key and uploads it to
+// storagePath, if the backend supports uploads to a given path
+func (s *EncryptedStorage) UploadWithKeyTo(storagePath string, fileContent io.Reader, contentType string) (string, *FileKey, error) {
+	backend, ok := s.backend.(PathStorage)
+	if !ok {
+		return "", nil, ErrPathUploadNotSupported
+	}
+
+	encrypted, key, err := s.encrypt(fileContent)
+	if err != nil {
+		return "", nil, err
+	}
+
+	publicURL, err := backend.UploadTo(storagePath, encrypted, contentType)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return publicURL, key, nil
+}
+
+// encrypt returns a reader encrypting content under a new data key, along
+// with the wrapped data key
+func (s *EncryptedStorage) encrypt(content io.Reader) (io.Reader, *FileKey, error) {
+	dataKey, err := encryption.GenerateDataKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	wrapped, keyID, err := s.keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	fileEncryption, err := encryption.NewEncryption(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encrypted, err := fileEncryption.EncryptReader(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to encrypt file: %w", err)
+	}
+
+	return encrypted, &FileKey{WrappedKey: wrapped, KeyID: keyID, Version: encryption.StreamVersion}, nil
+}
+
+// Open returns the stored bytes as-is. It is used for files stored before
+// encryption was enabled; encrypted files must be read with OpenWithKey.
+func (s *EncryptedStorage) Open(storagePath string) (io.ReadSeekCloser, error) {
+	return s.backend.Open(storagePath)
+}
+
+// OpenWithKey opens an encrypted file and returns a seekable reader over its
+// plaintext. Only the segments covering the bytes read are decrypted.
+func (s *EncryptedStorage) OpenWithKey(storagePath string, key *FileKey) (io.ReadSeekCloser, error) {
+	if key == nil || key.Version != encryption.StreamVersion {
+		return nil, fmt.Errorf("unsupported encryption version")
+	}
+
+	dataKey, err := s.keys.UnwrapKey(key.WrappedKey, key.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	fileEncryption, err := encryption.NewEncryption(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.backend.Open(storagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := fileEncryption.DecryptSeeker(raw)
+	if err != nil {
+		raw.Close()
+		return nil, fmt.Errorf("failed to decrypt file: %w", err)
+	}
+
+	return &decryptedFile{ReadSeeker: plaintext, raw: raw}, nil
+}
+
+// CurrentKeyID returns the ID of the master key new files are wrapped with
+func (s *EncryptedStorage) CurrentKeyID() (string, error) {
+	return s.keys.CurrentKeyID()
+}
+
+// RewrapKey re-wraps a file key under the current master key
+func (s *EncryptedStorage) RewrapKey(key *FileKey) (*FileKey, error) {
+	dataKey, err := s.keys.UnwrapKey(key.WrappedKey, key.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+
+	wrapped, keyID, err := s.keys.WrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+
+	return &FileKey{WrappedKey: wrapped, KeyID: keyID, Version: key.Version}, nil
+}
+
+// Delete deletes a file
+func (s *EncryptedStorage) Delete(storagePath string) error {
+	return s.backend.Delete(storagePath)
+}
+
+// GetPublicURL returns the public URL for a file. Note that the object behind
+// it holds ciphertext; downloads must go through the API.
+func (s *EncryptedStorage) GetPublicURL(storagePath string) string {
+	return s.backend.GetPublicURL(storagePath)
+}
+
+// List lists the objects of the backend, if it supports listing
+func (s *EncryptedStorage) List(fn func(ObjectInfo) error) error {
+	listable, ok := s.backend.(ListableStorage)
+	if !ok {
+		return ErrListingNotSupported
+	}
+
+	return listable.List(fn)
+}
+
+// Quarantine quarantines an object of the backend, if it supports listing
+func (s *EncryptedStorage) Quarantine(storagePath string) (string, error) {
+	listable, ok := s.backend.(ListableStorage)
+	if !ok {
+		return "", ErrListingNotSupported
+	}
+
+	return listable.Quarantine(storagePath)
+}
+
+// decryptedFile closes the underlying object when the plaintext reader is closed
+type decryptedFile struct {
+	io.ReadSeeker
+	raw io.Closer
+}
+
+// Close closes the underlying object
+func (f *decryptedFile) Close() error {
+	return f.raw.Close()
+}
@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"file-sharing-platform/pkg/encryption"
+)
+
+// newTestKeyring creates a keyring wrapping new data keys with the master
+// key currentKeyID, out of master keys filled with their index
+func newTestKeyring(t *testing.T, currentKeyID string, keyIDs ...string) *encryption.Keyring {
+	t.Helper()
+
+	keys := make(map[string][]byte, len(keyIDs))
+	for i, id := range keyIDs {
+		keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+
+	keyring, err := encryption.NewKeyring(currentKeyID, keys)
+	if err != nil {
+		t.Fatalf("NewKeyring failed: %v", err)
+	}
+
+	return keyring
+}
+
+// newTestEncryptedStorage creates encrypted storage on top of local storage
+// in a temporary directory
+func newTestEncryptedStorage(t *testing.T) (*EncryptedStorage, *LocalStorage) {
+	t.Helper()
+
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost")
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+
+	return NewEncryptedStorage(local, newTestKeyring(t, "current", "current")), local
+}
+
+// readAll reads a whole object opened with key
+func readAll(t *testing.T, storage *EncryptedStorage, storagePath string, key *FileKey) ([]byte, error) {
+	t.Helper()
+
+	file, err := storage.OpenWithKey(storagePath, key)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	storage, local := newTestEncryptedStorage(t)
+	content := testContent(3*encryption.DefaultSegmentSize + 100)
+
+	storagePath, _, key, err := storage.UploadWithKey(bytes.NewReader(content), "file.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("UploadWithKey failed: %v", err)
+	}
+	if key.KeyID != "current" || key.Version != encryption.StreamVersion {
+		t.Errorf("got key %s version %d, want current version %d", key.KeyID, key.Version, encryption.StreamVersion)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(local.basePath, storagePath))
+	if err != nil {
+		t.Fatalf("failed to read stored object: %v", err)
+	}
+	if int64(len(stored)) != encryption.EncryptedSize(int64(len(content))) || bytes.Contains(stored, content[:1024]) {
+		t.Error("expected the stored object to hold ciphertext")
+	}
+
+	data, err := readAll(t, storage, storagePath, key)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("expected the content back, got %d bytes, %v", len(data), err)
+	}
+
+	_, _, err = storage.Upload(bytes.NewReader(content), "file.bin", "application/octet-stream")
+	if !errors.Is(err, ErrFileKeyRequired) {
+		t.Errorf("expected Upload to require a file key, got %v", err)
+	}
+}
+
+func TestEncryptedStorageUploadWithKeyTo(t *testing.T) {
+	storage, _ := newTestEncryptedStorage(t)
+	content := testContent(1000)
+
+	_, key, err := storage.UploadWithKeyTo("blobs/ab/abcdef", bytes.NewReader(content), "application/octet-stream")
+	if err != nil {
+		t.Fatalf("UploadWithKeyTo failed: %v", err)
+	}
+
+	data, err := readAll(t, storage, "blobs/ab/abcdef", key)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("expected the content back, got %d bytes, %v", len(data), err)
+	}
+}
+
+func TestEncryptedStorageRejectsWrongKeys(t *testing.T) {
+	storage, local := newTestEncryptedStorage(t)
+
+	firstPath, _, firstKey, err := storage.UploadWithKey(bytes.NewReader(testContent(1000)), "first.bin", "")
+	if err != nil {
+		t.Fatalf("UploadWithKey failed: %v", err)
+	}
+	_, _, secondKey, err := storage.UploadWithKey(bytes.NewReader(testContent(1000)), "second.bin", "")
+	if err != nil {
+		t.Fatalf("UploadWithKey failed: %v", err)
+	}
+
+	// The data key of another file
+	if _, err := readAll(t, storage, firstPath, secondKey); err == nil {
+		t.Error("expected a file not to decrypt with the key of another file")
+	}
+
+	// A master key with the same ID as the one that wrapped the data key
+	other := NewEncryptedStorage(local, newTestKeyring(t, "current", "other", "current"))
+	if _, err := readAll(t, other, firstPath, firstKey); err == nil {
+		t.Error("expected a data key not to unwrap with another master key")
+	}
+}
+
+func TestEncryptedStorageDetectsTampering(t *testing.T) {
+	storage, local := newTestEncryptedStorage(t)
+	content := testContent(2*encryption.DefaultSegmentSize + 100)
+
+	storagePath, _, key, err := storage.UploadWithKey(bytes.NewReader(content), "file.bin", "")
+	if err != nil {
+		t.Fatalf("UploadWithKey failed: %v", err)
+	}
+
+	fullPath := filepath.Join(local.basePath, storagePath)
+	stored, err := os.ReadFile(fullPath)
+	if err != nil {
+		t.Fatalf("failed to read stored object: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"flipped byte", func(b []byte) []byte { b[len(b)/2] ^= 1; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-1] }},
+	}
+
+	for _, tt := range tests {
+		tampered := tt.tamper(append([]byte(nil), stored...))
+		if err := os.WriteFile(fullPath, tampered, 0644); err != nil {
+			t.Fatalf("failed to tamper with stored object: %v", err)
+		}
+
+		if _, err := readAll(t, storage, storagePath, key); err == nil {
+			t.Errorf("%s: expected reading a tampered object to fail", tt.name)
+		}
+	}
+}
+
+func TestEncryptedStorageRangedRead(t *testing.T) {
+	storage, _ := newTestEncryptedStorage(t)
+	content := testContent(3*encryption.DefaultSegmentSize + 100)
+
+	storagePath, _, key, err := storage.UploadWithKey(bytes.NewReader(content), "file.bin", "")
+	if err != nil {
+		t.Fatalf("UploadWithKey failed: %v", err)
+	}
+
+	file, err := storage.OpenWithKey(storagePath, key)
+	if err != nil {
+		t.Fatalf("OpenWithKey failed: %v", err)
+	}
+	defer file.Close()
+
+	// A range spanning a segment boundary
+	offset := int64(encryption.DefaultSegmentSize - 50)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		t.Fatalf("Seek failed: %v", err)
+	}
+	part := make([]byte, 100)
+	if _, err := io.ReadFull(file, part); err != nil || !bytes.Equal(part, content[offset:offset+100]) {
+		t.Errorf("expected bytes %d-%d, got %v", offset, offset+99, err)
+	}
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil || size != int64(len(content)) {
+		t.Errorf("expected the plaintext size %d, got %d, %v", len(content), size, err)
+	}
+}
+
+func TestEncryptedStorageOpensPlaintextFiles(t *testing.T) {
+	storage, local := newTestEncryptedStorage(t)
+
+	// A file stored before encryption was enabled, with EncryptionVersion 0
+	storagePath, _, err := local.Upload(bytes.NewReader([]byte("plaintext")), "old.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	file, err := storage.Open(storagePath)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, _ := io.ReadAll(file)
+	file.Close()
+	if string(data) != "plaintext" {
+		t.Errorf("expected the stored bytes as-is, got %q", data)
+	}
+
+	if _, err := storage.OpenWithKey(storagePath, &FileKey{}); err == nil {
+		t.Error("expected OpenWithKey to refuse a file without encryption")
+	}
+}
+
+func TestEncryptedStorageRewrapKey(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost")
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+	content := testContent(1000)
+
+	storage := NewEncryptedStorage(local, newTestKeyring(t, "old", "old"))
+	storagePath, _, key, err := storage.UploadWithKey(bytes.NewReader(content), "file.bin", "")
+	if err != nil {
+		t.Fatalf("UploadWithKey failed: %v", err)
+	}
+
+	rotated := NewEncryptedStorage(local, newTestKeyring(t, "new", "old", "new"))
+	rewrapped, err := rotated.RewrapKey(key)
+	if err != nil {
+		t.Fatalf("RewrapKey failed: %v", err)
+	}
+	if rewrapped.KeyID != "new" || rewrapped.Version != key.Version || bytes.Equal(rewrapped.WrappedKey, key.WrappedKey) {
+		t.Errorf("expected the key rewrapped under new, got %s version %d", rewrapped.KeyID, rewrapped.Version)
+	}
+
+	// The old master key is no longer needed, only the same new one
+	retired := NewEncryptedStorage(local, newTestKeyring(t, "new", "retired", "new"))
+	data, err := readAll(t, retired, storagePath, rewrapped)
+	if err != nil || !bytes.Equal(data, content) {
+		t.Fatalf("expected the content back with the rewrapped key, got %d bytes, %v", len(data), err)
+	}
+}
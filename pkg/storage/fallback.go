@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"io"
+)
+
+// FallbackStorage writes to a primary backend and reads objects the primary
+// does not have from a fallback backend. It keeps all files readable while
+// their objects are migrated from the fallback to the primary.
+type FallbackStorage struct {
+	primary  FileStorage
+	fallback FileStorage
+}
+
+// NewFallbackStorage creates storage that falls back to fallback for objects
+// missing from primary
+func NewFallbackStorage(primary, fallback FileStorage) *FallbackStorage {
+	return &FallbackStorage{
+		primary:  primary,
+		fallback: fallback,
+	}
+}
+
+// Upload uploads a file to the primary backend
+func (s *FallbackStorage) Upload(fileContent io.Reader, fileName, contentType string) (string, string, error) {
+	return s.primary.Upload(fileContent, fileName, contentType)
+}
+
+// UploadTo uploads a file to storagePath in the primary backend
+func (s *FallbackStorage) UploadTo(storagePath string, fileContent io.Reader, contentType string) (string, error) {
+	primary, ok := s.primary.(PathStorage)
+	if !ok {
+		return "", ErrPathUploadNotSupported
+	}
+
+	return primary.UploadTo(storagePath, fileContent, contentType)
+}
+
+// Open opens a file from the primary backend, or from the fallback if the
+// primary cannot open it
+func (s *FallbackStorage) Open(storagePath string) (io.ReadSeekCloser, error) {
+	file, err := s.primary.Open(storagePath)
+	if err == nil {
+		return file, nil
+	}
+
+	file, fallbackErr := s.fallback.Open(storagePath)
+	if fallbackErr != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// Delete deletes a file from both backends. It only fails if neither
+// backend could delete it.
+func (s *FallbackStorage) Delete(storagePath string) error {
+	err := s.primary.Delete(storagePath)
+	fallbackErr := s.fallback.Delete(storagePath)
+	if err != nil && fallbackErr != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetPublicURL returns the public URL a file gets in the primary backend
+func (s *FallbackStorage) GetPublicURL(storagePath string) string {
+	return s.primary.GetPublicURL(storagePath)
+}
+
+// List lists the objects of both backends
+func (s *FallbackStorage) List(fn func(ObjectInfo) error) error {
+	for _, backend := range []FileStorage{s.primary, s.fallback} {
+		listable, ok := backend.(ListableStorage)
+		if !ok {
+			return ErrListingNotSupported
+		}
+
+		err := listable.List(fn)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Quarantine quarantines an object in the backend that holds it
+func (s *FallbackStorage) Quarantine(storagePath string) (string, error) {
+	var err error
+	for _, backend := range []FileStorage{s.primary, s.fallback} {
+		listable, ok := backend.(ListableStorage)
+		if !ok {
+			return "", ErrListingNotSupported
+		}
+
+		var target string
+		target, err = listable.Quarantine(storagePath)
+		if err == nil {
+			return target, nil
+		}
+	}
+
+	return "", err
+}
@@ -2,13 +2,22 @@ package storage
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -20,6 +29,11 @@ type FileStorage interface {
 	// Upload uploads a file and returns its path and public URL
 	Upload(fileContent io.Reader, fileName, contentType string) (string, string, error)
 
+	// Open opens a file for reading. The returned reader is seekable so
+	// callers can serve byte ranges without reading the whole object. The
+	// error for a missing file wraps fs.ErrNotExist.
+	Open(storagePath string) (io.ReadSeekCloser, error)
+
 	// Delete deletes a file
 	Delete(storagePath string) error
 
@@ -27,15 +41,86 @@ type FileStorage interface {
 	GetPublicURL(storagePath string) string
 }
 
+// QuarantinePrefix is the path under which quarantined objects are kept.
+// Listing skips it, so quarantined objects are not reported again.
+const QuarantinePrefix = "quarantine/"
+
+// ErrListingNotSupported is returned when the underlying storage cannot
+// list its objects
+var ErrListingNotSupported = errors.New("storage does not support listing")
+
+// ErrPathUploadNotSupported is returned when the underlying storage cannot
+// store objects under a path chosen by the caller
+var ErrPathUploadNotSupported = errors.New("storage does not support uploads to a given path")
+
+// PathStorage is implemented by storage that can store an object under a
+// path chosen by the caller, such as a path derived from its content hash
+type PathStorage interface {
+	FileStorage
+
+	// UploadTo uploads a file to storagePath, replacing any object stored
+	// there, and returns its public URL
+	UploadTo(storagePath string, fileContent io.Reader, contentType string) (string, error)
+}
+
+// ObjectInfo describes an object in storage
+type ObjectInfo struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// ListableStorage is implemented by storage that can enumerate its objects,
+// so storage can be reconciled with the database
+type ListableStorage interface {
+	FileStorage
+
+	// List calls fn for every stored object outside the quarantine, in no
+	// particular order. Listing stops at the first error fn returns.
+	List(fn func(ObjectInfo) error) error
+
+	// Quarantine moves an object under QuarantinePrefix, keeping its path
+	// below it, and returns the new path
+	Quarantine(storagePath string) (string, error)
+}
+
+// S3Client is the subset of the S3 API used by S3Storage. *s3.S3 satisfies it;
+// tests can provide an in-process fake.
+type S3Client interface {
+	HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error)
+	CreateBucket(input *s3.CreateBucketInput) (*s3.CreateBucketOutput, error)
+	PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error)
+	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error)
+	CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error)
+	ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+	CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error)
+}
+
+const (
+	// MinS3PartSize is the smallest part size S3 accepts for all but the last part
+	MinS3PartSize = 5 << 20
+
+	// maxS3Parts is the maximum number of parts in a multipart upload
+	maxS3Parts = 10000
+)
+
 // S3Storage implements FileStorage for AWS S3
 type S3Storage struct {
-	s3Client *s3.S3
-	bucket   string
-	region   string
+	s3Client    S3Client
+	bucket      string
+	region      string
+	partSize    int64
+	concurrency int
 }
 
-// NewS3Storage creates a new S3 storage handler
-func NewS3Storage(region, bucket, endpoint, accessKey, secretKey string) (*S3Storage, error) {
+// NewS3Storage creates a new S3 storage handler. Uploads are streamed in
+// parts of partSize bytes with up to concurrency parts in flight.
+func NewS3Storage(region, bucket, endpoint, accessKey, secretKey string, partSize int64, concurrency int) (*S3Storage, error) {
 	config := &aws.Config{
 		Region: aws.String(region),
 		Credentials: credentials.NewStaticCredentials(
@@ -56,10 +141,20 @@ func NewS3Storage(region, bucket, endpoint, accessKey, secretKey string) (*S3Sto
 		return nil, fmt.Errorf("failed to create S3 session: %w", err)
 	}
 
-	s3Client := s3.New(sess)
+	return NewS3StorageWithClient(s3.New(sess), region, bucket, partSize, concurrency)
+}
+
+// NewS3StorageWithClient creates a new S3 storage handler using the given client
+func NewS3StorageWithClient(s3Client S3Client, region, bucket string, partSize int64, concurrency int) (*S3Storage, error) {
+	if partSize < MinS3PartSize {
+		partSize = MinS3PartSize
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
 
 	// Check if bucket exists, create if not
-	_, err = s3Client.HeadBucket(&s3.HeadBucketInput{
+	_, err := s3Client.HeadBucket(&s3.HeadBucketInput{
 		Bucket: aws.String(bucket),
 	})
 
@@ -73,22 +168,18 @@ func NewS3Storage(region, bucket, endpoint, accessKey, secretKey string) (*S3Sto
 	}
 
 	return &S3Storage{
-		s3Client: s3Client,
-		bucket:   bucket,
-		region:   region,
+		s3Client:    s3Client,
+		bucket:      bucket,
+		region:      region,
+		partSize:    partSize,
+		concurrency: concurrency,
 	}, nil
 }
 
-// Upload uploads a file to S3
+// Upload uploads a file to S3. Content is read one part at a time, so memory
+// use is bounded by partSize * concurrency regardless of the file size.
+// Content that fits in a single part is sent with a plain PutObject.
 func (s *S3Storage) Upload(fileContent io.Reader, fileName, contentType string) (string, string, error) {
-	// Read file content into a buffer to support seeking
-	buf := new(bytes.Buffer)
-	_, err := io.Copy(buf, fileContent)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to read file content: %w", err)
-	}
-	body := bytes.NewReader(buf.Bytes()) // Convert buffer to io.ReadSeeker
-
 	// Generate a unique file path
 	key := fmt.Sprintf("uploads/%s/%s", time.Now().Format("2006/01/02"), uuid.New().String())
 
@@ -97,19 +188,282 @@ func (s *S3Storage) Upload(fileContent io.Reader, fileName, contentType string)
 		key += ext
 	}
 
-	// Upload to S3
-	_, err = s.s3Client.PutObject(&s3.PutObjectInput{
+	publicURL, err := s.UploadTo(key, fileContent, contentType)
+	if err != nil {
+		return "", "", err
+	}
+
+	return key, publicURL, nil
+}
+
+// UploadTo uploads a file to S3 under key, the same way as Upload
+func (s *S3Storage) UploadTo(key string, fileContent io.Reader, contentType string) (string, error) {
+	// Read the first part to decide between a single PUT and multipart
+	first := make([]byte, s.partSize)
+	n, err := io.ReadFull(fileContent, first)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read file content: %w", err)
+	}
+
+	if int64(n) < s.partSize {
+		_, err = s.s3Client.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(first[:n]),
+			ContentType: aws.String(contentType),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to upload file to S3: %w", err)
+		}
+
+		return s.GetPublicURL(key), nil
+	}
+
+	err = s.uploadMultipart(key, contentType, first, fileContent)
+	if err != nil {
+		return "", err
+	}
+
+	return s.GetPublicURL(key), nil
+}
+
+// uploadMultipart streams content to key as a multipart upload, starting with
+// the already read first part. The upload is aborted if any part fails so no
+// orphaned parts are left billed in the bucket.
+func (s *S3Storage) uploadMultipart(key, contentType string, first []byte, rest io.Reader) error {
+	created, err := s.s3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
 		Bucket:      aws.String(s.bucket),
 		Key:         aws.String(key),
-		Body:        body,
 		ContentType: aws.String(contentType),
 	})
+	if err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	uploadID := created.UploadId
 
+	// Buffers double as the concurrency limit: a part can only be read once
+	// a previous upload has returned its buffer
+	buffers := make(chan []byte, s.concurrency)
+	for i := 1; i < s.concurrency; i++ {
+		buffers <- make([]byte, s.partSize)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []*s3.CompletedPart
+		firstErr error
+	)
+
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	uploadPart := func(number int64, buf []byte, n int) {
+		defer wg.Done()
+		defer func() { buffers <- buf }()
+
+		out, err := s.s3Client.UploadPart(&s3.UploadPartInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			UploadId:      uploadID,
+			PartNumber:    aws.Int64(number),
+			Body:          bytes.NewReader(buf[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		})
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to upload part %d: %w", number, err)
+			}
+			return
+		}
+		parts = append(parts, &s3.CompletedPart{ETag: out.ETag, PartNumber: aws.Int64(number)})
+	}
+
+	wg.Add(1)
+	go uploadPart(1, first, len(first))
+
+	for number := int64(2); !failed(); number++ {
+		buf := <-buffers
+
+		n, readErr := io.ReadFull(rest, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			buffers <- buf
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to read file content: %w", readErr)
+			}
+			mu.Unlock()
+			break
+		}
+
+		if n == 0 {
+			buffers <- buf
+			break
+		}
+
+		if number > maxS3Parts {
+			buffers <- buf
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = fmt.Errorf("file exceeds %d parts of %d bytes", maxS3Parts, s.partSize)
+			}
+			mu.Unlock()
+			break
+		}
+
+		wg.Add(1)
+		go uploadPart(number, buf, n)
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		s.abortMultipart(key, uploadID)
+		return firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+
+	_, err = s.s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		s.abortMultipart(key, uploadID)
+		return fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+
+	return nil
+}
+
+// abortMultipart discards the parts of a failed multipart upload
+func (s *S3Storage) abortMultipart(key string, uploadID *string) {
+	_, err := s.s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		log.Printf("Failed to abort multipart upload %s: %v", aws.StringValue(uploadID), err)
+	}
+}
+
+// Open opens a file in S3 for reading
+func (s *S3Storage) Open(storagePath string) (io.ReadSeekCloser, error) {
+	head, err := s.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(storagePath),
+	})
 	if err != nil {
-		return "", "", fmt.Errorf("failed to upload file to S3: %w", err)
+		if isS3NotFound(err) {
+			return nil, fmt.Errorf("file not found in S3: %w", fs.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to stat file in S3: %w", err)
+	}
+
+	return &s3Object{
+		s3Client: s.s3Client,
+		bucket:   s.bucket,
+		key:      storagePath,
+		size:     aws.Int64Value(head.ContentLength),
+	}, nil
+}
+
+// isS3NotFound reports whether an S3 request failed because the object does
+// not exist
+func isS3NotFound(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+
+	return awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound"
+}
+
+// s3Object is a seekable reader over an S3 object. Each seek drops the
+// current response body and the next read issues a ranged GET from the new
+// offset, so only the requested bytes are transferred.
+type s3Object struct {
+	s3Client S3Client
+	bucket   string
+	key      string
+	size     int64
+	offset   int64
+	body     io.ReadCloser
+}
+
+// Read reads from the current offset, opening a ranged GET if needed
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
 	}
 
-	return key, s.GetPublicURL(key), nil
+	if o.body == nil {
+		out, err := o.s3Client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(o.bucket),
+			Key:    aws.String(o.key),
+			Range:  aws.String(fmt.Sprintf("bytes=%d-", o.offset)),
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to read file from S3: %w", err)
+		}
+		o.body = out.Body
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = o.offset + offset
+	case io.SeekEnd:
+		abs = o.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence: %d", whence)
+	}
+
+	if abs < 0 {
+		return 0, fmt.Errorf("negative position: %d", abs)
+	}
+
+	if abs != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = abs
+
+	return abs, nil
+}
+
+// Close releases the current response body, if any
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
 }
 
 // Delete deletes a file from S3
@@ -131,6 +485,64 @@ func (s *S3Storage) GetPublicURL(storagePath string) string {
 	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s", s.bucket, storagePath)
 }
 
+// List lists the objects in the bucket a page at a time
+func (s *S3Storage) List(fn func(ObjectInfo) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+	}
+
+	for {
+		out, err := s.s3Client.ListObjectsV2(input)
+		if err != nil {
+			return fmt.Errorf("failed to list files in S3: %w", err)
+		}
+
+		for _, object := range out.Contents {
+			key := aws.StringValue(object.Key)
+			if strings.HasPrefix(key, QuarantinePrefix) {
+				continue
+			}
+
+			err = fn(ObjectInfo{
+				Path:    key,
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if !aws.BoolValue(out.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = out.NextContinuationToken
+	}
+}
+
+// Quarantine copies an object under the quarantine prefix and deletes the
+// original. S3 cannot copy objects over 5 GB in one request, so those fail.
+// The copy source is URL-encoded, as S3 expects it.
+func (s *S3Storage) Quarantine(storagePath string) (string, error) {
+	target := QuarantinePrefix + storagePath
+
+	_, err := s.s3Client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(target),
+		CopySource: aws.String(s.bucket + "/" + url.PathEscape(storagePath)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to copy file to quarantine: %w", err)
+	}
+
+	err = s.Delete(storagePath)
+	if err != nil {
+		return "", err
+	}
+
+	return target, nil
+}
+
 // LocalStorage implements FileStorage for local file system
 type LocalStorage struct {
 	basePath string
@@ -153,13 +565,6 @@ func NewLocalStorage(basePath, baseURL string) (*LocalStorage, error) {
 
 // Upload uploads a file to local storage
 func (l *LocalStorage) Upload(fileContent io.Reader, fileName, contentType string) (string, string, error) {
-	// Generate a unique file path
-	dir := filepath.Join(l.basePath, time.Now().Format("2006/01/02"))
-	err := os.MkdirAll(dir, 0755)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create directory: %w", err)
-	}
-
 	// Generate a unique file name
 	uniqueName := uuid.New().String()
 
@@ -168,23 +573,52 @@ func (l *LocalStorage) Upload(fileContent io.Reader, fileName, contentType strin
 		uniqueName = uniqueName + ext
 	}
 
-	fullPath := filepath.Join(dir, uniqueName)
 	relativePath := filepath.Join(time.Now().Format("2006/01/02"), uniqueName)
 
+	publicURL, err := l.UploadTo(relativePath, fileContent, contentType)
+	if err != nil {
+		return "", "", err
+	}
+
+	return relativePath, publicURL, nil
+}
+
+// UploadTo uploads a file to storagePath in local storage
+func (l *LocalStorage) UploadTo(storagePath string, fileContent io.Reader, contentType string) (string, error) {
+	fullPath := filepath.Join(l.basePath, storagePath)
+	err := os.MkdirAll(filepath.Dir(fullPath), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
 	// Create the file
 	file, err := os.Create(fullPath)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create file: %w", err)
+		return "", fmt.Errorf("failed to create file: %w", err)
 	}
 	defer file.Close()
 
 	// Copy the content
 	_, err = io.Copy(file, fileContent)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to write file content: %w", err)
+		// Don't leave a partial file behind
+		_ = os.Remove(fullPath)
+		return "", fmt.Errorf("failed to write file content: %w", err)
 	}
 
-	return relativePath, l.GetPublicURL(relativePath), nil
+	return l.GetPublicURL(storagePath), nil
+}
+
+// Open opens a file in local storage for reading
+func (l *LocalStorage) Open(storagePath string) (io.ReadSeekCloser, error) {
+	fullPath := filepath.Join(l.basePath, storagePath)
+
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	return file, nil
 }
 
 // Delete deletes a file from local storage
@@ -203,3 +637,56 @@ func (l *LocalStorage) Delete(storagePath string) error {
 func (l *LocalStorage) GetPublicURL(storagePath string) string {
 	return fmt.Sprintf("%s/%s", l.baseURL, storagePath)
 }
+
+// List walks the storage directory. Paths are relative to it, as returned
+// by Upload.
+func (l *LocalStorage) List(fn func(ObjectInfo) error) error {
+	quarantine := filepath.Join(l.basePath, QuarantinePrefix)
+
+	return filepath.WalkDir(l.basePath, func(fullPath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("failed to list files: %w", err)
+		}
+
+		if entry.IsDir() {
+			if filepath.Clean(fullPath) == filepath.Clean(quarantine) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat file: %w", err)
+		}
+
+		relativePath, err := filepath.Rel(l.basePath, fullPath)
+		if err != nil {
+			return err
+		}
+
+		return fn(ObjectInfo{
+			Path:    relativePath,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	})
+}
+
+// Quarantine moves a file into the quarantine directory
+func (l *LocalStorage) Quarantine(storagePath string) (string, error) {
+	target := path.Join(QuarantinePrefix, filepath.ToSlash(storagePath))
+	fullTarget := filepath.Join(l.basePath, filepath.FromSlash(target))
+
+	err := os.MkdirAll(filepath.Dir(fullTarget), 0755)
+	if err != nil {
+		return "", fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	err = os.Rename(filepath.Join(l.basePath, storagePath), fullTarget)
+	if err != nil {
+		return "", fmt.Errorf("failed to move file to quarantine: %w", err)
+	}
+
+	return target, nil
+}
@@ -0,0 +1,476 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// fakeS3 is an in-process S3Client that keeps objects and multipart uploads in memory
+type fakeS3 struct {
+	mu        sync.Mutex
+	objects   map[string][]byte
+	uploads   map[string]map[int64][]byte
+	aborted   int
+	putCalls  int
+	failPart  int64
+	inFlight  int
+	maxFlight int
+	pageSize  int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		uploads: make(map[string]map[int64][]byte),
+	}
+}
+
+func (f *fakeS3) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) CreateBucket(input *s3.CreateBucketInput) (*s3.CreateBucketOutput, error) {
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (f *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.putCalls++
+	f.objects[aws.StringValue(input.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	var start int64
+	if input.Range != nil {
+		fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-", &start)
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data[start:]))}, nil
+}
+
+func (f *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// The copy source is URL-encoded; S3 would cut it off at a raw ? or #
+	copySource := aws.StringValue(input.CopySource)
+	if strings.ContainsAny(copySource, " ?#") {
+		return nil, awserr.New("InvalidArgument", "Invalid copy source encoding", nil)
+	}
+
+	source := strings.SplitN(copySource, "/", 2)
+	key, err := url.PathUnescape(source[1])
+	if err != nil {
+		return nil, awserr.New("InvalidArgument", "Invalid copy source encoding", err)
+	}
+
+	data, ok := f.objects[key]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+
+	f.objects[aws.StringValue(input.Key)] = data
+	return &s3.CopyObjectOutput{}, nil
+}
+
+// ListObjectsV2 lists objects in key order, pageSize keys per page
+func (f *fakeS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := []string{}
+	for key := range f.objects {
+		if key > aws.StringValue(input.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	out := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	if f.pageSize > 0 && len(keys) > f.pageSize {
+		keys = keys[:f.pageSize]
+		out.IsTruncated = aws.Bool(true)
+		out.NextContinuationToken = aws.String(keys[len(keys)-1])
+	}
+
+	for _, key := range keys {
+		out.Contents = append(out.Contents, &s3.Object{
+			Key:  aws.String(key),
+			Size: aws.Int64(int64(len(f.objects[key]))),
+		})
+	}
+
+	return out, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+	f.uploads[id] = make(map[int64][]byte)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	f.mu.Lock()
+	f.inFlight++
+	if f.inFlight > f.maxFlight {
+		f.maxFlight = f.inFlight
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.inFlight--
+		f.mu.Unlock()
+	}()
+
+	number := aws.Int64Value(input.PartNumber)
+	if number == f.failPart {
+		return nil, errors.New("part upload failed")
+	}
+
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.uploads[aws.StringValue(input.UploadId)][number] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", number))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := aws.StringValue(input.UploadId)
+	parts := f.uploads[id]
+
+	numbers := []int64{}
+	for _, part := range input.MultipartUpload.Parts {
+		numbers = append(numbers, aws.Int64Value(part.PartNumber))
+	}
+	if !sort.SliceIsSorted(numbers, func(i, j int) bool { return numbers[i] < numbers[j] }) {
+		return nil, errors.New("parts not in ascending order")
+	}
+
+	var buf bytes.Buffer
+	for _, number := range numbers {
+		buf.Write(parts[number])
+	}
+
+	f.objects[aws.StringValue(input.Key)] = buf.Bytes()
+	delete(f.uploads, id)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aborted++
+	delete(f.uploads, aws.StringValue(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func testContent(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
+
+func TestS3UploadSmallFileUsesPutObject(t *testing.T) {
+	fake := newFakeS3()
+	store, err := NewS3StorageWithClient(fake, "us-east-1", "bucket", MinS3PartSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := testContent(1024)
+	key, _, err := store.Upload(bytes.NewReader(content), "small.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if fake.putCalls != 1 {
+		t.Errorf("expected 1 PutObject call, got %d", fake.putCalls)
+	}
+	if !bytes.Equal(fake.objects[key], content) {
+		t.Errorf("stored object does not match uploaded content")
+	}
+}
+
+func TestS3UploadMultipart(t *testing.T) {
+	fake := newFakeS3()
+	store, err := NewS3StorageWithClient(fake, "us-east-1", "bucket", MinS3PartSize, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Seven and a half parts
+	content := testContent(MinS3PartSize*7 + MinS3PartSize/2)
+	key, _, err := store.Upload(bytes.NewReader(content), "large.bin", "application/octet-stream")
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+
+	if fake.putCalls != 0 {
+		t.Errorf("expected no PutObject calls, got %d", fake.putCalls)
+	}
+	if !bytes.Equal(fake.objects[key], content) {
+		t.Errorf("stored object does not match uploaded content")
+	}
+	if fake.maxFlight > 3 {
+		t.Errorf("expected at most 3 concurrent part uploads, got %d", fake.maxFlight)
+	}
+
+	// Read it back through Open with a seek into the middle
+	reader, err := store.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	offset := int64(MinS3PartSize + 17)
+	if _, err := reader.Seek(offset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rest, content[offset:]) {
+		t.Errorf("ranged read does not match uploaded content")
+	}
+}
+
+func TestS3UploadMultipartAbortsOnFailure(t *testing.T) {
+	fake := newFakeS3()
+	fake.failPart = 3
+	store, err := NewS3StorageWithClient(fake, "us-east-1", "bucket", MinS3PartSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := testContent(MinS3PartSize * 5)
+	_, _, err = store.Upload(bytes.NewReader(content), "large.bin", "application/octet-stream")
+	if err == nil {
+		t.Fatal("expected upload to fail")
+	}
+
+	if fake.aborted != 1 {
+		t.Errorf("expected multipart upload to be aborted once, got %d", fake.aborted)
+	}
+	if len(fake.objects) != 0 || len(fake.uploads) != 0 {
+		t.Errorf("expected no objects or pending uploads after abort")
+	}
+}
+
+// listPaths collects the paths listed by storage
+func listPaths(t *testing.T, storage ListableStorage) []string {
+	t.Helper()
+
+	paths := []string{}
+	err := storage.List(func(object ObjectInfo) error {
+		paths = append(paths, object.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+func TestS3ListAndQuarantine(t *testing.T) {
+	client := newFakeS3()
+	client.pageSize = 2
+	for _, key := range []string{"uploads/a", "uploads/b", "uploads/c", "quarantine/uploads/old"} {
+		client.objects[key] = []byte(key)
+	}
+
+	s3Storage, err := NewS3StorageWithClient(client, "us-east-1", "bucket", MinS3PartSize, 1)
+	if err != nil {
+		t.Fatalf("NewS3StorageWithClient failed: %v", err)
+	}
+
+	paths := listPaths(t, s3Storage)
+	if strings.Join(paths, ",") != "uploads/a,uploads/b,uploads/c" {
+		t.Fatalf("listed %v, want the three uploads", paths)
+	}
+
+	target, err := s3Storage.Quarantine("uploads/b")
+	if err != nil {
+		t.Fatalf("Quarantine failed: %v", err)
+	}
+	if target != "quarantine/uploads/b" {
+		t.Errorf("quarantined to %q, want quarantine/uploads/b", target)
+	}
+	if _, ok := client.objects["uploads/b"]; ok {
+		t.Error("quarantined object still in place")
+	}
+
+	paths = listPaths(t, s3Storage)
+	if strings.Join(paths, ",") != "uploads/a,uploads/c" {
+		t.Errorf("listed %v after quarantine, want uploads/a and uploads/c", paths)
+	}
+
+	// Keys are escaped in the copy source
+	client.objects["uploads/100% done?.txt"] = []byte("content")
+	target, err = s3Storage.Quarantine("uploads/100% done?.txt")
+	if err != nil {
+		t.Fatalf("Quarantine failed: %v", err)
+	}
+	if string(client.objects[target]) != "content" || target != "quarantine/uploads/100% done?.txt" {
+		t.Errorf("quarantined to %q, want quarantine/uploads/100%% done?.txt", target)
+	}
+}
+
+func TestLocalListAndQuarantine(t *testing.T) {
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost/files")
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+
+	first, _, err := local.Upload(bytes.NewReader([]byte("first")), "first.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	second, _, err := local.Upload(bytes.NewReader([]byte("second")), "second.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	want := []string{first, second}
+	sort.Strings(want)
+	if paths := listPaths(t, local); strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("listed %v, want %v", paths, want)
+	}
+
+	target, err := local.Quarantine(first)
+	if err != nil {
+		t.Fatalf("Quarantine failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(local.basePath, target)); err != nil {
+		t.Errorf("quarantined file not found: %v", err)
+	}
+
+	if paths := listPaths(t, local); len(paths) != 1 || paths[0] != second {
+		t.Errorf("listed %v after quarantine, want [%s]", paths, second)
+	}
+}
+
+func TestFallbackStorage(t *testing.T) {
+	primary, err := NewLocalStorage(t.TempDir(), "http://localhost/new")
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+	fallback, err := NewLocalStorage(t.TempDir(), "http://localhost/old")
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+
+	oldPath, _, err := fallback.Upload(bytes.NewReader([]byte("old")), "old.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	storage := NewFallbackStorage(primary, fallback)
+
+	newPath, _, err := storage.Upload(bytes.NewReader([]byte("new")), "new.txt", "text/plain")
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if _, err := primary.Open(newPath); err != nil {
+		t.Errorf("upload did not go to the primary backend: %v", err)
+	}
+
+	for path, want := range map[string]string{oldPath: "old", newPath: "new"} {
+		file, err := storage.Open(path)
+		if err != nil {
+			t.Fatalf("Open(%s) failed: %v", path, err)
+		}
+		data, _ := io.ReadAll(file)
+		file.Close()
+		if string(data) != want {
+			t.Errorf("Open(%s) read %q, want %q", path, data, want)
+		}
+	}
+
+	if err := storage.Delete(oldPath); err != nil {
+		t.Errorf("Delete of a fallback object failed: %v", err)
+	}
+	if _, err := storage.Open(oldPath); err == nil {
+		t.Error("deleted object can still be opened")
+	}
+}
+
+func TestOpenMissingObject(t *testing.T) {
+	s3Store, err := NewS3StorageWithClient(newFakeS3(), "us-east-1", "bucket", MinS3PartSize, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewLocalStorage(t.TempDir(), "http://localhost")
+	if err != nil {
+		t.Fatalf("NewLocalStorage failed: %v", err)
+	}
+
+	for name, store := range map[string]FileStorage{"s3": s3Store, "local": local} {
+		if _, err := store.Open("missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s: expected fs.ErrNotExist for a missing object, got %v", name, err)
+		}
+	}
+}